@@ -3,8 +3,12 @@ package agg
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/victhorio/opa/agg/core"
 )
@@ -16,6 +20,11 @@ type Agent struct {
 	model     core.Model
 	tools     ToolRegistry
 	toolSpecs []core.Tool
+
+	budget Budget
+	spend  SpendSource
+
+	postProcess func(string) string
 }
 
 func NewAgent(
@@ -36,13 +45,46 @@ func NewAgent(
 	}
 
 	for _, tool := range tools {
-		a.tools.Register(tool.Spec.Name, tool.Handler)
+		a.tools.Register(tool)
 		a.toolSpecs = append(a.toolSpecs, tool.Spec)
 	}
 
 	return a
 }
 
+// Model returns the model currently used by the agent.
+func (a *Agent) Model() core.Model {
+	return a.model
+}
+
+// SetModel changes the model used by the agent from the next turn onwards, which can be from a
+// different provider than the previous one. It must not be called while a turn is running.
+func (a *Agent) SetModel(model core.Model) {
+	a.model = model
+}
+
+// SetPostProcess makes the agent rewrite the text of every response of the model with fn, e.g. to
+// resolve citations, in what it emits and returns. The history keeps the text as the model
+// generated it, and the deltas are still streamed as they come. It must not be called while a
+// turn is running.
+func (a *Agent) SetPostProcess(fn func(string) string) {
+	a.postProcess = fn
+}
+
+// render returns msgs with the text of their content post-processed, leaving msgs untouched since
+// they go to the history.
+func (a *Agent) render(msgs []*core.Msg) []*core.Msg {
+	r := make([]*core.Msg, len(msgs))
+	for i, msg := range msgs {
+		r[i] = msg
+		if content, ok := msg.AsContent(); ok {
+			r[i] = core.NewMsgContent(content.Role, a.postProcess(content.Text), content.Parts...)
+			r[i].Provider, r[i].Model, r[i].Usage = msg.Provider, msg.Model, msg.Usage
+		}
+	}
+	return r
+}
+
 func (a *Agent) Run(
 	ctx context.Context,
 	client *http.Client,
@@ -67,12 +109,31 @@ func (a *Agent) RunStream(
 	ctxChild, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	// Sub-agents emit their events from the goroutines of their tool calls, so we serialize them
+	// with ours, and drop the ones of stragglers that finish after we returned.
+	var emitMu sync.Mutex
+	returned := false
+	defer func() {
+		emitMu.Lock()
+		returned = true
+		emitMu.Unlock()
+	}()
 	emit := func(event core.Event) {
-		if onEvent != nil {
+		emitMu.Lock()
+		defer emitMu.Unlock()
+		if onEvent != nil && !returned {
 			onEvent(event)
 		}
 	}
 
+	warning, err := a.checkBudget(time.Now())
+	if err != nil {
+		return "", fmt.Errorf("Agent.Run: %w", err)
+	}
+	if warning != nil {
+		emit(core.NewEvWarning(warning))
+	}
+
 	msgs := a.Store.Messages(sessionID)
 	// let's remember up to which idx of `msgs` we already have it stored
 	msgsStoreIdx := len(msgs)
@@ -82,87 +143,106 @@ func (a *Agent) RunStream(
 		msgs = append(msgs, core.NewMsgContent("system", a.sysPrompt))
 	}
 	msgs = append(msgs, core.NewMsgContent("user", input))
+	roundsStart := len(msgs)
 
 	var usage core.Usage
+
+	// fail returns err, persisting the rounds that did complete. If none did the session is left
+	// untouched, otherwise it'd end with the input and no answer, and retrying would store it twice.
+	fail := func(err error) (string, error) {
+		if len(msgs) == roundsStart {
+			return "", err
+		}
+		return "", errors.Join(err, a.persist(sessionID, msgs[msgsStoreIdx:], usage))
+	}
 	var out bytes.Buffer
 
+	// We keep track of how many times in a row each tool was called with invalid arguments, so
+	// that a model stuck trying to fix its arguments gets cut off instead of burning all rounds.
+	invalidArgsStreak := make(map[string]int)
+	var invalidArgsLoop bool
+
 	for round := range agentRoundsMax {
 		if err := ctx.Err(); err != nil {
-			return "", fmt.Errorf("Agent.Run: context error: %w", err)
-		}
-
-		cfg := core.StreamCfg{}
-		if round == agentRoundsMax-1 {
-			// When we're at the last round, we need to behave differently between OpenAI and
-			// Anthropic models due to different behaviors from them.
-			//
-			// **OpenAI**
-			//
-			// If we simply forbit tool choice for the OpenAI model at this point, it will generate
-			// a confused response because it will actually be /completely unaware/ of the available
-			// tools and more importantly, it will not have visibility of the tool calls/results
-			// already made. So it ends up generating a confused message about not being able to
-			// do anything at all, whereas if we got here, it 100% already did quite a bit of calls.
-			//
-			// Thankfully, OpenAI particularly allows system messages in the middle of the
-			// conversation history, so we can just add a system message here indicating that the
-			// harness forbids another tool call without an intermediate user interaction first,
-			// driving it to create a regular message.
-			//
-			// **Anthropic**
-			//
-			// Anthropic models still preserve visibility of their tool calls even if we force it
-			// to not use them, so we can just disable them directly. Unfortunately, Anthropic does
-			// not allow system messages in the middle of the conversation history. This would've
-			// been helpful because currently the model mostly messages something like "Now I'll
-			// make this tool call:" (and actually doesnt't), so the UX is not perfect but fine.
-
-			switch a.model.Provider() {
-			case core.ProviderOpenAI:
-				msgs = append(msgs, core.NewMsgContent("system", toolCallLimitReachedPrompt))
-			case core.ProviderAnthropic:
-				cfg.DisableTools = true
-			}
+			// a tool may have returned as soon as we were cancelled, so the previous round can
+			// still have completed and needs to be kept
+			return fail(fmt.Errorf("Agent.Run: context error: %w", err))
+		}
+
+		var cfg core.StreamCfg
+		forceResponsePrompt := ""
+		switch {
+		case round == agentRoundsMax-1:
+			forceResponsePrompt = toolCallLimitReachedPrompt
+		case invalidArgsLoop:
+			forceResponsePrompt = toolArgsLoopPrompt
+			invalidArgsLoop = false
 		}
 
-		stream, err := a.model.OpenStream(
-			ctxChild,
-			client,
-			msgs,
-			a.toolSpecs,
-			cfg,
-		)
+		// the prompt only goes with this request, the history never keeps it
+		cfg.ForceResponse = forceResponsePrompt
+		reqMsgs, reqCfg := prepareRequest(a.model, msgs, cfg)
+
+		stream, err := a.model.OpenStream(ctxChild, client, reqMsgs, a.toolSpecs, reqCfg)
 		if err != nil {
-			return "", fmt.Errorf("Agent.Run: error opening stream: %w", err)
+			// like when cancelled, the rounds that did complete are kept
+			return fail(fmt.Errorf("Agent.Run: error opening stream: %w", err))
 		}
 
 		events := make(chan core.Event, 1)
 		go stream.Consume(ctxChild, events)
 
 		var resp core.Response
-		var toolCallCount int
-		toolResults := make(chan core.ToolResult, 4)
+		// calls keeps the tool calls in the order the model made them, so that the results are
+		// appended to the history in the same order regardless of which one finishes first
+		var calls []core.ToolCall
+		toolResults := make(chan toolOutcome, 4)
+		// where the internals of this round start in out, in case the stream starts over
+		roundStart := out.Len()
 		for event := range events {
-			emit(event)
+			if event.Type == core.EvResp && a.postProcess != nil {
+				rendered := event
+				rendered.Response.Messages = a.render(event.Response.Messages)
+				emit(rendered)
+			} else {
+				emit(event)
+			}
 			switch event.Type {
 			case core.EvToolCall:
 				// let's immediately start running the tool call
-				toolCallCount++
-
 				tc := event.Call
+				idx := len(calls)
+				calls = append(calls, tc)
+
 				go func() {
-					toolResult := core.ToolResult{ID: tc.ID}
+					outcome := toolOutcome{
+						ToolResult: core.ToolResult{ID: tc.ID},
+						idx:        idx,
+						name:       tc.Name,
+					}
 
-					result, err := a.tools.Call(ctxChild, tc.Name, []byte(tc.Arguments))
-					if err != nil {
-						toolResult.Result = fmt.Sprintf("error calling tool %s: %v", tc.Name, err)
-					} else {
-						toolResult.Result = result
+					scope := &toolCallScope{emit: emit}
+					result, err := a.tools.Call(withToolCallScope(ctxChild, scope), tc.Name, []byte(tc.Arguments))
+					outcome.spent = scope.spent()
+					var argsErr *ToolArgsError
+					var timeoutErr *ToolTimeoutError
+					switch {
+					case errors.As(err, &argsErr):
+						// this is already meant to be read by the model
+						outcome.Result = argsErr.Error()
+						outcome.invalidArgs = true
+					case errors.As(err, &timeoutErr):
+						outcome.Result = timeoutErr.Error()
+					case err != nil:
+						outcome.Result = fmt.Sprintf("error calling tool %s: %v", tc.Name, err)
+					default:
+						outcome.Result = result.Text
+						outcome.Parts = result.Parts
 					}
 
 					select {
 					case <-ctxChild.Done():
-					case toolResults <- toolResult:
+					case toolResults <- outcome:
 					}
 				}()
 
@@ -173,68 +253,271 @@ func (a *Agent) RunStream(
 				if includeInternals {
 					fmt.Fprintf(&out, "\n[Reasoning: %s]\n\n", event.Delta)
 				}
+			case core.EvRetry:
+				// the reasoning so far belongs to an attempt that was abandoned, and there can't be
+				// tool calls since streams that made them aren't retried
+				out.Truncate(roundStart)
 			case core.EvResp:
 				resp = event.Response
 
 				lastMsg := resp.Messages[len(resp.Messages)-1]
 				content, ok := lastMsg.AsContent()
-				if ok {
+				if ok && a.postProcess != nil {
+					out.WriteString(a.postProcess(content.Text))
+				} else if ok {
 					out.WriteString(content.Text)
 				}
 			case core.EvError:
-				return "", fmt.Errorf("Agent.Run: error during stream: %w", event.Err)
+				// Whatever we got from this round is incomplete, but the previous rounds (and what
+				// their tool calls cost) are persisted like when cancelled, instead of losing the turn.
+				return fail(fmt.Errorf("Agent.Run: error during stream: %w", event.Err))
+			}
+		}
+
+		if resp.Messages == nil {
+			// The stream was closed before we got the response, which can only happen if the
+			// context was cancelled. Whatever we got from this round is incomplete, so we only
+			// persist what we had up until the previous one.
+			return fail(fmt.Errorf("Agent.Run: context error: %w", ctx.Err()))
+		}
+
+		for _, msg := range resp.Messages {
+			// wrappers like ResilientModel know better which provider actually responded
+			if msg.Provider == "" {
+				msg.Provider = a.model.Provider()
+			}
+			msg.Model = resp.Model
+		}
+		// reasoning isn't persisted, so the usage goes with the last message that is
+		for i := len(resp.Messages) - 1; i >= 0; i-- {
+			if resp.Messages[i].Type != core.MsgTypeReasoning {
+				u := resp.Usage
+				resp.Messages[i].Usage = &u
+				break
 			}
 		}
 
 		msgs = append(msgs, resp.Messages...)
 		usage.Inc(resp.Usage)
 
-		if toolCallCount == 0 {
+		if len(calls) == 0 {
 			// We only ever need to loop if the agent is generating tool calls instead of an actual
 			// response. If no tool calls were collected, there's nothing to loop for.
 			break
 		}
 
 		// Collect the tool results.
-		for range toolCallCount {
+		outcomes := make([]*toolOutcome, len(calls))
+		var cancelled bool
+		for collected := 0; collected < len(calls) && !cancelled; collected++ {
 			select {
 			case <-ctx.Done():
-				return "", fmt.Errorf("Agent.Run: context error: %w", ctx.Err())
-			case toolResult := <-toolResults:
-				msgs = append(msgs, core.NewMsgToolResult(toolResult.ID, toolResult.Result))
+				cancelled = true
+			case outcome := <-toolResults:
+				outcomes[outcome.idx] = &outcome
+			}
+		}
+
+		for i, outcome := range outcomes {
+			if outcome == nil {
+				// Only possible if we were cancelled. Every tool call needs a matching result for
+				// the history to be valid, so we let the model know what happened to it.
+				outcome = &toolOutcome{
+					ToolResult: core.ToolResult{ID: calls[i].ID, Result: toolCallCancelledResult},
+					name:       calls[i].Name,
+				}
+			}
+
+			if outcome.invalidArgs {
+				invalidArgsStreak[outcome.name]++
+				if invalidArgsStreak[outcome.name] >= toolArgsFailuresMax {
+					outcome.Result += "\n\n" + fmt.Sprintf(toolArgsLoopResult, outcome.name, invalidArgsStreak[outcome.name])
+					invalidArgsLoop = true
+				}
+			} else {
+				delete(invalidArgsStreak, outcome.name)
 			}
+
+			msg := core.NewMsgToolResult(outcome.ID, outcome.Result, outcome.Parts...)
+			if spent := outcome.spent; spent != nil {
+				// whatever the tool spent is attributed to its result, like a response's usage is
+				msg.Provider, msg.Model, msg.Usage = spent.provider, spent.model, &spent.usage
+				usage.Inc(spent.usage)
+			}
+			msgs = append(msgs, msg)
+		}
+
+		if cancelled {
+			return fail(fmt.Errorf("Agent.Run: context error: %w", ctx.Err()))
 		}
 	}
 
-	// Before returning, we need to update the store so that the conversation history persists
-	// correctly. We need to store every message starting from `msgsStoreIdx` onwards (the previous
-	// ones were already fetched from store, so we don't want duplication).
-	//
-	// There is an important detail here: we'll skip any reasoning messages. This is because while
-	// we /could/ preserve them in the history, both OpenAI and Anthropic will ignore/discard them
-	// from the context /unless/ the reasoning block precedes an ongoing tool call loop. I.e. they
-	// only readd reasoning to the context if (1) the reasoning block precedes a tool call and (2)
-	// no user messages exist after this tool call yet. Since we already carried out the tool call
-	// loop above, there's no reason to ever waste resources storing these reasoning loops.
-	msgsToStore := make([]*core.Msg, 0, len(msgs)-msgsStoreIdx)
-	for _, msg := range msgs[msgsStoreIdx:] {
+	if err := a.persist(sessionID, msgs[msgsStoreIdx:], usage); err != nil {
+		return "", err
+	}
+
+	return out.String(), nil
+}
+
+// persist updates the store so that the conversation history persists correctly. It should be
+// given every message starting from the ones that weren't fetched from the store (otherwise we'd
+// be duplicating them).
+//
+// There is an important detail here: we'll skip any reasoning messages. This is because while we
+// /could/ preserve them in the history, both OpenAI and Anthropic will ignore/discard them from the
+// context /unless/ the reasoning block precedes an ongoing tool call loop. I.e. they only readd
+// reasoning to the context if (1) the reasoning block precedes a tool call and (2) no user messages
+// exist after this tool call yet. Since by the time we persist we're done with the tool call loop,
+// there's no reason to ever waste resources storing these reasoning blocks.
+func (a *Agent) persist(sessionID string, msgs []*core.Msg, usage core.Usage) error {
+	msgsToStore := make([]*core.Msg, 0, len(msgs))
+	for _, msg := range msgs {
 		if msg.Type != core.MsgTypeReasoning {
 			msgsToStore = append(msgsToStore, msg)
 		}
 	}
 
-	err := a.Store.Extend(sessionID, msgsToStore, usage)
-	if err != nil {
-		return "", fmt.Errorf("Agent.Run: error extending store: %w", err)
+	if err := a.Store.Extend(sessionID, msgsToStore, usage); err != nil {
+		return fmt.Errorf("Agent.Run: error extending store: %w", err)
 	}
 
-	return out.String(), nil
+	return nil
+}
+
+// requestPreparer is implemented by models that prepare each request themselves for the model that
+// ends up serving it, like ResilientModel does since it can pick one of several models. Wrappers of
+// such a model should forward the method to it, so that requests aren't prepared twice.
+type requestPreparer interface {
+	PreparesRequests() bool
+}
+
+// prepareRequest returns what to send to model, see requestFor, leaving the messages and the
+// configuration as they are if the model prepares its requests itself.
+func prepareRequest(model core.Model, msgs []*core.Msg, cfg core.StreamCfg) ([]*core.Msg, core.StreamCfg) {
+	if p, ok := model.(requestPreparer); ok && p.PreparesRequests() {
+		return msgs, cfg
+	}
+	return requestFor(model.Provider(), msgs, cfg)
+}
+
+// requestFor returns the messages and configuration to send to a model of the given provider,
+// making it respond without tools when cfg.ForceResponse is set.
+//
+// When we're at the last round (or cutting off a model stuck in a tool call loop), we need to
+// behave differently between OpenAI and Anthropic models due to different behaviors from them.
+//
+// **OpenAI**
+//
+// If we simply forbit tool choice for the OpenAI model at this point, it will generate a confused
+// response because it will actually be /completely unaware/ of the available tools and more
+// importantly, it will not have visibility of the tool calls/results already made. So it ends up
+// generating a confused message about not being able to do anything at all, whereas if we got
+// here, it 100% already did quite a bit of calls.
+//
+// Thankfully, OpenAI particularly allows system messages in the middle of the conversation
+// history, so we can just add a system message here indicating that the harness forbids another
+// tool call without an intermediate user interaction first, driving it to create a regular
+// message. It's only added to the request: persisted, it would end up in front of models that
+// don't take system messages mid-conversation once the session switches to them.
+//
+// **Anthropic**
+//
+// Anthropic models still preserve visibility of their tool calls even if we force it to not use
+// them, so we can just disable them directly. Unfortunately, Anthropic does not allow system
+// messages in the middle of the conversation history. This would've been helpful because
+// currently the model mostly messages something like "Now I'll make this tool call:" (and
+// actually doesnt't), so the UX is not perfect but fine.
+//
+// **OpenAI-compatible**
+//
+// Chat completions keep the tool definitions around with `tool_choice: none`, but many of the
+// servers speaking it reject system messages that aren't the first one, so we go with the same
+// approach as Anthropic.
+//
+// **Gemini**
+//
+// System instructions live outside of the contents, so there's no mid-conversation system message
+// either. The function calling mode `NONE` keeps the declarations visible while forbidding new
+// calls, which is what DisableTools maps to.
+func requestFor(provider core.Provider, msgs []*core.Msg, cfg core.StreamCfg) ([]*core.Msg, core.StreamCfg) {
+	msgs = historyFor(provider, msgs)
+	if cfg.ForceResponse == "" {
+		return msgs, cfg
+	}
+
+	switch provider {
+	case core.ProviderOpenAI:
+		msgs = append(slices.Clip(msgs), core.NewMsgContent("system", cfg.ForceResponse))
+	case core.ProviderAnthropic, core.ProviderOpenAICompat, core.ProviderGemini:
+		cfg.DisableTools = true
+	}
+	return msgs, cfg
+}
+
+// historyFor returns the messages that can be sent to a model of the given provider. Reasoning
+// messages carry provider-specific (and usually encrypted) payloads that no other provider can
+// make sense of, so the ones generated by another provider are dropped. Messages with no provider
+// are kept, since we can't tell where they came from.
+//
+// Only OpenAI takes system messages other than the first one, which sessions from before they
+// stopped being persisted may have, so they're dropped for every other provider.
+func historyFor(provider core.Provider, msgs []*core.Msg) []*core.Msg {
+	drop := func(i int) bool {
+		msg := msgs[i]
+		if msg.Type == core.MsgTypeReasoning {
+			return msg.Provider != "" && msg.Provider != provider
+		}
+		if content, ok := msg.AsContent(); ok && i > 0 && provider != core.ProviderOpenAI {
+			return content.Role == "system"
+		}
+		return false
+	}
+
+	i := 0
+	for i < len(msgs) && !drop(i) {
+		i++
+	}
+	if i == len(msgs) {
+		return msgs
+	}
+
+	r := make([]*core.Msg, 0, len(msgs))
+	for i := range msgs {
+		if !drop(i) {
+			r = append(r, msgs[i])
+		}
+	}
+	return r
+}
+
+// toolOutcome is what a tool call goroutine reports back to the agent loop.
+type toolOutcome struct {
+	core.ToolResult
+	// idx is the position of the tool call within its round
+	idx         int
+	name        string
+	invalidArgs bool
+	// spent is what the tool spent on models of its own, if anything
+	spent *toolSpend
 }
 
 const (
 	agentRoundsMax = 4
 
+	// toolArgsFailuresMax is how many times in a row a tool can be called with invalid arguments
+	// before we stop allowing tool calls for the current run.
+	toolArgsFailuresMax = 3
+
 	toolCallLimitReachedPrompt = `You have reached the maximum number of sequential tool call turns
 without an user interaction. Generate a user message this turn. If you need to make further tool
 calls, just let the user know and once they respond, you can continue making more tool calls.`
+
+	toolCallCancelledResult = "<error>This tool call was cancelled before it could complete.</error>"
+
+	toolArgsLoopResult = `You have called %s with invalid arguments %d times in a row, so no more
+tool calls are allowed for now.`
+
+	toolArgsLoopPrompt = `You have repeatedly made tool calls with invalid arguments. Generate a user
+message this turn explaining what you were trying to do and the problem you ran into. Do not make
+any further tool calls until the user responds.`
 )
@@ -0,0 +1,785 @@
+package agg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/victhorio/opa/agg/anthropic"
+	"github.com/victhorio/opa/agg/core"
+	"github.com/victhorio/opa/agg/fake"
+)
+
+func TestAgentSimpleResponse(t *testing.T) {
+	model := fake.NewModel(
+		core.ProviderOpenAI,
+		fake.NewTurn().Reasoning("hmm").Text("Hel", "lo!").Usage(core.Usage{Input: 10, Output: 5, Total: 15, Cost: 7}),
+	)
+
+	store := NewEphemeralStore()
+	agent := NewAgent("sys", model, &store, []Tool{sleepTool()})
+
+	var deltas []string
+	out, err := agent.RunStream(context.Background(), http.DefaultClient, "s", "hi", false, func(ev core.Event) {
+		if ev.Type == core.EvDelta {
+			deltas = append(deltas, ev.Delta)
+		}
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "Hello!" {
+		t.Fatalf("expected output 'Hello!', got %q", out)
+	}
+	if got := strings.Join(deltas, "|"); got != "Hel|lo!" {
+		t.Errorf("expected deltas 'Hel|lo!', got %q", got)
+	}
+
+	calls := model.Calls()
+	if len(calls) != 1 {
+		t.Fatalf("expected 1 call to the model, got %d", len(calls))
+	}
+	assertRoles(t, calls[0].Msgs, "system", "user")
+	if len(calls[0].Tools) != 1 || calls[0].Tools[0].Name != "sleep" {
+		t.Errorf("expected the model to receive the sleep tool, got %+v", calls[0].Tools)
+	}
+	if calls[0].Cfg.DisableTools {
+		t.Errorf("expected tools to be enabled on the first round")
+	}
+
+	// reasoning is never persisted
+	assertRoles(t, store.Messages("s"), "system", "user", "assistant")
+	if u := store.Usage("s"); u.Total != 15 || u.Cost != 7 {
+		t.Errorf("expected usage to be persisted, got %+v", u)
+	}
+}
+
+func TestAgentPostProcess(t *testing.T) {
+	model := fake.NewModel(
+		core.ProviderOpenAI,
+		fake.NewTurn().Text("let me ", "check").ToolCall("1", "sleep", `{"ms": 0}`),
+		fake.NewTurn().Text("all ", "done"),
+	)
+
+	store := NewEphemeralStore()
+	agent := NewAgent("sys", model, &store, []Tool{sleepTool()})
+	agent.SetPostProcess(strings.ToUpper)
+
+	var deltas, responses []string
+	out, err := agent.RunStream(context.Background(), http.DefaultClient, "s", "hi", false, func(ev core.Event) {
+		switch ev.Type {
+		case core.EvDelta:
+			deltas = append(deltas, ev.Delta)
+		case core.EvResp:
+			content, _ := ev.Response.Messages[0].AsContent()
+			responses = append(responses, content.Text)
+		}
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "ALL DONE" {
+		t.Errorf("expected the output to be post-processed, got %q", out)
+	}
+	if got := strings.Join(deltas, "|"); got != "let me |check|all |done" {
+		t.Errorf("expected the deltas as generated, got %q", got)
+	}
+	if got := strings.Join(responses, "|"); got != "LET ME CHECK|ALL DONE" {
+		t.Errorf("expected every response to be post-processed, got %q", got)
+	}
+
+	// the history keeps what the model said, so it sees its own words in the next turns
+	msgs := store.Messages("s")
+	if content, _ := msgs[len(msgs)-1].AsContent(); content.Text != "all done" {
+		t.Errorf("expected the stored response as generated, got %q", content.Text)
+	}
+	if content, _ := msgs[2].AsContent(); content.Text != "let me check" {
+		t.Errorf("expected the stored first response as generated, got %q", content.Text)
+	}
+}
+
+func TestAgentIncludeInternals(t *testing.T) {
+	model := fake.NewModel(
+		core.ProviderAnthropic,
+		fake.NewTurn().Reasoning("let me sleep").ToolCall("1", "sleep", `{"ms": 0}`),
+		fake.NewTurn().Text("done"),
+	)
+
+	store := NewEphemeralStore()
+	agent := NewAgent("sys", model, &store, []Tool{sleepTool()})
+
+	out, err := agent.Run(context.Background(), http.DefaultClient, "s", "hi", true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, want := range []string{"[Reasoning: let me sleep]", `[Tool Call: sleep, 1, {"ms": 0}]`, "done"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected output to contain %q, got %q", want, out)
+		}
+	}
+}
+
+func TestAgentContinuesSession(t *testing.T) {
+	model := fake.NewModel(
+		core.ProviderAnthropic,
+		fake.NewTurn().Text("first"),
+		fake.NewTurn().Text("second"),
+	)
+
+	store := NewEphemeralStore()
+	agent := NewAgent("sys", model, &store, nil)
+
+	if _, err := agent.Run(context.Background(), http.DefaultClient, "s", "one", false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := agent.Run(context.Background(), http.DefaultClient, "s", "two", false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the system prompt is only added once, and the history is replayed on the second run
+	calls := model.Calls()
+	assertRoles(t, calls[1].Msgs, "system", "user", "assistant", "user")
+	assertRoles(t, store.Messages("s"), "system", "user", "assistant", "user", "assistant")
+
+	// other sessions are unaffected
+	if n := len(store.Messages("other")); n != 0 {
+		t.Errorf("expected no messages for another session, got %d", n)
+	}
+}
+
+func TestAgentSwitchModel(t *testing.T) {
+	first := fake.NewModel(core.ProviderAnthropic, fake.NewTurn().Reasoning("hmm").Text("first"))
+	second := fake.NewModel(core.ProviderOpenAI, fake.NewTurn().Text("second"))
+
+	store := NewEphemeralStore()
+	agent := NewAgent("sys", first, &store, nil)
+
+	if _, err := agent.Run(context.Background(), http.DefaultClient, "s", "one", false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// a store could keep reasoning around, which the next provider wouldn't understand
+	foreign := core.NewMsgReasoning("signature", "thinking")
+	foreign.Provider = core.ProviderAnthropic
+	if err := store.Extend("s", []*core.Msg{foreign}, core.Usage{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	agent.SetModel(second)
+	if agent.Model() != second {
+		t.Fatalf("expected the agent to use the new model")
+	}
+	if _, err := agent.Run(context.Background(), http.DefaultClient, "s", "two", false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	calls := second.Calls()
+	assertRoles(t, calls[0].Msgs, "system", "user", "assistant", "user")
+
+	msgs := store.Messages("s")
+	for i, want := range map[int]core.Provider{2: core.ProviderAnthropic, 5: core.ProviderOpenAI} {
+		if msgs[i].Provider != want || msgs[i].Model != "fake" {
+			t.Errorf("expected message %d to be from %s:fake, got %s:%s", i, want, msgs[i].Provider, msgs[i].Model)
+		}
+	}
+	if msgs[1].Provider != "" {
+		t.Errorf("expected the user message to have no provider, got %s", msgs[1].Provider)
+	}
+}
+
+func TestAgentStreamErrors(t *testing.T) {
+	errBoom := errors.New("boom")
+
+	t.Run("error opening stream", func(t *testing.T) {
+		model := fake.NewModel(core.ProviderOpenAI, fake.NewTurn().FailOpen(errBoom))
+		store := NewEphemeralStore()
+		agent := NewAgent("sys", model, &store, nil)
+
+		_, err := agent.Run(context.Background(), http.DefaultClient, "s", "hi", false)
+		if !errors.Is(err, errBoom) {
+			t.Fatalf("expected error to wrap errBoom, got %v", err)
+		}
+	})
+
+	t.Run("error during stream", func(t *testing.T) {
+		model := fake.NewModel(core.ProviderOpenAI, fake.NewTurn().Text("partial").Error(errBoom))
+		store := NewEphemeralStore()
+		agent := NewAgent("sys", model, &store, nil)
+
+		_, err := agent.Run(context.Background(), http.DefaultClient, "s", "hi", false)
+		if !errors.Is(err, errBoom) {
+			t.Fatalf("expected error to wrap errBoom, got %v", err)
+		}
+	})
+}
+
+func TestAgentRoundLimit(t *testing.T) {
+	for _, provider := range []core.Provider{core.ProviderOpenAI, core.ProviderAnthropic} {
+		t.Run(string(provider), func(t *testing.T) {
+			// a model that would call tools forever if we let it
+			model := fake.NewModel(provider)
+			for i := range agentRoundsMax + 1 {
+				model.Push(fake.NewTurn().ToolCall(fmt.Sprint(i), "sleep", `{"ms": 0}`).Cost(1))
+			}
+
+			store := NewEphemeralStore()
+			agent := NewAgent("sys", model, &store, []Tool{sleepTool()})
+
+			if _, err := agent.Run(context.Background(), http.DefaultClient, "s", "hi", false); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			calls := model.Calls()
+			if len(calls) != agentRoundsMax {
+				t.Fatalf("expected %d calls to the model, got %d", agentRoundsMax, len(calls))
+			}
+
+			for i, call := range calls {
+				last := i == len(calls)-1
+				forced := call.Cfg.DisableTools || hasSystemPrompt(call.Msgs, toolCallLimitReachedPrompt)
+				if forced != last {
+					t.Errorf("round %d: expected response to be forced only on the last round", i)
+				}
+			}
+
+			lastCall := calls[len(calls)-1]
+			switch provider {
+			case core.ProviderOpenAI:
+				if lastCall.Cfg.DisableTools {
+					t.Errorf("expected OpenAI to keep tools enabled on the last round")
+				}
+			case core.ProviderAnthropic:
+				if !lastCall.Cfg.DisableTools {
+					t.Errorf("expected Anthropic to have tools disabled on the last round")
+				}
+			}
+
+			if u := store.Usage("s"); u.Cost != int64(agentRoundsMax) {
+				t.Errorf("expected usage from every round, got %+v", u)
+			}
+		})
+	}
+}
+
+func TestAgentSwitchProviderAfterForcedResponse(t *testing.T) {
+	model := fake.NewModel(core.ProviderOpenAI)
+	for i := range agentRoundsMax {
+		model.Push(fake.NewTurn().ToolCall(fmt.Sprint(i), "sleep", `{"ms": 0}`))
+	}
+
+	store := NewEphemeralStore()
+	agent := NewAgent("sys", model, &store, []Tool{sleepTool()})
+	if _, err := agent.Run(context.Background(), http.DefaultClient, "s", "hi", false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// OpenAI was told to respond with a system message, which only goes with that request
+	calls := model.Calls()
+	if !hasSystemPrompt(calls[len(calls)-1].Msgs, toolCallLimitReachedPrompt) {
+		t.Fatalf("expected the last round to be forced with a system message")
+	}
+	if hasSystemPrompt(store.Messages("s"), toolCallLimitReachedPrompt) {
+		t.Errorf("expected the forcing system message not to be persisted")
+	}
+
+	// Anthropic refuses (and our conversion panics on) system messages past the first one
+	var bodies []string
+	srv := serveAnthropic(t, &bodies, "Switched.")
+	agent.SetModel(anthropic.NewModel(anthropic.Haiku, 1024, 0, false).WithBaseURL(srv.URL))
+
+	out, err := agent.Run(context.Background(), http.DefaultClient, "s", "still there?", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "Switched." || len(bodies) != 1 {
+		t.Errorf("expected a single request answered by Anthropic, got %q after %d", out, len(bodies))
+	}
+}
+
+func TestHistoryForDropsMidHistorySystemMessages(t *testing.T) {
+	// sessions from before the forcing system messages stopped being persisted still have them
+	msgs := []*core.Msg{
+		core.NewMsgContent("system", "sys"),
+		core.NewMsgContent("user", "hi"),
+		core.NewMsgContent("system", toolCallLimitReachedPrompt),
+		core.NewMsgContent("assistant", "hello"),
+	}
+
+	assertRoles(t, historyFor(core.ProviderOpenAI, msgs), "system", "user", "system", "assistant")
+	for _, provider := range []core.Provider{core.ProviderAnthropic, core.ProviderOpenAICompat, core.ProviderGemini} {
+		assertRoles(t, historyFor(provider, msgs), "system", "user", "assistant")
+	}
+}
+
+func TestAgentInvalidArgsLoop(t *testing.T) {
+	// every failure counts towards the streak, even when they happen within the same round
+	bad := fake.NewTurn()
+	for i := range toolArgsFailuresMax {
+		bad.ToolCall(fmt.Sprint(i), "sleep", `{"ms": "soon"}`)
+	}
+	model := fake.NewModel(
+		core.ProviderAnthropic,
+		bad,
+		fake.NewTurn().Text("I keep getting the arguments wrong"),
+	)
+
+	store := NewEphemeralStore()
+	agent := NewAgent("sys", model, &store, []Tool{sleepTool()})
+
+	out, err := agent.Run(context.Background(), http.DefaultClient, "s", "hi", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "I keep getting the arguments wrong" {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	calls := model.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("expected 2 calls to the model, got %d", len(calls))
+	}
+	if calls[0].Cfg.DisableTools {
+		t.Errorf("expected tools to be enabled on the first round")
+	}
+	// cut off well before reaching the round limit
+	if !calls[1].Cfg.DisableTools {
+		t.Errorf("expected tools to be disabled after %d invalid calls", toolArgsFailuresMax)
+	}
+
+	msgs := store.Messages("s")
+	result, ok := msgs[len(msgs)-2].AsToolResult()
+	if !ok {
+		t.Fatalf("expected the last tool result before the response")
+	}
+	want := fmt.Sprintf("invalid arguments %d times in a row", toolArgsFailuresMax)
+	if !strings.Contains(result.Result, want) {
+		t.Errorf("expected the last result to explain the cut-off, got %q", result.Result)
+	}
+}
+
+func TestAgentInvalidArgsLoopThenSwitchProvider(t *testing.T) {
+	bad := fake.NewTurn()
+	for i := range toolArgsFailuresMax {
+		bad.ToolCall(fmt.Sprint(i), "sleep", `{"ms": "soon"}`)
+	}
+	model := fake.NewModel(core.ProviderOpenAI, bad, fake.NewTurn().Text("I keep getting the arguments wrong"))
+
+	store := NewEphemeralStore()
+	agent := NewAgent("sys", model, &store, []Tool{sleepTool()})
+	if _, err := agent.Run(context.Background(), http.DefaultClient, "s", "hi", false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the cut-off is a system message for OpenAI, which must not outlive its request
+	if calls := model.Calls(); !hasSystemPrompt(calls[1].Msgs, toolArgsLoopPrompt) {
+		t.Fatalf("expected the model to be cut off with a system message")
+	}
+	if hasSystemPrompt(store.Messages("s"), toolArgsLoopPrompt) {
+		t.Errorf("expected the cut-off system message not to be persisted")
+	}
+
+	var bodies []string
+	srv := serveAnthropic(t, &bodies, "Let's try again.")
+	agent.SetModel(anthropic.NewModel(anthropic.Haiku, 1024, 0, false).WithBaseURL(srv.URL))
+
+	out, err := agent.Run(context.Background(), http.DefaultClient, "s", "try again", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "Let's try again." {
+		t.Errorf("expected Anthropic to answer, got %q", out)
+	}
+}
+
+func TestAgentSQLitePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "opa.db")
+
+	store, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+
+	model := fake.NewModel(
+		core.ProviderOpenAI,
+		fake.NewTurn().Reasoning("hmm").ToolCall("1", "sleep", `{"ms": 0}`).Cost(2),
+		fake.NewTurn().Text("rested").Cost(3),
+	)
+	agent := NewAgent("sys", model, store, []Tool{sleepTool()})
+
+	if _, err := agent.Run(context.Background(), http.DefaultClient, "s", "hi", false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("failed to close store: %v", err)
+	}
+
+	// a fresh store over the same file should see the whole conversation
+	store, err = NewSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store.Close()
+
+	model = fake.NewModel(core.ProviderOpenAI, fake.NewTurn().Text("still rested").Cost(1))
+	agent = NewAgent("sys", model, store, []Tool{sleepTool()})
+
+	if _, err := agent.Run(context.Background(), http.DefaultClient, "s", "again", false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	assertRoles(t, model.Calls()[0].Msgs, "system", "user", "tool", "tool", "assistant", "user")
+	assertRoles(t, store.Messages("s"), "system", "user", "tool", "tool", "assistant", "user", "assistant")
+	if u := store.Usage("s"); u.Cost != 6 {
+		t.Errorf("expected accumulated cost 6, got %d", u.Cost)
+	}
+}
+
+func TestAgentToolResultsFollowCallOrder(t *testing.T) {
+	model := fake.NewModel(
+		core.ProviderAnthropic,
+		fake.NewTurn().
+			ToolCall("1", "sleep", `{"ms": 50}`).
+			ToolCall("2", "sleep", `{"ms": 0}`).
+			ToolCall("3", "sleep", `{"ms": 25}`),
+		fake.NewTurn().Text("done"),
+	)
+
+	store := NewEphemeralStore()
+	agent := NewAgent("sys", model, &store, []Tool{sleepTool()})
+
+	out, err := agent.Run(context.Background(), http.DefaultClient, "s", "hi", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "done" {
+		t.Fatalf("expected output 'done', got %q", out)
+	}
+
+	// system, user, 3 tool calls, 3 tool results, final content
+	msgs := store.Messages("s")
+	if len(msgs) != 9 {
+		t.Fatalf("expected 9 stored messages, got %d", len(msgs))
+	}
+
+	for i, wantID := range []string{"1", "2", "3"} {
+		result, ok := msgs[5+i].AsToolResult()
+		if !ok {
+			t.Fatalf("expected message %d to be a tool result, got %d", 5+i, msgs[5+i].Type)
+		}
+		if result.ID != wantID {
+			t.Errorf("expected tool result %d to have ID %s, got %s", i, wantID, result.ID)
+		}
+	}
+}
+
+func TestAgentToolResultParts(t *testing.T) {
+	model := fake.NewModel(
+		core.ProviderAnthropic,
+		fake.NewTurn().ToolCall("1", "look", `{}`),
+		fake.NewTurn().Text("a cat"),
+	)
+
+	look := NewToolWithParts(func(ctx context.Context, args struct{}) (ToolOutput, error) {
+		return ToolOutput{
+			Text:  "cat.png",
+			Parts: []core.Part{core.NewPartImage("image/png", []byte("png"))},
+		}, nil
+	}, core.Tool{Name: "look"})
+
+	store := NewEphemeralStore()
+	agent := NewAgent("sys", model, &store, []Tool{look})
+
+	if _, err := agent.Run(context.Background(), http.DefaultClient, "s", "what is it?", false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the second call must carry the image along with the tool result
+	msgs := model.Calls()[1].Msgs
+	result, ok := msgs[len(msgs)-1].AsToolResult()
+	if !ok {
+		t.Fatalf("expected the last message to be a tool result, got %d", msgs[len(msgs)-1].Type)
+	}
+	if result.Result != "cat.png" || len(result.Parts) != 1 || result.Parts[0].MediaType != "image/png" {
+		t.Errorf("unexpected tool result %+v", result)
+	}
+}
+
+func TestAgentRecoversToolPanic(t *testing.T) {
+	model := fake.NewModel(
+		core.ProviderAnthropic,
+		fake.NewTurn().ToolCall("1", "boom", `{}`),
+		fake.NewTurn().Text("sorry"),
+	)
+
+	panicky := NewTool(func(ctx context.Context, args struct{}) (string, error) {
+		panic("something went very wrong")
+	}, core.Tool{Name: "boom"})
+
+	store := NewEphemeralStore()
+	agent := NewAgent("sys", model, &store, []Tool{panicky})
+
+	out, err := agent.Run(context.Background(), http.DefaultClient, "s", "hi", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "sorry" {
+		t.Fatalf("expected output 'sorry', got %q", out)
+	}
+
+	result, ok := store.Messages("s")[3].AsToolResult()
+	if !ok {
+		t.Fatalf("expected a tool result")
+	}
+	if !strings.Contains(result.Result, "something went very wrong") {
+		t.Fatalf("expected tool result to mention the panic, got %q", result.Result)
+	}
+}
+
+func TestAgentPersistsPartialRoundOnCancel(t *testing.T) {
+	model := fake.NewModel(
+		core.ProviderAnthropic,
+		fake.NewTurn().
+			ToolCall("1", "sleep", `{"ms": 0}`).
+			ToolCall("2", "block", `{}`).
+			Cost(1),
+		fake.NewTurn().Text("never reached"),
+	)
+
+	started := make(chan struct{})
+	block := NewTool(func(ctx context.Context, args struct{}) (string, error) {
+		close(started)
+		<-ctx.Done()
+		return "", ctx.Err()
+	}, core.Tool{Name: "block"})
+
+	store := NewEphemeralStore()
+	agent := NewAgent("sys", model, &store, []Tool{sleepTool(), block})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		// give the other tool call a chance to finish
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := agent.Run(ctx, http.DefaultClient, "s", "hi", false)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	// system, user, 2 tool calls, 2 tool results
+	msgs := store.Messages("s")
+	if len(msgs) != 6 {
+		t.Fatalf("expected 6 stored messages, got %d", len(msgs))
+	}
+
+	first, _ := msgs[4].AsToolResult()
+	if first.ID != "1" || first.Result != "slept 0ms" {
+		t.Errorf("expected completed result to be kept, got %+v", first)
+	}
+	second, _ := msgs[5].AsToolResult()
+	if second.ID != "2" || second.Result != toolCallCancelledResult {
+		t.Errorf("expected cancelled result for pending call, got %+v", second)
+	}
+
+	if u := store.Usage("s"); u.Cost != 1 {
+		t.Errorf("expected usage of the completed round to be persisted, got %+v", u)
+	}
+}
+
+func TestAgentPersistsRoundCancelledAfterToolsFinished(t *testing.T) {
+	// the latency lets the tool call finish before the response arrives
+	model := fake.NewModel(
+		core.ProviderAnthropic,
+		fake.NewTurn().ToolCall("1", "sleep", `{"ms": 0}`).Cost(1),
+		fake.NewTurn().Text("never reached"),
+	).WithLatency(10 * time.Millisecond)
+
+	store := NewEphemeralStore()
+	agent := NewAgent("sys", model, &store, []Tool{sleepTool()})
+
+	// By the time the results are collected, both the tool result and the cancellation are there,
+	// so either may be noticed first. Either way the round is kept.
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := agent.RunStream(ctx, http.DefaultClient, "s", "hi", false, func(ev core.Event) {
+		if ev.Type == core.EvResp {
+			cancel()
+		}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	msgs := store.Messages("s")
+	assertRoles(t, msgs, "system", "user", "tool", "tool")
+	if u := store.Usage("s"); u.Cost != 1 {
+		t.Errorf("expected usage of the completed round to be persisted, got %+v", u)
+	}
+}
+
+func TestAgentPersistsCompletedRoundsOnError(t *testing.T) {
+	errBoom := errors.New("boom")
+	model := fake.NewModel(
+		core.ProviderOpenAI,
+		fake.NewTurn().ToolCall("1", "sleep", `{"ms": 0}`).Cost(1),
+		fake.NewTurn().Text("partial").Error(errBoom),
+	)
+
+	store := NewEphemeralStore()
+	agent := NewAgent("sys", model, &store, []Tool{sleepTool()})
+
+	_, err := agent.Run(context.Background(), http.DefaultClient, "s", "hi", false)
+	if !errors.Is(err, errBoom) {
+		t.Fatalf("expected error to wrap errBoom, got %v", err)
+	}
+
+	// the first round is kept, while nothing of the failed one is
+	msgs := store.Messages("s")
+	assertRoles(t, msgs, "system", "user", "tool", "tool")
+	if result, _ := msgs[3].AsToolResult(); result.Result != "slept 0ms" {
+		t.Errorf("expected the tool result to be kept, got %+v", result)
+	}
+
+	if u := store.Usage("s"); u.Cost != 1 {
+		t.Errorf("expected usage of the completed round to be persisted, got %+v", u)
+	}
+}
+
+func TestAgentCancelWhileStreaming(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// the response never arrives, and we cancel once the first delta is seen
+	model := fake.NewModel(core.ProviderAnthropic, fake.NewTurn().Text("partial").Hang()).
+		WithLatency(time.Millisecond)
+
+	store := NewEphemeralStore()
+	agent := NewAgent("sys", model, &store, nil)
+
+	_, err := agent.RunStream(ctx, http.DefaultClient, "s", "hi", false, func(ev core.Event) {
+		if ev.Type == core.EvDelta {
+			cancel()
+		}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	// no round completed, so the session is left untouched
+	if msgs := store.Messages("s"); len(msgs) != 0 {
+		t.Fatalf("expected no stored messages, got %d", len(msgs))
+	}
+}
+
+func TestAgentFirstRoundOpenErrorKeepsHistory(t *testing.T) {
+	model := fake.NewModel(
+		core.ProviderOpenAI,
+		fake.NewTurn().Text("Hello!"),
+		fake.NewTurn().FailOpen(&core.APIError{Provider: core.ProviderOpenAI, Status: http.StatusBadRequest}),
+		fake.NewTurn().Text("Sure."),
+	)
+	store := NewEphemeralStore()
+	agent := NewAgent("sys", model, &store, nil)
+
+	if _, err := agent.Run(context.Background(), http.DefaultClient, "s", "hi", false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var apiErr *core.APIError
+	if _, err := agent.Run(context.Background(), http.DefaultClient, "s", "again", false); !errors.As(err, &apiErr) {
+		t.Fatalf("expected the API error, got %v", err)
+	}
+	assertRoles(t, store.Messages("s"), "system", "user", "assistant")
+
+	// retrying the same input stores it once, right after the previous answer
+	if _, err := agent.Run(context.Background(), http.DefaultClient, "s", "again", false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	msgs := store.Messages("s")
+	assertRoles(t, msgs, "system", "user", "assistant", "user", "assistant")
+	if c, _ := msgs[3].AsContent(); c.Text != "again" {
+		t.Errorf("unexpected user message %+v", c)
+	}
+}
+
+func sleepTool() Tool {
+	return NewTool(func(ctx context.Context, args struct {
+		Ms int `json:"ms"`
+	}) (string, error) {
+		time.Sleep(time.Duration(args.Ms) * time.Millisecond)
+		return fmt.Sprintf("slept %dms", args.Ms), nil
+	}, core.Tool{
+		Name:   "sleep",
+		Params: map[string]core.ToolParam{"ms": {Type: core.JSTInteger, Desc: "How long to sleep"}},
+	})
+}
+
+// assertRoles checks the sequence of messages, using "tool" for tool calls and results, and
+// "reasoning" for reasoning messages.
+func assertRoles(t *testing.T, msgs []*core.Msg, want ...string) {
+	t.Helper()
+
+	got := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		switch msg.Type {
+		case core.MsgTypeContent:
+			c, _ := msg.AsContent()
+			got = append(got, c.Role)
+		case core.MsgTypeReasoning:
+			got = append(got, "reasoning")
+		default:
+			got = append(got, "tool")
+		}
+	}
+
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected messages %v, got %v", want, got)
+	}
+}
+
+// serveAnthropic serves the Messages API, answering every request with text and recording the
+// body of each of them in bodies.
+func serveAnthropic(t *testing.T, bodies *[]string, text string) *httptest.Server {
+	t.Helper()
+
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		*bodies = append(*bodies, string(body))
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		delta, _ := json.Marshal(text)
+		for _, data := range []string{
+			`{"type":"message_start","message":{"model":"claude-haiku-4-5-20251001"}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":` + string(delta) + `}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"message_delta","usage":{"input_tokens":10,"output_tokens":2}}`,
+			`{"type":"message_stop"}`,
+		} {
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func hasSystemPrompt(msgs []*core.Msg, prompt string) bool {
+	for _, msg := range msgs {
+		if c, ok := msg.AsContent(); ok && c.Role == "system" && c.Text == prompt {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package anthropic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/victhorio/opa/agg/core"
+)
+
+func TestCacheBreakpoints(t *testing.T) {
+	msgs := []*core.Msg{core.NewMsgContent("system", "You are a helpful assistant.")}
+	for i := range 6 {
+		msgs = append(msgs,
+			core.NewMsgContent("user", fmt.Sprintf("question %d", i)),
+			core.NewMsgReasoning("sig", "thinking"),
+			core.NewMsgToolCall(fmt.Sprintf("call_%d", i), "search", "{}"),
+			core.NewMsgToolResult(fmt.Sprintf("call_%d", i), "result"),
+		)
+	}
+	// with 17 messages the rolling breakpoint would be at index 10, which is a reasoning message, so
+	// it moves back to the user message before it
+	msgs = msgs[:17]
+
+	model := NewModel(Haiku, 2048, 1024, true).WithCachePolicy(CachePolicy{
+		Tools:        true,
+		System:       true,
+		LastMessage:  true,
+		RollingEvery: 10,
+	})
+
+	if got := model.rollingBreakpoint(msgs); got != 9 {
+		t.Fatalf("expected the rolling breakpoint at 9, got %d", got)
+	}
+
+	sys, converted := model.fromCoreMsgs(msgs)
+	raw, err := json.Marshal(requestBody{
+		SysPrompt: sys,
+		Msgs:      converted,
+		Tools:     []tool{{Name: "search", CacheCtrl: &cacheCtrl{Type: "ephemeral"}}},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal request: %v", err)
+	}
+	// tools, system prompt, rolling and last message
+	if n := strings.Count(string(raw), `"cache_control"`); n != 4 {
+		t.Fatalf("expected 4 cache breakpoints, got %d in %s", n, raw)
+	}
+	if !strings.Contains(string(raw), `"system":[{"type":"text","text":"You are a helpful assistant.","cache_control":{"type":"ephemeral"}}]`) {
+		t.Errorf("expected the system prompt as a text block with a breakpoint, got %s", raw)
+	}
+
+	// breakpoints must not end up in the cached transforms, or they'd pile up in later requests
+	for i, msg := range msgs {
+		if cached := msg.CachedTransform(core.ProviderAnthropic); strings.Contains(string(cached), "cache_control") {
+			t.Errorf("message %d has a breakpoint in its cached transform", i)
+		}
+	}
+
+	// without caching the system prompt stays a plain string
+	sys, _ = NewModel(Haiku, 2048, 1024, false).fromCoreMsgs(msgs)
+	if raw, _ := json.Marshal(sys); string(raw) != `"You are a helpful assistant."` {
+		t.Errorf("expected a plain system prompt, got %s", raw)
+	}
+}
+
+func TestCacheWriteUsage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, ev := range []string{
+			`{"type":"message_start","message":{"model":"claude-haiku-4-5-20251001"}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hi!"}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"input_tokens":10,"cache_read_input_tokens":2000,"cache_creation_input_tokens":500,"output_tokens":5}}`,
+			`{"type":"message_stop"}`,
+		} {
+			fmt.Fprintf(w, "data: %s\n\n", ev)
+		}
+	}))
+	defer srv.Close()
+
+	model := NewModel(Haiku, 2048, 0, true).WithBaseURL(srv.URL)
+	stream, err := model.OpenStream(context.Background(), srv.Client(), []*core.Msg{core.NewMsgContent("user", "hi")}, nil, core.StreamCfg{})
+	if err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+
+	resp, _ := consume(context.Background(), t, stream)
+
+	want := core.Usage{
+		Input:      10,
+		Cached:     2000,
+		CacheWrite: 500,
+		Output:     5,
+		Total:      2515,
+		Cost:       10*1000 + 2000*100 + 500*1250 + 5*5000,
+	}
+	if resp.Usage != want {
+		t.Errorf("expected usage %+v, got %+v", want, resp.Usage)
+	}
+}
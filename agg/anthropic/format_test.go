@@ -0,0 +1,74 @@
+package anthropic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/victhorio/opa/agg/core"
+)
+
+func TestResponseFormat(t *testing.T) {
+	var body map[string]json.RawMessage
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		_ = json.Unmarshal(raw, &body)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, ev := range []string{
+			`{"type":"message_start","message":{"model":"claude-haiku-4-5-20251001"}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"tool_use","id":"toolu_1","name":"city"}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"{\"name\":"}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"\"Paris\"}"}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"input_tokens":10,"output_tokens":5}}`,
+			`{"type":"message_stop"}`,
+		} {
+			fmt.Fprintf(w, "data: %s\n\n", ev)
+		}
+	}))
+	defer srv.Close()
+
+	format := &core.ResponseFormat{
+		Name:   "city",
+		Desc:   "The city asked about.",
+		Schema: map[string]core.ToolParam{"name": {Type: core.JSTString, Desc: "Name of the city"}},
+	}
+
+	model := NewModel(Haiku, 2048, 1024, false).WithBaseURL(srv.URL)
+	stream, err := model.OpenStream(
+		context.Background(),
+		srv.Client(),
+		[]*core.Msg{core.NewMsgContent("user", "What's the capital of France?")},
+		nil,
+		core.StreamCfg{ResponseFormat: format},
+	)
+	if err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+
+	resp, events := consume(context.Background(), t, stream)
+
+	if got := string(body["tool_choice"]); got != `{"type":"tool","name":"city"}` {
+		t.Errorf("expected the format tool to be forced, got %s", got)
+	}
+	if _, ok := body["thinking"]; ok {
+		t.Errorf("expected thinking to be disabled along with a forced tool")
+	}
+
+	for _, ev := range events {
+		if ev.Type == core.EvToolCall {
+			t.Errorf("expected no tool call events, got %+v", ev.Call)
+		}
+	}
+	if len(resp.Messages) != 1 {
+		t.Fatalf("expected a single message, got %d", len(resp.Messages))
+	}
+	if c, ok := resp.Messages[0].AsContent(); !ok || c.Text != `{"name":"Paris"}` || c.Role != "assistant" {
+		t.Errorf("expected the object as an assistant message, got %+v", resp.Messages[0])
+	}
+}
@@ -1,7 +1,7 @@
 package anthropic
 
 import (
-	"log"
+	"strings"
 
 	"github.com/victhorio/opa/agg/core"
 )
@@ -11,19 +11,72 @@ type Model struct {
 	model        ModelID
 	maxTok       int
 	maxTokReason int
-	shouldCache  bool
+	cache        CachePolicy
+	baseURL      string
 }
 
-// NewModel creates a new Anthropic Model with the given configuration.
+// NewModel creates a new Anthropic Model with the given configuration. If shouldCache is set the
+// model uses DefaultCachePolicy, which can be changed with WithCachePolicy.
 func NewModel(model ModelID, maxTok int, maxTokReason int, shouldCache bool) *Model {
+	var cache CachePolicy
+	if shouldCache {
+		cache = DefaultCachePolicy()
+	}
+
 	return &Model{
 		model:        model,
 		maxTok:       maxTok,
 		maxTokReason: maxTokReason,
-		shouldCache:  shouldCache,
+		cache:        cache,
+		baseURL:      defaultBaseURL,
+	}
+}
+
+// WithCachePolicy changes where the model places cache breakpoints in its requests.
+func (m *Model) WithCachePolicy(p CachePolicy) *Model {
+	m.cache = p
+	return m
+}
+
+// CachePolicy says where requests place cache breakpoints, i.e. the points up to which Anthropic
+// caches the prompt so that later requests starting with the same prefix are cheaper and faster.
+// The prompt is made of the tools, then the system prompt, then the messages, so each breakpoint
+// caches everything that comes before it. The API allows at most 4 breakpoints per request, which
+// is what enabling all of them uses.
+type CachePolicy struct {
+	// Tools places a breakpoint after the tool definitions.
+	Tools bool
+	// System places a breakpoint after the system prompt. For us this is the largest part of the
+	// prompt that stays the same across sessions, so it's worth caching on its own.
+	System bool
+	// LastMessage places a breakpoint at the last message, i.e. the user's message or the latest
+	// tool result, so that the next round or turn can reuse the whole conversation.
+	LastMessage bool
+	// RollingEvery, if positive, places a breakpoint at the last message whose position is a
+	// multiple of it. Anthropic only looks for cached prefixes up to 20 blocks before each
+	// breakpoint, so when a turn adds more than that (e.g. many tool calls) the previous cache
+	// would be missed. Since these positions don't change from one request to the next, they keep
+	// hitting the cache as the session grows.
+	RollingEvery int
+}
+
+// DefaultCachePolicy uses every breakpoint, with a rolling one every 10 messages.
+func DefaultCachePolicy() CachePolicy {
+	return CachePolicy{
+		Tools:        true,
+		System:       true,
+		LastMessage:  true,
+		RollingEvery: 10,
 	}
 }
 
+// WithBaseURL makes the model send its requests to the API rooted at url (e.g.
+// "http://localhost:8080/v1") instead of the official Anthropic one.
+func (m *Model) WithBaseURL(url string) *Model {
+	m.baseURL = strings.TrimRight(url, "/")
+	return m
+}
+
 func (m *Model) Provider() core.Provider {
 	return core.ProviderAnthropic
 }
@@ -36,44 +89,68 @@ const (
 	Opus   ModelID = "claude-opus-4-5-20251101"
 )
 
-// no cache because I'm not leveraging it anyway for now
-type modelCost struct {
-	In           int64
-	InCacheWrite int64
-	InCacheRead  int64
-	Out          int64
+func init() {
+	for _, info := range models {
+		core.RegisterModel(info)
+	}
 }
 
-var modelCosts = map[ModelID]modelCost{
-	Haiku: {
-		In:           1000, // $1.000 per 1M
-		InCacheWrite: 1250, // $1.250 per 1M
-		InCacheRead:  100,  // $0.100 per 1M
-		Out:          5000, // $5.000 per 1M
+var models = []core.ModelInfo{
+	{
+		Provider:      core.ProviderAnthropic,
+		ID:            string(Haiku),
+		Aliases:       []string{"haiku"},
+		ContextWindow: 200_000,
+		MaxOutput:     64_000,
+		Reasoning:     true,
+		Caching:       true,
+		Tools:         true,
+		Prices: core.Prices{
+			Input:      1000, // $1.000 per 1M
+			CacheWrite: 1250, // $1.250 per 1M
+			Cached:     100,  // $0.100 per 1M
+			Output:     5000, // $5.000 per 1M
+		},
 	},
-	Sonnet: {
-		In:           3000,  // $3.000 per 1M
-		InCacheWrite: 3750,  // $3.750 per 1M
-		InCacheRead:  300,   // $0.300 per 1M
-		Out:          15000, // $15.000 per 1M
+	{
+		Provider:      core.ProviderAnthropic,
+		ID:            string(Sonnet),
+		Aliases:       []string{"sonnet"},
+		ContextWindow: 200_000,
+		MaxOutput:     64_000,
+		Reasoning:     true,
+		Caching:       true,
+		Tools:         true,
+		Prices: core.Prices{
+			Input:      3000,  // $3.000 per 1M
+			CacheWrite: 3750,  // $3.750 per 1M
+			Cached:     300,   // $0.300 per 1M
+			Output:     15000, // $15.000 per 1M
+		},
 	},
-	Opus: {
-		In:           5000,  // $5.000 per 1M
-		InCacheWrite: 6250,  // $6.250 per 1M
-		InCacheRead:  500,   // $0.500 per 1M
-		Out:          25000, // $25.000 per 1M
+	{
+		Provider:      core.ProviderAnthropic,
+		ID:            string(Opus),
+		Aliases:       []string{"opus"},
+		ContextWindow: 200_000,
+		MaxOutput:     64_000,
+		Reasoning:     true,
+		Caching:       true,
+		Tools:         true,
+		Prices: core.Prices{
+			Input:      5000,  // $5.000 per 1M
+			CacheWrite: 6250,  // $6.250 per 1M
+			Cached:     500,   // $0.500 per 1M
+			Output:     25000, // $25.000 per 1M
+		},
 	},
 }
 
 func costFromUsage(model ModelID, usage usage) int64 {
-	costs, ok := modelCosts[model]
-	if !ok {
-		log.Printf("cannot compute costs: unknown model: %s", model)
+	prices, err := core.ModelPrices(core.ProviderAnthropic, string(model))
+	if err != nil {
 		return 0
 	}
 
-	return (costs.In*usage.In +
-		costs.InCacheWrite*usage.InCacheWrite +
-		costs.InCacheRead*usage.InCacheRead +
-		costs.Out*usage.Out)
+	return prices.Cost(usage.In, usage.InCacheRead, usage.InCacheWrite, usage.Out)
 }
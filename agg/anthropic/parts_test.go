@@ -0,0 +1,37 @@
+package anthropic
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/victhorio/opa/agg/core"
+)
+
+func TestPartsConversion(t *testing.T) {
+	png := core.NewPartImage("image/png", []byte("png"))
+	pdf := core.NewPartDocument("paper.pdf", "application/pdf", []byte("pdf"))
+
+	msgs := []*core.Msg{
+		core.NewMsgContent("user", "What's in here?", png),
+		core.NewMsgToolCall("call_a", "readAttachment", `{"path":"paper.pdf"}`),
+		core.NewMsgToolResult("call_a", "Attached paper.pdf.", pdf),
+	}
+
+	model := NewModel(Haiku, 2048, 1024, false)
+	for range 2 {
+		// the second round goes through the cached transforms
+		_, converted := model.fromCoreMsgs(msgs)
+		got, _ := json.Marshal(converted)
+		want := `[` +
+			`{"role":"user","content":[{"type":"text","text":"What's in here?"},` +
+			`{"type":"image","source":{"type":"base64","media_type":"image/png","data":"cG5n"}}]},` +
+			`{"role":"assistant","content":[{"type":"tool_use","id":"call_a","name":"readAttachment","input":{"path":"paper.pdf"}}]},` +
+			`{"role":"user","content":[{"type":"tool_result","tool_use_id":"call_a","content":[` +
+			`{"type":"text","text":"Attached paper.pdf."},` +
+			`{"type":"document","source":{"type":"base64","media_type":"application/pdf","data":"cGRm"},"title":"paper.pdf"}]}]}` +
+			`]`
+		if string(got) != want {
+			t.Errorf("unexpected messages:\n got: %s\nwant: %s", got, want)
+		}
+	}
+}
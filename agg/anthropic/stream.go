@@ -18,6 +18,10 @@ import (
 type Stream struct {
 	stream  io.ReadCloser
 	modelID ModelID
+
+	// format is the name of the tool standing in for the response format, if any, whose call is
+	// turned back into a text response
+	format string
 }
 
 func (m *Model) OpenStream(
@@ -39,6 +43,10 @@ func (m *Model) OpenStream(
 		Tools:     fromCoreTools(tools),
 	}
 
+	if m.cache.Tools && len(payload.Tools) > 0 {
+		payload.Tools[len(payload.Tools)-1].CacheCtrl = &cacheCtrl{Type: "ephemeral"}
+	}
+
 	if m.maxTokReason > 0 {
 		payload.Reason = newReasonCfg(true, m.maxTokReason)
 	}
@@ -51,12 +59,22 @@ func (m *Model) OpenStream(
 		}
 	}
 
+	// There's no native response format, so we force the model to call a tool taking the expected
+	// object instead. Forcing a tool isn't compatible with extended thinking, so that goes away.
+	var format string
+	if cfg.ResponseFormat != nil {
+		format = cfg.ResponseFormat.Name
+		payload.Tools = append(payload.Tools, fromCoreTool(cfg.ResponseFormat.AsTool()))
+		payload.ToolCfg = &toolCfg{Type: "tool", Name: format}
+		payload.Reason = nil
+	}
+
 	body, err := json.Marshal(payload)
 	if err != nil {
 		return nil, fmt.Errorf("anthropic.OpenStream: error marshalling request body: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", messagesEndpoint, bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", m.baseURL+"/messages", bytes.NewBuffer(body))
 	if err != nil {
 		return nil, fmt.Errorf("anthropic.OpenStream: error creating request: %w", err)
 	}
@@ -86,12 +104,13 @@ func (m *Model) OpenStream(
 		if err != nil {
 			return nil, fmt.Errorf("anthropic.OpenStream: error reading response body: %w", err)
 		}
-		return nil, fmt.Errorf("anthropic.OpenStream: error response: %s, body=%s", resp.Status, string(body))
+		return nil, fmt.Errorf("anthropic.OpenStream: %w", core.NewAPIError(core.ProviderAnthropic, resp, body))
 	}
 
 	return &Stream{
 		stream:  resp.Body,
 		modelID: m.model,
+		format:  format,
 	}, nil
 }
 
@@ -185,11 +204,20 @@ func (s *Stream) dispatchRawEvent(
 	case stMsgDelta:
 		resp.Usage.Input = ev.Usage.In
 		resp.Usage.Cached = ev.Usage.InCacheRead
+		resp.Usage.CacheWrite = ev.Usage.InCacheWrite
 		resp.Usage.Output = ev.Usage.Out
-		resp.Usage.Total = ev.Usage.In + ev.Usage.Out
+		resp.Usage.Total = ev.Usage.In + ev.Usage.InCacheRead + ev.Usage.InCacheWrite + ev.Usage.Out
 		resp.Usage.Cost = costFromUsage(s.modelID, ev.Usage)
 	case stMsgStop:
 		return true, nil
+	case stError:
+		err := &core.APIError{
+			Provider: core.ProviderAnthropic,
+			Type:     ev.Error.Type,
+			Message:  ev.Error.Message,
+		}
+		_ = sendEvent(ctx, out, core.NewEvError(fmt.Errorf("anthropic: %w", err)))
+		return true, err
 	case stContBlockStart:
 		switch ev.ContentBlock.Type {
 		case msgContTypeReason:
@@ -262,6 +290,14 @@ func (s *Stream) dispatchRawEvent(
 		switch lastMsg.Type {
 		case core.MsgTypeToolCall:
 			toolCall, _ := lastMsg.AsToolCall()
+			if s.format != "" && toolCall.Name == s.format {
+				// this is the response itself, so it goes out as text like any other provider
+				resp.Messages[len(resp.Messages)-1] = core.NewMsgContent("assistant", toolCall.Arguments)
+				if ok := sendEvent(ctx, out, core.NewEvDelta(toolCall.Arguments)); !ok {
+					return true, fmt.Errorf("context done")
+				}
+				break
+			}
 			if ok := sendEvent(ctx, out, core.NewEvToolCall(*toolCall)); !ok {
 				return true, fmt.Errorf("context done")
 			}
@@ -295,13 +331,30 @@ type requestBody struct {
 	Msgs      []*msg     `json:"messages"`
 	Model     ModelID    `json:"model"`
 	Stream    bool       `json:"stream"`
-	SysPrompt string     `json:"system,omitempty"`
+	SysPrompt *sysPrompt `json:"system,omitempty"`
 	Temp      *float64   `json:"temperature,omitempty"`
 	Reason    *reasonCfg `json:"thinking,omitempty"`
-	ToolCfg   *toolCfg   `json:"tool_choice,omitempty"` // TODO: currently unused
+	ToolCfg   *toolCfg   `json:"tool_choice,omitempty"`
 	Tools     []tool     `json:"tools,omitempty"`
 }
 
+// sysPrompt is the system prompt, which is sent as a plain string unless it needs a cache
+// breakpoint, since only text blocks can have one.
+type sysPrompt struct {
+	Text      string
+	CacheCtrl *cacheCtrl
+}
+
+func (p *sysPrompt) MarshalJSON() ([]byte, error) {
+	if p.CacheCtrl == nil {
+		return json.Marshal(p.Text)
+	}
+
+	block := newMsgText(p.Text)
+	block.CacheCtrl = p.CacheCtrl
+	return json.Marshal([]*msgContent{block})
+}
+
 type reasonCfg struct {
 	Type string `json:"type"` // "enabled" or "disabled"
 	// must be at least 1024 and less than requestBody.MaxToks, must be set iff Type = "enabled"
@@ -320,7 +373,8 @@ func newReasonCfg(enabled bool, maxToks int) *reasonCfg {
 }
 
 type toolCfg struct {
-	Type            string `json:"type"`                                // "auto", "any", "none"
+	Type            string `json:"type"`                                // "auto", "any", "tool", "none"
+	Name            string `json:"name,omitempty"`                      // only if Type == "tool"
 	DisableParallel *bool  `json:"disable_parallel_tool_use,omitempty"` // should not be set if Type == "none"
 }
 
@@ -348,9 +402,12 @@ type msgContent struct {
 	ID   string          `json:"id,omitempty"`
 	Name string          `json:"name,omitempty"`
 	Args json.RawMessage `json:"input,omitempty"`
-	// tool result fields
+	// tool result fields, where Output is either a string or a list of blocks
 	ToolUseID string `json:"tool_use_id,omitempty"`
-	Output    string `json:"content,omitempty"`
+	Output    any    `json:"content,omitempty"`
+	// image and document fields
+	Source *blockSource `json:"source,omitempty"`
+	Title  string       `json:"title,omitempty"`
 
 	// this are fields used to indicate caching (cannot be used for Reasoning)
 	CacheCtrl *cacheCtrl `json:"cache_control,omitempty"`
@@ -359,6 +416,12 @@ type msgContent struct {
 	PartialArgs string `json:"partial_json,omitempty"`
 }
 
+type blockSource struct {
+	Type      string `json:"type"` // always "base64" for us
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
 type cacheCtrl struct {
 	Type string `json:"type"`          // should always be "ephemeral"
 	TTL  string `json:"ttl,omitempty"` // either "5m" or "1h", but cost calculation assumes "5m"
@@ -371,6 +434,8 @@ const (
 	msgContTypeReason     msgContentType = "thinking"
 	msgContTypeTool       msgContentType = "tool_use"
 	msgContTypeToolResult msgContentType = "tool_result"
+	msgContTypeImage      msgContentType = "image"
+	msgContTypeDocument   msgContentType = "document"
 
 	// delta types
 	deltaTypeReasonText msgContentType = "thinking_delta"
@@ -403,17 +468,52 @@ func newMsgToolUse(id, name string, args json.RawMessage) *msgContent {
 	}
 }
 
-func newMsgToolResult(toolUseID, output string) *msgContent {
-	return &msgContent{
+func newMsgToolResult(toolUseID, output string, parts []core.Part) *msgContent {
+	content := &msgContent{
 		Type:      msgContTypeToolResult,
 		ToolUseID: toolUseID,
-		Output:    output,
+	}
+
+	switch {
+	case len(parts) > 0:
+		blocks := make([]*msgContent, 0, len(parts)+1)
+		if output != "" {
+			blocks = append(blocks, newMsgText(output))
+		}
+		for _, p := range parts {
+			blocks = append(blocks, fromCorePart(p))
+		}
+		content.Output = blocks
+	case output != "":
+		content.Output = output
+	}
+
+	return content
+}
+
+// fromCorePart converts a part of a message or tool result into a content block.
+func fromCorePart(p core.Part) *msgContent {
+	switch p.Type {
+	case core.PartImage:
+		return &msgContent{
+			Type:   msgContTypeImage,
+			Source: &blockSource{Type: "base64", MediaType: p.MediaType, Data: p.Base64()},
+		}
+	case core.PartDocument:
+		return &msgContent{
+			Type:   msgContTypeDocument,
+			Source: &blockSource{Type: "base64", MediaType: p.MediaType, Data: p.Base64()},
+			Title:  p.Name,
+		}
+	default:
+		return newMsgText(p.Text)
 	}
 }
 
-func (m *Model) fromCoreMsgs(coreMsgs []*core.Msg) (string, []*msg) {
-	var sysPrompt string
+func (m *Model) fromCoreMsgs(coreMsgs []*core.Msg) (*sysPrompt, []*msg) {
+	var sys *sysPrompt
 	r := make([]*msg, 0, len(coreMsgs))
+	rolling := m.rollingBreakpoint(coreMsgs)
 
 	// For Anthropic messages, sequential messages from the same role must be added together,
 	// particularly when both reasoning /and/ tool use are happening. So we need to recall if our
@@ -422,6 +522,7 @@ func (m *Model) fromCoreMsgs(coreMsgs []*core.Msg) (string, []*msg) {
 
 	for i, coreMsg := range coreMsgs {
 		isLast := i == len(coreMsgs)-1
+		breakpoint := (isLast && m.cache.LastMessage) || i == rolling
 
 		switch coreMsg.Type {
 		case core.MsgTypeReasoning:
@@ -436,9 +537,9 @@ func (m *Model) fromCoreMsgs(coreMsgs []*core.Msg) (string, []*msg) {
 			r, lastRole = appendOrCreateMsg(r, lastRole, role, rawContent)
 
 		case core.MsgTypeContent:
-			rawContent, role := m.processContentMsg(coreMsg, isLast)
+			blocks, role := m.processContentMsg(coreMsg, breakpoint)
 			if role == "system" {
-				if sysPrompt != "" {
+				if sys != nil {
 					// TODO(robust): don't panic here
 					// For reference, originally sysPrompt would be a buffer and anytime we found
 					// a system message, we would append to the buffer. This has two issues: one,
@@ -448,10 +549,15 @@ func (m *Model) fromCoreMsgs(coreMsgs []*core.Msg) (string, []*msg) {
 					panic("multiple system messages not allowed for anthropic")
 				}
 				content, _ := coreMsg.AsContent()
-				sysPrompt = content.Text
+				sys = &sysPrompt{Text: content.Text}
+				if m.cache.System {
+					sys.CacheCtrl = &cacheCtrl{Type: "ephemeral"}
+				}
 				continue
 			}
-			r, lastRole = appendOrCreateMsg(r, lastRole, role, rawContent)
+			for _, rawContent := range blocks {
+				r, lastRole = appendOrCreateMsg(r, lastRole, role, rawContent)
+			}
 
 		case core.MsgTypeToolCall:
 			if isLast {
@@ -459,11 +565,11 @@ func (m *Model) fromCoreMsgs(coreMsgs []*core.Msg) (string, []*msg) {
 				// tool call block (we get here either through a user message or a tool result).
 				panic("not implemented: last message cannot be a tool call")
 			}
-			rawContent, role := m.processToolCallMsg(coreMsg)
+			rawContent, role := m.processToolCallMsg(coreMsg, breakpoint)
 			r, lastRole = appendOrCreateMsg(r, lastRole, role, rawContent)
 
 		case core.MsgTypeToolResult:
-			rawContent, role := m.processToolResultMsg(coreMsg, isLast)
+			rawContent, role := m.processToolResultMsg(coreMsg, breakpoint)
 			r, lastRole = appendOrCreateMsg(r, lastRole, role, rawContent)
 
 		default:
@@ -472,13 +578,39 @@ func (m *Model) fromCoreMsgs(coreMsgs []*core.Msg) (string, []*msg) {
 		}
 	}
 
-	return sysPrompt, r
+	return sys, r
+}
+
+// rollingBreakpoint returns the index of the message that gets the rolling cache breakpoint, or -1
+// if there's none. It's the last message at a multiple of CachePolicy.RollingEvery, moved back to
+// the closest one that can hold a breakpoint, which also never changes once the history is there.
+func (m *Model) rollingBreakpoint(coreMsgs []*core.Msg) int {
+	if m.cache.RollingEvery <= 0 {
+		return -1
+	}
+
+	// the last message already has a breakpoint of its own, if enabled
+	i := (len(coreMsgs) - 2) / m.cache.RollingEvery * m.cache.RollingEvery
+	for ; i > 0; i-- {
+		switch coreMsgs[i].Type {
+		case core.MsgTypeReasoning:
+			// reasoning blocks can't have a breakpoint
+			continue
+		case core.MsgTypeContent:
+			if content, _ := coreMsgs[i].AsContent(); content.Role == "system" {
+				continue
+			}
+		}
+		return i
+	}
+
+	return -1
 }
 
 // processReasoningMsg handles Reasoning messages with caching.
 func (m *Model) processReasoningMsg(coreMsg *core.Msg) (json.RawMessage, string) {
-	if coreMsg.CachedTransform != nil {
-		return coreMsg.CachedTransform, "assistant"
+	if cached := coreMsg.CachedTransform(core.ProviderAnthropic); cached != nil {
+		return cached, "assistant"
 	}
 
 	reasoning, _ := coreMsg.AsReasoning()
@@ -489,72 +621,102 @@ func (m *Model) processReasoningMsg(coreMsg *core.Msg) (json.RawMessage, string)
 		panic(fmt.Errorf("unexpectedly failed to marshal reasoning message: %w", err))
 	}
 
-	coreMsg.CachedTransform = rawContent
+	coreMsg.SetCachedTransform(core.ProviderAnthropic, rawContent)
 	return rawContent, "assistant"
 }
 
-// processContentMsg handles Content messages with optional cache control.
-func (m *Model) processContentMsg(coreMsg *core.Msg, isLast bool) (json.RawMessage, string) {
+// processContentMsg handles Content messages with optional cache control. A message with parts
+// becomes several content blocks: its text (if any) followed by one block per part.
+func (m *Model) processContentMsg(coreMsg *core.Msg, breakpoint bool) ([]json.RawMessage, string) {
 	content, _ := coreMsg.AsContent()
 
-	// Use cached transform if available and not the last message
-	if !isLast && coreMsg.CachedTransform != nil {
-		return coreMsg.CachedTransform, content.Role
+	// Use cached transform if available and not a cache breakpoint
+	if cached := coreMsg.CachedTransform(core.ProviderAnthropic); !breakpoint && cached != nil {
+		return splitBlocks(cached, len(content.Parts) > 0), content.Role
 	}
 
 	// Create msgContent
-	msgCont := newMsgText(content.Text)
+	blocks := make([]*msgContent, 0, len(content.Parts)+1)
+	if content.Text != "" || len(content.Parts) == 0 {
+		blocks = append(blocks, newMsgText(content.Text))
+	}
+	for _, p := range content.Parts {
+		blocks = append(blocks, fromCorePart(p))
+	}
 
-	// Add cache control if this is the last message and caching is enabled
-	if isLast && m.shouldCache {
-		msgCont.CacheCtrl = &cacheCtrl{Type: "ephemeral"}
+	if breakpoint {
+		blocks[len(blocks)-1].CacheCtrl = &cacheCtrl{Type: "ephemeral"}
 	}
 
-	// Marshal to JSON
-	rawContent, err := json.Marshal(msgCont)
+	// Marshal to JSON, as a single block unless we have parts
+	var toMarshal any = blocks[0]
+	if len(content.Parts) > 0 {
+		toMarshal = blocks
+	}
+	rawContent, err := json.Marshal(toMarshal)
 	if err != nil {
 		// Should never panic for this type.
 		panic(fmt.Errorf("unexpectedly failed to marshal content message: %w", err))
 	}
 
-	// Cache the result only if not the last message
-	if !isLast {
-		coreMsg.CachedTransform = rawContent
+	// Cache the result only if it's not a breakpoint, since most requests won't have one there
+	if !breakpoint {
+		coreMsg.SetCachedTransform(core.ProviderAnthropic, rawContent)
 	}
 
-	return rawContent, content.Role
+	return splitBlocks(rawContent, len(content.Parts) > 0), content.Role
 }
 
-// processToolCallMsg handles ToolCall messages with caching.
-func (m *Model) processToolCallMsg(coreMsg *core.Msg) (json.RawMessage, string) {
-	if coreMsg.CachedTransform != nil {
-		return coreMsg.CachedTransform, "assistant"
+// splitBlocks turns the transform of a content message into its content blocks. Messages with
+// parts are stored as a JSON array of blocks, every other one as a single block.
+func splitBlocks(raw json.RawMessage, isArray bool) []json.RawMessage {
+	if !isArray {
+		return []json.RawMessage{raw}
+	}
+
+	var blocks []json.RawMessage
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		// Should never panic since we marshalled it ourselves.
+		panic(fmt.Errorf("unexpectedly failed to split content blocks: %w", err))
+	}
+	return blocks
+}
+
+// processToolCallMsg handles ToolCall messages with optional cache control.
+func (m *Model) processToolCallMsg(coreMsg *core.Msg, breakpoint bool) (json.RawMessage, string) {
+	if cached := coreMsg.CachedTransform(core.ProviderAnthropic); !breakpoint && cached != nil {
+		return cached, "assistant"
 	}
 
 	toolCall, _ := coreMsg.AsToolCall()
 	content := newMsgToolUse(toolCall.ID, toolCall.Name, json.RawMessage(toolCall.Arguments))
+	if breakpoint {
+		content.CacheCtrl = &cacheCtrl{Type: "ephemeral"}
+	}
+
 	rawContent, err := json.Marshal(content)
 	if err != nil {
 		// Should never panic for this type.
 		panic(fmt.Errorf("unexpectedly failed to marshal tool call message: %w", err))
 	}
 
-	coreMsg.CachedTransform = rawContent
+	if !breakpoint {
+		coreMsg.SetCachedTransform(core.ProviderAnthropic, rawContent)
+	}
 	return rawContent, "assistant"
 }
 
 // processToolResultMsg handles ToolResult messages with optional cache control.
-func (m *Model) processToolResultMsg(coreMsg *core.Msg, isLast bool) (json.RawMessage, string) {
-	// Use cached transform if available and not the last message
-	if !isLast && coreMsg.CachedTransform != nil {
-		return coreMsg.CachedTransform, "user"
+func (m *Model) processToolResultMsg(coreMsg *core.Msg, breakpoint bool) (json.RawMessage, string) {
+	// Use cached transform if available and not a cache breakpoint
+	if cached := coreMsg.CachedTransform(core.ProviderAnthropic); !breakpoint && cached != nil {
+		return cached, "user"
 	}
 
 	toolResult, _ := coreMsg.AsToolResult()
-	content := newMsgToolResult(toolResult.ID, toolResult.Result)
+	content := newMsgToolResult(toolResult.ID, toolResult.Result, toolResult.Parts)
 
-	// Add cache control if this is the last message and caching is enabled
-	if isLast && m.shouldCache {
+	if breakpoint {
 		content.CacheCtrl = &cacheCtrl{Type: "ephemeral"}
 	}
 
@@ -565,9 +727,9 @@ func (m *Model) processToolResultMsg(coreMsg *core.Msg, isLast bool) (json.RawMe
 		panic(err)
 	}
 
-	// Cache the result only if not the last message
-	if !isLast {
-		coreMsg.CachedTransform = rawContent
+	// Cache the result only if it's not a breakpoint, since most requests won't have one there
+	if !breakpoint {
+		coreMsg.SetCachedTransform(core.ProviderAnthropic, rawContent)
 	}
 
 	return rawContent, "user"
@@ -593,16 +755,10 @@ func appendOrCreateMsg(
 }
 
 type tool struct {
-	Name   string     `json:"name"`
-	Desc   string     `json:"description"`
-	Schema toolSchema `json:"input_schema"`
-}
-
-type toolSchema struct {
-	Type       string `json:"type"` // always "object"
-	Properties map[string]core.ToolParam
-	Required   []string `json:"required"`
-	Strict     bool     `json:"strict"`
+	Name      string      `json:"name"`
+	Desc      string      `json:"description"`
+	Schema    core.Schema `json:"input_schema"`
+	CacheCtrl *cacheCtrl  `json:"cache_control,omitempty"`
 }
 
 func fromCoreTools(tools []core.Tool) []tool {
@@ -613,24 +769,14 @@ func fromCoreTools(tools []core.Tool) []tool {
 	return r
 }
 
+// fromCoreTool converts a core.Tool into an Anthropic tool. Unlike OpenAI's strict mode, Anthropic
+// accepts regular JSON Schema, so the tool's schema goes as-is.
 func fromCoreTool(x core.Tool) tool {
-	r := tool{
-		Name: x.Name,
-		Desc: x.Desc,
-		Schema: toolSchema{
-			Type:       "object",
-			Properties: make(map[string]core.ToolParam),
-			Required:   make([]string, 0),
-			Strict:     true,
-		},
-	}
-
-	for paramName, param := range x.Params {
-		r.Schema.Properties[paramName] = param
-		r.Schema.Required = append(r.Schema.Required, paramName)
+	return tool{
+		Name:   x.Name,
+		Desc:   x.Desc,
+		Schema: x.JSONSchema(),
 	}
-
-	return r
 }
 
 type sse struct {
@@ -650,6 +796,12 @@ type sse struct {
 	} `json:"content_block"`
 
 	Delta msgContent `json:"delta"`
+
+	// only for stError, e.g. when the API is overloaded
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
 }
 
 type sseType string
@@ -673,6 +825,8 @@ const (
 	stContBlockStop sseType = "content_block_stop"
 	// no-op event from anthropic
 	stPing sseType = "ping"
+	// requires parsing .error, the stream is over after it
+	stError sseType = "error"
 )
 
 type usage struct {
@@ -691,6 +845,6 @@ func intPtr(i int) *int {
 }
 
 const (
-	messagesEndpoint    = "https://api.anthropic.com/v1/messages"
+	defaultBaseURL      = "https://api.anthropic.com/v1"
 	anthropicApiVersion = "2023-06-01"
 )
@@ -3,281 +3,345 @@ package anthropic
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
-	"strings"
+	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/victhorio/opa/agg/core"
 )
 
-func TestSimpleMessage(t *testing.T) {
+var getWeatherTool = core.Tool{
+	Name: "getWeather",
+	Desc: "Get the weather for a given location",
+	Params: map[string]core.ToolParam{
+		"location": {
+			Type: core.JSTString,
+			Desc: "The location to get the weather for",
+		},
+		"units": {
+			Type: core.JSTString,
+			Desc: "The units to use for the weather",
+			Enum: []string{"Celsius", "Fahrenheit"},
+		},
+	},
+}
+
+// TestUnknownModel makes sure models without prices in the registry are refused before anything
+// is sent, instead of their responses quietly costing nothing.
+func TestUnknownModel(t *testing.T) {
 	t.Parallel()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
+	// models the registry doesn't list yet still work, their usage just can't be priced
+	model := serve(t, NewModel("claude-0-unknown", 1024, 0, false), func(map[string]any) []string {
+		return []string{
+			`{"type":"message_start","message":{"model":"claude-0-unknown","usage":{"input_tokens":10,"output_tokens":1}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hi!"}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"input_tokens":10,"output_tokens":2}}`,
+			`{"type":"message_stop"}`,
+		}
+	})
 
-	client := &http.Client{}
-	ch := make(chan core.Event, 1)
+	msgs := []*core.Msg{core.NewMsgContent("user", "hi")}
+	r, _ := consumeStream(t, model, msgs, nil, core.StreamCfg{})
+	if r.Usage.Input != 10 || r.Usage.Output != 2 || r.Usage.Cost != 0 {
+		t.Errorf("expected the usage to be recorded at no cost, got %+v", r.Usage)
+	}
+}
+
+// TestStreamText checks a plain text response against a stand-in server.
+func TestStreamText(t *testing.T) {
+	t.Parallel()
+
+	var body map[string]any
+	model := serve(t, NewModel(Haiku, 1024, 0, false), func(b map[string]any) []string {
+		body = b
+		return []string{
+			`{"type":"message_start","message":{"model":"claude-haiku-4-5-20251001","usage":{"input_tokens":20,"output_tokens":1}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"ping"}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"The capital"}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":" is Paris."}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"input_tokens":20,"output_tokens":8}}`,
+			`{"type":"message_stop"}`,
+		}
+	})
 
 	msgs := []*core.Msg{
+		core.NewMsgContent("system", "Be brief."),
 		core.NewMsgContent("user", "What is the capital of France?"),
 	}
+	r, events := consumeStream(t, model, msgs, nil, core.StreamCfg{})
 
-	model := NewModel(Haiku, 2048, 1024, false)
-	stream, err := model.OpenStream(ctx, client, msgs, []core.Tool{}, core.StreamCfg{})
-	if err != nil {
-		t.Fatalf("NewStream failed: %v", err)
+	if body["model"] != string(Haiku) || body["system"] != "Be brief." || body["stream"] != true {
+		t.Errorf("unexpected request %v", body)
 	}
 
-	go stream.Consume(ctx, ch)
-
-	var r core.Response
-	for event := range ch {
-		switch event.Type {
-		case core.EvDeltaReason:
-			// ignore
-		case core.EvDelta:
-			// ignore
-		case core.EvToolCall:
-			t.Fatalf("Unexpected tool call: %v", event.Call)
-		case core.EvResp:
-			r = event.Response
-		}
+	deltas := eventsOfType(events, core.EvDelta)
+	if len(deltas) != 2 || deltas[0].Delta != "The capital" || deltas[1].Delta != " is Paris." {
+		t.Errorf("unexpected deltas %+v", deltas)
 	}
 
-	if r.Messages == nil {
-		t.Fatalf("No messages in response")
+	if r.Model != string(Haiku) {
+		t.Errorf("expected the model from the stream, got %q", r.Model)
 	}
-
-	msg := r.Messages[len(r.Messages)-1]
-	content, ok := msg.AsContent()
-	if !ok {
-		t.Fatalf("Last message is not a content message, got %d", msg.Type)
+	if len(r.Messages) != 1 {
+		t.Fatalf("expected a single message, got %+v", r.Messages)
+	}
+	if c, _ := r.Messages[0].AsContent(); c.Role != "assistant" || c.Text != "The capital is Paris." {
+		t.Errorf("unexpected content %+v", c)
 	}
 
-	if !strings.Contains(content.Text, "Paris") {
-		t.Fatalf("Last message does not contain 'Paris', got %s", content.Text)
+	want := core.Usage{Input: 20, Output: 8, Total: 28, Cost: 20*1000 + 8*5000}
+	if r.Usage != want {
+		t.Errorf("expected usage %+v, got %+v", want, r.Usage)
 	}
 }
 
-func TestMultiTurnMessages(t *testing.T) {
+// TestStreamToolLoop goes through a tool call loop with parallel calls and extended thinking
+// against a stand-in server, checking that the signed thinking block is sent back along with the
+// calls and their results.
+func TestStreamToolLoop(t *testing.T) {
 	t.Parallel()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
-
-	client := &http.Client{}
-	ch := make(chan core.Event, 1)
+	var bodies []map[string]any
+	model := serve(t, NewModel(Haiku, 4096, 2048, false), func(b map[string]any) []string {
+		bodies = append(bodies, b)
+		if len(bodies) == 1 {
+			return []string{
+				`{"type":"message_start","message":{"model":"claude-haiku-4-5-20251001"}}`,
+				`{"type":"content_block_start","index":0,"content_block":{"type":"thinking","thinking":""}}`,
+				`{"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"I need both "}}`,
+				`{"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"forecasts."}}`,
+				`{"type":"content_block_delta","index":0,"delta":{"type":"signature_delta","signature":"sig-1"}}`,
+				`{"type":"content_block_stop","index":0}`,
+				`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_a","name":"getWeather","input":{}}}`,
+				`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"location\": \"Tokyo\","}}`,
+				`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":" \"units\": \"Celsius\"}"}}`,
+				`{"type":"content_block_stop","index":1}`,
+				`{"type":"content_block_start","index":2,"content_block":{"type":"tool_use","id":"toolu_b","name":"getWeather","input":{}}}`,
+				`{"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":"{\"location\": \"Lisbon\", \"units\": \"Celsius\"}"}}`,
+				`{"type":"content_block_stop","index":2}`,
+				`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"input_tokens":590,"output_tokens":160}}`,
+				`{"type":"message_stop"}`,
+			}
+		}
+		return []string{
+			`{"type":"message_start","message":{"model":"claude-haiku-4-5-20251001"}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Tokyo is warmer."}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"input_tokens":712,"output_tokens":148}}`,
+			`{"type":"message_stop"}`,
+		}
+	})
 
-	msgs := make([]*core.Msg, 0, 4)
-	msgs = append(
-		msgs,
-		core.NewMsgContent("user", "Hi! My name is Victhor, what is your name?"),
-	)
+	msgs := []*core.Msg{core.NewMsgContent("user", "Is it warmer in Tokyo or in Lisbon right now?")}
+	r, events := consumeStream(t, model, msgs, []core.Tool{getWeatherTool}, core.StreamCfg{})
 
-	model := NewModel(Haiku, 2048, 1024, false)
-	firstStream, err := model.OpenStream(ctx, client, msgs, []core.Tool{}, core.StreamCfg{})
-	if err != nil {
-		t.Fatalf("NewStream failed: %v", err)
+	if thinking, _ := bodies[0]["thinking"].(map[string]any); thinking["type"] != "enabled" || thinking["budget_tokens"] != 2048.0 {
+		t.Errorf("unexpected thinking config %v", bodies[0]["thinking"])
 	}
 
-	go firstStream.Consume(ctx, ch)
-
-	var r core.Response
-	for event := range ch {
-		switch event.Type {
-		case core.EvDeltaReason:
-			// ignore
-		case core.EvDelta:
-			// ignore
-		case core.EvToolCall:
-			t.Fatalf("Unexpected tool call: %v", event.Call)
-		case core.EvResp:
-			r = event.Response
-		}
+	// the thinking is emitted once complete, and each call once its arguments are
+	if reasoning := eventsOfType(events, core.EvDeltaReason); len(reasoning) != 1 || reasoning[0].Delta != "I need both forecasts." {
+		t.Errorf("expected the complete thinking once, got %+v", reasoning)
 	}
-
-	if r.Messages == nil {
-		t.Fatalf("No messages in response")
+	calls := eventsOfType(events, core.EvToolCall)
+	if len(calls) != 2 {
+		t.Fatalf("expected two parallel tool calls, got %d", len(calls))
 	}
-
-	msgs = append(msgs, r.Messages...)
-	msgs = append(msgs, core.NewMsgContent("user", "Can you repeat my name to me?"))
-
-	ch = make(chan core.Event, 1)
-	secondStream, err := model.OpenStream(ctx, client, msgs, []core.Tool{}, core.StreamCfg{})
-	if err != nil {
-		t.Fatalf("NewStream failed: %v", err)
+	if c := calls[0].Call; c.ID != "toolu_a" || c.Arguments != `{"location": "Tokyo", "units": "Celsius"}` {
+		t.Errorf("unexpected first call %+v", c)
 	}
-
-	go secondStream.Consume(ctx, ch)
-
-	var r2 core.Response
-	for event := range ch {
-		switch event.Type {
-		case core.EvDeltaReason:
-			// ignore
-		case core.EvDelta:
-			// ignore
-		case core.EvToolCall:
-			t.Fatalf("Unexpected tool call: %v", event.Call)
-		case core.EvResp:
-			r2 = event.Response
-		}
+	if c := calls[1].Call; c.ID != "toolu_b" || c.Arguments != `{"location": "Lisbon", "units": "Celsius"}` {
+		t.Errorf("unexpected second call %+v", c)
 	}
 
-	if r2.Messages == nil {
-		t.Fatalf("No messages in response")
+	reasoning, ok := r.Messages[0].AsReasoning()
+	if !ok || reasoning.Encrypted != "sig-1" || reasoning.Text != "I need both forecasts." {
+		t.Fatalf("expected the response to start with the signed thinking, got %+v", r.Messages[0])
 	}
-
-	msg := r2.Messages[len(r2.Messages)-1]
-	content, ok := msg.AsContent()
-	if !ok {
-		t.Fatalf("Last message is not a content message, got %d", msg.Type)
+	want := core.Usage{Input: 590, Output: 160, Total: 750, Cost: 590*1000 + 160*5000}
+	if r.Usage != want {
+		t.Errorf("expected usage %+v, got %+v", want, r.Usage)
 	}
 
-	if !strings.Contains(content.Text, "Victhor") {
-		t.Fatalf("Last message does not contain 'Victhor', got %s", content.Text)
+	msgs = append(msgs, r.Messages...)
+	msgs = append(
+		msgs,
+		core.NewMsgToolResult("toolu_a", "25C, sunny"),
+		core.NewMsgToolResult("toolu_b", "17C, light rain"),
+	)
+	r2, _ := consumeStream(t, model, msgs, []core.Tool{getWeatherTool}, core.StreamCfg{})
+
+	sent, _ := json.Marshal(bodies[1]["messages"])
+	wantSent := `[` +
+		`{"content":[{"text":"Is it warmer in Tokyo or in Lisbon right now?","type":"text"}],"role":"user"},` +
+		`{"content":[` +
+		`{"signature":"sig-1","thinking":"I need both forecasts.","type":"thinking"},` +
+		`{"id":"toolu_a","input":{"location":"Tokyo","units":"Celsius"},"name":"getWeather","type":"tool_use"},` +
+		`{"id":"toolu_b","input":{"location":"Lisbon","units":"Celsius"},"name":"getWeather","type":"tool_use"}],"role":"assistant"},` +
+		`{"content":[` +
+		`{"content":"25C, sunny","tool_use_id":"toolu_a","type":"tool_result"},` +
+		`{"content":"17C, light rain","tool_use_id":"toolu_b","type":"tool_result"}],"role":"user"}` +
+		`]`
+	if string(sent) != wantSent {
+		t.Errorf("unexpected messages sent back:\n got: %s\nwant: %s", sent, wantSent)
+	}
+
+	if c, _ := r2.Messages[0].AsContent(); c.Text != "Tokyo is warmer." {
+		t.Errorf("unexpected answer %+v", c)
+	}
+	want = core.Usage{Input: 712, Output: 148, Total: 860, Cost: 712*1000 + 148*5000}
+	if r2.Usage != want {
+		t.Errorf("expected usage %+v, got %+v", want, r2.Usage)
 	}
 }
 
-func TestToolCall(t *testing.T) {
+func TestStreamErrors(t *testing.T) {
 	t.Parallel()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
+	t.Run("error event", func(t *testing.T) {
+		model := serve(t, NewModel(Haiku, 1024, 0, false), func(map[string]any) []string {
+			return []string{
+				`{"type":"message_start","message":{"model":"claude-haiku-4-5-20251001"}}`,
+				`{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`,
+			}
+		})
 
-	client := &http.Client{}
-	ch := make(chan core.Event, 1)
+		err := streamError(t, model)
+		var apiErr *core.APIError
+		if !errors.As(err, &apiErr) || apiErr.Type != "overloaded_error" || apiErr.Message != "Overloaded" {
+			t.Fatalf("expected an APIError from the event, got %v", err)
+		}
+	})
 
-	msgs := []*core.Msg{
-		core.NewMsgContent("user", "What is the weather in Tokyo? In Celsius"),
-	}
+	t.Run("truncated stream", func(t *testing.T) {
+		model := serve(t, NewModel(Haiku, 1024, 0, false), func(map[string]any) []string {
+			return []string{`{"type":"message_start","message":{"model":"claude-haiku-4-5-20251001"}}`}
+		})
 
-	model := NewModel(Haiku, 2048, 1024, false)
-	stream, err := model.OpenStream(ctx, client, msgs, []core.Tool{getWeatherTool}, core.StreamCfg{})
-	if err != nil {
-		t.Fatalf("NewStream failed: %v", err)
-	}
+		if err := streamError(t, model); !errors.Is(err, io.EOF) {
+			t.Fatalf("expected io.EOF, got %v", err)
+		}
+	})
+}
 
-	go stream.Consume(ctx, ch)
+// serve starts a stand-in server for the messages endpoint, answering each request with the
+// events returned by handler, and points the model to it.
+func serve(t *testing.T, model *Model, handler func(body map[string]any) []string) *Model {
+	t.Helper()
 
-	var tc_count int
-	var tc core.ToolCall
-	var r core.Response
-	for event := range ch {
-		switch event.Type {
-		case core.EvDeltaReason:
-			// ignore
-		case core.EvDelta:
-			// ignore
-		case core.EvToolCall:
-			tc_count++
-			if tc_count > 1 {
-				t.Fatalf("Expected only one tool call, got %d", tc_count)
-			}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/messages" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
 
-			tc = event.Call
-		case core.EvResp:
-			r = event.Response
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("error decoding request: %v", err)
+			return
 		}
-	}
 
-	if tc_count != 1 {
-		t.Fatalf("Expected one tool call, got %d", tc_count)
-	}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, ev := range handler(body) {
+			fmt.Fprintf(w, "data: %s\n\n", ev)
+		}
+	}))
+	t.Cleanup(srv.Close)
 
-	if tc.Name != "getWeather" {
-		t.Fatalf("Expected tool call name to be 'getWeather', got %s", tc.Name)
-	}
+	return model.WithBaseURL(srv.URL)
+}
 
-	type args struct {
-		Location string `json:"location"`
-		Units    string `json:"units"`
-	}
+// consumeStream opens a stream against the model and collects every event of it.
+func consumeStream(
+	t *testing.T,
+	model *Model,
+	msgs []*core.Msg,
+	tools []core.Tool,
+	cfg core.StreamCfg,
+) (core.Response, []core.Event) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-	var a args
-	err = json.Unmarshal([]byte(tc.Arguments), &a)
+	stream, err := model.OpenStream(ctx, http.DefaultClient, msgs, tools, cfg)
 	if err != nil {
-		t.Fatalf("Unmarshal failed: %v", err)
-	}
-	if !strings.Contains(a.Location, "Tokyo") {
-		t.Fatalf("Expected location to contain 'Tokyo', got %s", a.Location)
-	}
-	if a.Units != "Celsius" {
-		t.Fatalf("Expected units to be 'Celsius', got %s", a.Units)
+		t.Fatalf("OpenStream failed: %v", err)
 	}
+	return consume(ctx, t, stream)
+}
 
-	if r.Messages == nil {
-		t.Fatalf("No messages in response")
-	}
+// streamError consumes a stream expected to fail, returning its first error. Like the agent, it
+// stops listening once it gets the error.
+func streamError(t *testing.T, model *Model) error {
+	t.Helper()
 
-	msg := r.Messages[len(r.Messages)-1]
-	msg_tc, ok := msg.AsToolCall()
-	if !ok {
-		t.Fatalf("Last message is not a tool call message, got %d", msg.Type)
-	}
-	if msg_tc.Name != "getWeather" {
-		t.Fatalf("Expected tool call name to be 'getWeather', got %s", msg_tc.Name)
-	}
-	if msg_tc.Arguments != tc.Arguments {
-		t.Fatalf("Expected tool call arguments to be %s, got %s", tc.Arguments, msg_tc.Arguments)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	msgs := []*core.Msg{core.NewMsgContent("user", "hi")}
+	stream, err := model.OpenStream(ctx, http.DefaultClient, msgs, nil, core.StreamCfg{})
+	if err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
 	}
 
-	// now let's add a tool result and check if it answers correctly
-	toolResult := core.NewMsgToolResult(tc.ID, `{"temperature": 25, "description": "Sunny"}`)
-	msgs = append(msgs, r.Messages...)
-	msgs = append(msgs, toolResult)
+	ch := make(chan core.Event, 1)
+	go stream.Consume(ctx, ch)
 
-	ch = make(chan core.Event, 1)
-	stream, err = model.OpenStream(ctx, client, msgs, []core.Tool{getWeatherTool}, core.StreamCfg{})
-	if err != nil {
-		t.Fatalf("NewStream failed: %v", err)
+	for ev := range ch {
+		switch ev.Type {
+		case core.EvError:
+			return ev.Err
+		case core.EvResp:
+			t.Fatalf("expected no response, got %+v", ev.Response)
+		}
 	}
+
+	t.Fatalf("expected an error event")
+	return nil
+}
+
+// consume collects every event of a stream, failing the test on error events.
+func consume(ctx context.Context, t *testing.T, stream core.ResponseStream) (core.Response, []core.Event) {
+	t.Helper()
+
+	ch := make(chan core.Event, 1)
 	go stream.Consume(ctx, ch)
 
-	var r2 core.Response
+	var r core.Response
+	var events []core.Event
 	for event := range ch {
 		switch event.Type {
-		case core.EvDeltaReason:
-			// ignore
-		case core.EvDelta:
-			// ignore
-		case core.EvToolCall:
-			t.Fatalf("Unexpected tool call: %v", event.Call)
+		case core.EvError:
+			t.Fatalf("Unexpected error event: %v", event.Err)
 		case core.EvResp:
-			r2 = event.Response
+			r = event.Response
 		}
+		events = append(events, event)
 	}
 
-	if r2.Messages == nil {
+	if r.Messages == nil {
 		t.Fatalf("No messages in response")
 	}
 
-	msg = r2.Messages[len(r2.Messages)-1]
-	content, ok := msg.AsContent()
-	if !ok {
-		t.Fatalf("Last message is not a content message, got %d", msg.Type)
-	}
-
-	if !strings.Contains(content.Text, "25") || !strings.Contains(strings.ToLower(content.Text), "sunny") {
-		t.Fatalf("Expected weather in Tokyo to contain '25' and 'Sunny', got %s", content.Text)
-	}
+	return r, events
 }
 
-var getWeatherTool = core.Tool{
-	Name: "getWeather",
-	Desc: "Get the weather for a given location",
-	Params: map[string]core.ToolParam{
-		"location": {
-			Type: core.JSTString,
-			Desc: "The location to get the weather for",
-		},
-		"units": {
-			Type: core.JSTString,
-			Desc: "The units to use for the weather",
-			Enum: []string{"Celsius", "Fahrenheit"},
-		},
-	},
+func eventsOfType(events []core.Event, typ core.EventType) []core.Event {
+	var r []core.Event
+	for _, ev := range events {
+		if ev.Type == typ {
+			r = append(r, ev)
+		}
+	}
+	return r
 }
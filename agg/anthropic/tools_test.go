@@ -0,0 +1,127 @@
+package anthropic
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/victhorio/opa/agg/core"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func TestFromCoreToolGolden(t *testing.T) {
+	tests := []struct {
+		name string
+		tool core.Tool
+	}{
+		{"no_params", core.Tool{Name: "now", Desc: "Get the current time"}},
+		{"weather", getWeatherTool},
+		{"search_notes", searchNotesTool},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.MarshalIndent(fromCoreTool(tt.tool), "", "  ")
+			if err != nil {
+				t.Fatalf("failed to marshal tool: %v", err)
+			}
+			got = append(got, '\n')
+
+			goldenPath := filepath.Join("testdata", "tool_"+tt.name+".golden.json")
+			if *update {
+				if err := os.WriteFile(goldenPath, got, 0644); err != nil {
+					t.Fatalf("failed to update golden file: %v", err)
+				}
+			}
+
+			want, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatalf("failed to read golden file (run with -update to create it): %v", err)
+			}
+
+			if !bytes.Equal(got, want) {
+				t.Fatalf("tool %s does not match golden file %s\n\ngot:\n%s\n\nwant:\n%s",
+					tt.name, goldenPath, got, want)
+			}
+		})
+	}
+}
+
+func TestFromCoreToolRequired(t *testing.T) {
+	r := fromCoreTool(searchNotesTool)
+
+	// optional parameters are simply left out of the required list, at every level
+	wantRequired := []string{"dates", "folder", "query", "tags"}
+	if !slices.Equal(r.Schema.Required, wantRequired) {
+		t.Errorf("expected required %v, got %v", wantRequired, r.Schema.Required)
+	}
+
+	dates := r.Schema.Properties["dates"]
+	if !slices.Equal(dates.Required, []string{"from"}) {
+		t.Errorf("expected nested required [from], got %v", dates.Required)
+	}
+	if dates.AdditionalProperties == nil || *dates.AdditionalProperties {
+		t.Errorf("expected nested object to disallow additional properties")
+	}
+
+	limit := r.Schema.Properties["limit"]
+	if limit.Default != 10 {
+		t.Errorf("expected 'limit' default to be passed along, got %v", limit.Default)
+	}
+	if len(limit.Type) != 1 || limit.Type[0] != core.JSTInteger {
+		t.Errorf("expected optional 'limit' to not be nullable, got %v", limit.Type)
+	}
+}
+
+var searchNotesTool = core.Tool{
+	Name: "searchNotes",
+	Desc: "Search notes in the vault",
+	Params: map[string]core.ToolParam{
+		"query": {
+			Type: core.JSTString,
+			Desc: "The search query",
+		},
+		"limit": {
+			Type:     core.JSTInteger,
+			Desc:     "Maximum number of notes to return",
+			Optional: true,
+			Default:  10,
+			Minimum:  floatPtr(1),
+			Maximum:  floatPtr(50),
+		},
+		"sort": {
+			Type:     core.JSTString,
+			Desc:     "How to sort the results",
+			Optional: true,
+			Enum:     []string{"relevance", "recency"},
+		},
+		"tags": {
+			Type:     core.JSTArray,
+			Desc:     "Only include notes with all of these tags",
+			Items:    &core.ToolParam{Type: core.JSTString, Desc: "A tag, without the leading #"},
+			MaxItems: intPtr(5),
+		},
+		"dates": {
+			Type: core.JSTObject,
+			Desc: "Restrict the search to notes modified in this range",
+			Properties: map[string]core.ToolParam{
+				"from": {Type: core.JSTString, Desc: "Start date (YYYY-MM-DD)"},
+				"to":   {Type: core.JSTString, Desc: "End date (YYYY-MM-DD)", Optional: true},
+			},
+		},
+		"folder": {
+			Type:     core.JSTString,
+			Desc:     "Folder to search in",
+			Nullable: boolPtr(true),
+		},
+	},
+}
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
@@ -0,0 +1,105 @@
+package agg
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrBudgetExceeded is returned by Agent.RunStream when a turn is refused because a budget was
+// already spent.
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// Budget caps how much can be spent on models (and embeddings) per calendar day and month, in the
+// same unit as core.Usage.Cost. A zero cap means there's no limit for that period.
+type Budget struct {
+	Daily   int64
+	Monthly int64
+	// WarnAt is the fraction of a cap after which every turn comes with a warning. Defaults to
+	// budgetWarnAtDefault.
+	WarnAt float64
+}
+
+// BudgetConfig is how budgets are given in the config file, in dollars, e.g.:
+//
+//	budget:
+//	  daily: 2.50
+//	  monthly: 40
+//	  warn_at: 0.9
+type BudgetConfig struct {
+	Daily   float64 `yaml:"daily"`
+	Monthly float64 `yaml:"monthly"`
+	WarnAt  float64 `yaml:"warn_at"`
+}
+
+// Budget converts the config into a Budget.
+func (c BudgetConfig) Budget() Budget {
+	return Budget{
+		Daily:   int64(c.Daily * 1_000_000_000),
+		Monthly: int64(c.Monthly * 1_000_000_000),
+		WarnAt:  c.WarnAt,
+	}
+}
+
+// SpendSource reports how much was spent since a given time, in the same unit as core.Usage.Cost.
+// SQLiteStore implements it over everything it recorded.
+type SpendSource interface {
+	Spend(since time.Time) (int64, error)
+}
+
+// SetBudget makes the agent enforce budget with the spend reported by spend: turns that start once
+// a cap is reached are refused, and turns that start past the warning threshold emit a warning.
+// Since the check happens when the turn starts, a turn that goes over the cap is not interrupted.
+func (a *Agent) SetBudget(budget Budget, spend SpendSource) {
+	if budget.WarnAt <= 0 {
+		budget.WarnAt = budgetWarnAtDefault
+	}
+
+	a.budget = budget
+	a.spend = spend
+}
+
+// checkBudget returns an error wrapping ErrBudgetExceeded if a cap was reached, or a warning (and
+// no error) if the spend of a period is past the warning threshold or can't be checked.
+func (a *Agent) checkBudget(now time.Time) (warning error, err error) {
+	if a.spend == nil {
+		return nil, nil
+	}
+
+	periods := []struct {
+		name  string
+		cap   int64
+		since time.Time
+	}{
+		{"daily", a.budget.Daily, time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())},
+		{"monthly", a.budget.Monthly, time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())},
+	}
+
+	for _, p := range periods {
+		if p.cap <= 0 {
+			continue
+		}
+
+		spent, err := a.spend.Spend(p.since)
+		if err != nil {
+			// not knowing the spend shouldn't lock the user out
+			return fmt.Errorf("cannot check the %s budget: %w", p.name, err), nil
+		}
+
+		switch {
+		case spent >= p.cap:
+			return nil, fmt.Errorf("%w: spent %s of the %s budget of %s", ErrBudgetExceeded, FormatCost(spent), p.name, FormatCost(p.cap))
+		case float64(spent) >= a.budget.WarnAt*float64(p.cap) && warning == nil:
+			warning = fmt.Errorf("spent %s of the %s budget of %s", FormatCost(spent), p.name, FormatCost(p.cap))
+		}
+	}
+
+	return warning, nil
+}
+
+// FormatCost formats a cost in the unit of core.Usage.Cost as dollars.
+func FormatCost(cost int64) string {
+	return fmt.Sprintf("$%.3f", float64(cost)/1_000_000_000)
+}
+
+const budgetWarnAtDefault = 0.8
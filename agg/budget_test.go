@@ -0,0 +1,66 @@
+package agg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/victhorio/opa/agg/core"
+	"github.com/victhorio/opa/agg/fake"
+)
+
+// fixedSpend reports the daily spend for times after the start of today, and the monthly one
+// otherwise.
+type fixedSpend struct {
+	daily, monthly int64
+}
+
+func (s fixedSpend) Spend(since time.Time) (int64, error) {
+	now := time.Now()
+	if since.Equal(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())) {
+		return s.daily, nil
+	}
+	return s.monthly, nil
+}
+
+func TestAgentBudget(t *testing.T) {
+	budget := Budget{Daily: 100, Monthly: 1000}
+
+	for name, tc := range map[string]struct {
+		spend   fixedSpend
+		refused bool
+		warned  bool
+	}{
+		"under":       {fixedSpend{10, 100}, false, false},
+		"daily warn":  {fixedSpend{85, 100}, false, true},
+		"month warn":  {fixedSpend{10, 900}, false, true},
+		"daily cap":   {fixedSpend{100, 100}, true, false},
+		"monthly cap": {fixedSpend{10, 1500}, true, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			model := fake.NewModel(core.ProviderOpenAI, fake.NewTurn().Text("Hi!"))
+			store := NewEphemeralStore()
+			agent := NewAgent("sys", model, &store, nil)
+			agent.SetBudget(budget, tc.spend)
+
+			var warned bool
+			_, err := agent.RunStream(context.Background(), http.DefaultClient, "s", "hi", false, func(ev core.Event) {
+				if ev.Type == core.EvWarning {
+					warned = true
+				}
+			})
+
+			if refused := errors.Is(err, ErrBudgetExceeded); refused != tc.refused {
+				t.Fatalf("expected refused=%v, got error %v", tc.refused, err)
+			}
+			if tc.refused && len(model.Calls()) != 0 {
+				t.Errorf("expected the model not to be called once the budget is spent")
+			}
+			if warned != tc.warned {
+				t.Errorf("expected warned=%v, got %v", tc.warned, warned)
+			}
+		})
+	}
+}
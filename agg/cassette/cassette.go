@@ -0,0 +1,351 @@
+// Package cassette records HTTP exchanges with provider APIs into files and replays them offline,
+// so that provider streams can be regression tested without network access or API keys.
+//
+// A cassette is a JSON file holding the sequence of request/response pairs of a session. In record
+// mode every request is forwarded to the real API and the exchange is appended to the cassette,
+// with credentials scrubbed. In replay mode requests are answered from the cassette in order, and
+// a request that differs from the recorded one is an error, which is what makes cassettes useful
+// to catch unintended changes in what we send to providers.
+package cassette
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+type Mode int
+
+const (
+	ModeReplay Mode = iota
+	ModeRecord
+)
+
+// Cassette is the on-disk format of a recorded session.
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+type Request struct {
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Headers http.Header `json:"headers,omitempty"`
+	// Body is kept as JSON when possible so that cassettes are readable and diffable, otherwise
+	// it's stored as a JSON string.
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+type Response struct {
+	Status  int         `json:"status"`
+	Headers http.Header `json:"headers,omitempty"`
+	Body    string      `json:"body"`
+}
+
+// Transport is an http.RoundTripper that records to or replays from a cassette file.
+type Transport struct {
+	path    string
+	mode    Mode
+	real    http.RoundTripper
+	secrets []string
+
+	mu       sync.Mutex
+	cassette Cassette
+	next     int
+}
+
+// New creates a Transport for the cassette at path. In replay mode the cassette must exist, in
+// record mode it's overwritten by Finish.
+func New(path string, mode Mode) (*Transport, error) {
+	t := &Transport{
+		path: path,
+		mode: mode,
+		real: http.DefaultTransport,
+	}
+
+	if mode == ModeRecord {
+		return t, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cassette.New: error reading cassette: %w", err)
+	}
+	if err := json.Unmarshal(data, &t.cassette); err != nil {
+		return nil, fmt.Errorf("cassette.New: error parsing cassette %s: %w", path, err)
+	}
+
+	return t, nil
+}
+
+// WithTransport sets the transport used to reach the real API when recording. Defaults to
+// http.DefaultTransport.
+func (t *Transport) WithTransport(rt http.RoundTripper) *Transport {
+	t.real = rt
+	return t
+}
+
+// Scrub registers values (usually API keys) that must never be written to the cassette. They're
+// replaced wherever they show up, on top of the credential headers that are always redacted.
+func (t *Transport) Scrub(secrets ...string) *Transport {
+	for _, s := range secrets {
+		if s != "" {
+			t.secrets = append(t.secrets, s)
+		}
+	}
+	return t
+}
+
+// Client returns an http.Client using this transport.
+func (t *Transport) Client() *http.Client {
+	return &http.Client{Transport: t}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cassette: error reading request body: %w", err)
+		}
+	}
+
+	if t.mode == ModeRecord {
+		return t.record(req, body)
+	}
+	return t.replay(req, body)
+}
+
+func (t *Transport) record(req *http.Request, body []byte) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+
+	resp, err := t.real.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// This buffers the whole stream before handing it back, which is fine for tests.
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cassette: error reading response body: %w", err)
+	}
+
+	t.mu.Lock()
+	t.cassette.Interactions = append(t.cassette.Interactions, Interaction{
+		Request: Request{
+			Method:  req.Method,
+			URL:     t.scrubURL(req.URL),
+			Headers: t.scrubHeaders(req.Header),
+			Body:    t.scrubBody(body),
+		},
+		Response: Response{
+			Status:  resp.StatusCode,
+			Headers: keepHeaders(resp.Header),
+			Body:    t.scrub(string(respBody)),
+		},
+	})
+	t.mu.Unlock()
+
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	return resp, nil
+}
+
+func (t *Transport) replay(req *http.Request, body []byte) (*http.Response, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.next >= len(t.cassette.Interactions) {
+		return nil, fmt.Errorf(
+			"cassette: unexpected request %s %s: all %d recorded interactions were used",
+			req.Method,
+			req.URL.Path,
+			len(t.cassette.Interactions),
+		)
+	}
+
+	it := t.cassette.Interactions[t.next]
+	t.next++
+
+	if err := it.Request.match(req, t.scrubBody(body)); err != nil {
+		return nil, fmt.Errorf("cassette: request %d doesn't match %s, re-record it if the change is intended: %w", t.next, t.path, err)
+	}
+
+	header := it.Response.Headers.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", it.Response.Status, http.StatusText(it.Response.Status)),
+		StatusCode:    it.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(it.Response.Body)),
+		ContentLength: int64(len(it.Response.Body)),
+		Request:       req,
+	}, nil
+}
+
+// Finish must be called once the session is over. In record mode it writes the cassette to disk,
+// in replay mode it reports an error if some of the recorded interactions were never requested.
+func (t *Transport) Finish() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.mode == ModeReplay {
+		if unused := len(t.cassette.Interactions) - t.next; unused > 0 {
+			return fmt.Errorf("Transport.Finish: %d recorded interactions of %s were never requested", unused, t.path)
+		}
+		return nil
+	}
+
+	// bodies are full of markup, which we don't want escaped
+	var data bytes.Buffer
+	enc := json.NewEncoder(&data)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(t.cassette); err != nil {
+		return fmt.Errorf("Transport.Finish: error marshalling cassette: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(t.path), 0755); err != nil {
+		return fmt.Errorf("Transport.Finish: error creating cassette directory: %w", err)
+	}
+	if err := os.WriteFile(t.path, data.Bytes(), 0644); err != nil {
+		return fmt.Errorf("Transport.Finish: error writing cassette: %w", err)
+	}
+
+	return nil
+}
+
+// match compares an incoming request against the recorded one. Only the method, the path and the
+// body are compared, so that the same cassette works regardless of the base URL.
+func (r Request) match(req *http.Request, body json.RawMessage) error {
+	recorded, err := url.Parse(r.URL)
+	if err != nil {
+		return fmt.Errorf("invalid recorded URL: %w", err)
+	}
+
+	if req.Method != r.Method || req.URL.Path != recorded.Path {
+		return fmt.Errorf("got %s %s, recorded %s %s", req.Method, req.URL.Path, r.Method, recorded.Path)
+	}
+
+	got, want := normalize(body), normalize(r.Body)
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("request bodies differ:\n got: %s\nwant: %s", got, want)
+	}
+
+	return nil
+}
+
+// normalize re-encodes a JSON body so that formatting and escaping differences don't matter.
+func normalize(body json.RawMessage) []byte {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return body
+	}
+
+	out, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+func (t *Transport) scrub(s string) string {
+	for _, secret := range t.secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	return s
+}
+
+func (t *Transport) scrubURL(u *url.URL) string {
+	u2 := *u
+	q := u2.Query()
+	for _, key := range sensitiveParams {
+		if q.Has(key) {
+			q.Set(key, redacted)
+		}
+	}
+	u2.RawQuery = q.Encode()
+	return t.scrub(u2.String())
+}
+
+func (t *Transport) scrubHeaders(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for key, values := range h {
+		if isSensitiveHeader(key) {
+			out[key] = []string{redacted}
+			continue
+		}
+		for _, v := range values {
+			out.Add(key, t.scrub(v))
+		}
+	}
+	return out
+}
+
+func (t *Transport) scrubBody(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+
+	scrubbed := t.scrub(string(body))
+	if json.Valid([]byte(scrubbed)) {
+		return json.RawMessage(scrubbed)
+	}
+
+	// not JSON, so we store it as a string instead (which can't fail to marshal)
+	encoded, _ := json.Marshal(scrubbed)
+	return encoded
+}
+
+func isSensitiveHeader(key string) bool {
+	key = http.CanonicalHeaderKey(key)
+	for _, s := range sensitiveHeaders {
+		if key == http.CanonicalHeaderKey(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// keepHeaders drops every response header except the few that affect how a response is read, since
+// the rest are mostly request ids, rate limits and organization details.
+func keepHeaders(h http.Header) http.Header {
+	out := make(http.Header)
+	for _, key := range []string{"Content-Type", "Retry-After"} {
+		if v := h.Values(key); len(v) > 0 {
+			out[key] = v
+		}
+	}
+	return out
+}
+
+const redacted = "REDACTED"
+
+var (
+	sensitiveHeaders = []string{"Authorization", "X-Api-Key", "Api-Key", "X-Goog-Api-Key", "Cookie", "Set-Cookie"}
+	sensitiveParams  = []string{"key", "api_key", "access_token"}
+)
@@ -0,0 +1,128 @@
+package cassette
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	const secret = "sk-very-secret"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+secret {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("X-Request-Id", "req_123")
+		io.WriteString(w, "data: {\"echo\": "+string(body)+"}\n\n")
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "cassettes", "echo.json")
+
+	// record
+	rec, err := New(path, ModeRecord)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rec.Scrub(secret)
+
+	got := post(t, rec.Client(), server.URL+"/v1/echo?key="+secret, `{"n": 1, "html": "<b>"}`, secret)
+	want := "data: {\"echo\": {\"n\": 1, \"html\": \"<b>\"}}\n\n"
+	if got != want {
+		t.Fatalf("expected recorded response %q, got %q", want, got)
+	}
+	if err := rec.Finish(); err != nil {
+		t.Fatalf("unexpected error saving cassette: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error reading cassette: %v", err)
+	}
+	if strings.Contains(string(data), secret) {
+		t.Fatalf("expected secret to be scrubbed from the cassette:\n%s", data)
+	}
+	if strings.Contains(string(data), "req_123") {
+		t.Errorf("expected irrelevant response headers to be dropped:\n%s", data)
+	}
+	if !strings.Contains(string(data), `"html": "<b>"`) {
+		t.Errorf("expected request body to be stored as readable JSON:\n%s", data)
+	}
+
+	// replay, with the server gone and against a different host
+	server.Close()
+
+	rep, err := New(path, ModeReplay)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got = post(t, rep.Client(), "http://localhost:1/v1/echo", `{"html":"<b>","n":1}`, "")
+	if got != want {
+		t.Fatalf("expected replayed response %q, got %q", want, got)
+	}
+	if err := rep.Finish(); err != nil {
+		t.Fatalf("unexpected error finishing replay: %v", err)
+	}
+
+	// requests that differ from the recording are rejected
+	rep, _ = New(path, ModeReplay)
+	resp, err := rep.Client().Post("http://localhost:1/v1/echo", "application/json", strings.NewReader(`{"n": 2}`))
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("expected an error for a mismatched request body")
+	}
+	if !strings.Contains(err.Error(), "request bodies differ") {
+		t.Errorf("expected the error to explain the mismatch, got %v", err)
+	}
+	if _, err := rep.Client().Get("http://localhost:1/v1/echo"); err == nil {
+		t.Errorf("expected an error once every interaction was used")
+	}
+
+	// and unused interactions are reported
+	rep, _ = New(path, ModeReplay)
+	if err := rep.Finish(); err == nil {
+		t.Errorf("expected an error for unused interactions")
+	}
+}
+
+func TestReplayMissingCassette(t *testing.T) {
+	if _, err := New(filepath.Join(t.TempDir(), "missing.json"), ModeReplay); err == nil {
+		t.Fatalf("expected an error for a missing cassette")
+	}
+}
+
+func post(t *testing.T, client *http.Client, url, body, key string) string {
+	t.Helper()
+
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+key)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error reading body: %v", err)
+	}
+	return string(data)
+}
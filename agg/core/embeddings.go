@@ -7,10 +7,20 @@ type EmbeddingsResult struct {
 	// TODO(optimize): let's eventually move to a base64 representation instead of an explicit
 	//                 array of floats.
 	Vectors [][]float64
+	// Model is the name of the model that generated the embeddings, and Tokens how many tokens
+	// of input it was given.
+	Model  string
+	Tokens int64
 	// Cost unit is thousandths of a millionth of a dollar.
 	Cost int64
 }
 
+// EmbeddingsLedger records the embeddings that were generated, so that what they cost can be
+// accounted for along with the usage of the models.
+type EmbeddingsLedger interface {
+	RecordEmbeddings(provider Provider, result *EmbeddingsResult) error
+}
+
 // Embedder is implemented by providers that can generate embeddings.
 type Embedder interface {
 	Embed(ctx context.Context, inputs []string, dimensions *int) (*EmbeddingsResult, error)
@@ -0,0 +1,82 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// APIError is an error reported by a provider's API, either as a non-2xx response to the request
+// or as an error event in the middle of a stream.
+type APIError struct {
+	Provider Provider
+	// Status is the HTTP status of the response, or of the error event if the provider includes
+	// one. It's 0 otherwise.
+	Status int
+	// Type is the provider-specific kind of the error, e.g. "overloaded_error". It's always set
+	// for errors in the middle of a stream, and empty for non-2xx responses.
+	Type string
+	// Message is the error message, or the (possibly truncated) body of the response if it came
+	// from a non-2xx one.
+	Message string
+	// RetryAfter is how long the API asked us to wait before retrying, 0 if it didn't say.
+	RetryAfter time.Duration
+}
+
+// NewAPIError creates an APIError for a non-2xx response, given (part of) its body.
+func NewAPIError(provider Provider, resp *http.Response, body []byte) *APIError {
+	return &APIError{
+		Provider:   provider,
+		Status:     resp.StatusCode,
+		Message:    string(body),
+		RetryAfter: retryAfter(resp.Header),
+	}
+}
+
+func (e *APIError) Error() string {
+	if e.Type == "" {
+		return fmt.Sprintf("error response: %d %s, body=%s", e.Status, http.StatusText(e.Status), e.Message)
+	}
+	return fmt.Sprintf("error event: %s: %s", e.Type, e.Message)
+}
+
+// Temporary reports whether the same request could succeed if retried later, which is the case for
+// rate limits, overloaded servers and server errors.
+func (e *APIError) Temporary() bool {
+	switch {
+	case e.Status == http.StatusRequestTimeout, e.Status == http.StatusTooManyRequests:
+		return true
+	case e.Status >= 500:
+		return true
+	}
+
+	switch e.Type {
+	case "overloaded_error", "rate_limit_error", "api_error", // Anthropic
+		"server_error", "rate_limit_exceeded", // OpenAI
+		"UNAVAILABLE", "RESOURCE_EXHAUSTED", "INTERNAL": // Gemini
+		return true
+	}
+
+	return false
+}
+
+// retryAfter parses how long the response asks us to wait before retrying. Besides the standard
+// Retry-After header (in seconds or as a date), OpenAI also sends the more precise retry-after-ms.
+func retryAfter(h http.Header) time.Duration {
+	if ms, err := strconv.ParseFloat(h.Get("Retry-After-Ms"), 64); err == nil && ms > 0 {
+		return time.Duration(ms * float64(time.Millisecond))
+	}
+
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseFloat(v, 64); err == nil && secs > 0 {
+		return time.Duration(secs * float64(time.Second))
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
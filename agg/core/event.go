@@ -6,6 +6,10 @@ type Event struct {
 	Response Response
 	Call     ToolCall
 	Err      error
+
+	// Path names the sub-agents an event comes from, outermost first, for the events of sub-agents
+	// that are surfaced through the agent that called them. It's empty for the agent's own events.
+	Path []string
 }
 
 type EventType int
@@ -17,6 +21,13 @@ const (
 	EvResp
 	EvToolCall
 	EvError
+	// EvWarning reports something the user should know about, in Err, without interrupting the
+	// stream.
+	EvWarning
+	// EvRetry reports that the stream failed midway, with the error in Err, and is starting over.
+	// Every delta and reasoning delta emitted before it belongs to a generation that was
+	// abandoned, so listeners should discard whatever they showed of them.
+	EvRetry
 )
 
 func NewEvDelta(delta string) Event {
@@ -53,3 +64,17 @@ func NewEvError(err error) Event {
 		Err:  err,
 	}
 }
+
+func NewEvWarning(err error) Event {
+	return Event{
+		Type: EvWarning,
+		Err:  err,
+	}
+}
+
+func NewEvRetry(err error) Event {
+	return Event{
+		Type: EvRetry,
+		Err:  err,
+	}
+}
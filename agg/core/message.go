@@ -18,8 +18,8 @@ const (
 // Msg represents a single message in a conversation.
 //
 // IMPORTANT: Msg instances are NOT safe for concurrent access. A single Msg should never be
-// shared across goroutines without external synchronization, as the CachedTransform field may
-// be written to during message transformation.
+// shared across goroutines without external synchronization, as the cached transform may be
+// written to during message transformation.
 //
 // TODO(experiment): Evaluate the performance impact of adding synchronization (e.g., sync.RWMutex
 // or atomic operations) to make Msg safe for concurrent use.
@@ -30,14 +30,22 @@ type Msg struct {
 	ToolCall   *ToolCall   `json:"tool_call,omitempty"`
 	ToolResult *ToolResult `json:"tool_result,omitempty"`
 
-	// CachedTransform holds provider-specific transforms for a given Msg. This is done to avoid
-	// re-transforming the same message multiple times throughout a conversation. Evidently this
-	// has two implications:
-	// 1. If the Msg is mutated for whatever reason, the CachedTransform needs to be manually
-	//    invalidated.
-	// 2. If the Msg is going to be used by a model from a different provider, the CachedTransform
-	//    needs to be manually invalidated.
-	CachedTransform json.RawMessage `json:"-"`
+	// Provider and Model identify what generated the message, where Model is the name the API
+	// reported for it. Both are empty for messages that didn't come from a model, like user inputs
+	// and tool results (except for those of sub-agents, see Usage).
+	Provider Provider `json:"provider,omitempty"`
+	Model    string   `json:"model,omitempty"`
+	// Usage is the usage of the response that generated this message. It's only set for the last
+	// message of each response (that isn't a reasoning one), so that it can be summed up. Results
+	// of tools that ran models of their own, like sub-agents, carry what those spent.
+	Usage *Usage `json:"usage,omitempty"`
+
+	// cachedTransform holds the provider-specific transform of the Msg, to avoid re-transforming
+	// the same message multiple times throughout a conversation. It's only valid for the provider
+	// in cachedFor, so that the conversation can switch between models of different providers. If
+	// the Msg is mutated for whatever reason, the cache needs to be manually invalidated.
+	cachedTransform json.RawMessage
+	cachedFor       Provider
 }
 
 func NewMsgReasoning(encrypted, text string) *Msg {
@@ -47,14 +55,16 @@ func NewMsgReasoning(encrypted, text string) *Msg {
 	}
 }
 
-func NewMsgContent(role, text string) *Msg {
+// NewMsgContent creates a content message with the given text, followed by any parts (e.g. images)
+// that go along with it.
+func NewMsgContent(role, text string, parts ...Part) *Msg {
 	if role != "assistant" && role != "user" && role != "system" {
 		panic(fmt.Errorf("invalid role: %s", role))
 	}
 
 	return &Msg{
 		Type:    MsgTypeContent,
-		Content: &Content{Role: role, Text: text},
+		Content: &Content{Role: role, Text: text, Parts: parts},
 	}
 }
 
@@ -65,10 +75,12 @@ func NewMsgToolCall(id, name, arguments string) *Msg {
 	}
 }
 
-func NewMsgToolResult(id, result string) *Msg {
+// NewMsgToolResult creates a tool result message with the given text, followed by any parts (e.g.
+// images) the tool returned along with it.
+func NewMsgToolResult(id, result string, parts ...Part) *Msg {
 	return &Msg{
 		Type:       MsgTypeToolResult,
-		ToolResult: &ToolResult{ID: id, Result: result},
+		ToolResult: &ToolResult{ID: id, Result: result, Parts: parts},
 	}
 }
 
@@ -112,8 +124,24 @@ func (m *Msg) AsToolResult() (*ToolResult, bool) {
 	return m.ToolResult, true
 }
 
+// CachedTransform returns the transform cached for provider, or nil if there's none.
+func (m *Msg) CachedTransform(provider Provider) json.RawMessage {
+	if m.cachedFor != provider {
+		return nil
+	}
+	return m.cachedTransform
+}
+
+// SetCachedTransform caches the transform of the message for provider, replacing any transform
+// cached for another one.
+func (m *Msg) SetCachedTransform(provider Provider, transform json.RawMessage) {
+	m.cachedTransform = transform
+	m.cachedFor = provider
+}
+
 func (m *Msg) ResetCache() {
-	m.CachedTransform = nil
+	m.cachedTransform = nil
+	m.cachedFor = ""
 }
 
 type Reasoning struct {
@@ -124,6 +152,8 @@ type Reasoning struct {
 type Content struct {
 	Role string `json:"role"`
 	Text string `json:"text"`
+	// Parts are the images, documents or further text that come after Text.
+	Parts []Part `json:"parts,omitempty"`
 }
 
 type ToolCall struct {
@@ -135,4 +165,6 @@ type ToolCall struct {
 type ToolResult struct {
 	ID     string `json:"id"`
 	Result string `json:"result"`
+	// Parts are the images, documents or further text that come after Result.
+	Parts []Part `json:"parts,omitempty"`
 }
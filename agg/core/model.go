@@ -11,9 +11,32 @@ type StreamCfg struct {
 	// When true, the model will be forced to generate a direct response.
 	DisableTools bool
 
+	// ForceResponse, if set, is why the model must respond without making any more tool calls.
+	// The agent turns it into what each provider needs (see agg's requestFor), so models
+	// themselves don't look at it.
+	ForceResponse string
+
 	// DetailedReasoning configures the model to provide a detailed summary of the reasoning
 	// process instead of the default "concise" one.
 	DetailedReasoning bool
+
+	// ResponseFormat, if set, constrains the final response to a JSON object matching its schema,
+	// which is returned as the text of the assistant message.
+	ResponseFormat *ResponseFormat
+}
+
+// ResponseFormat describes the JSON object a model must respond with. The schema uses the same
+// subset of JSON Schema as tool parameters, with Schema holding the properties of the top-level
+// object. Providers without native support for it get it as a tool they're forced to call.
+type ResponseFormat struct {
+	Name   string               `json:"name"`
+	Desc   string               `json:"description"`
+	Schema map[string]ToolParam `json:"schema"`
+}
+
+// AsTool returns the response format as a tool whose parameters are the expected object.
+func (f ResponseFormat) AsTool() Tool {
+	return Tool{Name: f.Name, Desc: f.Desc, Params: f.Schema}
 }
 
 // Model represents an AI model provider that can create response streams.
@@ -31,6 +54,8 @@ type ResponseStream interface {
 type Provider string
 
 const (
-	ProviderOpenAI    Provider = "openai"
-	ProviderAnthropic Provider = "anthropic"
+	ProviderOpenAI       Provider = "openai"
+	ProviderAnthropic    Provider = "anthropic"
+	ProviderOpenAICompat Provider = "openai-compat"
+	ProviderGemini       Provider = "gemini"
 )
@@ -0,0 +1,51 @@
+package core
+
+import (
+	"encoding/base64"
+	"fmt"
+)
+
+// PartType is the kind of content held by a Part.
+type PartType string
+
+const (
+	PartText     PartType = "text"
+	PartImage    PartType = "image"
+	PartDocument PartType = "document"
+)
+
+// Part is a piece of content that goes along with the text of a message or tool result, such as an
+// image or a PDF. The text of the message always comes first, followed by its parts in order.
+type Part struct {
+	Type PartType `json:"type"`
+	Text string   `json:"text,omitempty"`
+
+	// MediaType is the MIME type of Data, e.g. "image/png" or "application/pdf".
+	MediaType string `json:"media_type,omitempty"`
+	// Name is the file name of a document, which some providers require.
+	Name string `json:"name,omitempty"`
+	// Data is the raw content of an image or document. It's base64 encoded when marshalled.
+	Data []byte `json:"data,omitempty"`
+}
+
+func NewPartText(text string) Part {
+	return Part{Type: PartText, Text: text}
+}
+
+func NewPartImage(mediaType string, data []byte) Part {
+	return Part{Type: PartImage, MediaType: mediaType, Data: data}
+}
+
+func NewPartDocument(name, mediaType string, data []byte) Part {
+	return Part{Type: PartDocument, Name: name, MediaType: mediaType, Data: data}
+}
+
+// Base64 returns Data encoded as standard base64, which is how every provider takes it.
+func (p Part) Base64() string {
+	return base64.StdEncoding.EncodeToString(p.Data)
+}
+
+// DataURL returns Data as a data URL, e.g. "data:image/png;base64,...".
+func (p Part) DataURL() string {
+	return fmt.Sprintf("data:%s;base64,%s", p.MediaType, p.Base64())
+}
@@ -0,0 +1,175 @@
+package core
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+)
+
+// ModelInfo describes a model that can be picked by name, along with what it supports and what it
+// costs. Provider packages register the models they know about, and entries can be added or
+// overridden afterwards (e.g. from a config file) when prices change before the code does.
+type ModelInfo struct {
+	Provider Provider `json:"provider"`
+	// ID is the name of the model in its provider's API.
+	ID string `json:"id"`
+	// Aliases are shorter names that can be used instead of the ID, e.g. "sonnet".
+	Aliases []string `json:"aliases,omitempty"`
+
+	// BaseURL and APIKeyEnv, if set, override where requests are sent and which environment
+	// variable holds the key. They're mostly useful for OpenAI-compatible servers.
+	BaseURL   string `json:"base_url,omitempty"`
+	APIKeyEnv string `json:"api_key_env,omitempty"`
+
+	ContextWindow int  `json:"context_window"`
+	MaxOutput     int  `json:"max_output"`
+	Reasoning     bool `json:"reasoning"`
+	Caching       bool `json:"caching"`
+	Tools         bool `json:"tools"`
+
+	Prices Prices `json:"prices"`
+}
+
+// Prices are the prices of a model per token, in the same unit as Usage.Cost (billionths of a
+// dollar). This makes them the same numbers as the price in thousandths of a dollar per million
+// tokens, e.g. 2000 for $2.000 per 1M.
+type Prices struct {
+	Input      int64 `json:"input"`
+	Cached     int64 `json:"cached"`
+	CacheWrite int64 `json:"cache_write,omitempty"`
+	Output     int64 `json:"output"`
+
+	// Some models charge more for every token of a request once its prompt goes over a threshold,
+	// in which case Long replaces the prices above for those requests.
+	LongThreshold int64   `json:"long_threshold,omitempty"`
+	Long          *Prices `json:"long,omitempty"`
+}
+
+// Cost computes the cost of a request in the same unit as Usage.Cost. The input tokens must not
+// include the cached or cache write ones, and the output tokens must include the reasoning ones.
+func (p Prices) Cost(input, cached, cacheWrite, output int64) int64 {
+	if p.Long != nil && p.LongThreshold > 0 && input+cached+cacheWrite > p.LongThreshold {
+		p = *p.Long
+	}
+
+	return (p.Input*input +
+		p.Cached*cached +
+		p.CacheWrite*cacheWrite +
+		p.Output*output)
+}
+
+// ErrUnknownModel is returned for models that aren't in the registry, see ModelPrices.
+var ErrUnknownModel = errors.New("unknown model")
+
+var registry = struct {
+	mu      sync.RWMutex
+	models  map[registryKey]ModelInfo
+	aliases map[registryKey]string
+}{
+	models:  make(map[registryKey]ModelInfo),
+	aliases: make(map[registryKey]string),
+}
+
+type registryKey struct {
+	provider Provider
+	name     string
+}
+
+// RegisterModel adds a model to the registry, replacing any previous entry with the same provider
+// and ID.
+func RegisterModel(info ModelInfo) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	key := registryKey{info.Provider, info.ID}
+	if old, ok := registry.models[key]; ok {
+		for _, alias := range old.Aliases {
+			delete(registry.aliases, registryKey{info.Provider, alias})
+		}
+	}
+
+	info = info.clone()
+	registry.models[key] = info
+	for _, alias := range info.Aliases {
+		registry.aliases[registryKey{info.Provider, alias}] = info.ID
+	}
+}
+
+// LookupModel returns the registered model of the provider with the given ID or alias.
+func LookupModel(provider Provider, name string) (ModelInfo, bool) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	if id, ok := registry.aliases[registryKey{provider, name}]; ok {
+		name = id
+	}
+
+	info, ok := registry.models[registryKey{provider, name}]
+	if !ok {
+		return ModelInfo{}, false
+	}
+
+	return info.clone(), true
+}
+
+// ModelPrices returns the prices of the registered model of the provider with the given ID or
+// alias, or ErrUnknownModel if there's none. Providers use it to price the usage of responses.
+//
+// Models the registry doesn't list yet (e.g. newly released ones) still work, but their usage is
+// recorded at $0, so it doesn't count towards budgets either. This is logged the first time it
+// happens for each model, so that it can be registered with its prices, see RegisterModel.
+func ModelPrices(provider Provider, name string) (Prices, error) {
+	info, ok := LookupModel(provider, name)
+	if !ok {
+		if _, warned := unpricedWarned.LoadOrStore(registryKey{provider, name}, true); !warned {
+			log.Printf("warning: unknown model %s:%s, its usage will be recorded at $0", provider, name)
+		}
+		return Prices{}, fmt.Errorf("%w %s:%s", ErrUnknownModel, provider, name)
+	}
+	return info.Prices, nil
+}
+
+// unpricedWarned has the models ModelPrices already warned about.
+var unpricedWarned sync.Map
+
+// SetModelPrices overrides the prices of a registered model, given by its ID or alias.
+func SetModelPrices(provider Provider, name string, prices Prices) error {
+	info, ok := LookupModel(provider, name)
+	if !ok {
+		return fmt.Errorf("core.SetModelPrices: unknown model %s:%s", provider, name)
+	}
+
+	info.Prices = prices
+	RegisterModel(info)
+	return nil
+}
+
+// Models returns every registered model, sorted by provider and ID.
+func Models() []ModelInfo {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	r := make([]ModelInfo, 0, len(registry.models))
+	for _, info := range registry.models {
+		r = append(r, info.clone())
+	}
+
+	slices.SortFunc(r, func(a, b ModelInfo) int {
+		return cmp.Or(cmp.Compare(a.Provider, b.Provider), cmp.Compare(a.ID, b.ID))
+	})
+	return r
+}
+
+// clone returns a copy of info that doesn't share memory with it, so that callers can't change the
+// registry by modifying what they got from it.
+func (info ModelInfo) clone() ModelInfo {
+	info.Aliases = slices.Clone(info.Aliases)
+	if info.Prices.Long != nil {
+		long := *info.Prices.Long
+		info.Prices.Long = &long
+	}
+	return info
+}
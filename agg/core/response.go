@@ -7,11 +7,14 @@ type Response struct {
 }
 
 type Usage struct {
-	Input     int64
-	Cached    int64
-	Output    int64
-	Reasoning int64
-	Total     int64
+	Input  int64
+	Cached int64
+	// CacheWrite are the input tokens that were written to the cache, for providers that charge
+	// for it (Anthropic). Like Cached, they're not included in Input.
+	CacheWrite int64
+	Output     int64
+	Reasoning  int64
+	Total      int64
 	// unit here is thousandth of a millionth of a dollar
 	// this means that a value of a billion equals 1 USD
 	Cost int64
@@ -20,6 +23,7 @@ type Usage struct {
 func (u *Usage) Inc(ou Usage) {
 	u.Input += ou.Input
 	u.Cached += ou.Cached
+	u.CacheWrite += ou.CacheWrite
 	u.Output += ou.Output
 	u.Reasoning += ou.Reasoning
 	u.Total += ou.Total
@@ -0,0 +1,133 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// Schema is the plain JSON Schema representation of a tool's input and of its nested parameters.
+// Providers that accept regular JSON Schema send it as-is, the others translate it into their own
+// dialect, so that there's a single place deciding what a ToolParam means.
+type Schema struct {
+	Type        SchemaType `json:"type,omitempty"`
+	Description string     `json:"description,omitempty"`
+
+	// structural
+	Items                *Schema           `json:"items,omitempty"`
+	Properties           map[string]Schema `json:"properties,omitempty"`
+	Required             []string          `json:"required,omitempty"`
+	AdditionalProperties *bool             `json:"additionalProperties,omitempty"`
+
+	// validation / constraints
+	Enum     []any    `json:"enum,omitempty"`
+	Default  any      `json:"default,omitempty"`
+	Minimum  *float64 `json:"minimum,omitempty"`
+	Maximum  *float64 `json:"maximum,omitempty"`
+	MinItems *int     `json:"minItems,omitempty"`
+	MaxItems *int     `json:"maxItems,omitempty"`
+
+	// never produced by us, but other tools' schemas (e.g. from MCP servers) can have them
+	AnyOf []Schema `json:"anyOf,omitempty"`
+	Ref   string   `json:"$ref,omitempty"`
+}
+
+// SchemaType is the JSON Schema "type" keyword, which is a plain string for a single type or an
+// array of strings when the value can take multiple types (e.g. ["string", "null"]).
+type SchemaType []JSType
+
+func (t SchemaType) MarshalJSON() ([]byte, error) {
+	if len(t) == 1 {
+		return json.Marshal(t[0])
+	}
+	return json.Marshal([]JSType(t))
+}
+
+func (t *SchemaType) UnmarshalJSON(data []byte) error {
+	var single JSType
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = SchemaType{single}
+		return nil
+	}
+
+	var multiple []JSType
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return fmt.Errorf("type must be a string or an array of strings: %w", err)
+	}
+	*t = multiple
+	return nil
+}
+
+// JSONSchema returns the schema of the tool's input, see ObjectSchema.
+func (t Tool) JSONSchema() Schema {
+	return ObjectSchema(t.Params)
+}
+
+// ObjectSchema returns the schema of an object with the given parameters as its properties.
+// Optional parameters are left out of `required`, nullable ones take null as a type (and as a
+// value of their enum, if any) and defaults are passed along as-is. Additional properties are
+// disallowed on every object, so that models are nudged towards the exact shape handlers decode.
+func ObjectSchema(params map[string]ToolParam) Schema {
+	r := Schema{
+		Type:                 SchemaType{JSTObject},
+		Properties:           make(map[string]Schema, len(params)),
+		Required:             make([]string, 0, len(params)),
+		AdditionalProperties: boolPtr(false),
+	}
+
+	// we sort the names so that request bodies are deterministic, otherwise we'd be invalidating
+	// prompt caches at random
+	for _, name := range slices.Sorted(maps.Keys(params)) {
+		param := params[name]
+		r.Properties[name] = param.JSONSchema()
+		if !param.Optional {
+			r.Required = append(r.Required, name)
+		}
+	}
+
+	return r
+}
+
+// JSONSchema returns the schema of the parameter, see ObjectSchema.
+func (p ToolParam) JSONSchema() Schema {
+	var r Schema
+	if p.Type == JSTObject {
+		r = ObjectSchema(p.Properties)
+	} else {
+		r.Type = SchemaType{p.Type}
+	}
+
+	r.Description = p.Desc
+	r.Default = p.Default
+	r.Minimum = p.Minimum
+	r.Maximum = p.Maximum
+	r.MinItems = p.MinItems
+	r.MaxItems = p.MaxItems
+
+	if p.Items != nil {
+		items := p.Items.JSONSchema()
+		r.Items = &items
+	}
+
+	nullable := p.Nullable != nil && *p.Nullable
+	if nullable {
+		r.Type = append(r.Type, JSTNull)
+	}
+
+	if len(p.Enum) > 0 {
+		r.Enum = make([]any, 0, len(p.Enum)+1)
+		for _, v := range p.Enum {
+			r.Enum = append(r.Enum, v)
+		}
+		if nullable {
+			r.Enum = append(r.Enum, nil)
+		}
+	}
+
+	return r
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
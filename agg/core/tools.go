@@ -6,6 +6,13 @@ type Tool struct {
 	Params map[string]ToolParam `json:"params"`
 }
 
+// ToolParam describes a single parameter of a tool (or a nested property of an object parameter)
+// using a subset of JSON Schema. See JSONSchema for what it translates to, which providers send
+// as-is or translate into whatever dialect they accept, see openai.fromCoreTool.
+//
+// Parameters are required by default, which matches what strict modes expect. Set Optional to
+// let the model omit it; providers that require every property to be listed as required will
+// instead make it nullable, so handlers should treat a missing value and a null one the same way.
 type ToolParam struct {
 	Type JSType `json:"type"`
 	Desc string `json:"description"`
@@ -13,11 +20,29 @@ type ToolParam struct {
 	// we can tell that the type is nullable
 	Nullable *bool `json:"nullable,omitempty"`
 
+	// Optional indicates the model does not need to provide this parameter.
+	Optional bool `json:"optional,omitempty"`
+
+	// Default is the value assumed when an optional parameter is not provided. It's advertised to
+	// the model but it is up to the handler to actually apply it.
+	Default any `json:"default,omitempty"`
+
 	// if Type == JSTArray, Items indicate the type of the items in the array
 	Items *ToolParam `json:"items,omitempty"`
 
+	// if Type == JSTObject, Properties indicate the nested parameters of the object
+	Properties map[string]ToolParam `json:"properties,omitempty"`
+
 	// if Type == JSTString it can optionally be an enumerator with specific values
 	Enum []string `json:"enum,omitempty"`
+
+	// if Type == JSTNumber or Type == JSTInteger, the inclusive range of accepted values
+	Minimum *float64 `json:"minimum,omitempty"`
+	Maximum *float64 `json:"maximum,omitempty"`
+
+	// if Type == JSTArray, the inclusive range of accepted lengths
+	MinItems *int `json:"minItems,omitempty"`
+	MaxItems *int `json:"maxItems,omitempty"`
 }
 
 type ToolMap = map[string]func(string) (string, error)
@@ -27,6 +52,9 @@ type JSType string
 const (
 	JSTString  JSType = "string"
 	JSTNumber  JSType = "number"
+	JSTInteger JSType = "integer"
 	JSTBoolean JSType = "boolean"
 	JSTArray   JSType = "array"
+	JSTObject  JSType = "object"
+	JSTNull    JSType = "null"
 )
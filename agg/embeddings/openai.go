@@ -123,6 +123,8 @@ func (e *OpenAIEmbeddings) Embed(ctx context.Context, inputs []string, dimension
 
 	return &core.EmbeddingsResult{
 		Vectors: vectors,
+		Model:   string(e.modelID),
+		Tokens:  embResp.Usage.PromptTokens,
 		Cost:    cost,
 	}, nil
 }
@@ -0,0 +1,170 @@
+package agg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/victhorio/opa/agg/core"
+)
+
+// ExtractError is returned by Extract when the model still doesn't produce a valid object after
+// being asked to repair it. Raw is the last response it gave.
+type ExtractError struct {
+	Format string
+	Raw    string
+	Err    error
+}
+
+func (e *ExtractError) Error() string {
+	return fmt.Sprintf("invalid %s response: %v", e.Format, e.Err)
+}
+
+func (e *ExtractError) Unwrap() error {
+	return e.Err
+}
+
+// Extract asks model to respond to msgs with a JSON object matching format and decodes it into a
+// T, whose fields must line up with the format's schema. The response is validated against the
+// schema before being decoded, and if either step fails the model is told what's wrong and given
+// one chance to repair it. The returned usage covers every request made.
+//
+// msgs isn't modified. Extract doesn't pass any tools, so the model must answer straight away.
+func Extract[T any](
+	ctx context.Context,
+	client *http.Client,
+	model core.Model,
+	msgs []*core.Msg,
+	format core.ResponseFormat,
+) (T, core.Usage, error) {
+	var zero T
+	var usage core.Usage
+
+	msgs = append([]*core.Msg(nil), msgs...)
+	cfg := core.StreamCfg{ResponseFormat: &format}
+
+	const attempts = 2
+	var lastErr error
+	for attempt := range attempts {
+		raw, err := extractOnce(ctx, client, model, msgs, cfg, &usage)
+		if err != nil {
+			return zero, usage, fmt.Errorf("agg.Extract: %w", err)
+		}
+
+		value, issues := decodeExtracted[T](format, raw)
+		if issues == nil {
+			return value, usage, nil
+		}
+
+		lastErr = &ExtractError{Format: format.Name, Raw: raw, Err: issues}
+		if attempt == attempts-1 {
+			break
+		}
+
+		msgs = append(msgs,
+			core.NewMsgContent("assistant", raw),
+			core.NewMsgContent("user", repairPrompt(issues)),
+		)
+	}
+
+	return zero, usage, fmt.Errorf("agg.Extract: %w", lastErr)
+}
+
+// extractOnce runs a single request and returns the text of the response, adding its usage.
+func extractOnce(
+	ctx context.Context,
+	client *http.Client,
+	model core.Model,
+	msgs []*core.Msg,
+	cfg core.StreamCfg,
+	usage *core.Usage,
+) (string, error) {
+	stream, err := model.OpenStream(ctx, client, msgs, nil, cfg)
+	if err != nil {
+		return "", fmt.Errorf("error opening stream: %w", err)
+	}
+
+	events := make(chan core.Event, 1)
+	go stream.Consume(ctx, events)
+
+	var resp *core.Response
+	var streamErr error
+	for ev := range events {
+		switch ev.Type {
+		case core.EvResp:
+			resp = &ev.Response
+		case core.EvError:
+			if streamErr == nil {
+				streamErr = ev.Err
+			}
+		}
+	}
+
+	if streamErr != nil {
+		return "", fmt.Errorf("error during stream: %w", streamErr)
+	}
+	if resp == nil {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		return "", errors.New("stream ended without a response")
+	}
+	usage.Inc(resp.Usage)
+
+	var sb strings.Builder
+	for _, msg := range resp.Messages {
+		if content, ok := msg.AsContent(); ok {
+			sb.WriteString(content.Text)
+		}
+	}
+	return sb.String(), nil
+}
+
+// decodeExtracted validates raw against the format and decodes it into a T.
+func decodeExtracted[T any](format core.ResponseFormat, raw string) (T, error) {
+	var value T
+
+	// models without native support for a response format like wrapping it in a code block
+	raw = strings.TrimSpace(raw)
+	if trimmed, ok := strings.CutPrefix(raw, "```"); ok {
+		trimmed = strings.TrimPrefix(trimmed, "json")
+		raw = strings.TrimSpace(strings.TrimSuffix(trimmed, "```"))
+	}
+
+	if err := validateArgs(format.AsTool(), json.RawMessage(raw)); err != nil {
+		return value, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader([]byte(raw)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&value); err != nil {
+		return value, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return value, nil
+}
+
+// repairPrompt tells the model what was wrong with its last response.
+func repairPrompt(err error) string {
+	var sb strings.Builder
+	sb.WriteString("Your response does not match the expected format. Fix the following and respond again with only the corrected JSON object:\n")
+
+	var argsErr *ToolArgsError
+	if !errors.As(err, &argsErr) {
+		fmt.Fprintf(&sb, "- %v\n", err)
+		return sb.String()
+	}
+
+	for _, issue := range argsErr.Issues {
+		if issue.Path == "" {
+			fmt.Fprintf(&sb, "- %s\n", issue.Fix)
+		} else {
+			fmt.Fprintf(&sb, "- %s: %s\n", issue.Path, issue.Fix)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,114 @@
+package agg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/victhorio/opa/agg/core"
+	"github.com/victhorio/opa/agg/fake"
+)
+
+type city struct {
+	Name       string `json:"name"`
+	Population int    `json:"population"`
+}
+
+var cityFormat = core.ResponseFormat{
+	Name: "city",
+	Schema: map[string]core.ToolParam{
+		"name":       {Type: core.JSTString, Desc: "Name of the city"},
+		"population": {Type: core.JSTInteger, Desc: "Number of inhabitants"},
+	},
+}
+
+func TestExtract(t *testing.T) {
+	model := fake.NewModel(
+		core.ProviderOpenAI,
+		fake.NewTurn().Text(`{"name":"Paris",`, `"population":2100000}`).Cost(3),
+	)
+	msgs := []*core.Msg{core.NewMsgContent("user", "Capital of France?")}
+
+	got, usage, err := Extract[city](context.Background(), http.DefaultClient, model, msgs, cityFormat)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != (city{Name: "Paris", Population: 2100000}) {
+		t.Errorf("unexpected value %+v", got)
+	}
+	if usage.Cost != 3 {
+		t.Errorf("expected the usage of the request, got %+v", usage)
+	}
+
+	calls := model.Calls()
+	if len(calls) != 1 || calls[0].Cfg.ResponseFormat == nil || calls[0].Cfg.ResponseFormat.Name != "city" {
+		t.Fatalf("expected a single call with the response format, got %+v", calls)
+	}
+	if len(calls[0].Tools) != 0 {
+		t.Errorf("expected no tools, got %+v", calls[0].Tools)
+	}
+}
+
+func TestExtractRepairs(t *testing.T) {
+	model := fake.NewModel(
+		core.ProviderAnthropic,
+		fake.NewTurn().Text(`{"name":"Paris","population":"lots"}`).Cost(3),
+		fake.NewTurn().Text("```json\n{\"name\":\"Paris\",\"population\":2100000}\n```").Cost(4),
+	)
+	msgs := []*core.Msg{core.NewMsgContent("user", "Capital of France?")}
+
+	got, usage, err := Extract[city](context.Background(), http.DefaultClient, model, msgs, cityFormat)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Population != 2100000 {
+		t.Errorf("unexpected value %+v", got)
+	}
+	if usage.Cost != 7 {
+		t.Errorf("expected the usage of both requests, got %+v", usage)
+	}
+	if len(msgs) != 1 {
+		t.Errorf("expected the caller's messages to be left alone, got %d", len(msgs))
+	}
+
+	repair := model.Calls()[1].Msgs
+	assertRoles(t, repair, "user", "assistant", "user")
+	if c, _ := repair[2].AsContent(); !strings.Contains(c.Text, "- population: expected an integer") {
+		t.Errorf("expected the repair prompt to point at the issue, got %q", c.Text)
+	}
+}
+
+func TestExtractGivesUp(t *testing.T) {
+	model := fake.NewModel(
+		core.ProviderOpenAI,
+		fake.NewTurn().Text(`{"name":"Paris"}`),
+		fake.NewTurn().Text(`not json`),
+	)
+
+	_, _, err := Extract[city](context.Background(), http.DefaultClient, model, nil, cityFormat)
+
+	var extractErr *ExtractError
+	if !errors.As(err, &extractErr) {
+		t.Fatalf("expected an ExtractError, got %v", err)
+	}
+	if extractErr.Raw != "not json" {
+		t.Errorf("expected the last response in the error, got %q", extractErr.Raw)
+	}
+	if model.Remaining() != 0 {
+		t.Errorf("expected exactly one repair attempt")
+	}
+}
+
+func TestExtractStreamError(t *testing.T) {
+	model := fake.NewModel(core.ProviderOpenAI, fake.NewTurn().Error(errors.New("boom")))
+
+	_, _, err := Extract[city](context.Background(), http.DefaultClient, model, nil, cityFormat)
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("expected the stream error, got %v", err)
+	}
+	if model.Remaining() != 0 || len(model.Calls()) != 1 {
+		t.Errorf("expected stream errors not to be repaired")
+	}
+}
@@ -0,0 +1,234 @@
+// Package fake provides a scripted core.Model for deterministic tests of code built on top of agg,
+// without needing to talk to any real provider.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/victhorio/opa/agg/core"
+)
+
+// Model is a core.Model that replays one scripted Turn per call to OpenStream, in order. It
+// records everything it receives so tests can make assertions about what the model was given.
+//
+// A Model is safe for concurrent use, although turns are handed out in the order OpenStream is
+// called.
+type Model struct {
+	provider core.Provider
+	latency  time.Duration
+
+	mu    sync.Mutex
+	turns []*Turn
+	calls []Call
+}
+
+// Call records the arguments of a single call to OpenStream.
+type Call struct {
+	Msgs  []*core.Msg
+	Tools []core.Tool
+	Cfg   core.StreamCfg
+}
+
+// NewModel creates a Model that will pretend to be from provider, replaying the given turns.
+func NewModel(provider core.Provider, turns ...*Turn) *Model {
+	return &Model{
+		provider: provider,
+		turns:    turns,
+	}
+}
+
+// WithLatency makes every stream wait for d before emitting each of its events.
+func (m *Model) WithLatency(d time.Duration) *Model {
+	m.latency = d
+	return m
+}
+
+// Push appends more turns to the script.
+func (m *Model) Push(turns ...*Turn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.turns = append(m.turns, turns...)
+}
+
+// Calls returns every call made to OpenStream so far.
+func (m *Model) Calls() []Call {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Call(nil), m.calls...)
+}
+
+// Remaining returns how many scripted turns haven't been used yet.
+func (m *Model) Remaining() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.turns)
+}
+
+func (m *Model) Provider() core.Provider {
+	return m.provider
+}
+
+func (m *Model) OpenStream(
+	ctx context.Context,
+	client *http.Client,
+	msgs []*core.Msg,
+	tools []core.Tool,
+	cfg core.StreamCfg,
+) (core.ResponseStream, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// callers usually keep appending to the same slice, so we need our own copy
+	m.calls = append(m.calls, Call{
+		Msgs:  append([]*core.Msg(nil), msgs...),
+		Tools: append([]core.Tool(nil), tools...),
+		Cfg:   cfg,
+	})
+
+	if len(m.turns) == 0 {
+		return nil, fmt.Errorf("fake.Model: no scripted turn left for call %d", len(m.calls))
+	}
+
+	turn := m.turns[0]
+	m.turns = m.turns[1:]
+
+	if turn.openErr != nil {
+		return nil, turn.openErr
+	}
+
+	return &Stream{turn: turn, latency: m.latency}, nil
+}
+
+// Turn is the scripted output of a single call to OpenStream. Build it by chaining its methods,
+// which are replayed in order. Unless the turn ends with Error or Hang, the stream is finished
+// with an EvResp whose messages are everything the turn produced.
+type Turn struct {
+	events  []core.Event
+	msgs    []*core.Msg
+	usage   core.Usage
+	model   string
+	openErr error
+	hang    bool
+	failed  bool
+}
+
+// NewTurn starts a new empty turn.
+func NewTurn() *Turn {
+	return &Turn{model: "fake"}
+}
+
+// Text emits each chunk as a delta and adds the concatenation as an assistant message.
+func (t *Turn) Text(chunks ...string) *Turn {
+	for _, chunk := range chunks {
+		t.events = append(t.events, core.NewEvDelta(chunk))
+	}
+	t.msgs = append(t.msgs, core.NewMsgContent("assistant", strings.Join(chunks, "")))
+	return t
+}
+
+// Reasoning emits a reasoning delta and adds a matching reasoning message.
+func (t *Turn) Reasoning(text string) *Turn {
+	t.events = append(t.events, core.NewEvDeltaReason(text))
+	t.msgs = append(t.msgs, core.NewMsgReasoning("fake-encrypted", text))
+	return t
+}
+
+// ToolCall emits a tool call event and adds a matching tool call message.
+func (t *Turn) ToolCall(id, name, args string) *Turn {
+	t.events = append(t.events, core.NewEvToolCall(core.ToolCall{ID: id, Name: name, Arguments: args}))
+	t.msgs = append(t.msgs, core.NewMsgToolCall(id, name, args))
+	return t
+}
+
+// Usage sets the usage reported in the final response.
+func (t *Turn) Usage(u core.Usage) *Turn {
+	t.usage = u
+	return t
+}
+
+// Cost is a shorthand to only set the cost reported in the final response.
+func (t *Turn) Cost(cost int64) *Turn {
+	t.usage.Cost = cost
+	return t
+}
+
+// Event emits an arbitrary event, without affecting the final response.
+func (t *Turn) Event(ev core.Event) *Turn {
+	t.events = append(t.events, ev)
+	return t
+}
+
+// Error emits an error event and ends the stream without a response.
+func (t *Turn) Error(err error) *Turn {
+	t.events = append(t.events, core.NewEvError(err))
+	t.failed = true
+	return t
+}
+
+// FailOpen makes OpenStream return err instead of a stream for this turn.
+func (t *Turn) FailOpen(err error) *Turn {
+	t.openErr = err
+	return t
+}
+
+// Hang makes the stream block after replaying its events until the context is cancelled, never
+// emitting a response.
+func (t *Turn) Hang() *Turn {
+	t.hang = true
+	return t
+}
+
+// Response returns the response that will be emitted at the end of the turn.
+func (t *Turn) Response() core.Response {
+	return core.Response{
+		Model:    t.model,
+		Usage:    t.usage,
+		Messages: t.msgs,
+	}
+}
+
+// Stream replays a Turn, implementing core.ResponseStream.
+type Stream struct {
+	turn    *Turn
+	latency time.Duration
+}
+
+func (s *Stream) Consume(ctx context.Context, out chan<- core.Event) {
+	defer close(out)
+
+	for _, ev := range s.turn.events {
+		if !s.send(ctx, out, ev) {
+			return
+		}
+	}
+
+	switch {
+	case s.turn.failed:
+	case s.turn.hang:
+		<-ctx.Done()
+	default:
+		_ = s.send(ctx, out, core.NewEvResp(s.turn.Response()))
+	}
+}
+
+func (s *Stream) send(ctx context.Context, out chan<- core.Event, ev core.Event) bool {
+	if s.latency > 0 {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(s.latency):
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		return false
+	case out <- ev:
+		return true
+	}
+}
@@ -0,0 +1,83 @@
+package fake
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/victhorio/opa/agg/core"
+)
+
+func TestModelReplaysTurns(t *testing.T) {
+	model := NewModel(
+		core.ProviderOpenAI,
+		NewTurn().Reasoning("hmm").ToolCall("1", "fn", "{}").Cost(3),
+		NewTurn().Text("a", "b"),
+	).WithLatency(5 * time.Millisecond)
+
+	msgs := []*core.Msg{core.NewMsgContent("user", "hi")}
+	tools := []core.Tool{{Name: "fn"}}
+
+	start := time.Now()
+	events := consume(t, model, msgs, tools)
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Errorf("expected latency before each of the 3 events, took %s", elapsed)
+	}
+
+	wantTypes := []core.EventType{core.EvDeltaReason, core.EvToolCall, core.EvResp}
+	if len(events) != len(wantTypes) {
+		t.Fatalf("expected %d events, got %d", len(wantTypes), len(events))
+	}
+	for i, want := range wantTypes {
+		if events[i].Type != want {
+			t.Errorf("event %d: expected type %v, got %v", i, want, events[i].Type)
+		}
+	}
+	resp := events[2].Response
+	if len(resp.Messages) != 2 || resp.Usage.Cost != 3 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+
+	// mutating the caller's slice must not affect what was recorded
+	msgs = append(msgs, core.NewMsgContent("assistant", "x"))
+	events = consume(t, model, msgs, nil)
+	if last := events[len(events)-1]; last.Response.Messages[0].Content.Text != "ab" {
+		t.Errorf("expected concatenated text message, got %+v", last.Response.Messages[0])
+	}
+
+	calls := model.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("expected 2 recorded calls, got %d", len(calls))
+	}
+	if len(calls[0].Msgs) != 1 || len(calls[0].Tools) != 1 {
+		t.Errorf("unexpected first call %+v", calls[0])
+	}
+	if len(calls[1].Msgs) != 2 || len(calls[1].Tools) != 0 {
+		t.Errorf("unexpected second call %+v", calls[1])
+	}
+
+	if _, err := model.OpenStream(context.Background(), nil, msgs, nil, core.StreamCfg{}); err == nil {
+		t.Errorf("expected an error once the script is exhausted")
+	}
+	if model.Remaining() != 0 {
+		t.Errorf("expected no remaining turns, got %d", model.Remaining())
+	}
+}
+
+func consume(t *testing.T, model *Model, msgs []*core.Msg, tools []core.Tool) []core.Event {
+	t.Helper()
+
+	stream, err := model.OpenStream(context.Background(), nil, msgs, tools, core.StreamCfg{})
+	if err != nil {
+		t.Fatalf("unexpected error opening stream: %v", err)
+	}
+
+	out := make(chan core.Event)
+	go stream.Consume(context.Background(), out)
+
+	var events []core.Event
+	for ev := range out {
+		events = append(events, ev)
+	}
+	return events
+}
@@ -0,0 +1,145 @@
+package gemini
+
+import (
+	"strings"
+
+	"github.com/victhorio/opa/agg/core"
+)
+
+// Model holds Gemini-specific configuration for making API requests.
+type Model struct {
+	model          ModelID
+	maxTok         int
+	thinkingBudget int
+	baseURL        string
+}
+
+// NewModel creates a new Gemini Model with the given configuration. A thinkingBudget of 0 leaves
+// the amount of thinking up to the model, a negative one asks for dynamic thinking, and a positive
+// one caps the number of thinking tokens. Thought summaries are always requested.
+func NewModel(model ModelID, maxTok int, thinkingBudget int) *Model {
+	return &Model{
+		model:          model,
+		maxTok:         maxTok,
+		thinkingBudget: thinkingBudget,
+		baseURL:        defaultBaseURL,
+	}
+}
+
+// WithBaseURL makes the model send its requests to the API rooted at url (e.g.
+// "http://localhost:8080/v1beta") instead of the official Gemini one.
+func (m *Model) WithBaseURL(url string) *Model {
+	m.baseURL = strings.TrimRight(url, "/")
+	return m
+}
+
+func (m *Model) Provider() core.Provider {
+	return core.ProviderGemini
+}
+
+type ModelID string
+
+const (
+	Gemini3Pro        ModelID = "gemini-3-pro-preview"
+	Gemini25Pro       ModelID = "gemini-2.5-pro"
+	Gemini25Flash     ModelID = "gemini-2.5-flash"
+	Gemini25FlashLite ModelID = "gemini-2.5-flash-lite"
+)
+
+func init() {
+	for _, info := range models {
+		core.RegisterModel(info)
+	}
+}
+
+// Some Gemini models charge more for every token of a request once its prompt goes over 200k
+// tokens, which matters for the long-context use cases these models are good at.
+var models = []core.ModelInfo{
+	{
+		Provider:      core.ProviderGemini,
+		ID:            string(Gemini3Pro),
+		Aliases:       []string{"pro"},
+		ContextWindow: 1_048_576,
+		MaxOutput:     65_536,
+		Reasoning:     true,
+		Caching:       true,
+		Tools:         true,
+		Prices: core.Prices{
+			Input:         2000,  // $2.000 per 1M
+			Cached:        200,   // $0.200 per 1M
+			Output:        12000, // $12.000 per 1M
+			LongThreshold: 200_000,
+			Long: &core.Prices{
+				Input:  4000,  // $4.000 per 1M
+				Cached: 400,   // $0.400 per 1M
+				Output: 18000, // $18.000 per 1M
+			},
+		},
+	},
+	{
+		Provider:      core.ProviderGemini,
+		ID:            string(Gemini25Pro),
+		ContextWindow: 1_048_576,
+		MaxOutput:     65_536,
+		Reasoning:     true,
+		Caching:       true,
+		Tools:         true,
+		Prices: core.Prices{
+			Input:         1250,  // $1.250 per 1M
+			Cached:        125,   // $0.125 per 1M
+			Output:        10000, // $10.000 per 1M
+			LongThreshold: 200_000,
+			Long: &core.Prices{
+				Input:  2500,  // $2.500 per 1M
+				Cached: 250,   // $0.250 per 1M
+				Output: 15000, // $15.000 per 1M
+			},
+		},
+	},
+	{
+		Provider:      core.ProviderGemini,
+		ID:            string(Gemini25Flash),
+		Aliases:       []string{"flash"},
+		ContextWindow: 1_048_576,
+		MaxOutput:     65_536,
+		Reasoning:     true,
+		Caching:       true,
+		Tools:         true,
+		Prices: core.Prices{
+			Input:  300,  // $0.300 per 1M
+			Cached: 30,   // $0.030 per 1M
+			Output: 2500, // $2.500 per 1M
+		},
+	},
+	{
+		Provider:      core.ProviderGemini,
+		ID:            string(Gemini25FlashLite),
+		Aliases:       []string{"flash-lite"},
+		ContextWindow: 1_048_576,
+		MaxOutput:     65_536,
+		Reasoning:     true,
+		Caching:       true,
+		Tools:         true,
+		Prices: core.Prices{
+			Input:  100, // $0.100 per 1M
+			Cached: 10,  // $0.010 per 1M
+			Output: 400, // $0.400 per 1M
+		},
+	},
+}
+
+func costFromUsage(model ModelID, usage usage) int64 {
+	prices, err := core.ModelPrices(core.ProviderGemini, string(model))
+	if err != nil {
+		return 0
+	}
+
+	// Gemini reports cached tokens as a subset of the prompt tokens, and thoughts separately from
+	// the candidates even though they're billed as output.
+	regularInput := usage.Prompt - usage.Cached
+	if regularInput < 0 {
+		panic("assumption violated: more cached tokens than prompt tokens")
+	}
+
+	return prices.Cost(regularInput, usage.Cached, 0, usage.Candidates+usage.Thoughts)
+}
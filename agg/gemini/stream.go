@@ -0,0 +1,710 @@
+package gemini
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/victhorio/opa/agg/core"
+)
+
+type Stream struct {
+	stream  io.ReadCloser
+	modelID ModelID
+}
+
+// OpenStream sends a request to the streamGenerateContent endpoint and returns a ResponseStream
+// that can be consumed for events.
+func (m *Model) OpenStream(
+	ctx context.Context,
+	client *http.Client,
+	messages []*core.Msg,
+	tools []core.Tool,
+	cfg core.StreamCfg,
+) (core.ResponseStream, error) {
+	// Like Anthropic, Gemini takes the system instruction separately from the contents.
+	sysInstruction, contents := fromCoreMsgs(messages)
+
+	payload := requestBody{
+		SysInstruction: sysInstruction,
+		Contents:       contents,
+		GenCfg: genCfg{
+			MaxToks: m.maxTok,
+			Thinking: &thinkingCfg{
+				IncludeThoughts: true,
+			},
+		},
+	}
+
+	if m.thinkingBudget != 0 {
+		payload.GenCfg.Thinking.Budget = intPtr(max(m.thinkingBudget, -1))
+	}
+
+	if len(tools) > 0 {
+		payload.Tools = []toolGroup{{Functions: fromCoreTools(tools)}}
+
+		mode := "AUTO"
+		if cfg.DisableTools {
+			// unlike removing the tools, this keeps the model aware of the calls it already made
+			mode = "NONE"
+		}
+		payload.ToolCfg = &toolCfg{FunctionCalling: functionCallingCfg{Mode: mode}}
+	}
+
+	if cfg.ResponseFormat != nil {
+		// function calling can't be combined with a JSON response, so the tools have to go
+		schema := fromSchema(core.ObjectSchema(cfg.ResponseFormat.Schema))
+		schema.Description = cfg.ResponseFormat.Desc
+		payload.GenCfg.MimeType = "application/json"
+		payload.GenCfg.Schema = &schema
+		payload.Tools = nil
+		payload.ToolCfg = nil
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("gemini.OpenStream: error marshalling request body: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/models/%s:streamGenerateContent?alt=sse", m.baseURL, m.model)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, fmt.Errorf("gemini.OpenStream: error creating request: %w", err)
+	}
+
+	req.Header.Set("X-Goog-Api-Key", os.Getenv("GEMINI_API_KEY"))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("gemini.OpenStream: error sending request: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+
+		if resp.StatusCode == 400 {
+			// Let's save the payload we were sending.
+			m, err := json.MarshalIndent(payload, "", "  ")
+			if err == nil {
+				core.DumpErrorLog("gemini-400", string(m))
+			}
+		}
+
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if err != nil {
+			return nil, fmt.Errorf("gemini.OpenStream: error reading response body: %w", err)
+		}
+		return nil, fmt.Errorf("gemini.OpenStream: %w", core.NewAPIError(core.ProviderGemini, resp, body))
+	}
+
+	return &Stream{
+		stream:  resp.Body,
+		modelID: m.model,
+	}, nil
+}
+
+// Consume reads the stream of events from the Gemini API and emits them to the output channel.
+// Every event is a partial response with a few more parts, which we map as follows:
+// - text parts are emitted as output deltas right away
+// - thought parts are accumulated and emitted as a single reasoning delta once the model moves on
+// - function calls always arrive complete, so they're emitted right away
+//
+// This function closes both the stream and the channel at the end of execution.
+func (s *Stream) Consume(ctx context.Context, out chan<- core.Event) {
+	defer s.stream.Close()
+	defer close(out)
+
+	reader := bufio.NewReaderSize(s.stream, 10*1024)
+
+	// We'll store multiple `data:` entries per server side event into this buffer and collect
+	// them only when the event is over to be SSE compliant.
+	var buf bytes.Buffer
+
+	b := respBuilder{modelID: s.modelID}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			_ = sendEvent(ctx, out, core.NewEvError(err))
+			return
+		}
+		eof := err == io.EOF
+
+		line = strings.TrimRight(line, "\n\r")
+		if data, ok := strings.CutPrefix(line, "data:"); ok {
+			buf.WriteString(data)
+		}
+
+		// In SSE, empty lines mean the event is over. Gemini simply closes the connection after
+		// the last one, so the end of the stream works the same way.
+		if (line == "" || eof) && buf.Len() > 0 {
+			rawEventBytes := bytes.Clone(buf.Bytes())
+			buf.Reset()
+
+			if err := b.dispatchRawEvent(ctx, rawEventBytes, out); err != nil {
+				_ = sendEvent(ctx, out, core.NewEvError(err))
+				return
+			}
+		}
+
+		if eof {
+			break
+		}
+	}
+
+	resp, err := b.finish(ctx, out)
+	if err != nil {
+		_ = sendEvent(ctx, out, core.NewEvError(err))
+		return
+	}
+
+	_ = sendEvent(ctx, out, core.NewEvResp(resp))
+}
+
+// respBuilder incrementally builds the final response out of the streamed chunks.
+type respBuilder struct {
+	modelID      ModelID
+	resp         core.Response
+	usage        usage
+	finishReason string
+	// thinking is true while we're getting thought parts that weren't emitted yet
+	thinking bool
+}
+
+func (b *respBuilder) dispatchRawEvent(ctx context.Context, dataBytes []byte, out chan<- core.Event) error {
+	var ev chunk
+	if err := json.Unmarshal(dataBytes, &ev); err != nil {
+		return fmt.Errorf("gemini: error decoding event: %w", err)
+	}
+
+	if ev.Error != nil {
+		return fmt.Errorf("gemini: %w", &core.APIError{
+			Provider: core.ProviderGemini,
+			Status:   ev.Error.Code,
+			Type:     cmp.Or(ev.Error.Status, "error"),
+			Message:  ev.Error.Message,
+		})
+	}
+	if ev.PromptFeedback != nil && ev.PromptFeedback.BlockReason != "" {
+		return fmt.Errorf("gemini: prompt blocked: %s", ev.PromptFeedback.BlockReason)
+	}
+
+	if ev.ModelVersion != "" {
+		b.resp.Model = ev.ModelVersion
+	}
+	if ev.Usage != nil {
+		// every chunk has the usage so far, so we just keep the last one
+		b.usage = *ev.Usage
+	}
+
+	if len(ev.Candidates) == 0 {
+		return nil
+	}
+	cand := ev.Candidates[0]
+	if cand.FinishReason != "" {
+		b.finishReason = cand.FinishReason
+	}
+
+	for _, p := range cand.Content.Parts {
+		if p.Thought {
+			b.appendThought(p.Text)
+			if p.ThoughtSignature != "" {
+				b.sign(len(b.resp.Messages)-1, p.ThoughtSignature)
+			}
+			continue
+		}
+
+		// the model moved on, so the thoughts so far are complete
+		if err := b.sendThoughts(ctx, out); err != nil {
+			return err
+		}
+
+		switch {
+		case p.FunctionCall != nil:
+			call := core.ToolCall{
+				ID:        p.FunctionCall.ID,
+				Name:      p.FunctionCall.Name,
+				Arguments: string(p.FunctionCall.Args),
+			}
+			if call.ID == "" {
+				// Gemini usually doesn't identify the calls, but we need IDs to match the results
+				call.ID = generatedIDPrefix + rand.Text()
+			}
+			if call.Arguments == "" || call.Arguments == "null" {
+				call.Arguments = "{}"
+			}
+
+			b.resp.Messages = append(b.resp.Messages, core.NewMsgToolCall(call.ID, call.Name, call.Arguments))
+			if p.ThoughtSignature != "" {
+				b.sign(len(b.resp.Messages)-1, p.ThoughtSignature)
+			}
+
+			if !sendEvent(ctx, out, core.NewEvToolCall(call)) {
+				return ctx.Err()
+			}
+		default:
+			// text parts (the signature sometimes comes in a last empty one)
+			idx := b.appendText(p.Text)
+			if p.ThoughtSignature != "" {
+				b.sign(idx, p.ThoughtSignature)
+			}
+
+			if p.Text != "" && !sendEvent(ctx, out, core.NewEvDelta(p.Text)) {
+				return ctx.Err()
+			}
+		}
+	}
+
+	return nil
+}
+
+func (b *respBuilder) appendThought(text string) {
+	if !b.thinking {
+		b.resp.Messages = append(b.resp.Messages, core.NewMsgReasoning("", ""))
+		b.thinking = true
+	}
+
+	reasoning, _ := b.resp.Messages[len(b.resp.Messages)-1].AsReasoning()
+	reasoning.Text += text
+}
+
+// appendText adds text to the current content message, creating one if needed, and returns its
+// index.
+func (b *respBuilder) appendText(text string) int {
+	n := len(b.resp.Messages)
+	if n > 0 {
+		if content, ok := b.resp.Messages[n-1].AsContent(); ok {
+			content.Text += text
+			return n - 1
+		}
+	}
+
+	b.resp.Messages = append(b.resp.Messages, core.NewMsgContent("assistant", text))
+	return n
+}
+
+// sign attaches a thought signature to the message at idx. Signatures belong to the part they came
+// with, so they're stored in a reasoning message right before it, and fromCoreMsgs puts them back
+// on the part that follows.
+func (b *respBuilder) sign(idx int, signature string) {
+	if msg := b.resp.Messages[idx]; msg.Type == core.MsgTypeReasoning {
+		msg.Reasoning.Encrypted = signature
+		return
+	}
+
+	if idx > 0 {
+		if reasoning, ok := b.resp.Messages[idx-1].AsReasoning(); ok && reasoning.Encrypted == "" {
+			reasoning.Encrypted = signature
+			return
+		}
+	}
+
+	b.resp.Messages = slices.Insert(b.resp.Messages, idx, core.NewMsgReasoning(signature, ""))
+}
+
+func (b *respBuilder) sendThoughts(ctx context.Context, out chan<- core.Event) error {
+	if !b.thinking {
+		return nil
+	}
+	b.thinking = false
+
+	reasoning, _ := b.resp.Messages[len(b.resp.Messages)-1].AsReasoning()
+	if reasoning.Text == "" {
+		return nil
+	}
+
+	if !sendEvent(ctx, out, core.NewEvDeltaReason(reasoning.Text)) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (b *respBuilder) finish(ctx context.Context, out chan<- core.Event) (core.Response, error) {
+	if b.finishReason == "" {
+		return core.Response{}, fmt.Errorf("gemini: stream ended before the response was complete: %w", io.ErrUnexpectedEOF)
+	}
+
+	if err := b.sendThoughts(ctx, out); err != nil {
+		return core.Response{}, err
+	}
+
+	produced := slices.ContainsFunc(b.resp.Messages, func(m *core.Msg) bool {
+		return m.Type != core.MsgTypeReasoning
+	})
+
+	switch b.finishReason {
+	case "STOP", "MAX_TOKENS":
+	default:
+		// blocked or otherwise broken responses, which are only a problem if there's nothing else
+		if !produced {
+			return core.Response{}, fmt.Errorf("gemini: response finished with reason %s", b.finishReason)
+		}
+	}
+
+	if !produced {
+		// e.g. we ran out of tokens while thinking, but callers expect something to show
+		b.resp.Messages = append(b.resp.Messages, core.NewMsgContent("assistant", ""))
+	}
+
+	u := b.usage
+	b.resp.Usage = core.Usage{
+		// Gemini reports cached tokens as a subset of the prompt tokens.
+		Input:     u.Prompt - u.Cached,
+		Cached:    u.Cached,
+		Output:    u.Candidates + u.Thoughts,
+		Reasoning: u.Thoughts,
+		Total:     u.Prompt + u.Candidates + u.Thoughts,
+		Cost:      costFromUsage(b.modelID, u),
+	}
+
+	return b.resp, nil
+}
+
+// sendEvent sends an event to the output channel while avoiding blocking if context is done.
+// Returns true if the event was sent, false if the context is done.
+func sendEvent(ctx context.Context, out chan<- core.Event, ev core.Event) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case out <- ev:
+		return true
+	}
+}
+
+// fromCoreMsgs converts the history into Gemini contents. Consecutive messages from the same role
+// are merged into a single content, which is how Gemini expects parallel function calls and their
+// responses. Thought summaries are never sent back, but their signatures are attached to the part
+// that follows them, as the API requires for function calling with thinking.
+func fromCoreMsgs(coreMsgs []*core.Msg) (*content, []content) {
+	var sysParts []part
+	contents := make([]content, 0, len(coreMsgs))
+
+	appendPart := func(role string, p part) {
+		if n := len(contents); n > 0 && contents[n-1].Role == role {
+			contents[n-1].Parts = append(contents[n-1].Parts, p)
+			return
+		}
+		contents = append(contents, content{Role: role, Parts: []part{p}})
+	}
+
+	// function responses need the name of the function, which we only have in the calls
+	callNames := make(map[string]string)
+	var signature string
+
+	// parts returned by tools can't go inside a functionResponse, so they're sent right after the
+	// whole group of responses, as the API wants function responses to follow their calls
+	var pendingParts []part
+	flushParts := func() {
+		for _, p := range pendingParts {
+			appendPart(roleUser, p)
+		}
+		pendingParts = nil
+	}
+
+	for _, coreMsg := range coreMsgs {
+		if coreMsg.Type != core.MsgTypeToolResult {
+			flushParts()
+		}
+
+		switch coreMsg.Type {
+		case core.MsgTypeReasoning:
+			reasoning, _ := coreMsg.AsReasoning()
+			signature = reasoning.Encrypted
+		case core.MsgTypeContent:
+			c, _ := coreMsg.AsContent()
+			switch c.Role {
+			case "system":
+				sysParts = append(sysParts, part{Text: c.Text})
+			case "assistant":
+				appendPart(roleModel, part{Text: c.Text, ThoughtSignature: signature})
+				signature = ""
+			default:
+				if c.Text != "" || len(c.Parts) == 0 {
+					appendPart(roleUser, part{Text: c.Text})
+				}
+				for _, p := range c.Parts {
+					appendPart(roleUser, fromCorePart(p))
+				}
+				signature = ""
+			}
+		case core.MsgTypeToolCall:
+			tc, _ := coreMsg.AsToolCall()
+			callNames[tc.ID] = tc.Name
+
+			args := json.RawMessage(tc.Arguments)
+			if !json.Valid(args) {
+				args = json.RawMessage("{}")
+			}
+
+			appendPart(roleModel, part{
+				FunctionCall: &functionCall{
+					ID:   apiID(tc.ID),
+					Name: tc.Name,
+					Args: args,
+				},
+				ThoughtSignature: signature,
+			})
+			signature = ""
+		case core.MsgTypeToolResult:
+			tr, _ := coreMsg.AsToolResult()
+			appendPart(roleUser, part{
+				FunctionResponse: &functionResponse{
+					ID:       apiID(tr.ID),
+					Name:     callNames[tr.ID],
+					Response: map[string]string{"result": tr.Result},
+				},
+			})
+			for _, p := range tr.Parts {
+				pendingParts = append(pendingParts, fromCorePart(p))
+			}
+		}
+	}
+	flushParts()
+
+	var sys *content
+	if len(sysParts) > 0 {
+		sys = &content{Parts: sysParts}
+	}
+
+	return sys, contents
+}
+
+// apiID returns the ID to send back to the API for a call, which is empty if we generated it.
+func apiID(id string) string {
+	if strings.HasPrefix(id, generatedIDPrefix) {
+		return ""
+	}
+	return id
+}
+
+// requestBody is the body of the request to the streamGenerateContent endpoint.
+type requestBody struct {
+	SysInstruction *content    `json:"systemInstruction,omitempty"`
+	Contents       []content   `json:"contents"`
+	Tools          []toolGroup `json:"tools,omitempty"`
+	ToolCfg        *toolCfg    `json:"toolConfig,omitempty"`
+	GenCfg         genCfg      `json:"generationConfig"`
+}
+
+type genCfg struct {
+	MaxToks  int          `json:"maxOutputTokens,omitempty"`
+	Thinking *thinkingCfg `json:"thinkingConfig,omitempty"`
+	// only set along with a response format
+	MimeType string  `json:"responseMimeType,omitempty"`
+	Schema   *schema `json:"responseSchema,omitempty"`
+}
+
+type thinkingCfg struct {
+	IncludeThoughts bool `json:"includeThoughts"`
+	// -1 means dynamic thinking, nil leaves it to the model's default
+	Budget *int `json:"thinkingBudget,omitempty"`
+}
+
+type toolCfg struct {
+	FunctionCalling functionCallingCfg `json:"functionCallingConfig"`
+}
+
+type functionCallingCfg struct {
+	Mode string `json:"mode"` // "AUTO", "ANY" or "NONE"
+}
+
+type content struct {
+	Role  string `json:"role,omitempty"` // "user" or "model"
+	Parts []part `json:"parts"`
+}
+
+type part struct {
+	Text             string            `json:"text,omitempty"`
+	Thought          bool              `json:"thought,omitempty"`
+	ThoughtSignature string            `json:"thoughtSignature,omitempty"`
+	FunctionCall     *functionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *functionResponse `json:"functionResponse,omitempty"`
+	InlineData       *inlineData       `json:"inlineData,omitempty"`
+}
+
+type inlineData struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+// fromCorePart converts an image, document or text part into a Gemini part.
+func fromCorePart(p core.Part) part {
+	if p.Type == core.PartText {
+		return part{Text: p.Text}
+	}
+	return part{InlineData: &inlineData{MimeType: p.MediaType, Data: p.Base64()}}
+}
+
+type functionCall struct {
+	ID   string          `json:"id,omitempty"`
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+type functionResponse struct {
+	ID       string            `json:"id,omitempty"`
+	Name     string            `json:"name"`
+	Response map[string]string `json:"response"`
+}
+
+type toolGroup struct {
+	Functions []functionDecl `json:"functionDeclarations"`
+}
+
+type functionDecl struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description,omitempty"`
+	Parameters  *schema `json:"parameters,omitempty"`
+}
+
+// schema is Gemini's (OpenAPI based) representation of a tool's input and its nested parameters.
+type schema struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+	Nullable    bool   `json:"nullable,omitempty"`
+	Format      string `json:"format,omitempty"`
+
+	// structural
+	Items            *schema           `json:"items,omitempty"`
+	Properties       map[string]schema `json:"properties,omitempty"`
+	Required         []string          `json:"required,omitempty"`
+	PropertyOrdering []string          `json:"propertyOrdering,omitempty"`
+
+	// validation / constraints
+	Enum     []string `json:"enum,omitempty"`
+	Default  any      `json:"default,omitempty"`
+	Minimum  *float64 `json:"minimum,omitempty"`
+	Maximum  *float64 `json:"maximum,omitempty"`
+	MinItems *int     `json:"minItems,omitempty"`
+	MaxItems *int     `json:"maxItems,omitempty"`
+}
+
+func fromCoreTools(tools []core.Tool) []functionDecl {
+	r := make([]functionDecl, 0, len(tools))
+	for _, tool := range tools {
+		decl := functionDecl{
+			Name:        tool.Name,
+			Description: tool.Desc,
+		}
+
+		// Gemini rejects objects without properties, so tools without parameters can't have a
+		// schema at all.
+		if len(tool.Params) > 0 {
+			params := fromSchema(tool.JSONSchema())
+			decl.Parameters = &params
+		}
+
+		r = append(r, decl)
+	}
+	return r
+}
+
+// fromSchema translates a plain JSON Schema into Gemini's. Optional parameters are left out of
+// `required` like for Anthropic, with the difference that null is a flag instead of a type and
+// that there's no way to disallow additional properties.
+func fromSchema(s core.Schema) schema {
+	r := schema{
+		Description: s.Description,
+		Required:    s.Required,
+		Default:     s.Default,
+		Minimum:     s.Minimum,
+		Maximum:     s.Maximum,
+		MinItems:    s.MinItems,
+		MaxItems:    s.MaxItems,
+	}
+
+	for _, t := range s.Type {
+		if t == core.JSTNull {
+			r.Nullable = true
+			continue
+		}
+		r.Type = schemaType(t)
+	}
+
+	if s.Items != nil {
+		items := fromSchema(*s.Items)
+		r.Items = &items
+	}
+
+	if len(s.Properties) > 0 {
+		names := slices.Sorted(maps.Keys(s.Properties))
+		r.Properties = make(map[string]schema, len(names))
+		for _, name := range names {
+			r.Properties[name] = fromSchema(s.Properties[name])
+		}
+		// without it Gemini orders properties alphabetically anyway, but we're explicit so that
+		// the order is stable regardless
+		r.PropertyOrdering = names
+	}
+
+	for _, v := range s.Enum {
+		// null is already covered by the flag
+		if str, ok := v.(string); ok {
+			r.Enum = append(r.Enum, str)
+		}
+	}
+	if len(r.Enum) > 0 {
+		r.Format = "enum"
+	}
+
+	return r
+}
+
+// schemaType converts a JSON Schema type into the OpenAPI type names used by Gemini.
+func schemaType(t core.JSType) string {
+	return strings.ToUpper(string(t))
+}
+
+// chunk is a single streamed GenerateContentResponse.
+type chunk struct {
+	Candidates []struct {
+		Content struct {
+			Parts []part `json:"parts"`
+		} `json:"content"`
+		FinishReason string `json:"finishReason"`
+	} `json:"candidates"`
+	PromptFeedback *struct {
+		BlockReason string `json:"blockReason"`
+	} `json:"promptFeedback"`
+	Usage        *usage `json:"usageMetadata"`
+	ModelVersion string `json:"modelVersion"`
+	Error        *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	} `json:"error"`
+}
+
+type usage struct {
+	Prompt     int64 `json:"promptTokenCount"`
+	Cached     int64 `json:"cachedContentTokenCount"`
+	Candidates int64 `json:"candidatesTokenCount"`
+	Thoughts   int64 `json:"thoughtsTokenCount"`
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+const (
+	defaultBaseURL = "https://generativelanguage.googleapis.com/v1beta"
+
+	roleUser  = "user"
+	roleModel = "model"
+
+	// generatedIDPrefix marks the IDs we make up for calls the API didn't identify, so that we
+	// don't send them back.
+	generatedIDPrefix = "gemini-call-"
+)
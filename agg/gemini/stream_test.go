@@ -0,0 +1,469 @@
+package gemini
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/victhorio/opa/agg/core"
+)
+
+var getWeatherTool = core.Tool{
+	Name: "getWeather",
+	Desc: "Get the weather for a given location",
+	Params: map[string]core.ToolParam{
+		"location": {
+			Type: core.JSTString,
+			Desc: "The location to get the weather for",
+		},
+		"units": {
+			Type: core.JSTString,
+			Desc: "The units to use for the weather",
+			Enum: []string{"Celsius", "Fahrenheit"},
+		},
+	},
+}
+
+// TestUnknownModel makes sure models without prices in the registry are refused before anything
+// is sent, instead of their responses quietly costing nothing.
+func TestUnknownModel(t *testing.T) {
+	t.Parallel()
+
+	// models the registry doesn't list yet still work, their usage just can't be priced
+	model := serve(t, NewModel("gemini-0-unknown", 1024, 0), func(*http.Request, map[string]any) []string {
+		return []string{
+			`{"candidates":[{"content":{"role":"model","parts":[{"text":"Hi!"}]},"finishReason":"STOP"}],` +
+				`"usageMetadata":{"promptTokenCount":10,"candidatesTokenCount":2}}`,
+		}
+	})
+
+	msgs := []*core.Msg{core.NewMsgContent("user", "hi")}
+	r, _ := consumeStream(t, model, msgs, nil, core.StreamCfg{})
+	if r.Usage.Input != 10 || r.Usage.Output != 2 || r.Usage.Cost != 0 {
+		t.Errorf("expected the usage to be recorded at no cost, got %+v", r.Usage)
+	}
+}
+
+// TestStreamText checks a response with thoughts and text against a stand-in server.
+func TestStreamText(t *testing.T) {
+	t.Parallel()
+
+	var got *http.Request
+	var body map[string]any
+	model := serve(t, NewModel(Gemini25Flash, 2048, 1024), func(r *http.Request, b map[string]any) []string {
+		got, body = r, b
+		return []string{
+			`{"candidates":[{"content":{"role":"model","parts":[{"text":"The user wants ","thought":true}]}}],"modelVersion":"gemini-2.5-flash"}`,
+			`{"candidates":[{"content":{"role":"model","parts":[{"text":"a capital.","thought":true}]}}],"modelVersion":"gemini-2.5-flash"}`,
+			`{"candidates":[{"content":{"role":"model","parts":[{"text":"The capital"}]}}],"modelVersion":"gemini-2.5-flash"}`,
+			`{"candidates":[{"content":{"role":"model","parts":[{"text":" is Paris."}]},"finishReason":"STOP"}],` +
+				`"usageMetadata":{"promptTokenCount":1200,"cachedContentTokenCount":1024,"candidatesTokenCount":8,"thoughtsTokenCount":40,"totalTokenCount":1248},` +
+				`"modelVersion":"gemini-2.5-flash"}`,
+		}
+	})
+
+	msgs := []*core.Msg{
+		core.NewMsgContent("system", "Be brief."),
+		core.NewMsgContent("user", "What is the capital of France?"),
+	}
+	r, events := consumeStream(t, model, msgs, nil, core.StreamCfg{})
+
+	if got.URL.Path != "/models/gemini-2.5-flash:streamGenerateContent" || got.URL.Query().Get("alt") != "sse" {
+		t.Errorf("unexpected request to %s", got.URL)
+	}
+	sys, _ := json.Marshal(body["systemInstruction"])
+	if string(sys) != `{"parts":[{"text":"Be brief."}]}` {
+		t.Errorf("unexpected system instruction %s", sys)
+	}
+	genCfg, _ := json.Marshal(body["generationConfig"])
+	if string(genCfg) != `{"maxOutputTokens":2048,"thinkingConfig":{"includeThoughts":true,"thinkingBudget":1024}}` {
+		t.Errorf("unexpected generation config %s", genCfg)
+	}
+	if _, ok := body["tools"]; ok {
+		t.Errorf("expected no tools in the request, got %v", body["tools"])
+	}
+
+	// the thoughts are emitted once complete, before the text
+	if events[0].Type != core.EvDeltaReason || events[0].Delta != "The user wants a capital." {
+		t.Errorf("expected the complete thoughts first, got %+v", events[0])
+	}
+	deltas := eventsOfType(events, core.EvDelta)
+	if len(deltas) != 2 || deltas[0].Delta != "The capital" || deltas[1].Delta != " is Paris." {
+		t.Errorf("unexpected deltas %+v", deltas)
+	}
+
+	if r.Model != "gemini-2.5-flash" {
+		t.Errorf("expected the model version, got %q", r.Model)
+	}
+	if len(r.Messages) != 2 || r.Messages[0].Type != core.MsgTypeReasoning {
+		t.Fatalf("expected reasoning and content messages, got %+v", r.Messages)
+	}
+	if c, _ := r.Messages[1].AsContent(); c.Role != "assistant" || c.Text != "The capital is Paris." {
+		t.Errorf("unexpected content %+v", c)
+	}
+
+	// the cached tokens are reported as part of the prompt ones, and the thoughts apart from the
+	// output ones
+	want := core.Usage{Input: 176, Cached: 1024, Output: 48, Reasoning: 40, Total: 1248, Cost: 176*300 + 1024*30 + 48*2500}
+	if r.Usage != want {
+		t.Errorf("expected usage %+v, got %+v", want, r.Usage)
+	}
+}
+
+// TestStreamLongPrompt checks that prompts over the threshold are priced at the long rates.
+func TestStreamLongPrompt(t *testing.T) {
+	t.Parallel()
+
+	model := serve(t, NewModel(Gemini25Pro, 2048, 0), func(*http.Request, map[string]any) []string {
+		return []string{
+			`{"candidates":[{"content":{"parts":[{"text":"Done."}]},"finishReason":"STOP"}],` +
+				`"usageMetadata":{"promptTokenCount":250000,"candidatesTokenCount":10,"thoughtsTokenCount":90}}`,
+		}
+	})
+
+	r, _ := consumeStream(t, model, []*core.Msg{core.NewMsgContent("user", "Summarize this.")}, nil, core.StreamCfg{})
+
+	want := core.Usage{Input: 250000, Output: 100, Reasoning: 90, Total: 250100, Cost: 250000*2500 + 100*15000}
+	if r.Usage != want {
+		t.Errorf("expected usage %+v, got %+v", want, r.Usage)
+	}
+}
+
+// TestStreamMultiTurn checks how the history is sent back: the signature of the previous answer
+// goes back on its part, and the thought summaries themselves are left out.
+func TestStreamMultiTurn(t *testing.T) {
+	t.Parallel()
+
+	var body map[string]any
+	model := serve(t, NewModel(Gemini25Flash, 2048, 0), func(_ *http.Request, b map[string]any) []string {
+		body = b
+		return []string{
+			`{"candidates":[{"content":{"parts":[{"text":"Your name is Victhor."}]},"finishReason":"STOP"}]}`,
+		}
+	})
+
+	msgs := []*core.Msg{
+		core.NewMsgContent("user", "Hi! My name is Victhor."),
+		core.NewMsgReasoning("sig-1", "The user introduced themselves."),
+		core.NewMsgContent("assistant", "Nice to meet you, Victhor!"),
+		core.NewMsgContent("user", "Can you repeat my name to me?"),
+	}
+	r, _ := consumeStream(t, model, msgs, nil, core.StreamCfg{})
+
+	contents, _ := json.Marshal(body["contents"])
+	want := `[` +
+		`{"parts":[{"text":"Hi! My name is Victhor."}],"role":"user"},` +
+		`{"parts":[{"text":"Nice to meet you, Victhor!","thoughtSignature":"sig-1"}],"role":"model"},` +
+		`{"parts":[{"text":"Can you repeat my name to me?"}],"role":"user"}` +
+		`]`
+	if string(contents) != want {
+		t.Errorf("unexpected contents:\n got: %s\nwant: %s", contents, want)
+	}
+
+	if c, _ := r.Messages[0].AsContent(); c.Text != "Your name is Victhor." {
+		t.Errorf("unexpected answer %+v", c)
+	}
+	if r.Usage != (core.Usage{}) {
+		t.Errorf("expected empty usage when the server doesn't report it, got %+v", r.Usage)
+	}
+}
+
+// TestStreamToolLoop goes through a tool call loop with parallel calls against a stand-in server,
+// checking that the thought signature goes back with the call it came with, and that the calls
+// and their responses are grouped the way Gemini expects.
+func TestStreamToolLoop(t *testing.T) {
+	t.Parallel()
+
+	var bodies []map[string]any
+	model := serve(t, NewModel(Gemini25Flash, 2048, -1), func(_ *http.Request, b map[string]any) []string {
+		bodies = append(bodies, b)
+		if len(bodies) == 1 {
+			return []string{
+				`{"candidates":[{"content":{"role":"model","parts":[{"text":"I need both forecasts.","thought":true}]}}]}`,
+				`{"candidates":[{"content":{"role":"model","parts":[` +
+					`{"functionCall":{"name":"getWeather","args":{"location":"Tokyo","units":"Celsius"}},"thoughtSignature":"sig-1"},` +
+					`{"functionCall":{"id":"call_b","name":"getWeather","args":{"location":"Lisbon","units":"Celsius"}}}` +
+					`]},"finishReason":"STOP"}],` +
+					`"usageMetadata":{"promptTokenCount":120,"candidatesTokenCount":30,"thoughtsTokenCount":50}}`,
+			}
+		}
+		return []string{
+			`{"candidates":[{"content":{"role":"model","parts":[{"text":"Tokyo is warmer."}]}}]}`,
+			`{"candidates":[{"content":{"role":"model","parts":[{"text":"","thoughtSignature":"sig-2"}]},"finishReason":"STOP"}],` +
+				`"usageMetadata":{"promptTokenCount":200,"candidatesTokenCount":5}}`,
+		}
+	})
+
+	msgs := []*core.Msg{core.NewMsgContent("user", "Is it warmer in Tokyo or in Lisbon right now?")}
+	r, events := consumeStream(t, model, msgs, []core.Tool{getWeatherTool}, core.StreamCfg{})
+
+	tools, _ := json.Marshal(bodies[0]["tools"])
+	wantTools := `[{"functionDeclarations":[{"description":"Get the weather for a given location","name":"getWeather",` +
+		`"parameters":{"properties":{"location":{"description":"The location to get the weather for","type":"STRING"},` +
+		`"units":{"description":"The units to use for the weather","enum":["Celsius","Fahrenheit"],"format":"enum","type":"STRING"}},` +
+		`"propertyOrdering":["location","units"],"required":["location","units"],"type":"OBJECT"}}]}]`
+	if string(tools) != wantTools {
+		t.Errorf("unexpected tools:\n got: %s\nwant: %s", tools, wantTools)
+	}
+	toolCfg, _ := json.Marshal(bodies[0]["toolConfig"])
+	if string(toolCfg) != `{"functionCallingConfig":{"mode":"AUTO"}}` {
+		t.Errorf("unexpected tool config %s", toolCfg)
+	}
+
+	if reasoning := eventsOfType(events, core.EvDeltaReason); len(reasoning) != 1 || reasoning[0].Delta != "I need both forecasts." {
+		t.Errorf("expected the complete thoughts once, got %+v", reasoning)
+	}
+	calls := eventsOfType(events, core.EvToolCall)
+	if len(calls) != 2 {
+		t.Fatalf("expected two parallel tool calls, got %d", len(calls))
+	}
+	first := calls[0].Call
+	if !strings.HasPrefix(first.ID, generatedIDPrefix) || first.Arguments != `{"location":"Tokyo","units":"Celsius"}` {
+		t.Errorf("expected a generated ID for the first call, got %+v", first)
+	}
+	if c := calls[1].Call; c.ID != "call_b" || c.Arguments != `{"location":"Lisbon","units":"Celsius"}` {
+		t.Errorf("unexpected second call %+v", c)
+	}
+
+	// the signature of the first call is kept with the thoughts right before it
+	if len(r.Messages) != 3 {
+		t.Fatalf("expected reasoning and two calls, got %+v", r.Messages)
+	}
+	if reasoning, ok := r.Messages[0].AsReasoning(); !ok || reasoning.Encrypted != "sig-1" || reasoning.Text != "I need both forecasts." {
+		t.Errorf("expected the signed thoughts first, got %+v", r.Messages[0])
+	}
+	want := core.Usage{Input: 120, Output: 80, Reasoning: 50, Total: 200, Cost: 120*300 + 80*2500}
+	if r.Usage != want {
+		t.Errorf("expected usage %+v, got %+v", want, r.Usage)
+	}
+
+	msgs = append(msgs, r.Messages...)
+	msgs = append(
+		msgs,
+		core.NewMsgToolResult(first.ID, "25C, sunny"),
+		core.NewMsgToolResult("call_b", "17C, light rain"),
+	)
+	r2, _ := consumeStream(t, model, msgs, []core.Tool{getWeatherTool}, core.StreamCfg{})
+
+	// the generated ID isn't sent back, while the one from the API is
+	contents, _ := json.Marshal(bodies[1]["contents"])
+	wantContents := `[` +
+		`{"parts":[{"text":"Is it warmer in Tokyo or in Lisbon right now?"}],"role":"user"},` +
+		`{"parts":[` +
+		`{"functionCall":{"args":{"location":"Tokyo","units":"Celsius"},"name":"getWeather"},"thoughtSignature":"sig-1"},` +
+		`{"functionCall":{"args":{"location":"Lisbon","units":"Celsius"},"id":"call_b","name":"getWeather"}}],"role":"model"},` +
+		`{"parts":[` +
+		`{"functionResponse":{"name":"getWeather","response":{"result":"25C, sunny"}}},` +
+		`{"functionResponse":{"id":"call_b","name":"getWeather","response":{"result":"17C, light rain"}}}],"role":"user"}` +
+		`]`
+	if string(contents) != wantContents {
+		t.Errorf("unexpected contents:\n got: %s\nwant: %s", contents, wantContents)
+	}
+
+	// the signature in the last empty part goes with the text before it
+	if len(r2.Messages) != 2 {
+		t.Fatalf("expected signature and content messages, got %+v", r2.Messages)
+	}
+	if reasoning, ok := r2.Messages[0].AsReasoning(); !ok || reasoning.Encrypted != "sig-2" {
+		t.Errorf("expected the signature before the answer, got %+v", r2.Messages[0])
+	}
+	if c, _ := r2.Messages[1].AsContent(); c.Text != "Tokyo is warmer." {
+		t.Errorf("unexpected answer %+v", c)
+	}
+	want = core.Usage{Input: 200, Output: 5, Total: 205, Cost: 200*300 + 5*2500}
+	if r2.Usage != want {
+		t.Errorf("expected usage %+v, got %+v", want, r2.Usage)
+	}
+}
+
+// TestStreamDisableTools checks that disabling tools keeps their declarations, so that the calls
+// already in the history still make sense to the model, and only forbids new calls.
+func TestStreamDisableTools(t *testing.T) {
+	t.Parallel()
+
+	var body map[string]any
+	model := serve(t, NewModel(Gemini25Flash, 2048, 0), func(_ *http.Request, b map[string]any) []string {
+		body = b
+		return []string{
+			`{"candidates":[{"content":{"role":"model","parts":[{"text":"It's 25°C and sunny in Tokyo."}]},"finishReason":"STOP"}]}`,
+		}
+	})
+
+	msgs := []*core.Msg{
+		core.NewMsgContent("user", "What is the weather in Tokyo? In Celsius"),
+		core.NewMsgToolCall("gemini-call-1", "getWeather", `{"location":"Tokyo","units":"Celsius"}`),
+		core.NewMsgToolResult("gemini-call-1", `{"temperature": 25, "description": "Sunny"}`),
+	}
+	r, events := consumeStream(t, model, msgs, []core.Tool{getWeatherTool}, core.StreamCfg{DisableTools: true})
+
+	if tools, ok := body["tools"].([]any); !ok || len(tools) != 1 {
+		t.Errorf("expected the tools to still be declared, got %v", body["tools"])
+	}
+	toolCfg, _ := json.Marshal(body["toolConfig"])
+	if string(toolCfg) != `{"functionCallingConfig":{"mode":"NONE"}}` {
+		t.Errorf("unexpected tool config %s", toolCfg)
+	}
+
+	if n := len(eventsOfType(events, core.EvToolCall)); n != 0 {
+		t.Errorf("expected no tool calls, got %d", n)
+	}
+	if c, _ := r.Messages[len(r.Messages)-1].AsContent(); c.Text != "It's 25°C and sunny in Tokyo." {
+		t.Errorf("unexpected answer %+v", c)
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	t.Parallel()
+
+	t.Run("error chunk", func(t *testing.T) {
+		model := serve(t, NewModel(Gemini25Flash, 2048, 0), func(*http.Request, map[string]any) []string {
+			return []string{
+				`{"candidates":[{"content":{"parts":[{"text":"Hel"}]}}]}`,
+				`{"error":{"code":503,"message":"The model is overloaded.","status":"UNAVAILABLE"}}`,
+			}
+		})
+
+		err := streamError(t, model)
+		var apiErr *core.APIError
+		if !errors.As(err, &apiErr) || apiErr.Status != 503 || apiErr.Type != "UNAVAILABLE" {
+			t.Fatalf("expected an APIError from the chunk, got %v", err)
+		}
+	})
+
+	t.Run("truncated stream", func(t *testing.T) {
+		model := serve(t, NewModel(Gemini25Flash, 2048, 0), func(*http.Request, map[string]any) []string {
+			return []string{`{"candidates":[{"content":{"parts":[{"text":"Hel"}]}}]}`}
+		})
+
+		if err := streamError(t, model); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+		}
+	})
+
+	t.Run("blocked response", func(t *testing.T) {
+		model := serve(t, NewModel(Gemini25Flash, 2048, 0), func(*http.Request, map[string]any) []string {
+			return []string{`{"candidates":[{"content":{"parts":[]},"finishReason":"SAFETY"}]}`}
+		})
+
+		if err := streamError(t, model); err == nil || !strings.Contains(err.Error(), "SAFETY") {
+			t.Fatalf("expected an error mentioning the finish reason, got %v", err)
+		}
+	})
+}
+
+// serve starts a stand-in server for the streamGenerateContent endpoint, answering each request
+// with the chunks returned by handler, and points the model to it.
+func serve(t *testing.T, model *Model, handler func(*http.Request, map[string]any) []string) *Model {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("error decoding request: %v", err)
+			return
+		}
+
+		// like the real API, events are separated by CRLFs and the connection is simply closed
+		// after the last one
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, c := range handler(r, body) {
+			fmt.Fprintf(w, "data: %s\r\n\r\n", c)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return model.WithBaseURL(srv.URL)
+}
+
+// consumeStream opens a stream against the model and collects every event of it.
+func consumeStream(
+	t *testing.T,
+	model *Model,
+	msgs []*core.Msg,
+	tools []core.Tool,
+	cfg core.StreamCfg,
+) (core.Response, []core.Event) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := model.OpenStream(ctx, http.DefaultClient, msgs, tools, cfg)
+	if err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+	return consume(ctx, t, stream)
+}
+
+// streamError consumes a stream expected to fail, returning its first error. Like the agent, it
+// stops listening once it gets the error.
+func streamError(t *testing.T, model *Model) error {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	msgs := []*core.Msg{core.NewMsgContent("user", "hi")}
+	stream, err := model.OpenStream(ctx, http.DefaultClient, msgs, nil, core.StreamCfg{})
+	if err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+
+	ch := make(chan core.Event, 1)
+	go stream.Consume(ctx, ch)
+
+	for ev := range ch {
+		switch ev.Type {
+		case core.EvError:
+			return ev.Err
+		case core.EvResp:
+			t.Fatalf("expected no response, got %+v", ev.Response)
+		}
+	}
+
+	t.Fatalf("expected an error event")
+	return nil
+}
+
+// consume collects every event of a stream, failing the test on error events.
+func consume(ctx context.Context, t *testing.T, stream core.ResponseStream) (core.Response, []core.Event) {
+	t.Helper()
+
+	ch := make(chan core.Event, 1)
+	go stream.Consume(ctx, ch)
+
+	var r core.Response
+	var events []core.Event
+	for event := range ch {
+		switch event.Type {
+		case core.EvError:
+			t.Fatalf("Unexpected error event: %v", event.Err)
+		case core.EvResp:
+			r = event.Response
+		}
+		events = append(events, event)
+	}
+
+	if r.Messages == nil {
+		t.Fatalf("No messages in response")
+	}
+
+	return r, events
+}
+
+func eventsOfType(events []core.Event, typ core.EventType) []core.Event {
+	var r []core.Event
+	for _, ev := range events {
+		if ev.Type == typ {
+			r = append(r, ev)
+		}
+	}
+	return r
+}
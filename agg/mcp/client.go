@@ -0,0 +1,287 @@
+package mcp
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"github.com/victhorio/opa/agg"
+	"github.com/victhorio/opa/agg/core"
+)
+
+// DefaultCallTimeout bounds the tool calls to servers that don't set a timeout of their own.
+const DefaultCallTimeout = 60 * time.Second
+
+// ServerConfig describes an MCP server to connect to, which is either launched as a subprocess
+// speaking over stdio (Command) or reached over HTTP (URL).
+type ServerConfig struct {
+	// Name identifies the server in logs and errors.
+	Name string `yaml:"name"`
+
+	Command string            `yaml:"command"`
+	Args    []string          `yaml:"args"`
+	Env     map[string]string `yaml:"env"` // added to the environment of opa itself
+
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"` // e.g. for an Authorization header
+
+	// Timeout bounds every tool call, defaults to DefaultCallTimeout.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// LoadConfig reads the servers listed under mcp_servers in the YAML file at path, e.g.:
+//
+//	mcp_servers:
+//	  - name: github
+//	    command: github-mcp-server
+//	    args: [stdio]
+//	    env: {GITHUB_PERSONAL_ACCESS_TOKEN: ...}
+//	  - name: calendar
+//	    url: http://localhost:8931/mcp
+//	    timeout: 10s
+//
+// Other keys are ignored, so the servers can live in a file with other settings.
+func LoadConfig(path string) ([]ServerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("mcp.LoadConfig: %w", err)
+	}
+
+	var file struct {
+		Servers []ServerConfig `yaml:"mcp_servers"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("mcp.LoadConfig: error parsing %s: %w", path, err)
+	}
+
+	for i, cfg := range file.Servers {
+		if (cfg.Command == "") == (cfg.URL == "") {
+			return nil, fmt.Errorf("mcp.LoadConfig: mcp_servers[%d]: exactly one of command and url must be set", i)
+		}
+		if cfg.Name == "" {
+			file.Servers[i].Name = cmp.Or(cfg.Command, cfg.URL)
+		}
+	}
+
+	return file.Servers, nil
+}
+
+// Client is a connection to an MCP server, whose tools can be given to an agg.Agent. It must be
+// closed once done, which also stops the server if it was launched by Dial.
+type Client struct {
+	cfg    ServerConfig
+	t      transport
+	nextID atomic.Int64
+}
+
+// Dial connects to the server, launching it if it's a command, and goes through the MCP
+// initialization. The client is only used for servers reached over HTTP, with nil meaning
+// http.DefaultClient.
+func Dial(ctx context.Context, client *http.Client, cfg ServerConfig) (*Client, error) {
+	c := &Client{cfg: cfg}
+	if c.cfg.Timeout == 0 {
+		c.cfg.Timeout = DefaultCallTimeout
+	}
+
+	switch {
+	case cfg.Command != "" && cfg.URL == "":
+		t, err := newStdioTransport(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("mcp.Dial: %s: %w", cfg.Name, err)
+		}
+		c.t = t
+	case cfg.URL != "" && cfg.Command == "":
+		c.t = newHTTPTransport(client, cfg)
+	default:
+		return nil, fmt.Errorf("mcp.Dial: %s: exactly one of command and url must be set", cfg.Name)
+	}
+
+	if err := c.initialize(ctx); err != nil {
+		_ = c.t.close()
+		return nil, fmt.Errorf("mcp.Dial: %s: %w", cfg.Name, err)
+	}
+
+	return c, nil
+}
+
+func (c *Client) initialize(ctx context.Context) error {
+	params := initializeParams{
+		ProtocolVersion: ProtocolVersion,
+		Capabilities:    json.RawMessage("{}"),
+		ClientInfo:      implementation{Name: "agg", Version: "1.0"},
+	}
+
+	var result initializeResult
+	if err := c.request(ctx, "initialize", params, &result); err != nil {
+		return fmt.Errorf("error initializing: %w", err)
+	}
+	if result.ProtocolVersion != ProtocolVersion {
+		// older revisions differ in things we don't use, so we give them a chance
+		log.Printf("mcp: %s speaks protocol version %s, we speak %s", c.cfg.Name, result.ProtocolVersion, ProtocolVersion)
+	}
+	log.Printf("mcp: connected to %s (%s %s)", c.cfg.Name, result.ServerInfo.Name, result.ServerInfo.Version)
+
+	if err := c.t.notify(ctx, message{Method: "notifications/initialized"}); err != nil {
+		return fmt.Errorf("error initializing: %w", err)
+	}
+	return nil
+}
+
+// Tools lists the tools of the server as agg tools, which call the server with the arguments they
+// get. Tools whose input schema can't be expressed as core.ToolParam are left out (and logged).
+func (c *Client) Tools(ctx context.Context) ([]agg.Tool, error) {
+	var tools []agg.Tool
+	var params listParams
+	for {
+		var result listToolsResult
+		if err := c.request(ctx, "tools/list", params, &result); err != nil {
+			return nil, fmt.Errorf("mcp.Client.Tools: %s: %w", c.cfg.Name, err)
+		}
+
+		for _, info := range result.Tools {
+			spec, err := toCoreTool(info)
+			if err != nil {
+				log.Printf("mcp: skipping tool %s of %s: %v", info.Name, c.cfg.Name, err)
+				continue
+			}
+			tools = append(tools, c.tool(spec))
+		}
+
+		if result.NextCursor == "" {
+			return tools, nil
+		}
+		params.Cursor = result.NextCursor
+	}
+}
+
+// tool wraps a tool of the server. Tools that fail report it in their result, which goes back to
+// the model as is, while protocol errors fail the call.
+func (c *Client) tool(spec core.Tool) agg.Tool {
+	handler := func(ctx context.Context, args json.RawMessage) (agg.ToolOutput, error) {
+		var result callToolResult
+		params := callToolParams{Name: spec.Name, Arguments: args}
+		if err := c.request(ctx, "tools/call", params, &result); err != nil {
+			return agg.ToolOutput{}, fmt.Errorf("mcp: %s: %w", c.cfg.Name, err)
+		}
+
+		out := toToolOutput(result.Content)
+		if result.IsError {
+			out.Text = fmt.Sprintf("<error>%s</error>", out.Text)
+		}
+		return out, nil
+	}
+
+	return agg.Tool{
+		Handler: handler,
+		Spec:    spec,
+		Policy:  agg.ToolPolicy{Timeout: c.cfg.Timeout},
+	}
+}
+
+// Close disconnects from the server, stopping it if it was launched by Dial.
+func (c *Client) Close() error {
+	if err := c.t.close(); err != nil {
+		return fmt.Errorf("mcp.Client.Close: %s: %w", c.cfg.Name, err)
+	}
+	return nil
+}
+
+// request sends a request and decodes its result into result. Requests abandoned because ctx is
+// done are cancelled on the server as well.
+func (c *Client) request(ctx context.Context, method string, params, result any) error {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("failed to marshal params: %w", err)
+	}
+
+	id := json.RawMessage(strconv.FormatInt(c.nextID.Add(1), 10))
+	resp, err := c.t.call(ctx, message{ID: id, Method: method, Params: raw})
+	if err != nil {
+		if ctx.Err() != nil {
+			c.cancel(id, context.Cause(ctx))
+		}
+		return err
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+
+	if err := json.Unmarshal(resp.Result, result); err != nil {
+		return fmt.Errorf("invalid result for %s: %w", method, err)
+	}
+	return nil
+}
+
+func (c *Client) cancel(id json.RawMessage, reason error) {
+	params, _ := json.Marshal(cancelledParams{RequestID: id, Reason: reason.Error()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), closeGracePeriod)
+	defer cancel()
+	if err := c.t.notify(ctx, message{Method: "notifications/cancelled", Params: params}); err != nil && !errors.Is(err, errTransportClosed) {
+		log.Printf("mcp: failed to cancel request %s on %s: %v", id, c.cfg.Name, err)
+	}
+}
+
+// toToolOutput converts the content of a tool result, keeping images and PDFs as parts and
+// describing whatever else can't be given to a model.
+func toToolOutput(content []contentItem) agg.ToolOutput {
+	var out agg.ToolOutput
+	var texts []string
+	for _, item := range content {
+		switch item.Type {
+		case "text":
+			texts = append(texts, item.Text)
+		case "image":
+			data, err := base64.StdEncoding.DecodeString(item.Data)
+			if err != nil {
+				texts = append(texts, fmt.Sprintf("[invalid %s image: %v]", item.MimeType, err))
+				continue
+			}
+			out.Parts = append(out.Parts, core.NewPartImage(item.MimeType, data))
+		case "resource":
+			if item.Resource == nil {
+				continue
+			}
+			if text := fromResourceContents(*item.Resource, &out.Parts); text != "" {
+				texts = append(texts, text)
+			}
+		case "resource_link":
+			texts = append(texts, fmt.Sprintf("[resource %s]", item.URI))
+		default:
+			texts = append(texts, fmt.Sprintf("[%s content omitted]", item.Type))
+		}
+	}
+
+	out.Text = strings.Join(texts, "\n")
+	return out
+}
+
+// fromResourceContents returns the text of an embedded resource, adding it to parts instead if
+// it's a PDF.
+func fromResourceContents(r ResourceContents, parts *[]core.Part) string {
+	if r.Blob == "" {
+		return r.Text
+	}
+
+	data, err := base64.StdEncoding.DecodeString(r.Blob)
+	if err != nil {
+		return fmt.Sprintf("[invalid resource %s: %v]", r.URI, err)
+	}
+	if r.MimeType == "application/pdf" {
+		*parts = append(*parts, core.NewPartDocument(path.Base(r.URI), r.MimeType, data))
+		return ""
+	}
+	return fmt.Sprintf("[binary resource %s (%s, %d bytes) omitted]", r.URI, r.MimeType, len(data))
+}
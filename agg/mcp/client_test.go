@@ -0,0 +1,408 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/victhorio/opa/agg"
+	"github.com/victhorio/opa/agg/core"
+)
+
+// fakeServerPath is the fake MCP server of testdata/fakeserver, built by TestMain.
+var fakeServerPath string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "mcp-test")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error creating temp dir: %v\n", err)
+		os.Exit(1)
+	}
+
+	fakeServerPath = filepath.Join(dir, "fakeserver")
+	build := exec.Command("go", "build", "-o", fakeServerPath, "./testdata/fakeserver")
+	build.Stdout, build.Stderr = os.Stderr, os.Stderr
+	if err := build.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "error building the fake server: %v\n", err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestClientStdio(t *testing.T) {
+	c := dialFakeServer(t, 0)
+	registry, specs := registerTools(t, c)
+
+	names := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		names = append(names, spec.Name)
+	}
+	if got := strings.Join(names, ","); got != "echo,attachments,fail,slow,greeting,cancelled" {
+		t.Errorf("unexpected tools %s", got)
+	}
+
+	echo := specs[0]
+	if echo.Desc != "Echoes the text back" {
+		t.Errorf("unexpected description %q", echo.Desc)
+	}
+	if p := echo.Params["text"]; p.Type != core.JSTString || p.Optional {
+		t.Errorf("expected text to be a required string, got %+v", p)
+	}
+	if p := echo.Params["times"]; p.Type != core.JSTInteger || !p.Optional || p.Minimum == nil || *p.Minimum != 1 {
+		t.Errorf("expected times to be an optional integer of at least 1, got %+v", p)
+	}
+
+	ctx := context.Background()
+
+	out, err := registry.Call(ctx, "echo", json.RawMessage(`{"text":"ab","times":2}`))
+	if err != nil || out.Text != "abab" {
+		t.Errorf("expected abab, got %+v (%v)", out, err)
+	}
+
+	// arguments are validated against the converted schema before reaching the server
+	_, err = registry.Call(ctx, "echo", json.RawMessage(`{"text":"ab","times":0}`))
+	var argsErr *agg.ToolArgsError
+	if !errors.As(err, &argsErr) {
+		t.Errorf("expected a ToolArgsError, got %v", err)
+	}
+
+	out, err = registry.Call(ctx, "attachments", json.RawMessage(`{}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Text != "a pixel and a report" || len(out.Parts) != 2 {
+		t.Fatalf("expected text and two parts, got %+v", out)
+	}
+	if p := out.Parts[0]; p.Type != core.PartImage || p.MediaType != "image/png" || string(p.Data) != "png" {
+		t.Errorf("unexpected image %+v", p)
+	}
+	if p := out.Parts[1]; p.Type != core.PartDocument || p.Name != "report.pdf" || string(p.Data) != "%PDF" {
+		t.Errorf("unexpected document %+v", p)
+	}
+
+	// failures of the tool are given to the model, they don't fail the call
+	out, err = registry.Call(ctx, "fail", json.RawMessage(`{}`))
+	if err != nil || !strings.HasPrefix(out.Text, "<error>") || !strings.Contains(out.Text, "the fake tool failed") {
+		t.Errorf("expected an error result, got %+v (%v)", out, err)
+	}
+
+	out, err = registry.Call(ctx, "greeting", json.RawMessage(`{}`))
+	if err != nil || out.Text != "hello from the test" {
+		t.Errorf("expected the server to get the configured env, got %+v (%v)", out, err)
+	}
+}
+
+func TestClientCallTimeout(t *testing.T) {
+	c := dialFakeServer(t, 100*time.Millisecond)
+	registry, _ := registerTools(t, c)
+
+	_, err := registry.Call(context.Background(), "slow", json.RawMessage(`{}`))
+	var timeoutErr *agg.ToolTimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Timeout != 100*time.Millisecond {
+		t.Fatalf("expected a ToolTimeoutError, got %v", err)
+	}
+
+	// the server is told to stop working on it
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		out, err := registry.Call(context.Background(), "cancelled", json.RawMessage(`{}`))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if out.Text == "1" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the server to have cancelled 1 call, got %s", out.Text)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	c, err := Dial(context.Background(), nil, ServerConfig{Name: "fake", Command: fakeServerPath})
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	tools, err := c.Tools(context.Background())
+	if err != nil {
+		t.Fatalf("error listing tools: %v", err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("error closing: %v", err)
+	}
+	select {
+	case <-c.t.(*stdioTransport).done:
+	default:
+		t.Errorf("expected the server to have exited")
+	}
+
+	if _, err := tools[0].Handler(context.Background(), json.RawMessage(`{"text":"hi"}`)); err == nil {
+		t.Errorf("expected calls to fail once closed")
+	}
+}
+
+func TestDialFailures(t *testing.T) {
+	ctx := context.Background()
+
+	if _, err := Dial(ctx, nil, ServerConfig{Name: "missing", Command: filepath.Join(t.TempDir(), "nope")}); err == nil {
+		t.Errorf("expected an error for a missing command")
+	}
+
+	// a program that exits right away instead of answering
+	if _, err := Dial(ctx, nil, ServerConfig{Name: "true", Command: "go", Args: []string{"version"}}); err == nil {
+		t.Errorf("expected an error for a server that exits")
+	}
+
+	if _, err := Dial(ctx, nil, ServerConfig{Name: "both", Command: "x", URL: "http://localhost"}); err == nil {
+		t.Errorf("expected an error with both a command and a URL")
+	}
+}
+
+func TestClientHTTP(t *testing.T) {
+	server := NewServer("fake", "1", []agg.Tool{echoTool()})
+
+	var mu sync.Mutex
+	var sessions, auths []string
+	deleted := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		sessions = append(sessions, r.Header.Get("Mcp-Session-Id"))
+		auths = append(auths, r.Header.Get("Authorization"))
+		deleted = deleted || r.Method == http.MethodDelete
+		mu.Unlock()
+
+		if r.Method != http.MethodPost {
+			return
+		}
+		// every request carries a single message, which the server answers before the body ends
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Mcp-Session-Id", "session-1")
+		if err := server.Serve(r.Context(), r.Body, w); err != nil {
+			t.Errorf("unexpected error serving: %v", err)
+		}
+	}))
+	defer ts.Close()
+
+	c, err := Dial(context.Background(), ts.Client(), ServerConfig{
+		Name:    "http",
+		URL:     ts.URL,
+		Headers: map[string]string{"Authorization": "Bearer secret"},
+	})
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+
+	registry, _ := registerTools(t, c)
+	out, err := registry.Call(context.Background(), "echo", json.RawMessage(`{"text":"hi","upper":true}`))
+	if err != nil || out.Text != "HI" {
+		t.Errorf("expected HI, got %+v (%v)", out, err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("error closing: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// initialize, initialized, tools/list, tools/call and the final delete
+	if len(sessions) != 5 {
+		t.Fatalf("expected 5 requests, got %d", len(sessions))
+	}
+	if sessions[0] != "" || sessions[1] != "session-1" || sessions[4] != "session-1" {
+		t.Errorf("expected the session ID to be sent after initialization, got %q", sessions)
+	}
+	for i, auth := range auths {
+		if auth != "Bearer secret" {
+			t.Errorf("expected the configured headers on request %d, got %q", i, auth)
+		}
+	}
+	if !deleted {
+		t.Errorf("expected the session to be ended on close")
+	}
+}
+
+func TestReadEventStream(t *testing.T) {
+	stream := strings.Join([]string{
+		": keep-alive",
+		"",
+		"event: message",
+		`data: {"jsonrpc":"2.0","method":"notifications/progress","params":{}}`,
+		"",
+		`data: {"jsonrpc":"2.0","id":1,"method":"ping"}`,
+		"",
+		`data: {"jsonrpc":"2.0","id":7,`,
+		`data: "result":{"ok":true}}`,
+		"",
+		"",
+	}, "\n")
+
+	msg, err := readEventStream(strings.NewReader(stream), json.RawMessage("7"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(msg.Result) != `{"ok":true}` {
+		t.Errorf("unexpected result %s", msg.Result)
+	}
+
+	if _, err := readEventStream(strings.NewReader(stream), json.RawMessage("8")); err == nil {
+		t.Errorf("expected an error when the response never comes")
+	}
+}
+
+func TestToCoreTool(t *testing.T) {
+	tool, err := toCoreTool(toolInfo{
+		Name:        "search",
+		Description: "Searches",
+		InputSchema: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"query": {"type": "string", "title": "Query", "description": "What to look for"},
+				"limit": {"anyOf": [{"type": "integer", "maximum": 50}, {"type": "null"}], "default": 10},
+				"sort": {"type": ["string", "null"], "enum": ["asc", "desc", null]},
+				"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 3},
+				"range": {
+					"type": "object",
+					"properties": {"from": {"type": "string"}, "to": {"type": "string"}},
+					"required": ["from"]
+				}
+			},
+			"required": ["query"]
+		}`),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if tool.Name != "search" || tool.Desc != "Searches" || len(tool.Params) != 5 {
+		t.Fatalf("unexpected tool %+v", tool)
+	}
+	if p := tool.Params["query"]; p.Type != core.JSTString || p.Optional || p.Desc != "What to look for" {
+		t.Errorf("unexpected query %+v", p)
+	}
+	if p := tool.Params["limit"]; p.Type != core.JSTInteger || !p.Optional || p.Nullable == nil || !*p.Nullable ||
+		p.Maximum == nil || *p.Maximum != 50 || p.Default != float64(10) {
+		t.Errorf("unexpected limit %+v", p)
+	}
+	if p := tool.Params["sort"]; p.Type != core.JSTString || p.Nullable == nil || strings.Join(p.Enum, ",") != "asc,desc" {
+		t.Errorf("unexpected sort %+v", p)
+	}
+	if p := tool.Params["tags"]; p.Type != core.JSTArray || p.Items == nil || p.Items.Type != core.JSTString || *p.MaxItems != 3 {
+		t.Errorf("unexpected tags %+v", p)
+	}
+	if p := tool.Params["range"]; p.Type != core.JSTObject || p.Properties["from"].Optional || !p.Properties["to"].Optional {
+		t.Errorf("unexpected range %+v", p)
+	}
+
+	unsupported := map[string]string{
+		"reference": `{"type":"object","properties":{"a":{"$ref":"#/$defs/A"}}}`,
+		"union":     `{"type":"object","properties":{"a":{"anyOf":[{"type":"string"},{"type":"integer"}]}}}`,
+		"free-form": `{"type":"object","properties":{"a":{"type":"object"}}}`,
+		"no items":  `{"type":"object","properties":{"a":{"type":"array"}}}`,
+		"no type":   `{"type":"object","properties":{"a":{"description":"anything"}}}`,
+		"numbers":   `{"type":"object","properties":{"a":{"type":"integer","enum":[1,2]}}}`,
+		"not obj":   `{"type":"string"}`,
+	}
+	for name, schema := range unsupported {
+		if _, err := toCoreTool(toolInfo{Name: name, InputSchema: json.RawMessage(schema)}); err == nil {
+			t.Errorf("expected an error for %s", name)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig(`
+model: anthropic:sonnet
+mcp_servers:
+  - name: local
+    command: my-server
+    args: [--stdio]
+    env: {TOKEN: abc}
+  - url: http://localhost:8931/mcp
+    timeout: 10s
+`)
+	servers, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(servers) != 2 {
+		t.Fatalf("expected 2 servers, got %+v", servers)
+	}
+	if s := servers[0]; s.Name != "local" || s.Command != "my-server" || len(s.Args) != 1 || s.Env["TOKEN"] != "abc" {
+		t.Errorf("unexpected first server %+v", s)
+	}
+	if s := servers[1]; s.Name != "http://localhost:8931/mcp" || s.Timeout != 10*time.Second {
+		t.Errorf("unexpected second server %+v", s)
+	}
+
+	writeConfig("mcp_servers:\n  - name: nothing\n")
+	if _, err := LoadConfig(path); err == nil {
+		t.Errorf("expected an error for a server without command or url")
+	}
+}
+
+// dialFakeServer launches the fake server, closing it at the end of the test.
+func dialFakeServer(t *testing.T, timeout time.Duration) *Client {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c, err := Dial(ctx, nil, ServerConfig{
+		Name:    "fake",
+		Command: fakeServerPath,
+		Env:     map[string]string{"FAKESERVER_GREETING": "hello from the test"},
+		Timeout: timeout,
+	})
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := c.Close(); err != nil {
+			t.Errorf("error closing: %v", err)
+		}
+	})
+
+	return c
+}
+
+// registerTools lists the tools of the client, registering them like an agent would.
+func registerTools(t *testing.T, c *Client) (agg.ToolRegistry, []core.Tool) {
+	t.Helper()
+
+	tools, err := c.Tools(context.Background())
+	if err != nil {
+		t.Fatalf("error listing tools: %v", err)
+	}
+
+	registry := agg.NewToolRegistry()
+	specs := make([]core.Tool, 0, len(tools))
+	for _, tool := range tools {
+		registry.Register(tool)
+		specs = append(specs, tool.Spec)
+	}
+	return registry, specs
+}
@@ -0,0 +1,65 @@
+package mcp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// conn reads and writes newline delimited JSON-RPC messages, which is how MCP frames messages over
+// stdio. Writes are safe for concurrent use, reads are not.
+type conn struct {
+	r *bufio.Reader
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newConn(r io.Reader, w io.Writer) *conn {
+	return &conn{r: bufio.NewReader(r), w: w}
+}
+
+// read returns the next message. Lines that aren't valid JSON-RPC messages are reported with a
+// *RPCError, after which reading can continue.
+func (c *conn) read() (message, error) {
+	for {
+		line, err := c.r.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			return message{}, err
+		}
+
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var msg message
+		if jsonErr := json.Unmarshal(line, &msg); jsonErr != nil {
+			return message{}, &RPCError{Code: codeParseError, Message: fmt.Sprintf("invalid message: %v", jsonErr)}
+		}
+		if msg.JSONRPC != "2.0" {
+			return message{}, &RPCError{Code: codeInvalidRequest, Message: `jsonrpc must be "2.0"`}
+		}
+
+		return msg, nil
+	}
+}
+
+// write sends a message, which json.Marshal guarantees to fit in a single line.
+func (c *conn) write(msg message) error {
+	msg.JSONRPC = "2.0"
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := c.w.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	return nil
+}
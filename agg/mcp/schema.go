@@ -0,0 +1,147 @@
+package mcp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/victhorio/opa/agg/core"
+)
+
+// fromCoreTool converts a core.Tool into an MCP tool. MCP takes regular JSON Schema, so the tool's
+// schema goes as-is, like it does for Anthropic.
+func fromCoreTool(x core.Tool) toolInfo {
+	inputSchema, err := json.Marshal(x.JSONSchema())
+	if err != nil {
+		// Should never happen since every field is a plain value.
+		panic(err)
+	}
+
+	return toolInfo{
+		Name:        x.Name,
+		Description: x.Desc,
+		InputSchema: inputSchema,
+	}
+}
+
+// toCoreTool converts the tool of another MCP server into a core.Tool. Only the subset of JSON
+// Schema that core.ToolParam can express is supported, tools using anything else (references,
+// unions, free-form objects, ...) return an error since we couldn't validate their arguments.
+func toCoreTool(x toolInfo) (core.Tool, error) {
+	var s core.Schema
+	if err := json.Unmarshal(x.InputSchema, &s); err != nil {
+		return core.Tool{}, fmt.Errorf("invalid input schema: %w", err)
+	}
+	if len(s.Type) != 1 || s.Type[0] != core.JSTObject {
+		return core.Tool{}, errors.New("input schema must be an object")
+	}
+
+	params, err := toCoreObject("", s)
+	if err != nil {
+		return core.Tool{}, err
+	}
+
+	return core.Tool{Name: x.Name, Desc: x.Description, Params: params}, nil
+}
+
+func toCoreObject(path string, s core.Schema) (map[string]core.ToolParam, error) {
+	r := make(map[string]core.ToolParam, len(s.Properties))
+	for name, prop := range s.Properties {
+		param, err := toCoreParam(joinPath(path, name), prop)
+		if err != nil {
+			return nil, err
+		}
+		param.Optional = !slices.Contains(s.Required, name)
+		r[name] = param
+	}
+	return r, nil
+}
+
+func toCoreParam(path string, s core.Schema) (core.ToolParam, error) {
+	if s.Ref != "" {
+		return core.ToolParam{}, fmt.Errorf("%s: references are not supported", path)
+	}
+
+	nullable := false
+	if len(s.AnyOf) > 0 {
+		// the only union we can express is a nullable type, e.g. {"anyOf": [{...}, {"type": "null"}]}
+		i := slices.IndexFunc(s.AnyOf, func(x core.Schema) bool { return slices.Equal(x.Type, core.SchemaType{core.JSTNull}) })
+		if len(s.AnyOf) != 2 || i < 0 {
+			return core.ToolParam{}, fmt.Errorf("%s: unions are not supported", path)
+		}
+		inner := s.AnyOf[1-i]
+		if inner.Description == "" {
+			inner.Description = s.Description
+		}
+		if inner.Default == nil {
+			inner.Default = s.Default
+		}
+		s = inner
+		nullable = true
+	}
+
+	types := slices.DeleteFunc(slices.Clone(s.Type), func(t core.JSType) bool { return t == core.JSTNull })
+	nullable = nullable || len(types) < len(s.Type)
+	if len(types) != 1 {
+		return core.ToolParam{}, fmt.Errorf("%s: exactly one type is required, got %v", path, s.Type)
+	}
+
+	r := core.ToolParam{
+		Type:     types[0],
+		Desc:     s.Description,
+		Default:  s.Default,
+		Minimum:  s.Minimum,
+		Maximum:  s.Maximum,
+		MinItems: s.MinItems,
+		MaxItems: s.MaxItems,
+	}
+	if nullable {
+		r.Nullable = boolPtr(true)
+	}
+
+	for _, v := range s.Enum {
+		if v == nil && nullable {
+			continue
+		}
+		str, ok := v.(string)
+		if !ok {
+			return core.ToolParam{}, fmt.Errorf("%s: only enums of strings are supported", path)
+		}
+		r.Enum = append(r.Enum, str)
+	}
+
+	switch r.Type {
+	case core.JSTObject:
+		if len(s.Properties) == 0 {
+			return core.ToolParam{}, fmt.Errorf("%s: objects without properties are not supported", path)
+		}
+		props, err := toCoreObject(path, s)
+		if err != nil {
+			return core.ToolParam{}, err
+		}
+		r.Properties = props
+	case core.JSTArray:
+		if s.Items == nil {
+			return core.ToolParam{}, fmt.Errorf("%s: arrays must declare their items", path)
+		}
+		items, err := toCoreParam(path+"[]", *s.Items)
+		if err != nil {
+			return core.ToolParam{}, err
+		}
+		r.Items = &items
+	}
+
+	return r, nil
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
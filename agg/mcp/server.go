@@ -0,0 +1,287 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/victhorio/opa/agg"
+	"github.com/victhorio/opa/agg/core"
+)
+
+// ErrResourceNotFound is returned by a ResourceProvider for URIs it doesn't know about.
+var ErrResourceNotFound = errors.New("resource not found")
+
+// ResourceProvider gives a Server the resources it exposes.
+type ResourceProvider interface {
+	ListResources() ([]Resource, error)
+	// ReadResource returns the contents of the resource, or an error wrapping ErrResourceNotFound.
+	ReadResource(uri string) (ResourceContents, error)
+}
+
+// Server exposes agg tools, and optionally resources, to MCP clients. Tool calls go through a
+// ToolRegistry, so arguments are validated and the tools' policies apply just like they do for an
+// Agent.
+type Server struct {
+	info      implementation
+	tools     agg.ToolRegistry
+	specs     []core.Tool
+	resources ResourceProvider
+}
+
+// NewServer creates a server with the given name and version, which are reported to clients.
+func NewServer(name, version string, tools []agg.Tool) *Server {
+	s := &Server{
+		info:  implementation{Name: name, Version: version},
+		tools: agg.NewToolRegistry(),
+		specs: make([]core.Tool, 0, len(tools)),
+	}
+
+	for _, tool := range tools {
+		s.tools.Register(tool)
+		s.specs = append(s.specs, tool.Spec)
+	}
+
+	return s
+}
+
+// WithResources makes the server expose the resources of p.
+func (s *Server) WithResources(p ResourceProvider) *Server {
+	s.resources = p
+	return s
+}
+
+// Serve handles the messages read from r, writing responses to w, until r is exhausted or ctx is
+// done. Tool calls run concurrently and can be cancelled by the client, everything else is
+// answered in order.
+func (s *Server) Serve(ctx context.Context, r io.Reader, w io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c := newConn(r, w)
+
+	type readResult struct {
+		msg message
+		err error
+	}
+	incoming := make(chan readResult)
+	go func() {
+		defer close(incoming)
+		for {
+			msg, err := c.read()
+			select {
+			case <-ctx.Done():
+				return
+			case incoming <- readResult{msg, err}:
+			}
+
+			var rpcErr *RPCError
+			if err != nil && !errors.As(err, &rpcErr) {
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	var mu sync.Mutex
+	inFlight := make(map[string]context.CancelFunc)
+
+	for {
+		var in readResult
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case in = <-incoming:
+		}
+
+		var rpcErr *RPCError
+		switch {
+		case errors.As(in.err, &rpcErr):
+			// we can't know the ID of a message we couldn't parse, so it goes with a null one
+			if err := c.write(message{ID: json.RawMessage("null"), Error: rpcErr}); err != nil {
+				return err
+			}
+			continue
+		case errors.Is(in.err, io.EOF):
+			return nil
+		case in.err != nil:
+			return fmt.Errorf("mcp.Server.Serve: error reading message: %w", in.err)
+		}
+
+		msg := in.msg
+		switch {
+		case msg.isNotification():
+			if msg.Method == "notifications/cancelled" {
+				var params cancelledParams
+				if json.Unmarshal(msg.Params, &params) == nil {
+					mu.Lock()
+					if cancelCall, ok := inFlight[string(params.RequestID)]; ok {
+						cancelCall()
+					}
+					mu.Unlock()
+				}
+			}
+			// every other notification (e.g. notifications/initialized) needs nothing from us
+		case msg.isRequest() && msg.Method == "tools/call":
+			callCtx, cancelCall := context.WithCancel(ctx)
+			mu.Lock()
+			inFlight[string(msg.ID)] = cancelCall
+			mu.Unlock()
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() {
+					mu.Lock()
+					delete(inFlight, string(msg.ID))
+					mu.Unlock()
+					cancelCall()
+				}()
+
+				result, rpcErr := s.callTool(callCtx, msg.Params)
+				_ = c.write(response(msg.ID, result, rpcErr))
+			}()
+		case msg.isRequest():
+			result, rpcErr := s.handle(msg.Method, msg.Params)
+			if err := c.write(response(msg.ID, result, rpcErr)); err != nil {
+				return err
+			}
+		default:
+			// a response, but we never send requests to the client
+		}
+	}
+}
+
+// handle answers every request except for tool calls.
+func (s *Server) handle(method string, params json.RawMessage) (any, *RPCError) {
+	switch method {
+	case "initialize":
+		var p initializeParams
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, &RPCError{Code: codeInvalidParams, Message: err.Error()}
+		}
+
+		// we only speak one version, the client decides whether it can work with it
+		result := initializeResult{
+			ProtocolVersion: ProtocolVersion,
+			ServerInfo:      s.info,
+		}
+		result.Capabilities.Tools = &struct{}{}
+		if s.resources != nil {
+			result.Capabilities.Resources = &struct{}{}
+		}
+		return result, nil
+	case "ping":
+		return struct{}{}, nil
+	case "tools/list":
+		tools := make([]toolInfo, 0, len(s.specs))
+		for _, spec := range s.specs {
+			tools = append(tools, fromCoreTool(spec))
+		}
+		return listToolsResult{Tools: tools}, nil
+	case "resources/list":
+		if s.resources == nil {
+			return nil, &RPCError{Code: codeMethodNotFound, Message: "resources are not supported"}
+		}
+		resources, err := s.resources.ListResources()
+		if err != nil {
+			return nil, &RPCError{Code: codeInternalError, Message: err.Error()}
+		}
+		if resources == nil {
+			resources = []Resource{}
+		}
+		return listResourcesResult{Resources: resources}, nil
+	case "resources/read":
+		if s.resources == nil {
+			return nil, &RPCError{Code: codeMethodNotFound, Message: "resources are not supported"}
+		}
+		var p readResourceParams
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, &RPCError{Code: codeInvalidParams, Message: err.Error()}
+		}
+		contents, err := s.resources.ReadResource(p.URI)
+		if errors.Is(err, ErrResourceNotFound) {
+			return nil, &RPCError{Code: codeResourceNotFound, Message: err.Error()}
+		}
+		if err != nil {
+			return nil, &RPCError{Code: codeInternalError, Message: err.Error()}
+		}
+		return readResourceResult{Contents: []ResourceContents{contents}}, nil
+	default:
+		return nil, &RPCError{Code: codeMethodNotFound, Message: fmt.Sprintf("unknown method %s", method)}
+	}
+}
+
+// callTool runs a tool call. Failures of the tool itself are reported in the result so that the
+// model calling it can see them, only unknown tools and malformed requests are protocol errors.
+func (s *Server) callTool(ctx context.Context, params json.RawMessage) (any, *RPCError) {
+	var p callToolParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, &RPCError{Code: codeInvalidParams, Message: err.Error()}
+	}
+	if !slices.ContainsFunc(s.specs, func(spec core.Tool) bool { return spec.Name == p.Name }) {
+		return nil, &RPCError{Code: codeInvalidParams, Message: fmt.Sprintf("unknown tool %s", p.Name)}
+	}
+
+	args := p.Arguments
+	if len(args) == 0 || string(args) == "null" {
+		args = json.RawMessage("{}")
+	}
+
+	out, err := s.tools.Call(ctx, p.Name, args)
+	if err != nil {
+		var argsErr *agg.ToolArgsError
+		var timeoutErr *agg.ToolTimeoutError
+		msg := err.Error()
+		if !errors.As(err, &argsErr) && !errors.As(err, &timeoutErr) {
+			msg = fmt.Sprintf("error calling tool %s: %v", p.Name, err)
+		}
+		return callToolResult{Content: []contentItem{{Type: "text", Text: msg}}, IsError: true}, nil
+	}
+
+	return callToolResult{Content: fromToolOutput(out)}, nil
+}
+
+// fromToolOutput converts the output of a tool into MCP content, with documents sent as embedded
+// resources since there's no content type for them.
+func fromToolOutput(out agg.ToolOutput) []contentItem {
+	r := make([]contentItem, 0, len(out.Parts)+1)
+	if out.Text != "" || len(out.Parts) == 0 {
+		r = append(r, contentItem{Type: "text", Text: out.Text})
+	}
+
+	for _, p := range out.Parts {
+		switch p.Type {
+		case core.PartImage:
+			r = append(r, contentItem{Type: "image", Data: p.Base64(), MimeType: p.MediaType})
+		case core.PartDocument:
+			r = append(r, contentItem{Type: "resource", Resource: &ResourceContents{
+				URI:      "attachment:///" + p.Name,
+				MimeType: p.MediaType,
+				Blob:     p.Base64(),
+			}})
+		default:
+			r = append(r, contentItem{Type: "text", Text: p.Text})
+		}
+	}
+
+	return r
+}
+
+func response(id json.RawMessage, result any, rpcErr *RPCError) message {
+	if rpcErr != nil {
+		return message{ID: id, Error: rpcErr}
+	}
+
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return message{ID: id, Error: &RPCError{Code: codeInternalError, Message: err.Error()}}
+	}
+	return message{ID: id, Result: raw}
+}
@@ -0,0 +1,333 @@
+package mcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/victhorio/opa/agg"
+	"github.com/victhorio/opa/agg/core"
+)
+
+func TestServerInitialize(t *testing.T) {
+	c := startServer(t, NewServer("opa", "1.2.3", nil))
+
+	c.send(`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"protocolVersion":"2025-06-18","capabilities":{},"clientInfo":{"name":"test","version":"0"}}}`)
+	c.send(`{"jsonrpc":"2.0","method":"notifications/initialized"}`)
+	c.send(`{"jsonrpc":"2.0","id":2,"method":"ping"}`)
+
+	var init struct {
+		ProtocolVersion string
+		Capabilities    map[string]json.RawMessage
+		ServerInfo      implementation
+	}
+	c.result(1, &init)
+	if init.ProtocolVersion != ProtocolVersion {
+		t.Errorf("expected protocol version %s, got %s", ProtocolVersion, init.ProtocolVersion)
+	}
+	if init.ServerInfo.Name != "opa" || init.ServerInfo.Version != "1.2.3" {
+		t.Errorf("unexpected server info %+v", init.ServerInfo)
+	}
+	if _, ok := init.Capabilities["tools"]; !ok {
+		t.Errorf("expected the tools capability, got %v", init.Capabilities)
+	}
+	if _, ok := init.Capabilities["resources"]; ok {
+		t.Errorf("expected no resources capability without a provider")
+	}
+
+	// the notification gets no response, so the next one is the ping
+	c.result(2, &struct{}{})
+}
+
+func TestServerListTools(t *testing.T) {
+	c := startServer(t, NewServer("opa", "1", []agg.Tool{echoTool()}))
+
+	c.send(`{"jsonrpc":"2.0","id":1,"method":"tools/list"}`)
+
+	var got listToolsResult
+	c.result(1, &got)
+	if len(got.Tools) != 1 {
+		t.Fatalf("expected 1 tool, got %+v", got.Tools)
+	}
+	if got.Tools[0].Name != "echo" || got.Tools[0].Description != "Echoes the text back" {
+		t.Errorf("unexpected tool %+v", got.Tools[0])
+	}
+
+	want := `{"type":"object","properties":{"text":{"type":"string","description":"What to echo"},"upper":{"type":"boolean","description":"Whether to uppercase it","default":false}},"required":["text"],"additionalProperties":false}`
+	if string(got.Tools[0].InputSchema) != want {
+		t.Errorf("unexpected input schema:\n got: %s\nwant: %s", got.Tools[0].InputSchema, want)
+	}
+}
+
+func TestServerCallTool(t *testing.T) {
+	c := startServer(t, NewServer("opa", "1", []agg.Tool{echoTool(), imageTool()}))
+
+	c.send(`{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"echo","arguments":{"text":"hi","upper":true}}}`)
+	var got callToolResult
+	c.result(1, &got)
+	if got.IsError || len(got.Content) != 1 || got.Content[0].Type != "text" || got.Content[0].Text != "HI" {
+		t.Errorf("unexpected result %+v", got)
+	}
+
+	// invalid arguments are reported to the model instead of failing the request
+	c.send(`{"jsonrpc":"2.0","id":2,"method":"tools/call","params":{"name":"echo","arguments":{"txt":"hi"}}}`)
+	got = callToolResult{}
+	c.result(2, &got)
+	if !got.IsError || len(got.Content) != 1 || !strings.Contains(got.Content[0].Text, "text") {
+		t.Errorf("expected an error result about the missing argument, got %+v", got)
+	}
+
+	c.send(`{"jsonrpc":"2.0","id":3,"method":"tools/call","params":{"name":"image"}}`)
+	got = callToolResult{}
+	c.result(3, &got)
+	if len(got.Content) != 2 || got.Content[0].Text != "a pixel" {
+		t.Fatalf("expected text and an image, got %+v", got)
+	}
+	if img := got.Content[1]; img.Type != "image" || img.MimeType != "image/png" || img.Data != "cG5n" {
+		t.Errorf("unexpected image %+v", img)
+	}
+
+	c.send(`{"jsonrpc":"2.0","id":4,"method":"tools/call","params":{"name":"nope","arguments":{}}}`)
+	if rpcErr := c.error(4); rpcErr.Code != codeInvalidParams {
+		t.Errorf("expected an invalid params error for an unknown tool, got %+v", rpcErr)
+	}
+}
+
+func TestServerCancelToolCall(t *testing.T) {
+	c := startServer(t, NewServer("opa", "1", []agg.Tool{blockTool()}))
+
+	c.send(`{"jsonrpc":"2.0","id":"call","method":"tools/call","params":{"name":"block"}}`)
+	// tool calls don't hold up other requests
+	c.send(`{"jsonrpc":"2.0","id":1,"method":"ping"}`)
+	c.result(1, &struct{}{})
+
+	c.send(`{"jsonrpc":"2.0","method":"notifications/cancelled","params":{"requestId":"call"}}`)
+
+	var got callToolResult
+	c.result(`"call"`, &got)
+	if !got.IsError || !strings.Contains(got.Content[0].Text, context.Canceled.Error()) {
+		t.Errorf("expected the call to fail with its context cancelled, got %+v", got)
+	}
+}
+
+func TestServerResources(t *testing.T) {
+	srv := NewServer("opa", "1", nil).WithResources(fakeResources{
+		"note://a": "contents of a",
+	})
+	c := startServer(t, srv)
+
+	c.send(`{"jsonrpc":"2.0","id":1,"method":"resources/list"}`)
+	var list listResourcesResult
+	c.result(1, &list)
+	if len(list.Resources) != 1 || list.Resources[0].URI != "note://a" {
+		t.Errorf("unexpected resources %+v", list.Resources)
+	}
+
+	c.send(`{"jsonrpc":"2.0","id":2,"method":"resources/read","params":{"uri":"note://a"}}`)
+	var read readResourceResult
+	c.result(2, &read)
+	if len(read.Contents) != 1 || read.Contents[0].Text != "contents of a" {
+		t.Errorf("unexpected contents %+v", read.Contents)
+	}
+
+	c.send(`{"jsonrpc":"2.0","id":3,"method":"resources/read","params":{"uri":"note://b"}}`)
+	if rpcErr := c.error(3); rpcErr.Code != codeResourceNotFound {
+		t.Errorf("expected a resource not found error, got %+v", rpcErr)
+	}
+}
+
+func TestServerMalformedMessages(t *testing.T) {
+	c := startServer(t, NewServer("opa", "1", nil))
+
+	c.send(`{not json`)
+	if rpcErr := c.error(nil); rpcErr.Code != codeParseError {
+		t.Errorf("expected a parse error, got %+v", rpcErr)
+	}
+
+	c.send(`{"jsonrpc":"1.0","id":1,"method":"ping"}`)
+	if rpcErr := c.error(nil); rpcErr.Code != codeInvalidRequest {
+		t.Errorf("expected an invalid request error, got %+v", rpcErr)
+	}
+
+	c.send(`{"jsonrpc":"2.0","id":2,"method":"prompts/list"}`)
+	if rpcErr := c.error(2); rpcErr.Code != codeMethodNotFound {
+		t.Errorf("expected a method not found error, got %+v", rpcErr)
+	}
+
+	// the server keeps going after all of them
+	c.send(`{"jsonrpc":"2.0","id":3,"method":"ping"}`)
+	c.result(3, &struct{}{})
+}
+
+// testClient talks to a Server running in the background over in-memory pipes. Everything the
+// server writes is buffered, so that tests can send several messages before reading the responses.
+type testClient struct {
+	t   *testing.T
+	w   io.Writer
+	out chan []byte
+}
+
+// startServer runs the server until the end of the test, when the client side is closed and the
+// server is expected to return without errors.
+func startServer(t *testing.T, srv *Server) *testClient {
+	t.Helper()
+
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Serve(context.Background(), inR, outW)
+		outW.Close()
+	}()
+
+	t.Cleanup(func() {
+		inW.Close()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("expected the server to stop cleanly, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("server did not stop after its input was closed")
+		}
+	})
+
+	out := make(chan []byte, 64)
+	go func() {
+		defer close(out)
+		scanner := bufio.NewScanner(outR)
+		for scanner.Scan() {
+			out <- slices.Clone(scanner.Bytes())
+		}
+	}()
+
+	return &testClient{t: t, w: inW, out: out}
+}
+
+func (c *testClient) send(line string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.w, line+"\n"); err != nil {
+		c.t.Fatalf("error writing to the server: %v", err)
+	}
+}
+
+// recv returns the next message written by the server, which must have the given ID.
+func (c *testClient) recv(id any) message {
+	c.t.Helper()
+
+	var line []byte
+	select {
+	case l, ok := <-c.out:
+		if !ok {
+			c.t.Fatalf("expected a message, the server closed its output")
+		}
+		line = l
+	case <-time.After(5 * time.Second):
+		c.t.Fatalf("timed out waiting for a message with ID %v", id)
+	}
+
+	var msg message
+	if err := json.Unmarshal(line, &msg); err != nil {
+		c.t.Fatalf("invalid message %s: %v", line, err)
+	}
+	if msg.JSONRPC != "2.0" {
+		c.t.Errorf("expected jsonrpc 2.0, got %q", msg.JSONRPC)
+	}
+
+	wantID := "null"
+	switch id := id.(type) {
+	case int:
+		wantID = fmt.Sprint(id)
+	case string:
+		wantID = id
+	}
+	if string(msg.ID) != wantID {
+		c.t.Fatalf("expected a message with ID %s, got %s", wantID, line)
+	}
+
+	return msg
+}
+
+func (c *testClient) result(id any, v any) {
+	c.t.Helper()
+
+	msg := c.recv(id)
+	if msg.Error != nil {
+		c.t.Fatalf("expected a result, got error %+v", msg.Error)
+	}
+	if err := json.Unmarshal(msg.Result, v); err != nil {
+		c.t.Fatalf("error decoding result %s: %v", msg.Result, err)
+	}
+}
+
+func (c *testClient) error(id any) *RPCError {
+	c.t.Helper()
+
+	msg := c.recv(id)
+	if msg.Error == nil {
+		c.t.Fatalf("expected an error, got result %s", msg.Result)
+	}
+	return msg.Error
+}
+
+func echoTool() agg.Tool {
+	return agg.NewTool(func(ctx context.Context, args struct {
+		Text  string `json:"text"`
+		Upper bool   `json:"upper"`
+	}) (string, error) {
+		if args.Upper {
+			return strings.ToUpper(args.Text), nil
+		}
+		return args.Text, nil
+	}, core.Tool{
+		Name: "echo",
+		Desc: "Echoes the text back",
+		Params: map[string]core.ToolParam{
+			"text":  {Type: core.JSTString, Desc: "What to echo"},
+			"upper": {Type: core.JSTBoolean, Desc: "Whether to uppercase it", Optional: true, Default: false},
+		},
+	})
+}
+
+func imageTool() agg.Tool {
+	return agg.NewToolWithParts(func(ctx context.Context, args struct{}) (agg.ToolOutput, error) {
+		return agg.ToolOutput{
+			Text:  "a pixel",
+			Parts: []core.Part{core.NewPartImage("image/png", []byte("png"))},
+		}, nil
+	}, core.Tool{Name: "image", Params: map[string]core.ToolParam{}})
+}
+
+// blockTool only returns once its context is done.
+func blockTool() agg.Tool {
+	return agg.NewTool(func(ctx context.Context, args struct{}) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}, core.Tool{Name: "block", Params: map[string]core.ToolParam{}})
+}
+
+// fakeResources maps URIs to their text.
+type fakeResources map[string]string
+
+func (f fakeResources) ListResources() ([]Resource, error) {
+	r := make([]Resource, 0, len(f))
+	for uri := range f {
+		r = append(r, Resource{URI: uri, Name: uri})
+	}
+	return r, nil
+}
+
+func (f fakeResources) ReadResource(uri string) (ResourceContents, error) {
+	text, ok := f[uri]
+	if !ok {
+		return ResourceContents{}, fmt.Errorf("%w: %s", ErrResourceNotFound, uri)
+	}
+	return ResourceContents{URI: uri, Text: text}, nil
+}
@@ -0,0 +1,75 @@
+// Command fakeserver is an MCP server over stdio for the tests of the client, built by TestMain.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/victhorio/opa/agg"
+	"github.com/victhorio/opa/agg/core"
+	"github.com/victhorio/opa/agg/mcp"
+)
+
+func main() {
+	var cancelled atomic.Int64
+
+	tools := []agg.Tool{
+		agg.NewTool(func(ctx context.Context, args struct {
+			Text  string `json:"text"`
+			Times *int   `json:"times"`
+		}) (string, error) {
+			times := 1
+			if args.Times != nil {
+				times = *args.Times
+			}
+			return strings.Repeat(args.Text, times), nil
+		}, core.Tool{
+			Name: "echo",
+			Desc: "Echoes the text back",
+			Params: map[string]core.ToolParam{
+				"text":  {Type: core.JSTString, Desc: "What to echo"},
+				"times": {Type: core.JSTInteger, Desc: "How many times", Optional: true, Minimum: ptr(1.0)},
+			},
+		}),
+		agg.NewToolWithParts(func(ctx context.Context, args struct{}) (agg.ToolOutput, error) {
+			return agg.ToolOutput{
+				Text: "a pixel and a report",
+				Parts: []core.Part{
+					core.NewPartImage("image/png", []byte("png")),
+					core.NewPartDocument("report.pdf", "application/pdf", []byte("%PDF")),
+				},
+			}, nil
+		}, core.Tool{Name: "attachments", Desc: "Returns an image and a PDF", Params: map[string]core.ToolParam{}}),
+		agg.NewTool(func(ctx context.Context, args struct{}) (string, error) {
+			return "", fmt.Errorf("the fake tool failed")
+		}, core.Tool{Name: "fail", Desc: "Always fails", Params: map[string]core.ToolParam{}}),
+		agg.NewTool(func(ctx context.Context, args struct{}) (string, error) {
+			select {
+			case <-ctx.Done():
+				cancelled.Add(1)
+				return "", ctx.Err()
+			case <-time.After(time.Minute):
+				return "done", nil
+			}
+		}, core.Tool{Name: "slow", Desc: "Takes a minute unless cancelled", Params: map[string]core.ToolParam{}}),
+		agg.NewTool(func(ctx context.Context, args struct{}) (string, error) {
+			return os.Getenv("FAKESERVER_GREETING"), nil
+		}, core.Tool{Name: "greeting", Desc: "Returns $FAKESERVER_GREETING", Params: map[string]core.ToolParam{}}),
+		agg.NewTool(func(ctx context.Context, args struct{}) (string, error) {
+			return fmt.Sprint(cancelled.Load()), nil
+		}, core.Tool{Name: "cancelled", Desc: "How many slow calls were cancelled", Params: map[string]core.ToolParam{}}),
+	}
+
+	if err := mcp.NewServer("fakeserver", "0.1", tools).Serve(context.Background(), os.Stdin, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
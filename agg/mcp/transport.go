@@ -0,0 +1,340 @@
+package mcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// closeGracePeriod is how long a launched server has to exit once its stdin is closed before it's
+// killed.
+const closeGracePeriod = 2 * time.Second
+
+// errTransportClosed is returned for requests that can't be answered since the connection is gone.
+var errTransportClosed = errors.New("connection to the server is closed")
+
+// transport carries messages to a server and back, matching responses to their requests.
+type transport interface {
+	// call sends a request and waits for its response, until ctx is done.
+	call(ctx context.Context, req message) (message, error)
+	notify(ctx context.Context, msg message) error
+	close() error
+}
+
+// stdioTransport talks to a server it launched through the server's stdin and stdout.
+type stdioTransport struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	conn  *conn
+
+	mu      sync.Mutex
+	pending map[string]chan message
+	err     error // set once the server's stdout is closed
+
+	done chan struct{} // closed once the process has exited
+}
+
+func newStdioTransport(cfg ServerConfig) (*stdioTransport, error) {
+	cmd := exec.Command(cfg.Command, cfg.Args...)
+	cmd.Env = os.Environ()
+	for _, k := range slices.Sorted(maps.Keys(cfg.Env)) {
+		cmd.Env = append(cmd.Env, k+"="+cfg.Env[k])
+	}
+	// servers log to stderr, which would otherwise end up in the middle of the TUI
+	cmd.Stderr = log.Writer()
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdin pipe: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdout pipe: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %w", cfg.Command, err)
+	}
+
+	t := &stdioTransport{
+		cmd:     cmd,
+		stdin:   stdin,
+		conn:    newConn(stdout, stdin),
+		pending: make(map[string]chan message),
+		done:    make(chan struct{}),
+	}
+	go t.readLoop()
+	go func() {
+		_ = cmd.Wait()
+		close(t.done)
+	}()
+
+	return t, nil
+}
+
+// readLoop dispatches responses to the requests waiting for them until the server's stdout closes.
+func (t *stdioTransport) readLoop() {
+	for {
+		msg, err := t.conn.read()
+		var rpcErr *RPCError
+		if errors.As(err, &rpcErr) {
+			log.Printf("mcp: ignoring invalid message from %s: %v", t.cmd.Path, err)
+			continue
+		}
+		if err != nil {
+			t.mu.Lock()
+			t.err = errTransportClosed
+			for id, ch := range t.pending {
+				close(ch)
+				delete(t.pending, id)
+			}
+			t.mu.Unlock()
+			return
+		}
+
+		switch {
+		case msg.isRequest():
+			// servers may ping us, but we don't offer them anything else (roots, sampling, ...)
+			if msg.Method == "ping" {
+				_ = t.conn.write(response(msg.ID, struct{}{}, nil))
+			} else {
+				_ = t.conn.write(response(msg.ID, nil, &RPCError{Code: codeMethodNotFound, Message: fmt.Sprintf("unknown method %s", msg.Method)}))
+			}
+		case msg.isNotification():
+			// logging and list changes, none of which we act upon
+		default:
+			t.mu.Lock()
+			ch, ok := t.pending[string(msg.ID)]
+			delete(t.pending, string(msg.ID))
+			t.mu.Unlock()
+			if ok {
+				ch <- msg
+			}
+		}
+	}
+}
+
+func (t *stdioTransport) call(ctx context.Context, req message) (message, error) {
+	ch := make(chan message, 1)
+	t.mu.Lock()
+	if t.err != nil {
+		t.mu.Unlock()
+		return message{}, t.err
+	}
+	t.pending[string(req.ID)] = ch
+	t.mu.Unlock()
+
+	if err := t.conn.write(req); err != nil {
+		t.forget(req.ID)
+		return message{}, err
+	}
+
+	select {
+	case <-ctx.Done():
+		t.forget(req.ID)
+		return message{}, ctx.Err()
+	case resp, ok := <-ch:
+		if !ok {
+			return message{}, errTransportClosed
+		}
+		return resp, nil
+	}
+}
+
+func (t *stdioTransport) forget(id json.RawMessage) {
+	t.mu.Lock()
+	delete(t.pending, string(id))
+	t.mu.Unlock()
+}
+
+func (t *stdioTransport) notify(ctx context.Context, msg message) error {
+	return t.conn.write(msg)
+}
+
+// close asks the server to exit by closing its stdin, which is how the MCP spec says stdio servers
+// are shut down, killing it if it doesn't do so in time.
+func (t *stdioTransport) close() error {
+	_ = t.stdin.Close()
+
+	select {
+	case <-t.done:
+		return nil
+	case <-time.After(closeGracePeriod):
+	}
+
+	if err := t.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return fmt.Errorf("failed to kill %s: %w", t.cmd.Path, err)
+	}
+	<-t.done
+	return nil
+}
+
+// httpTransport talks to a server over the streamable HTTP transport, where every message is
+// POSTed and the response comes back either as JSON or as a stream of server-sent events.
+type httpTransport struct {
+	client  *http.Client
+	url     string
+	headers map[string]string
+
+	mu        sync.Mutex
+	sessionID string // given by the server on initialization, if it keeps sessions
+}
+
+func newHTTPTransport(client *http.Client, cfg ServerConfig) *httpTransport {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &httpTransport{client: client, url: cfg.URL, headers: cfg.Headers}
+}
+
+func (t *httpTransport) call(ctx context.Context, req message) (message, error) {
+	resp, err := t.post(ctx, req)
+	if err != nil {
+		return message{}, err
+	}
+	defer resp.Body.Close()
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/event-stream" {
+		var msg message
+		if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+			return message{}, fmt.Errorf("invalid response: %w", err)
+		}
+		return msg, nil
+	}
+
+	// the stream may carry requests and notifications of the server before our response
+	return readEventStream(resp.Body, req.ID)
+}
+
+func (t *httpTransport) notify(ctx context.Context, msg message) error {
+	resp, err := t.post(ctx, msg)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// close ends the session on the server, if there's one. Servers may not allow it, so failures are
+// only logged.
+func (t *httpTransport) close() error {
+	t.mu.Lock()
+	sessionID := t.sessionID
+	t.mu.Unlock()
+	if sessionID == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), closeGracePeriod)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, t.url, nil)
+	if err != nil {
+		return err
+	}
+	t.setHeaders(req)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		log.Printf("mcp: failed to end session with %s: %v", t.url, err)
+		return nil
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (t *httpTransport) post(ctx context.Context, msg message) (*http.Response, error) {
+	msg.JSONRPC = "2.0"
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	t.setHeaders(req)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(detail))
+	}
+
+	if sessionID := resp.Header.Get("Mcp-Session-Id"); sessionID != "" {
+		t.mu.Lock()
+		t.sessionID = sessionID
+		t.mu.Unlock()
+	}
+
+	return resp, nil
+}
+
+func (t *httpTransport) setHeaders(req *http.Request) {
+	for _, k := range slices.Sorted(maps.Keys(t.headers)) {
+		req.Header.Set(k, t.headers[k])
+	}
+
+	req.Header.Set("MCP-Protocol-Version", ProtocolVersion)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sessionID != "" {
+		req.Header.Set("Mcp-Session-Id", t.sessionID)
+	}
+}
+
+// readEventStream reads server-sent events until the one carrying the response to the request
+// with the given ID.
+func readEventStream(r io.Reader, id json.RawMessage) (message, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16<<20)
+
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		if value, ok := strings.CutPrefix(line, "data:"); ok {
+			data.WriteString(strings.TrimPrefix(value, " "))
+			continue
+		}
+		if line != "" || data.Len() == 0 {
+			continue
+		}
+
+		var msg message
+		err := json.Unmarshal([]byte(data.String()), &msg)
+		data.Reset()
+		if err != nil {
+			return message{}, fmt.Errorf("invalid event: %w", err)
+		}
+		if !msg.isRequest() && !msg.isNotification() && bytes.Equal(msg.ID, id) {
+			return msg, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return message{}, fmt.Errorf("error reading event stream: %w", err)
+	}
+
+	return message{}, errors.New("event stream ended without a response")
+}
@@ -0,0 +1,178 @@
+package agg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+	"github.com/victhorio/opa/agg/anthropic"
+	"github.com/victhorio/opa/agg/core"
+	"github.com/victhorio/opa/agg/gemini"
+	"github.com/victhorio/opa/agg/openai"
+	"github.com/victhorio/opa/agg/openaicompat"
+)
+
+// Defaults used by NewModelFromSpec, which are meant for interactive use rather than long
+// unattended tasks.
+const (
+	specReasoningEffort = "low"
+	specMaxTok          = 16_384
+	specMaxTokReason    = 4096
+)
+
+// NewModelFromSpec creates a model from a spec of the form "provider:name", where name is either
+// the ID or one of the aliases of a model in the registry, e.g. "anthropic:sonnet" or
+// "openai:gpt-5.1". Reasoning is enabled with a modest budget for the models that support it.
+//
+// Unlike the provider constructors, which accept any model ID, unknown models are an error here
+// since their usage couldn't be priced. They can be added to the registry with LoadModelConfig.
+func NewModelFromSpec(spec string) (core.Model, error) {
+	provider, name, ok := strings.Cut(spec, ":")
+	if !ok || provider == "" || name == "" {
+		return nil, fmt.Errorf("agg.NewModelFromSpec: invalid spec %q, expected provider:name", spec)
+	}
+
+	info, ok := core.LookupModel(core.Provider(provider), name)
+	if !ok {
+		return nil, fmt.Errorf("agg.NewModelFromSpec: %w %q", core.ErrUnknownModel, spec)
+	}
+
+	maxTok := specMaxTok
+	if info.MaxOutput > 0 {
+		maxTok = min(maxTok, info.MaxOutput)
+	}
+
+	switch info.Provider {
+	case core.ProviderOpenAI:
+		var effort string
+		if info.Reasoning {
+			effort = specReasoningEffort
+		}
+		m := openai.NewModel(openai.ModelID(info.ID), effort)
+		if info.BaseURL != "" {
+			m.WithBaseURL(info.BaseURL)
+		}
+		return m, nil
+	case core.ProviderAnthropic:
+		var maxTokReason int
+		if info.Reasoning {
+			maxTokReason = min(specMaxTokReason, maxTok/2)
+		}
+		m := anthropic.NewModel(anthropic.ModelID(info.ID), maxTok, maxTokReason, info.Caching)
+		if info.BaseURL != "" {
+			m.WithBaseURL(info.BaseURL)
+		}
+		return m, nil
+	case core.ProviderGemini:
+		var thinkingBudget int
+		if info.Reasoning {
+			thinkingBudget = min(specMaxTokReason, maxTok/2)
+		}
+		m := gemini.NewModel(gemini.ModelID(info.ID), maxTok, thinkingBudget)
+		if info.BaseURL != "" {
+			m.WithBaseURL(info.BaseURL)
+		}
+		return m, nil
+	case core.ProviderOpenAICompat:
+		if info.BaseURL == "" {
+			return nil, fmt.Errorf("agg.NewModelFromSpec: model %q has no base_url", spec)
+		}
+		m := openaicompat.NewModel(info.BaseURL, info.ID).
+			WithMaxTokens(maxTok).
+			WithCosts(openaicompat.Costs{
+				Input:  info.Prices.Input,
+				Cached: info.Prices.Cached,
+				Output: info.Prices.Output,
+			})
+		if info.APIKeyEnv != "" {
+			m.WithAPIKey(os.Getenv(info.APIKeyEnv))
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("agg.NewModelFromSpec: unsupported provider %q", info.Provider)
+	}
+}
+
+// ModelConfig is the content of a model config file, e.g.:
+//
+//	model: anthropic:sonnet
+//	fallbacks: [openai:gpt-5.1]
+//	models:
+//	  - provider: anthropic
+//	    id: sonnet
+//	    prices: {input: 2500}
+//	  - provider: openai-compat
+//	    id: qwen3:32b
+//	    aliases: [qwen]
+//	    base_url: http://localhost:11434/v1
+//	    context_window: 40960
+//	    tools: true
+//
+// Entries for models that are already registered (by ID or alias) only override the fields they
+// set, so the first one above only changes the input price of Sonnet. Other entries register new
+// models, with the same fields as core.ModelInfo.
+type ModelConfig struct {
+	// Model is the spec of the model to use by default, see NewModelFromSpec.
+	Model string `yaml:"model"`
+	// Fallbacks are the specs of the models to fail over to, in order, when the default one keeps
+	// failing. See ResilientModel.
+	Fallbacks []string `yaml:"fallbacks"`
+	// Budget caps how much can be spent per day and month, see Agent.SetBudget.
+	Budget BudgetConfig `yaml:"budget"`
+}
+
+// LoadModelConfig reads the model config file at path, registering the models it declares.
+func LoadModelConfig(path string) (ModelConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ModelConfig{}, fmt.Errorf("agg.LoadModelConfig: %w", err)
+	}
+
+	var file struct {
+		ModelConfig `yaml:",inline"`
+		Models      []map[string]any `yaml:"models"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return ModelConfig{}, fmt.Errorf("agg.LoadModelConfig: error parsing %s: %w", path, err)
+	}
+
+	for i, entry := range file.Models {
+		if err := registerModelEntry(entry); err != nil {
+			return ModelConfig{}, fmt.Errorf("agg.LoadModelConfig: models[%d]: %w", i, err)
+		}
+	}
+
+	return file.ModelConfig, nil
+}
+
+// registerModelEntry applies a single entry of the config file on top of the registered model it
+// refers to, if any. Going through JSON lets us merge the entry into the existing one, which also
+// works for nested fields like the prices.
+func registerModelEntry(entry map[string]any) error {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error converting entry: %w", err)
+	}
+
+	var info core.ModelInfo
+	if err := json.Unmarshal(raw, &info); err != nil {
+		return fmt.Errorf("error decoding entry: %w", err)
+	}
+	if info.Provider == "" || info.ID == "" {
+		return fmt.Errorf("provider and id are required")
+	}
+
+	if existing, ok := core.LookupModel(info.Provider, info.ID); ok {
+		info = existing
+		if err := json.Unmarshal(raw, &info); err != nil {
+			return fmt.Errorf("error decoding entry: %w", err)
+		}
+		// the entry may have referred to the model by one of its aliases
+		info.ID = existing.ID
+	}
+
+	core.RegisterModel(info)
+	return nil
+}
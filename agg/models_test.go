@@ -0,0 +1,102 @@
+package agg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/victhorio/opa/agg/anthropic"
+	"github.com/victhorio/opa/agg/core"
+	"github.com/victhorio/opa/agg/openaicompat"
+)
+
+func TestNewModelFromSpec(t *testing.T) {
+	for _, spec := range []string{"anthropic:sonnet", "anthropic:" + string(anthropic.Sonnet)} {
+		m, err := NewModelFromSpec(spec)
+		if err != nil {
+			t.Fatalf("NewModelFromSpec(%q) failed: %v", spec, err)
+		}
+		if _, ok := m.(*anthropic.Model); !ok {
+			t.Fatalf("expected an anthropic model for %q, got %T", spec, m)
+		}
+	}
+
+	for _, spec := range []string{"sonnet", "anthropic:", "anthropic:sonet", "mistral:large"} {
+		if _, err := NewModelFromSpec(spec); err == nil {
+			t.Fatalf("expected an error for %q", spec)
+		}
+	}
+}
+
+func TestLoadModelConfig(t *testing.T) {
+	original, ok := core.LookupModel(core.ProviderAnthropic, "sonnet")
+	if !ok {
+		t.Fatalf("sonnet is not registered")
+	}
+	t.Cleanup(func() { core.RegisterModel(original) })
+
+	path := filepath.Join(t.TempDir(), "models.yaml")
+	config := `
+model: openai-compat:qwen
+models:
+  - provider: anthropic
+    id: sonnet
+    prices: {input: 2500}
+  - provider: openai-compat
+    id: qwen3:32b
+    aliases: [qwen]
+    base_url: http://localhost:11434/v1
+    context_window: 40960
+    tools: true
+    prices:
+      input: 100
+      output: 300
+`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	cfg, err := LoadModelConfig(path)
+	if err != nil {
+		t.Fatalf("LoadModelConfig failed: %v", err)
+	}
+	if cfg.Model != "openai-compat:qwen" {
+		t.Fatalf("expected the default model to be read, got %q", cfg.Model)
+	}
+
+	// only the input price of the existing entry should change
+	sonnet, _ := core.LookupModel(core.ProviderAnthropic, string(anthropic.Sonnet))
+	want := original.Prices
+	want.Input = 2500
+	if sonnet.Prices != want {
+		t.Fatalf("expected prices %+v, got %+v", want, sonnet.Prices)
+	}
+	if sonnet.ContextWindow != original.ContextWindow || !sonnet.Reasoning {
+		t.Fatalf("expected the capabilities to be kept, got %+v", sonnet)
+	}
+
+	m, err := NewModelFromSpec(cfg.Model)
+	if err != nil {
+		t.Fatalf("NewModelFromSpec failed: %v", err)
+	}
+	if _, ok := m.(*openaicompat.Model); !ok {
+		t.Fatalf("expected an openaicompat model, got %T", m)
+	}
+}
+
+func TestPricesLongContext(t *testing.T) {
+	p := core.Prices{
+		Input:         2,
+		Cached:        1,
+		Output:        10,
+		LongThreshold: 100,
+		Long:          &core.Prices{Input: 4, Cached: 2, Output: 20},
+	}
+
+	if c := p.Cost(60, 40, 0, 10); c != 60*2+40*1+10*10 {
+		t.Fatalf("unexpected cost at the threshold: %d", c)
+	}
+	if c := p.Cost(61, 40, 0, 10); c != 61*4+40*2+10*20 {
+		t.Fatalf("unexpected cost above the threshold: %d", c)
+	}
+}
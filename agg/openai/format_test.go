@@ -0,0 +1,31 @@
+package openai
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/victhorio/opa/agg/core"
+)
+
+func TestResponseFormat(t *testing.T) {
+	if fromCoreResponseFormat(nil) != nil {
+		t.Errorf("expected no text config without a response format")
+	}
+
+	got, _ := json.Marshal(fromCoreResponseFormat(&core.ResponseFormat{
+		Name: "city",
+		Desc: "The city asked about.",
+		Schema: map[string]core.ToolParam{
+			"name":    {Type: core.JSTString, Desc: "Name of the city"},
+			"country": {Type: core.JSTString, Desc: "Country of the city", Optional: true},
+		},
+	}))
+	want := `{"format":{"type":"json_schema","name":"city","description":"The city asked about.",` +
+		`"schema":{"type":"object","properties":{` +
+		`"country":{"type":["string","null"],"description":"Country of the city"},` +
+		`"name":{"type":"string","description":"Name of the city"}},` +
+		`"required":["country","name"],"additionalProperties":false},"strict":true}}`
+	if string(got) != want {
+		t.Errorf("unexpected text config:\n got: %s\nwant: %s", got, want)
+	}
+}
@@ -1,7 +1,7 @@
 package openai
 
 import (
-	"log"
+	"strings"
 
 	"github.com/victhorio/opa/agg/core"
 )
@@ -10,6 +10,7 @@ import (
 type Model struct {
 	model           ModelID
 	reasoningEffort string
+	baseURL         string
 }
 
 // NewModel creates a new OpenAI Model with the given configuration.
@@ -17,9 +18,17 @@ func NewModel(model ModelID, reasoningEffort string) *Model {
 	return &Model{
 		model:           model,
 		reasoningEffort: reasoningEffort,
+		baseURL:         defaultBaseURL,
 	}
 }
 
+// WithBaseURL makes the model send its requests to the API rooted at url (e.g.
+// "http://localhost:8080/v1") instead of the official OpenAI one.
+func (m *Model) WithBaseURL(url string) *Model {
+	m.baseURL = strings.TrimRight(url, "/")
+	return m
+}
+
 func (m *Model) Provider() core.Provider {
 	return core.ProviderOpenAI
 }
@@ -36,54 +45,114 @@ const (
 	GPT52Pro ModelID = "gpt-5.2-pro"
 )
 
-type modelCost struct {
-	InputTokens  int64
-	CachedTokens int64
-	OutputTokens int64
+func init() {
+	for _, info := range models {
+		core.RegisterModel(info)
+	}
 }
 
-var modelCosts = map[ModelID]modelCost{
-	GPT41: {
-		InputTokens:  2000, // $2.000 per 1M
-		CachedTokens: 500,  // $0.500 per 1M
-		OutputTokens: 8000, // $8.000 per 1M
+var models = []core.ModelInfo{
+	{
+		Provider:      core.ProviderOpenAI,
+		ID:            string(GPT41),
+		ContextWindow: 1_047_576,
+		MaxOutput:     32_768,
+		Caching:       true,
+		Tools:         true,
+		Prices: core.Prices{
+			Input:  2000, // $2.000 per 1M
+			Cached: 500,  // $0.500 per 1M
+			Output: 8000, // $8.000 per 1M
+		},
 	},
-	GPT5Nano: {
-		InputTokens:  50,  // $0.050 per 1M
-		CachedTokens: 5,   // $0.005 per 1M
-		OutputTokens: 400, // $0.400 per 1M
+	{
+		Provider:      core.ProviderOpenAI,
+		ID:            string(GPT5Nano),
+		ContextWindow: 400_000,
+		MaxOutput:     128_000,
+		Reasoning:     true,
+		Caching:       true,
+		Tools:         true,
+		Prices: core.Prices{
+			Input:  50,  // $0.050 per 1M
+			Cached: 5,   // $0.005 per 1M
+			Output: 400, // $0.400 per 1M
+		},
 	},
-	GPT5Mini: {
-		InputTokens:  250,  // $0.250 per 1M
-		CachedTokens: 25,   // $0.025 per 1M
-		OutputTokens: 2000, // $2.000 per 1M
+	{
+		Provider:      core.ProviderOpenAI,
+		ID:            string(GPT5Mini),
+		ContextWindow: 400_000,
+		MaxOutput:     128_000,
+		Reasoning:     true,
+		Caching:       true,
+		Tools:         true,
+		Prices: core.Prices{
+			Input:  250,  // $0.250 per 1M
+			Cached: 25,   // $0.025 per 1M
+			Output: 2000, // $2.000 per 1M
+		},
 	},
-	GPT5Pro: {
-		InputTokens:  15000,  // $15.000 per 1M
-		CachedTokens: 15000,  // $15.000 per 1M
-		OutputTokens: 120000, // $120.000 per 1M
+	{
+		// no discount for cached tokens on the pro models
+		Provider:      core.ProviderOpenAI,
+		ID:            string(GPT5Pro),
+		ContextWindow: 400_000,
+		MaxOutput:     272_000,
+		Reasoning:     true,
+		Tools:         true,
+		Prices: core.Prices{
+			Input:  15000,  // $15.000 per 1M
+			Cached: 15000,  // $15.000 per 1M
+			Output: 120000, // $120.000 per 1M
+		},
 	},
-	GPT51: {
-		InputTokens:  1250,  // $1.250 per 1M
-		CachedTokens: 125,   // $0.125 per 1M
-		OutputTokens: 10000, // $10.000 per 1M
+	{
+		Provider:      core.ProviderOpenAI,
+		ID:            string(GPT51),
+		ContextWindow: 400_000,
+		MaxOutput:     128_000,
+		Reasoning:     true,
+		Caching:       true,
+		Tools:         true,
+		Prices: core.Prices{
+			Input:  1250,  // $1.250 per 1M
+			Cached: 125,   // $0.125 per 1M
+			Output: 10000, // $10.000 per 1M
+		},
 	},
-	GPT52: {
-		InputTokens:  1750,  // $1.750 per 1M
-		CachedTokens: 175,   // $0.175 per 1M
-		OutputTokens: 14000, // $14.000 per 1M
+	{
+		Provider:      core.ProviderOpenAI,
+		ID:            string(GPT52),
+		ContextWindow: 400_000,
+		MaxOutput:     128_000,
+		Reasoning:     true,
+		Caching:       true,
+		Tools:         true,
+		Prices: core.Prices{
+			Input:  1750,  // $1.750 per 1M
+			Cached: 175,   // $0.175 per 1M
+			Output: 14000, // $14.000 per 1M
+		},
 	},
-	GPT52Pro: {
-		InputTokens:  21000,  // $21.000 per 1M
-		CachedTokens: 21000,  // $21.000 per 1M
-		OutputTokens: 168000, // $168.000 per 1M
+	{
+		Provider:      core.ProviderOpenAI,
+		ID:            string(GPT52Pro),
+		ContextWindow: 400_000,
+		MaxOutput:     128_000,
+		Reasoning:     true,
+		Tools:         true,
+		Prices: core.Prices{
+			Input:  21000,  // $21.000 per 1M
+			Cached: 21000,  // $21.000 per 1M
+			Output: 168000, // $168.000 per 1M
+		},
 	},
 }
 
 func costFromUsage(model ModelID, usage usage) int64 {
-	costs, ok := modelCosts[model]
-	if !ok {
-		log.Printf("cannot compute costs: unknown model: %s", model)
+	prices, err := core.ModelPrices(core.ProviderOpenAI, string(model))
+	if err != nil {
 		return 0
 	}
 
@@ -94,7 +163,5 @@ func costFromUsage(model ModelID, usage usage) int64 {
 		panic("assumption violated: more cached tokens than input tokens")
 	}
 
-	return (costs.InputTokens*regularInput +
-		costs.CachedTokens*usage.InputDetails.Cached +
-		costs.OutputTokens*usage.Output)
+	return prices.Cost(regularInput, usage.InputDetails.Cached, 0, usage.Output)
 }
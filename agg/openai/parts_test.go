@@ -0,0 +1,31 @@
+package openai
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/victhorio/opa/agg/core"
+)
+
+func TestPartsConversion(t *testing.T) {
+	png := core.NewPartImage("image/png", []byte("png"))
+	pdf := core.NewPartDocument("paper.pdf", "application/pdf", []byte("pdf"))
+
+	msgs := []*core.Msg{
+		core.NewMsgContent("user", "What's in here?", png),
+		core.NewMsgToolResult("call_a", "Attached paper.pdf.", pdf),
+		core.NewMsgToolResult("call_b", "plain"),
+	}
+
+	got, _ := json.Marshal(fromCoreMsgs(msgs))
+	want := `[` +
+		`{"type":"message","role":"user","content":[{"type":"input_text","text":"What's in here?"},` +
+		`{"type":"input_image","image_url":"data:image/png;base64,cG5n"}]},` +
+		`{"type":"function_call_output","call_id":"call_a","output":[{"type":"input_text","text":"Attached paper.pdf."},` +
+		`{"type":"input_file","filename":"paper.pdf","file_data":"data:application/pdf;base64,cGRm"}]},` +
+		`{"type":"function_call_output","call_id":"call_b","output":"plain"}` +
+		`]`
+	if string(got) != want {
+		t.Errorf("unexpected messages:\n got: %s\nwant: %s", got, want)
+	}
+}
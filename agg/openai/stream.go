@@ -3,12 +3,15 @@ package openai
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 
 	"github.com/victhorio/opa/agg/core"
@@ -36,6 +39,7 @@ func (m *Model) OpenStream(
 		Store:   boolPtr(false),
 		Stream:  true,
 		Tools:   fromCoreTools(tools),
+		Text:    fromCoreResponseFormat(cfg.ResponseFormat),
 	}
 
 	if cfg.DisableTools {
@@ -58,7 +62,7 @@ func (m *Model) OpenStream(
 		return nil, err
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", responsesEndpoint, bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", m.baseURL+"/responses", bytes.NewBuffer(body))
 	if err != nil {
 		return nil, err
 	}
@@ -80,7 +84,7 @@ func (m *Model) OpenStream(
 			return nil, fmt.Errorf("openai responses api error: status=%s (failed to read body: %w)", resp.Status, err)
 		}
 
-		return nil, fmt.Errorf("openai responses api error: status=%s, body=%s", resp.Status, string(body))
+		return nil, fmt.Errorf("openai responses api error: %w", core.NewAPIError(core.ProviderOpenAI, resp, body))
 	}
 
 	return &Stream{
@@ -155,9 +159,14 @@ func (s *Stream) Consume(ctx context.Context, out chan<- core.Event) {
 
 	// nothing else to read, let's check if we need to handle a last event
 	if buf.Len() > 0 {
-		// can ignore the return indicator since we're finishing anyway
-		_ = s.dispatchRawEvent(ctx, buf.Bytes(), out)
+		if shouldReturn := s.dispatchRawEvent(ctx, buf.Bytes(), out); shouldReturn {
+			return
+		}
 	}
+
+	// we only get here if the stream ended before the response was completed, i.e. the connection
+	// was cut short
+	_ = sendEvent(ctx, out, core.NewEvError(fmt.Errorf("openai: stream ended before the response was complete: %w", io.ErrUnexpectedEOF)))
 }
 
 func (s *Stream) dispatchRawEvent(ctx context.Context, dataBytes []byte, out chan<- core.Event) bool {
@@ -226,7 +235,12 @@ func (s *Stream) dispatchRawEvent(ctx context.Context, dataBytes []byte, out cha
 		}
 	case etReasoningDone:
 	case etError:
-		_ = sendEvent(ctx, out, core.NewEvError(fmt.Errorf("openai error: %s", string(dataBytes))))
+		err := &core.APIError{
+			Provider: core.ProviderOpenAI,
+			Type:     cmp.Or(event.Code, etError),
+			Message:  cmp.Or(event.Message, string(dataBytes)),
+		}
+		_ = sendEvent(ctx, out, core.NewEvError(fmt.Errorf("openai error: %w", err)))
 		return true
 	default:
 		fmt.Printf("\033[31munknown event type:\033[0m %s\n\n%s\n\n", event.Type, string(dataBytes))
@@ -278,10 +292,38 @@ type requestBody struct {
 	Store             *bool             `json:"store,omitempty"`
 	Stream            bool              `json:"stream,omitempty"`
 	Temperature       float64           `json:"temperature,omitempty"`
+	Text              *textCfg          `json:"text,omitempty"`
 	ToolChoice        string            `json:"tool_choice,omitempty"`
 	Tools             []tool            `json:"tools,omitempty"`
 }
 
+type textCfg struct {
+	Format textFormat `json:"format"`
+}
+
+// textFormat is a strict json_schema format, which shares its dialect with strict tools.
+type textFormat struct {
+	Type        string      `json:"type"` // always "json_schema"
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Schema      core.Schema `json:"schema"`
+	Strict      bool        `json:"strict"`
+}
+
+func fromCoreResponseFormat(f *core.ResponseFormat) *textCfg {
+	if f == nil {
+		return nil
+	}
+
+	return &textCfg{Format: textFormat{
+		Type:        "json_schema",
+		Name:        f.Name,
+		Description: f.Desc,
+		Schema:      strictSchema(core.ObjectSchema(f.Schema)),
+		Strict:      true,
+	}}
+}
+
 type reasoningCfg struct {
 	Effort  string `json:"effort,omitempty"`
 	Summary string `json:"summary,omitempty"`
@@ -304,14 +346,60 @@ type msg struct {
 	Encrypted string    `json:"encrypted_content,omitempty"`
 	Summary   *[]string `json:"summary,omitempty"`
 	// content fields
-	Role    string `json:"role,omitempty"`
-	Content string `json:"content,omitempty"`
+	Role    string       `json:"role,omitempty"`
+	Content contentParts `json:"content,omitzero"`
 	// tool call fields
 	CallID    string `json:"call_id,omitempty"`
 	Name      string `json:"name,omitempty"`
 	Arguments string `json:"arguments,omitempty"`
 	// tool result fields
-	Output string `json:"output,omitempty"`
+	Output contentParts `json:"output,omitzero"`
+}
+
+// contentParts is the content of a message or the output of a tool result. It's sent as a plain
+// string, unless there are parts to go along with the text.
+type contentParts struct {
+	text  string
+	parts []core.Part
+}
+
+func (c contentParts) IsZero() bool {
+	return c.text == "" && len(c.parts) == 0
+}
+
+func (c contentParts) MarshalJSON() ([]byte, error) {
+	if len(c.parts) == 0 {
+		return json.Marshal(c.text)
+	}
+
+	r := make([]inputPart, 0, len(c.parts)+1)
+	if c.text != "" {
+		r = append(r, inputPart{Type: "input_text", Text: c.text})
+	}
+	for _, p := range c.parts {
+		r = append(r, fromCorePart(p))
+	}
+	return json.Marshal(r)
+}
+
+// inputPart is a single part of contentParts.
+type inputPart struct {
+	Type     string `json:"type"` // "input_text", "input_image" or "input_file"
+	Text     string `json:"text,omitempty"`
+	ImageURL string `json:"image_url,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	FileData string `json:"file_data,omitempty"`
+}
+
+func fromCorePart(p core.Part) inputPart {
+	switch p.Type {
+	case core.PartImage:
+		return inputPart{Type: "input_image", ImageURL: p.DataURL()}
+	case core.PartDocument:
+		return inputPart{Type: "input_file", Filename: p.Name, FileData: p.DataURL()}
+	default:
+		return inputPart{Type: "input_text", Text: p.Text}
+	}
 }
 
 func newMsgReasoning(encrypted string) *msg {
@@ -322,11 +410,11 @@ func newMsgReasoning(encrypted string) *msg {
 	}
 }
 
-func newMsgContent(role, content string) *msg {
+func newMsgContent(role, content string, parts []core.Part) *msg {
 	return &msg{
 		Type:    msgTypeContent,
 		Role:    role,
-		Content: content,
+		Content: contentParts{content, parts},
 	}
 }
 
@@ -339,19 +427,19 @@ func newMsgToolCall(callID, name, arguments string) *msg {
 	}
 }
 
-func newMsgToolResult(callID, result string) *msg {
+func newMsgToolResult(callID, result string, parts []core.Part) *msg {
 	return &msg{
 		Type:   msgTypeToolResult,
 		CallID: callID,
-		Output: result,
+		Output: contentParts{result, parts},
 	}
 }
 
 func fromCoreMsgs(messages []*core.Msg) []json.RawMessage {
 	adapted := make([]json.RawMessage, 0, len(messages))
 	for _, message := range messages {
-		if message.CachedTransform != nil {
-			adapted = append(adapted, message.CachedTransform)
+		if cached := message.CachedTransform(core.ProviderOpenAI); cached != nil {
+			adapted = append(adapted, cached)
 			continue
 		}
 
@@ -364,17 +452,17 @@ func fromCoreMsgs(messages []*core.Msg) []json.RawMessage {
 				panic(err)
 			}
 
-			message.CachedTransform = m
+			message.SetCachedTransform(core.ProviderOpenAI, m)
 			adapted = append(adapted, m)
 		case core.MsgTypeContent:
 			content, _ := message.AsContent()
 
-			m, err := json.Marshal(newMsgContent(content.Role, content.Text))
+			m, err := json.Marshal(newMsgContent(content.Role, content.Text, content.Parts))
 			if err != nil {
 				panic(err)
 			}
 
-			message.CachedTransform = m
+			message.SetCachedTransform(core.ProviderOpenAI, m)
 			adapted = append(adapted, m)
 		case core.MsgTypeToolCall:
 			toolCall, _ := message.AsToolCall()
@@ -384,17 +472,17 @@ func fromCoreMsgs(messages []*core.Msg) []json.RawMessage {
 				panic(err)
 			}
 
-			message.CachedTransform = m
+			message.SetCachedTransform(core.ProviderOpenAI, m)
 			adapted = append(adapted, m)
 		case core.MsgTypeToolResult:
 			toolResult, _ := message.AsToolResult()
 
-			m, err := json.Marshal(newMsgToolResult(toolResult.ID, toolResult.Result))
+			m, err := json.Marshal(newMsgToolResult(toolResult.ID, toolResult.Result, toolResult.Parts))
 			if err != nil {
 				panic(err)
 			}
 
-			message.CachedTransform = m
+			message.SetCachedTransform(core.ProviderOpenAI, m)
 			adapted = append(adapted, m)
 		default:
 			panic(fmt.Errorf("unknown message type: %d", message.Type))
@@ -406,31 +494,11 @@ func fromCoreMsgs(messages []*core.Msg) []json.RawMessage {
 // Tool types for OpenAI API requests
 
 type tool struct {
-	Type        string     `json:"type"` // always "function"
-	Name        string     `json:"name"`
-	Description string     `json:"description"`
-	Parameters  toolParams `json:"parameters"`
-	Strict      bool       `json:"strict"`
-}
-
-type toolParams struct {
-	Type                 core.JSType          `json:"type"` // always "object"
-	Properties           map[string]paramProp `json:"properties,omitempty"`
-	Required             []string             `json:"required,omitempty"`
-	AdditionalProperties *bool                `json:"additionalProperties,omitempty"`
-}
-
-type paramProp struct {
-	Type        core.JSType `json:"type,omitempty"`
-	Description string      `json:"description,omitempty"`
-
-	// structural
-	Items                *paramProp `json:"items,omitempty"`
-	AdditionalProperties *bool      `json:"additionalProperties,omitempty"`
-
-	// validation / constraints
-	Enum     []string `json:"enum,omitempty"`
-	Nullable *bool    `json:"nullable,omitempty"`
+	Type        string      `json:"type"` // always "function"
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Parameters  core.Schema `json:"parameters"`
+	Strict      bool        `json:"strict"`
 }
 
 func fromCoreTools(tools []core.Tool) []tool {
@@ -441,41 +509,62 @@ func fromCoreTools(tools []core.Tool) []tool {
 	return adapted
 }
 
+// fromCoreTool converts a core.Tool into an OpenAI function tool. We always use strict mode, which
+// means that:
+//   - every object (including nested ones) must list all of its properties as required and disallow
+//     additional properties, so optional parameters are expressed by making them nullable instead;
+//   - `default` is not a supported keyword, so defaults are advertised in the description instead.
 func fromCoreTool(x core.Tool) tool {
-	r := tool{
+	return tool{
 		Type:        "function",
 		Name:        x.Name,
 		Description: x.Desc,
-		Parameters: toolParams{
-			Type:                 "object",
-			Properties:           make(map[string]paramProp),
-			Required:             make([]string, 0),
-			AdditionalProperties: boolPtr(false),
-		},
-		Strict: true,
+		Parameters:  strictSchema(x.JSONSchema()),
+		Strict:      true,
 	}
+}
 
-	for paramName, param := range x.Params {
-		r.Parameters.Required = append(r.Parameters.Required, paramName)
-
-		var items *paramProp
-		if param.Items != nil {
-			items = &paramProp{
-				Type: param.Items.Type,
-				Enum: param.Items.Enum,
+// strictSchema rewrites a plain JSON Schema into the strict dialect, see fromCoreTool.
+func strictSchema(s core.Schema) core.Schema {
+	if len(s.Properties) > 0 {
+		props := make(map[string]core.Schema, len(s.Properties))
+		for name, prop := range s.Properties {
+			prop = strictSchema(prop)
+			if !slices.Contains(s.Required, name) {
+				prop = nullSchema(prop)
 			}
+			props[name] = prop
 		}
+		s.Properties = props
+		s.Required = slices.Sorted(maps.Keys(props))
+	}
+
+	if s.Items != nil {
+		items := strictSchema(*s.Items)
+		s.Items = &items
+	}
 
-		r.Parameters.Properties[paramName] = paramProp{
-			Type:        param.Type,
-			Description: param.Desc,
-			Nullable:    param.Nullable,
-			Items:       items,
-			Enum:        param.Enum,
+	if s.Default != nil {
+		if d, err := json.Marshal(s.Default); err == nil {
+			s.Description = strings.TrimSpace(fmt.Sprintf("%s\nDefaults to %s when null.", s.Description, d))
 		}
+		s.Default = nil
 	}
 
-	return r
+	return s
+}
+
+// nullSchema makes a schema accept null, which is how strict mode expresses optional properties.
+func nullSchema(s core.Schema) core.Schema {
+	if slices.Contains(s.Type, core.JSTNull) {
+		return s
+	}
+	s.Type = append(slices.Clone(s.Type), core.JSTNull)
+	if len(s.Enum) > 0 {
+		// in strict mode the enum also constrains the value, so null must be listed as well
+		s.Enum = append(slices.Clone(s.Enum), nil)
+	}
+	return s
 }
 
 // Response and SSE types from OpenAI API
@@ -487,6 +576,10 @@ type eventRaw struct {
 	Item     item     `json:"item"`
 	Delta    string   `json:"delta"`
 	Text     string   `json:"text"`
+
+	// only for etError
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
 // response represents the complete response
@@ -555,4 +648,4 @@ func boolPtr(b bool) *bool {
 	return &b
 }
 
-const responsesEndpoint = "https://api.openai.com/v1/responses"
+const defaultBaseURL = "https://api.openai.com/v1"
@@ -3,294 +3,330 @@ package openai
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
-	"strings"
+	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/victhorio/opa/agg/core"
 )
 
-func TestSimpleMessage(t *testing.T) {
-	t.Parallel()
-
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
+var getWeatherTool = core.Tool{
+	Name: "getWeather",
+	Desc: "Get the weather for a given location",
+	Params: map[string]core.ToolParam{
+		"location": {
+			Type: core.JSTString,
+			Desc: "The location to get the weather for",
+		},
+		"units": {
+			Type: core.JSTString,
+			Desc: "The units to use for the weather",
+			Enum: []string{"Celsius", "Fahrenheit"},
+		},
+	},
+}
 
-	client := &http.Client{}
-	ch := make(chan core.Event, 1)
+// TestUnknownModel makes sure models without prices in the registry are refused before anything
+// is sent, instead of their responses quietly costing nothing.
+func TestUnknownModel(t *testing.T) {
+	t.Parallel()
 
-	msgs := []*core.Msg{
-		core.NewMsgContent("user", "What is the capital of France?"),
-	}
+	// models the registry doesn't list yet still work, their usage just can't be priced
+	model := serve(t, "gpt-0-unknown", "", func(map[string]any) []string {
+		return []string{
+			`{"type":"response.output_text.delta","delta":"Hi!"}`,
+			`{"type":"response.completed","response":{"model":"gpt-0-unknown","output":[` +
+				`{"type":"message","role":"assistant","content":[{"type":"output_text","text":"Hi!"}]}],` +
+				`"usage":{"input_tokens":10,"output_tokens":2,"total_tokens":12}}}`,
+		}
+	})
 
-	model := NewModel("gpt-5-mini", "low")
-	stream, err := model.OpenStream(ctx, client, msgs, []core.Tool{}, core.StreamCfg{})
-	if err != nil {
-		t.Fatalf("NewStream failed: %v", err)
+	msgs := []*core.Msg{core.NewMsgContent("user", "hi")}
+	r, _ := consumeStream(t, model, msgs, nil, core.StreamCfg{})
+	if r.Usage.Input != 10 || r.Usage.Output != 2 || r.Usage.Cost != 0 {
+		t.Errorf("expected the usage to be recorded at no cost, got %+v", r.Usage)
 	}
+}
 
-	go stream.Consume(ctx, ch)
+// TestStreamText checks a plain text response against a stand-in server.
+func TestStreamText(t *testing.T) {
+	t.Parallel()
 
-	var r core.Response
-	for event := range ch {
-		switch event.Type {
-		case core.EvDeltaReason:
-			// ignore
-		case core.EvDelta:
-			// ignore
-		case core.EvToolCall:
-			t.Fatalf("Unexpected tool call: %v", event.Call)
-		case core.EvResp:
-			r = event.Response
+	var body map[string]any
+	model := serve(t, GPT5Mini, "low", func(b map[string]any) []string {
+		body = b
+		return []string{
+			`{"type":"response.created","response":{"model":"gpt-5-mini-2025-08-07","output":[]}}`,
+			`{"type":"response.in_progress","response":{"model":"gpt-5-mini-2025-08-07","output":[]}}`,
+			`{"type":"response.output_item.added","item":{"type":"message","role":"assistant","content":[]}}`,
+			`{"type":"response.content_part.added","part":{"type":"output_text","text":""}}`,
+			`{"type":"response.output_text.delta","delta":"The capital"}`,
+			`{"type":"response.output_text.delta","delta":" is Paris."}`,
+			`{"type":"response.output_text.done","text":"The capital is Paris."}`,
+			`{"type":"response.content_part.done","part":{"type":"output_text","text":"The capital is Paris."}}`,
+			`{"type":"response.output_item.done","item":{"type":"message","role":"assistant","content":[{"type":"output_text","text":"The capital is Paris."}]}}`,
+			`{"type":"response.completed","response":{"model":"gpt-5-mini-2025-08-07","output":[` +
+				`{"type":"reasoning","encrypted_content":"enc-0","summary":[]},` +
+				`{"type":"message","role":"assistant","content":[{"type":"output_text","text":"The capital is Paris."}]}],` +
+				`"usage":{"input_tokens":300,"input_tokens_details":{"cached_tokens":256},"output_tokens":95,"output_tokens_details":{"reasoning_tokens":64},"total_tokens":395}}}`,
 		}
+	})
+
+	msgs := []*core.Msg{core.NewMsgContent("user", "What is the capital of France?")}
+	r, events := consumeStream(t, model, msgs, nil, core.StreamCfg{})
+
+	if body["model"] != "gpt-5-mini" || body["stream"] != true || body["store"] != false {
+		t.Errorf("unexpected request %v", body)
+	}
+	if reasoning, _ := body["reasoning"].(map[string]any); reasoning["effort"] != "low" || reasoning["summary"] != "concise" {
+		t.Errorf("unexpected reasoning config %v", body["reasoning"])
 	}
 
-	if r.Messages == nil {
-		t.Fatalf("No messages in response")
+	deltas := eventsOfType(events, core.EvDelta)
+	if len(deltas) != 2 || deltas[0].Delta != "The capital" || deltas[1].Delta != " is Paris." {
+		t.Errorf("unexpected deltas %+v", deltas)
 	}
 
-	msg := r.Messages[len(r.Messages)-1]
-	content, ok := msg.AsContent()
-	if !ok {
-		t.Fatalf("Last message is not a content message, got %d", msg.Type)
+	if r.Model != "gpt-5-mini-2025-08-07" {
+		t.Errorf("expected the model from the response, got %q", r.Model)
+	}
+	if len(r.Messages) != 2 || r.Messages[0].Type != core.MsgTypeReasoning {
+		t.Fatalf("expected reasoning and content messages, got %+v", r.Messages)
+	}
+	if c, _ := r.Messages[1].AsContent(); c.Role != "assistant" || c.Text != "The capital is Paris." {
+		t.Errorf("unexpected content %+v", c)
 	}
 
-	if !strings.Contains(content.Text, "Paris") {
-		t.Fatalf("Last message does not contain 'Paris', got %s", content.Text)
+	// the cached tokens are reported as part of the input ones
+	want := core.Usage{Input: 44, Cached: 256, Output: 95, Reasoning: 64, Total: 395, Cost: 44*250 + 256*25 + 95*2000}
+	if r.Usage != want {
+		t.Errorf("expected usage %+v, got %+v", want, r.Usage)
 	}
 }
 
-func TestMultiTurnMessages(t *testing.T) {
+// TestStreamToolLoop goes through a tool call loop against a stand-in server, checking that the
+// encrypted reasoning is sent back along with the tool call and its result.
+func TestStreamToolLoop(t *testing.T) {
 	t.Parallel()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
-
-	client := &http.Client{}
-	ch := make(chan core.Event, 1)
+	var bodies []map[string]any
+	model := serve(t, GPT5Mini, "medium", func(b map[string]any) []string {
+		bodies = append(bodies, b)
+		if len(bodies) == 1 {
+			return []string{
+				`{"type":"response.created","response":{"model":"gpt-5-mini-2025-08-07","output":[]}}`,
+				`{"type":"response.output_item.added","item":{"type":"reasoning","encrypted_content":"enc-1"}}`,
+				`{"type":"response.reasoning_summary_part.added","part":{"type":"summary_text","text":""}}`,
+				`{"type":"response.reasoning_summary_text.delta","delta":"Checking the forecast."}`,
+				`{"type":"response.reasoning_summary_text.done","text":"Checking the forecast."}`,
+				`{"type":"response.reasoning_summary_part.done","part":{"type":"summary_text","text":"Checking the forecast."}}`,
+				`{"type":"response.output_item.done","item":{"type":"reasoning","encrypted_content":"enc-1"}}`,
+				`{"type":"response.output_item.added","item":{"type":"function_call","call_id":"call_1","name":"getWeather","arguments":""}}`,
+				`{"type":"response.function_call_arguments.delta","delta":"{\"location\":\"Lisbon\",\"units\":\"Celsius\"}"}`,
+				`{"type":"response.function_call_arguments.done","arguments":"{\"location\":\"Lisbon\",\"units\":\"Celsius\"}"}`,
+				`{"type":"response.output_item.done","item":{"type":"function_call","call_id":"call_1","name":"getWeather","arguments":"{\"location\":\"Lisbon\",\"units\":\"Celsius\"}"}}`,
+				`{"type":"response.completed","response":{"model":"gpt-5-mini-2025-08-07","output":[` +
+					`{"type":"reasoning","encrypted_content":"enc-1","summary":[{"type":"summary_text","text":"Checking the forecast."}]},` +
+					`{"type":"function_call","call_id":"call_1","name":"getWeather","arguments":"{\"location\":\"Lisbon\",\"units\":\"Celsius\"}"}],` +
+					`"usage":{"input_tokens":158,"input_tokens_details":{"cached_tokens":0},"output_tokens":148,"output_tokens_details":{"reasoning_tokens":128},"total_tokens":306}}}`,
+			}
+		}
+		return []string{
+			`{"type":"response.output_text.delta","delta":"Yes, bring an umbrella."}`,
+			`{"type":"response.completed","response":{"model":"gpt-5-mini-2025-08-07","output":[` +
+				`{"type":"message","role":"assistant","content":[{"type":"output_text","text":"Yes, bring an umbrella."}]}],` +
+				`"usage":{"input_tokens":412,"input_tokens_details":{"cached_tokens":256},"output_tokens":95,"output_tokens_details":{"reasoning_tokens":64},"total_tokens":507}}}`,
+		}
+	})
+	cfg := core.StreamCfg{DetailedReasoning: true}
 
-	msgs := make([]*core.Msg, 0, 4)
-	msgs = append(
-		msgs,
-		core.NewMsgContent("user", "Hi! My name is Victhor, what is your name?"),
-	)
+	msgs := []*core.Msg{core.NewMsgContent("user", "Should I bring an umbrella in Lisbon today?")}
+	r, events := consumeStream(t, model, msgs, []core.Tool{getWeatherTool}, cfg)
 
-	model := NewModel("gpt-5-mini", "low")
-	firstStream, err := model.OpenStream(ctx, client, msgs, []core.Tool{}, core.StreamCfg{})
-	if err != nil {
-		t.Fatalf("NewStream failed: %v", err)
+	if reasoning := eventsOfType(events, core.EvDeltaReason); len(reasoning) != 1 || reasoning[0].Delta != "Checking the forecast." {
+		t.Errorf("expected the reasoning once complete, got %+v", reasoning)
 	}
-
-	go firstStream.Consume(ctx, ch)
-
-	var r core.Response
-	for event := range ch {
-		switch event.Type {
-		case core.EvDeltaReason:
-			// ignore
-		case core.EvDelta:
-			// ignore
-		case core.EvToolCall:
-			t.Fatalf("Unexpected tool call: %v", event.Call)
-		case core.EvResp:
-			r = event.Response
-		}
+	calls := eventsOfType(events, core.EvToolCall)
+	if len(calls) != 1 {
+		t.Fatalf("expected a single tool call, got %d", len(calls))
 	}
-
-	if r.Messages == nil {
-		t.Fatalf("No messages in response")
+	if c := calls[0].Call; c.ID != "call_1" || c.Name != "getWeather" || c.Arguments != `{"location":"Lisbon","units":"Celsius"}` {
+		t.Errorf("unexpected tool call %+v", c)
 	}
 
-	msgs = append(msgs, r.Messages...)
-	msgs = append(msgs, core.NewMsgContent("user", "Can you repeat my name to me?"))
-
-	ch = make(chan core.Event, 1)
-	secondStream, err := model.OpenStream(ctx, client, msgs, []core.Tool{}, core.StreamCfg{})
-	if err != nil {
-		t.Fatalf("NewStream failed: %v", err)
+	if reasoning, ok := r.Messages[0].AsReasoning(); !ok || reasoning.Encrypted != "enc-1" {
+		t.Fatalf("expected the response to start with the encrypted reasoning, got %+v", r.Messages[0])
 	}
-
-	go secondStream.Consume(ctx, ch)
-
-	var r2 core.Response
-	for event := range ch {
-		switch event.Type {
-		case core.EvDeltaReason:
-			// ignore
-		case core.EvDelta:
-			// ignore
-		case core.EvToolCall:
-			t.Fatalf("Unexpected tool call: %v", event.Call)
-		case core.EvResp:
-			r2 = event.Response
-		}
+	want := core.Usage{Input: 158, Output: 148, Reasoning: 128, Total: 306, Cost: 158*250 + 148*2000}
+	if r.Usage != want {
+		t.Errorf("expected usage %+v, got %+v", want, r.Usage)
 	}
 
-	if r2.Messages == nil {
-		t.Fatalf("No messages in response")
-	}
+	msgs = append(msgs, r.Messages...)
+	msgs = append(msgs, core.NewMsgToolResult("call_1", `{"temperature": 17, "description": "Light rain"}`))
+	r2, _ := consumeStream(t, model, msgs, []core.Tool{getWeatherTool}, cfg)
 
-	msg := r2.Messages[len(r2.Messages)-1]
-	content, ok := msg.AsContent()
-	if !ok {
-		t.Fatalf("Last message is not a content message, got %d", msg.Type)
+	input, _ := json.Marshal(bodies[1]["input"])
+	wantInput := `[` +
+		`{"content":"Should I bring an umbrella in Lisbon today?","role":"user","type":"message"},` +
+		`{"encrypted_content":"enc-1","summary":[],"type":"reasoning"},` +
+		`{"arguments":"{\"location\":\"Lisbon\",\"units\":\"Celsius\"}","call_id":"call_1","name":"getWeather","type":"function_call"},` +
+		`{"call_id":"call_1","output":"{\"temperature\": 17, \"description\": \"Light rain\"}","type":"function_call_output"}` +
+		`]`
+	if string(input) != wantInput {
+		t.Errorf("unexpected input sent back:\n got: %s\nwant: %s", input, wantInput)
 	}
 
-	if !strings.Contains(content.Text, "Victhor") {
-		t.Fatalf("Last message does not contain 'Victhor', got %s", content.Text)
+	if c, _ := r2.Messages[0].AsContent(); c.Text != "Yes, bring an umbrella." {
+		t.Errorf("unexpected answer %+v", c)
+	}
+	want = core.Usage{Input: 156, Cached: 256, Output: 95, Reasoning: 64, Total: 507, Cost: 156*250 + 256*25 + 95*2000}
+	if r2.Usage != want {
+		t.Errorf("expected usage %+v, got %+v", want, r2.Usage)
 	}
 }
 
-func TestToolCall(t *testing.T) {
+func TestStreamErrors(t *testing.T) {
 	t.Parallel()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
+	t.Run("error event", func(t *testing.T) {
+		model := serve(t, GPT5Mini, "", func(map[string]any) []string {
+			return []string{
+				`{"type":"response.output_text.delta","delta":"Hel"}`,
+				`{"type":"error","code":"server_error","message":"The server is overloaded"}`,
+			}
+		})
 
-	client := &http.Client{}
-	ch := make(chan core.Event, 1)
+		err := streamError(t, model)
+		var apiErr *core.APIError
+		if !errors.As(err, &apiErr) || apiErr.Type != "server_error" || apiErr.Message != "The server is overloaded" {
+			t.Fatalf("expected an APIError from the event, got %v", err)
+		}
+	})
 
-	msgs := []*core.Msg{
-		core.NewMsgContent("user", "What is the weather in Tokyo? In Celsius"),
-	}
+	t.Run("truncated stream", func(t *testing.T) {
+		model := serve(t, GPT5Mini, "", func(map[string]any) []string {
+			return []string{`{"type":"response.output_text.delta","delta":"Hel"}`}
+		})
 
-	model := NewModel("gpt-5-mini", "low")
-	stream, err := model.OpenStream(ctx, client, msgs, []core.Tool{getWeatherTool}, core.StreamCfg{})
-	if err != nil {
-		t.Fatalf("NewStream failed: %v", err)
-	}
+		if err := streamError(t, model); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+		}
+	})
+}
 
-	go stream.Consume(ctx, ch)
+// serve starts a stand-in server for the responses endpoint, answering each request with the
+// events returned by handler, and returns a model sending its requests there.
+func serve(t *testing.T, id ModelID, effort string, handler func(body map[string]any) []string) *Model {
+	t.Helper()
 
-	var tc_count int
-	var tc core.ToolCall
-	var r core.Response
-	for event := range ch {
-		switch event.Type {
-		case core.EvDeltaReason:
-			// ignore
-		case core.EvDelta:
-			// ignore
-		case core.EvToolCall:
-			tc_count++
-			if tc_count > 1 {
-				t.Fatalf("Expected only one tool call, got %d", tc_count)
-			}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/responses" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
 
-			tc = event.Call
-		case core.EvResp:
-			r = event.Response
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("error decoding request: %v", err)
+			return
 		}
-	}
 
-	if tc_count != 1 {
-		t.Fatalf("Expected one tool call, got %d", tc_count)
-	}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, ev := range handler(body) {
+			fmt.Fprintf(w, "data: %s\n\n", ev)
+		}
+	}))
+	t.Cleanup(srv.Close)
 
-	if tc.Name != "getWeather" {
-		t.Fatalf("Expected tool call name to be 'getWeather', got %s", tc.Name)
-	}
+	return NewModel(id, effort).WithBaseURL(srv.URL)
+}
 
-	type args struct {
-		Location string `json:"location"`
-		Units    string `json:"units"`
-	}
+// consumeStream opens a stream against the model and collects every event of it.
+func consumeStream(
+	t *testing.T,
+	model *Model,
+	msgs []*core.Msg,
+	tools []core.Tool,
+	cfg core.StreamCfg,
+) (core.Response, []core.Event) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-	var a args
-	err = json.Unmarshal([]byte(tc.Arguments), &a)
+	stream, err := model.OpenStream(ctx, http.DefaultClient, msgs, tools, cfg)
 	if err != nil {
-		t.Fatalf("Unmarshal failed: %v", err)
-	}
-	if !strings.Contains(a.Location, "Tokyo") {
-		t.Fatalf("Expected location to contain 'Tokyo', got %s", a.Location)
-	}
-	if a.Units != "Celsius" {
-		t.Fatalf("Expected units to be 'Celsius', got %s", a.Units)
-	}
-
-	if r.Messages == nil {
-		t.Fatalf("No messages in response")
-	}
-
-	msg := r.Messages[len(r.Messages)-1]
-	msg_tc, ok := msg.AsToolCall()
-	if !ok {
-		t.Fatalf("Last message is not a tool call message, got %d", msg.Type)
-	}
-	if msg_tc.Name != "getWeather" {
-		t.Fatalf("Expected tool call name to be 'getWeather', got %s", msg_tc.Name)
-	}
-	if msg_tc.Arguments != tc.Arguments {
-		t.Fatalf("Expected tool call arguments to be %s, got %s", tc.Arguments, msg_tc.Arguments)
+		t.Fatalf("OpenStream failed: %v", err)
 	}
+	return consume(ctx, t, stream)
 }
 
-func TestToolResult(t *testing.T) {
-	t.Parallel()
+// streamError consumes a stream expected to fail, returning its first error. Like the agent, it
+// stops listening once it gets the error.
+func streamError(t *testing.T, model *Model) error {
+	t.Helper()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	client := &http.Client{}
+	msgs := []*core.Msg{core.NewMsgContent("user", "hi")}
+	stream, err := model.OpenStream(ctx, http.DefaultClient, msgs, nil, core.StreamCfg{})
+	if err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+
 	ch := make(chan core.Event, 1)
+	go stream.Consume(ctx, ch)
 
-	// mock that we asked for the weather in rio and it generated a tool call for it already
-	msgs := []*core.Msg{
-		core.NewMsgContent("user", "What is the weather in Rio?"),
-		core.NewMsgToolCall("123", "getWeather", `{"location": "Rio", "units": "Celsius"}`),
-		core.NewMsgToolResult("123", `{"temperature": 25, "description": "Sunny"}`),
+	for ev := range ch {
+		switch ev.Type {
+		case core.EvError:
+			return ev.Err
+		case core.EvResp:
+			t.Fatalf("expected no response, got %+v", ev.Response)
+		}
 	}
 
-	model := NewModel("gpt-5-mini", "low")
-	stream, err := model.OpenStream(ctx, client, msgs, []core.Tool{getWeatherTool}, core.StreamCfg{})
-	if err != nil {
-		t.Fatalf("NewStream failed: %v", err)
-	}
+	t.Fatalf("expected an error event")
+	return nil
+}
+
+// consume collects every event of a stream, failing the test on error events.
+func consume(ctx context.Context, t *testing.T, stream core.ResponseStream) (core.Response, []core.Event) {
+	t.Helper()
 
+	ch := make(chan core.Event, 1)
 	go stream.Consume(ctx, ch)
 
 	var r core.Response
+	var events []core.Event
 	for event := range ch {
 		switch event.Type {
-		case core.EvDeltaReason:
-			// ignore
-		case core.EvDelta:
-			// ignore
-		case core.EvToolCall:
-			t.Fatalf("Unexpected tool call: %v", event.Call)
+		case core.EvError:
+			t.Fatalf("Unexpected error event: %v", event.Err)
 		case core.EvResp:
 			r = event.Response
 		}
+		events = append(events, event)
 	}
 
 	if r.Messages == nil {
 		t.Fatalf("No messages in response")
 	}
 
-	msg := r.Messages[len(r.Messages)-1]
-	content, ok := msg.AsContent()
-	if !ok {
-		t.Fatalf("Last message is not a content message, got %d", msg.Type)
-	}
-
-	if !strings.Contains(content.Text, "25") || !strings.Contains(strings.ToLower(content.Text), "sunny") {
-		t.Fatalf("Expected weather in Rio to contain '25' and 'Sunny', got %s", content.Text)
-	}
+	return r, events
 }
 
-var getWeatherTool = core.Tool{
-	Name: "getWeather",
-	Desc: "Get the weather for a given location",
-	Params: map[string]core.ToolParam{
-		"location": {
-			Type: core.JSTString,
-			Desc: "The location to get the weather for",
-		},
-		"units": {
-			Type: core.JSTString,
-			Desc: "The units to use for the weather",
-			Enum: []string{"Celsius", "Fahrenheit"},
-		},
-	},
+func eventsOfType(events []core.Event, typ core.EventType) []core.Event {
+	var r []core.Event
+	for _, ev := range events {
+		if ev.Type == typ {
+			r = append(r, ev)
+		}
+	}
+	return r
 }
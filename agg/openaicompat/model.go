@@ -0,0 +1,75 @@
+// Package openaicompat implements core.Model against the `/v1/chat/completions` streaming protocol,
+// which is spoken by most local and third-party inference servers (Ollama, llama.cpp, vLLM,
+// OpenRouter, Groq, ...).
+package openaicompat
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/victhorio/opa/agg/core"
+)
+
+// Model holds the configuration for making requests to an OpenAI-compatible server.
+type Model struct {
+	model   string
+	baseURL string
+	apiKey  string
+	header  http.Header
+	maxTok  int
+	costs   Costs
+}
+
+// Costs are the prices of a model per token, in the same unit as core.Usage.Cost (billionths of a
+// dollar). This makes them the same numbers as the price in thousandths of a dollar per million
+// tokens, e.g. 2000 for $2.000 per 1M. The zero value means the model is free, which is the
+// common case for local models.
+type Costs struct {
+	Input  int64
+	Cached int64
+	Output int64
+}
+
+// NewModel creates a Model for the given model name served at baseURL, which is the URL that
+// `/chat/completions` is appended to (e.g. "http://localhost:11434/v1" for Ollama).
+func NewModel(baseURL, model string) *Model {
+	return &Model{
+		model:   model,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		header:  make(http.Header),
+	}
+}
+
+// WithAPIKey makes requests authenticate with the given key as a bearer token.
+func (m *Model) WithAPIKey(key string) *Model {
+	m.apiKey = key
+	return m
+}
+
+// WithHeader adds a header to every request, e.g. the attribution headers used by OpenRouter.
+func (m *Model) WithHeader(key, value string) *Model {
+	m.header.Add(key, value)
+	return m
+}
+
+// WithMaxTokens caps the number of tokens generated per response. Zero leaves it to the server.
+func (m *Model) WithMaxTokens(n int) *Model {
+	m.maxTok = n
+	return m
+}
+
+// WithCosts sets the prices used to compute the cost of each response.
+func (m *Model) WithCosts(c Costs) *Model {
+	m.costs = c
+	return m
+}
+
+func (m *Model) Provider() core.Provider {
+	return core.ProviderOpenAICompat
+}
+
+func (c Costs) fromUsage(u usage) int64 {
+	// Like OpenAI, the cached tokens are reported as a subset of the prompt tokens.
+	regularInput := max(u.Prompt-u.PromptDetails.Cached, 0)
+	return c.Input*regularInput + c.Cached*u.PromptDetails.Cached + c.Output*u.Completion
+}
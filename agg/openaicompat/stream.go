@@ -0,0 +1,537 @@
+package openaicompat
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/victhorio/opa/agg/core"
+)
+
+type Stream struct {
+	stream io.ReadCloser
+	costs  Costs
+
+	// the response is built incrementally as the chunks arrive
+	model     string
+	usage     usage
+	reasoning strings.Builder
+	// reasoningSent tracks whether the reasoning was already emitted, since we only emit it once
+	// it's complete
+	reasoningSent bool
+	content       strings.Builder
+	calls         []*toolCallAcc
+	finished      bool
+}
+
+// toolCallAcc accumulates the fragments of a streamed tool call.
+type toolCallAcc struct {
+	index int
+	id    string
+	name  string
+	args  strings.Builder
+}
+
+// OpenStream sends a streaming request to the `/chat/completions` endpoint of the server and returns
+// a ResponseStream that can be consumed for events.
+func (m *Model) OpenStream(
+	ctx context.Context,
+	client *http.Client,
+	messages []*core.Msg,
+	tools []core.Tool,
+	cfg core.StreamCfg,
+) (core.ResponseStream, error) {
+	payload := requestBody{
+		Model:         m.model,
+		Msgs:          fromCoreMsgs(messages),
+		MaxToks:       m.maxTok,
+		Stream:        true,
+		StreamOptions: &streamOptions{IncludeUsage: true},
+		Tools:         fromCoreTools(tools),
+	}
+
+	if len(tools) > 0 && cfg.DisableTools {
+		payload.ToolChoice = "none"
+	}
+
+	if f := cfg.ResponseFormat; f != nil {
+		payload.RespFormat = &respFormat{
+			Type:       "json_schema",
+			JSONSchema: jsonSchema{Name: f.Name, Description: f.Desc, Schema: core.ObjectSchema(f.Schema)},
+		}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("openaicompat.OpenStream: error marshalling request body: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", m.baseURL+"/chat/completions", bytes.NewBuffer(body))
+	if err != nil {
+		return nil, fmt.Errorf("openaicompat.OpenStream: error creating request: %w", err)
+	}
+
+	for key, values := range m.header {
+		for _, v := range values {
+			req.Header.Add(key, v)
+		}
+	}
+	if m.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+m.apiKey)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("openaicompat.OpenStream: error sending request: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if err != nil {
+			return nil, fmt.Errorf("openaicompat.OpenStream: error reading response body: %w", err)
+		}
+		return nil, fmt.Errorf("openaicompat.OpenStream: %w", core.NewAPIError(core.ProviderOpenAICompat, resp, body))
+	}
+
+	return &Stream{
+		stream: resp.Body,
+		costs:  m.costs,
+		model:  m.model,
+	}, nil
+}
+
+// Consume reads the chunks streamed by the server and emits them to the output channel. Text deltas
+// are emitted as they arrive, while reasoning and tool calls are only emitted once complete, to
+// match the behavior of the other providers.
+//
+// This function closes both the stream and the channel at the end of execution.
+func (s *Stream) Consume(ctx context.Context, out chan<- core.Event) {
+	defer s.stream.Close()
+	defer close(out)
+
+	reader := bufio.NewReaderSize(s.stream, 10*1024)
+
+	// servers are all over the place on how they split events, so we're SSE compliant and
+	// accumulate every `data:` line of an event before dispatching it
+	var buf bytes.Buffer
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			_ = sendEvent(ctx, out, core.NewEvError(fmt.Errorf("openaicompat: error reading stream: %w", err)))
+			return
+		}
+		eof := err == io.EOF
+
+		line = strings.TrimRight(line, "\n\r")
+		if data, ok := strings.CutPrefix(line, "data:"); ok {
+			buf.WriteString(strings.TrimPrefix(data, " "))
+		}
+
+		// an empty line means the event is over, and so does the end of the stream
+		if (line == "" || eof) && buf.Len() > 0 {
+			data := bytes.Clone(buf.Bytes())
+			buf.Reset()
+
+			done, err := s.dispatchRawEvent(ctx, data, out)
+			if err != nil {
+				_ = sendEvent(ctx, out, core.NewEvError(err))
+				return
+			}
+			if done {
+				break
+			}
+		}
+
+		if eof {
+			// Some servers never send `[DONE]`, which is fine as long as we got to the end of the
+			// generation. Otherwise the connection was cut short.
+			if !s.finished {
+				_ = sendEvent(ctx, out, core.NewEvError(fmt.Errorf("openaicompat: stream ended before the response was complete: %w", io.ErrUnexpectedEOF)))
+				return
+			}
+			break
+		}
+	}
+
+	s.finish(ctx, out)
+}
+
+// dispatchRawEvent handles the data of a single event, returning true once the stream is over.
+func (s *Stream) dispatchRawEvent(ctx context.Context, data []byte, out chan<- core.Event) (bool, error) {
+	if string(data) == "[DONE]" {
+		return true, nil
+	}
+
+	var c chunk
+	if err := json.Unmarshal(data, &c); err != nil {
+		return true, fmt.Errorf("openaicompat: error decoding chunk: %w", err)
+	}
+
+	if c.Error != nil {
+		return true, fmt.Errorf("openaicompat: %w", &core.APIError{
+			Provider: core.ProviderOpenAICompat,
+			Type:     cmp.Or(c.Error.Type, "error"),
+			Message:  c.Error.Message,
+		})
+	}
+
+	if c.Model != "" {
+		s.model = c.Model
+	}
+	if c.Usage != nil {
+		s.usage = *c.Usage
+	}
+
+	// we never ask for more than one choice
+	if len(c.Choices) == 0 {
+		return false, nil
+	}
+	choice := c.Choices[0]
+	delta := choice.Delta
+
+	// different servers use different fields for the reasoning of open models
+	s.reasoning.WriteString(delta.ReasoningContent)
+	s.reasoning.WriteString(delta.Reasoning)
+
+	if delta.Content != "" {
+		if !s.sendReasoning(ctx, out) {
+			return true, ctx.Err()
+		}
+		s.content.WriteString(delta.Content)
+		if !sendEvent(ctx, out, core.NewEvDelta(delta.Content)) {
+			return true, ctx.Err()
+		}
+	}
+
+	for _, tc := range delta.ToolCalls {
+		if !s.sendReasoning(ctx, out) {
+			return true, ctx.Err()
+		}
+		s.addToolCallFragment(tc)
+	}
+
+	if choice.FinishReason != "" {
+		// we don't stop here since the usage usually comes in a chunk of its own right after
+		s.finished = true
+	}
+
+	return false, nil
+}
+
+func (s *Stream) addToolCallFragment(tc toolCallDelta) {
+	var acc *toolCallAcc
+	if tc.Index != nil {
+		for _, c := range s.calls {
+			if c.index == *tc.Index {
+				acc = c
+				break
+			}
+		}
+	} else if tc.ID == "" && len(s.calls) > 0 {
+		// without an index, fragments without an ID continue the last call
+		acc = s.calls[len(s.calls)-1]
+	}
+
+	if acc == nil {
+		acc = &toolCallAcc{index: len(s.calls)}
+		if tc.Index != nil {
+			acc.index = *tc.Index
+		}
+		s.calls = append(s.calls, acc)
+	}
+
+	if tc.ID != "" {
+		acc.id = tc.ID
+	}
+	if tc.Function.Name != "" {
+		acc.name = tc.Function.Name
+	}
+	acc.args.WriteString(tc.Function.Arguments)
+}
+
+// sendReasoning emits the accumulated reasoning if there's any and it wasn't sent yet. Returns
+// false if the context is done.
+func (s *Stream) sendReasoning(ctx context.Context, out chan<- core.Event) bool {
+	if s.reasoningSent || s.reasoning.Len() == 0 {
+		return true
+	}
+	s.reasoningSent = true
+	return sendEvent(ctx, out, core.NewEvDeltaReason(s.reasoning.String()))
+}
+
+// finish emits the tool calls and the final response.
+func (s *Stream) finish(ctx context.Context, out chan<- core.Event) {
+	if !s.sendReasoning(ctx, out) {
+		return
+	}
+
+	var msgs []*core.Msg
+	if s.reasoning.Len() > 0 {
+		// there's no standard way of sending the reasoning back, so it's kept only for the record
+		msgs = append(msgs, core.NewMsgReasoning("", s.reasoning.String()))
+	}
+	if s.content.Len() > 0 || len(s.calls) == 0 {
+		msgs = append(msgs, core.NewMsgContent("assistant", s.content.String()))
+	}
+
+	for _, acc := range s.calls {
+		call := core.ToolCall{ID: acc.id, Name: acc.name, Arguments: acc.args.String()}
+		if call.ID == "" {
+			// some servers don't generate IDs, but we need them to match the results to the calls
+			call.ID = "call_" + rand.Text()
+		}
+		if strings.TrimSpace(call.Arguments) == "" {
+			call.Arguments = "{}"
+		}
+
+		if !sendEvent(ctx, out, core.NewEvToolCall(call)) {
+			return
+		}
+		msgs = append(msgs, core.NewMsgToolCall(call.ID, call.Name, call.Arguments))
+	}
+
+	u := s.usage
+	_ = sendEvent(ctx, out, core.NewEvResp(core.Response{
+		Model: s.model,
+		Usage: core.Usage{
+			Input:     max(u.Prompt-u.PromptDetails.Cached, 0),
+			Cached:    u.PromptDetails.Cached,
+			Output:    u.Completion,
+			Reasoning: u.CompletionDetails.Reasoning,
+			Total:     u.Prompt + u.Completion,
+			Cost:      s.costs.fromUsage(u),
+		},
+		Messages: msgs,
+	}))
+}
+
+func sendEvent(ctx context.Context, out chan<- core.Event, ev core.Event) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case out <- ev:
+		return true
+	}
+}
+
+// fromCoreMsgs converts the history into chat messages. Consecutive tool calls are merged into a
+// single assistant message (along with the text that preceded them, if any) since that's how chat
+// completions represent parallel calls. Reasoning is dropped since there's no standard way to send
+// it back. Tool messages can only hold text, so any parts returned by tools are sent in a user
+// message after the group of tool results.
+func fromCoreMsgs(coreMsgs []*core.Msg) []msg {
+	r := make([]msg, 0, len(coreMsgs))
+
+	var pendingParts []core.Part
+	flushParts := func() {
+		if len(pendingParts) > 0 {
+			r = append(r, msg{Role: "user", Content: fromCoreParts("", pendingParts)})
+			pendingParts = nil
+		}
+	}
+
+	for _, coreMsg := range coreMsgs {
+		if coreMsg.Type != core.MsgTypeToolResult {
+			flushParts()
+		}
+
+		switch coreMsg.Type {
+		case core.MsgTypeContent:
+			content, _ := coreMsg.AsContent()
+			if len(content.Parts) > 0 {
+				r = append(r, msg{Role: content.Role, Content: fromCoreParts(content.Text, content.Parts)})
+			} else {
+				r = append(r, msg{Role: content.Role, Content: content.Text})
+			}
+		case core.MsgTypeToolCall:
+			tc, _ := coreMsg.AsToolCall()
+			call := toolCall{
+				ID:       tc.ID,
+				Type:     "function",
+				Function: toolCallFunction{Name: tc.Name, Arguments: tc.Arguments},
+			}
+
+			if n := len(r); n > 0 && r[n-1].Role == "assistant" {
+				r[n-1].ToolCalls = append(r[n-1].ToolCalls, call)
+			} else {
+				r = append(r, msg{Role: "assistant", ToolCalls: []toolCall{call}})
+			}
+		case core.MsgTypeToolResult:
+			result, _ := coreMsg.AsToolResult()
+			r = append(r, msg{Role: "tool", Content: result.Result, ToolCallID: result.ID})
+			pendingParts = append(pendingParts, result.Parts...)
+		}
+	}
+	flushParts()
+
+	return r
+}
+
+// requestBody is the body of the request to the chat completions endpoint.
+type requestBody struct {
+	Model         string         `json:"model"`
+	Msgs          []msg          `json:"messages"`
+	MaxToks       int            `json:"max_tokens,omitempty"`
+	Stream        bool           `json:"stream"`
+	StreamOptions *streamOptions `json:"stream_options,omitempty"`
+	ToolChoice    string         `json:"tool_choice,omitempty"`
+	Tools         []tool         `json:"tools,omitempty"`
+	RespFormat    *respFormat    `json:"response_format,omitempty"`
+}
+
+type respFormat struct {
+	Type       string     `json:"type"` // always "json_schema"
+	JSONSchema jsonSchema `json:"json_schema"`
+}
+
+type jsonSchema struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Schema      core.Schema `json:"schema"`
+}
+
+type streamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type msg struct {
+	Role string `json:"role"`
+	// Content is either a string, a list of contentParts, or nil for assistant messages with only
+	// tool calls
+	Content    any        `json:"content"`
+	ToolCalls  []toolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+}
+
+type contentPart struct {
+	Type     string        `json:"type"` // "text", "image_url" or "file"
+	Text     string        `json:"text,omitempty"`
+	ImageURL *imageURL     `json:"image_url,omitempty"`
+	File     *fileContents `json:"file,omitempty"`
+}
+
+type imageURL struct {
+	URL string `json:"url"`
+}
+
+type fileContents struct {
+	Filename string `json:"filename,omitempty"`
+	FileData string `json:"file_data"`
+}
+
+// fromCoreParts converts the text and parts of a message into a list of contentParts.
+func fromCoreParts(text string, parts []core.Part) []contentPart {
+	r := make([]contentPart, 0, len(parts)+1)
+	if text != "" {
+		r = append(r, contentPart{Type: "text", Text: text})
+	}
+
+	for _, p := range parts {
+		switch p.Type {
+		case core.PartImage:
+			r = append(r, contentPart{Type: "image_url", ImageURL: &imageURL{URL: p.DataURL()}})
+		case core.PartDocument:
+			r = append(r, contentPart{
+				Type: "file",
+				File: &fileContents{Filename: p.Name, FileData: p.DataURL()},
+			})
+		default:
+			r = append(r, contentPart{Type: "text", Text: p.Text})
+		}
+	}
+
+	return r
+}
+
+type toolCall struct {
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	Function toolCallFunction `json:"function"`
+}
+
+type toolCallFunction struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type tool struct {
+	Type     string       `json:"type"`
+	Function toolFunction `json:"function"`
+}
+
+type toolFunction struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Parameters  core.Schema `json:"parameters"`
+}
+
+// fromCoreTools converts the tools into function tools. Since we can't count on servers supporting
+// OpenAI's strict mode, their plain JSON Schema goes as-is, like we do for Anthropic.
+func fromCoreTools(tools []core.Tool) []tool {
+	r := make([]tool, 0, len(tools))
+	for _, t := range tools {
+		r = append(r, tool{
+			Type: "function",
+			Function: toolFunction{
+				Name:        t.Name,
+				Description: t.Desc,
+				Parameters:  t.JSONSchema(),
+			},
+		})
+	}
+	return r
+}
+
+// chunk is a single streamed `chat.completion.chunk` object.
+type chunk struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Delta        delta  `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *usage `json:"usage"`
+	// some servers (e.g. OpenRouter) report errors mid-stream this way
+	Error *struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+	} `json:"error"`
+}
+
+type delta struct {
+	Content          string          `json:"content"`
+	ReasoningContent string          `json:"reasoning_content"`
+	Reasoning        string          `json:"reasoning"`
+	ToolCalls        []toolCallDelta `json:"tool_calls"`
+}
+
+type toolCallDelta struct {
+	Index    *int   `json:"index"`
+	ID       string `json:"id"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type usage struct {
+	Prompt        int64 `json:"prompt_tokens"`
+	PromptDetails struct {
+		Cached int64 `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+	Completion        int64 `json:"completion_tokens"`
+	CompletionDetails struct {
+		Reasoning int64 `json:"reasoning_tokens"`
+	} `json:"completion_tokens_details"`
+}
@@ -0,0 +1,408 @@
+package openaicompat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/victhorio/opa/agg/core"
+)
+
+func TestSimpleMessage(t *testing.T) {
+	t.Parallel()
+
+	var got *http.Request
+	var body capturedRequest
+	model := serve(t, func(r *http.Request, b capturedRequest) (int, []string) {
+		got, body = r, b
+		return http.StatusOK, []string{
+			`{"id":"chatcmpl-1","object":"chat.completion.chunk","model":"llama3.2:3b","choices":[{"index":0,"delta":{"role":"assistant","content":""},"finish_reason":null}]}`,
+			`{"id":"chatcmpl-1","object":"chat.completion.chunk","model":"llama3.2:3b","choices":[{"index":0,"delta":{"content":"The capital"},"finish_reason":null}]}`,
+			`{"id":"chatcmpl-1","object":"chat.completion.chunk","model":"llama3.2:3b","choices":[{"index":0,"delta":{"content":" is Paris."},"finish_reason":null}]}`,
+			`{"id":"chatcmpl-1","object":"chat.completion.chunk","model":"llama3.2:3b","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+			`{"id":"chatcmpl-1","object":"chat.completion.chunk","model":"llama3.2:3b","choices":[],"usage":{"prompt_tokens":30,"completion_tokens":8,"total_tokens":38,"prompt_tokens_details":{"cached_tokens":10}}}`,
+			`[DONE]`,
+		}
+	})
+	model.WithAPIKey("secret").WithHeader("X-Title", "opa").WithCosts(Costs{Input: 100, Cached: 10, Output: 1000})
+
+	msgs := []*core.Msg{
+		core.NewMsgContent("system", "Be brief."),
+		core.NewMsgContent("user", "What is the capital of France?"),
+	}
+	r, events := consume(t, model, msgs, nil, core.StreamCfg{})
+
+	if got.URL.Path != "/v1/chat/completions" {
+		t.Errorf("expected request to /v1/chat/completions, got %s", got.URL.Path)
+	}
+	if auth := got.Header.Get("Authorization"); auth != "Bearer secret" {
+		t.Errorf("expected bearer auth, got %q", auth)
+	}
+	if title := got.Header.Get("X-Title"); title != "opa" {
+		t.Errorf("expected custom header to be sent, got %q", title)
+	}
+	if !body.Stream || body.StreamOptions == nil || !body.StreamOptions.IncludeUsage {
+		t.Errorf("expected a streaming request including usage, got %+v", body)
+	}
+	if body.Tools != nil || body.ToolChoice != "" {
+		t.Errorf("expected no tools in the request, got %+v", body.Tools)
+	}
+	if len(body.Msgs) != 2 || body.Msgs[0].Role != "system" || body.Msgs[1].Content != "What is the capital of France?" {
+		t.Errorf("unexpected messages %+v", body.Msgs)
+	}
+
+	if deltas := eventsOfType(events, core.EvDelta); len(deltas) != 2 {
+		t.Errorf("expected 2 text deltas, got %d", len(deltas))
+	}
+
+	if r.Model != "llama3.2:3b" {
+		t.Errorf("expected model from the chunks, got %q", r.Model)
+	}
+	if len(r.Messages) != 1 {
+		t.Fatalf("expected a single message, got %d", len(r.Messages))
+	}
+	if c, _ := r.Messages[0].AsContent(); c.Text != "The capital is Paris." || c.Role != "assistant" {
+		t.Errorf("unexpected content %+v", c)
+	}
+
+	want := core.Usage{Input: 20, Cached: 10, Output: 8, Total: 38, Cost: 20*100 + 10*10 + 8*1000}
+	if r.Usage != want {
+		t.Errorf("expected usage %+v, got %+v", want, r.Usage)
+	}
+}
+
+func TestToolCalls(t *testing.T) {
+	t.Parallel()
+
+	var body capturedRequest
+	model := serve(t, func(r *http.Request, b capturedRequest) (int, []string) {
+		body = b
+		return http.StatusOK, []string{
+			`{"choices":[{"index":0,"delta":{"role":"assistant","reasoning_content":"Two cities, "}}]}`,
+			`{"choices":[{"index":0,"delta":{"reasoning_content":"two calls."}}]}`,
+			`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_a","type":"function","function":{"name":"getWeather","arguments":""}}]}}]}`,
+			`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"location\":"}}]}}]}`,
+			`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"id":"call_b","type":"function","function":{"name":"getWeather","arguments":"{\"location\":\"Lisbon\"}"}}]}}]}`,
+			`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Tokyo\"}"}}]}}]}`,
+			`{"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+			// no usage and no [DONE], which some servers do
+		}
+	})
+
+	msgs := []*core.Msg{core.NewMsgContent("user", "Weather in Tokyo and Lisbon?")}
+	r, events := consume(t, model, msgs, []core.Tool{getWeatherTool}, core.StreamCfg{})
+
+	if len(body.Tools) != 1 || body.Tools[0].Type != "function" || body.Tools[0].Function.Name != "getWeather" {
+		t.Fatalf("unexpected tools in request %+v", body.Tools)
+	}
+	params := body.Tools[0].Function.Parameters
+	wantParams := `{"type":"object","properties":{"location":{"type":"string","description":"The location to get the weather for"},"units":{"type":["string","null"],"description":"The units to use for the weather","enum":["Celsius","Fahrenheit",null]}},"required":["location"],"additionalProperties":false}`
+	if string(params) != wantParams {
+		t.Errorf("unexpected parameters schema:\n got: %s\nwant: %s", params, wantParams)
+	}
+
+	// reasoning is emitted once complete, before anything else
+	if events[0].Type != core.EvDeltaReason || events[0].Delta != "Two cities, two calls." {
+		t.Errorf("expected the complete reasoning first, got %+v", events[0])
+	}
+
+	calls := eventsOfType(events, core.EvToolCall)
+	if len(calls) != 2 {
+		t.Fatalf("expected 2 tool calls, got %d", len(calls))
+	}
+	if c := calls[0].Call; c.ID != "call_a" || c.Arguments != `{"location":"Tokyo"}` {
+		t.Errorf("unexpected first call %+v", c)
+	}
+	if c := calls[1].Call; c.ID != "call_b" || c.Arguments != `{"location":"Lisbon"}` {
+		t.Errorf("unexpected second call %+v", c)
+	}
+
+	// reasoning, then both tool calls
+	if len(r.Messages) != 3 || r.Messages[0].Type != core.MsgTypeReasoning {
+		t.Fatalf("unexpected response messages %+v", r.Messages)
+	}
+	if tc, ok := r.Messages[2].AsToolCall(); !ok || tc.ID != "call_b" {
+		t.Errorf("expected last message to be the second call, got %+v", r.Messages[2])
+	}
+	if r.Usage != (core.Usage{}) {
+		t.Errorf("expected empty usage when the server doesn't report it, got %+v", r.Usage)
+	}
+}
+
+func TestToolCallsWithoutIDs(t *testing.T) {
+	t.Parallel()
+
+	model := serve(t, func(r *http.Request, b capturedRequest) (int, []string) {
+		return http.StatusOK, []string{
+			`{"choices":[{"index":0,"delta":{"tool_calls":[{"function":{"name":"listNotes","arguments":""}}]}}]}`,
+			`{"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+			`[DONE]`,
+		}
+	})
+
+	r, events := consume(t, model, []*core.Msg{core.NewMsgContent("user", "hi")}, nil, core.StreamCfg{})
+
+	calls := eventsOfType(events, core.EvToolCall)
+	if len(calls) != 1 {
+		t.Fatalf("expected 1 tool call, got %d", len(calls))
+	}
+	if c := calls[0].Call; !strings.HasPrefix(c.ID, "call_") || c.Arguments != "{}" {
+		t.Errorf("expected generated ID and empty object arguments, got %+v", c)
+	}
+	if tc, _ := r.Messages[0].AsToolCall(); tc.ID != calls[0].Call.ID {
+		t.Errorf("expected the response to use the same generated ID, got %s", tc.ID)
+	}
+}
+
+func TestHistoryConversion(t *testing.T) {
+	t.Parallel()
+
+	var body capturedRequest
+	model := serve(t, func(r *http.Request, b capturedRequest) (int, []string) {
+		body = b
+		return http.StatusOK, []string{
+			`{"choices":[{"index":0,"delta":{"content":"Done."},"finish_reason":"stop"}]}`,
+			`[DONE]`,
+		}
+	})
+
+	msgs := []*core.Msg{
+		core.NewMsgContent("system", "sys"),
+		core.NewMsgContent("user", "Weather in Tokyo and Lisbon?"),
+		core.NewMsgReasoning("", "I should call the tool twice."),
+		core.NewMsgContent("assistant", "Let me check."),
+		core.NewMsgToolCall("call_a", "getWeather", `{"location":"Tokyo"}`),
+		core.NewMsgToolCall("call_b", "getWeather", `{"location":"Lisbon"}`),
+		core.NewMsgToolResult("call_a", "25C"),
+		core.NewMsgToolResult("call_b", "17C"),
+	}
+	consume(t, model, msgs, []core.Tool{getWeatherTool}, core.StreamCfg{DisableTools: true})
+
+	if body.ToolChoice != "none" {
+		t.Errorf("expected tool_choice none, got %q", body.ToolChoice)
+	}
+
+	got, _ := json.Marshal(body.Msgs)
+	want := `[` +
+		`{"role":"system","content":"sys"},` +
+		`{"role":"user","content":"Weather in Tokyo and Lisbon?"},` +
+		`{"role":"assistant","content":"Let me check.","tool_calls":[` +
+		`{"id":"call_a","type":"function","function":{"name":"getWeather","arguments":"{\"location\":\"Tokyo\"}"}},` +
+		`{"id":"call_b","type":"function","function":{"name":"getWeather","arguments":"{\"location\":\"Lisbon\"}"}}]},` +
+		`{"role":"tool","content":"25C","tool_call_id":"call_a"},` +
+		`{"role":"tool","content":"17C","tool_call_id":"call_b"}` +
+		`]`
+	if string(got) != want {
+		t.Errorf("unexpected messages:\n got: %s\nwant: %s", got, want)
+	}
+
+	// tool calls without preceding text get a null content
+	got, _ = json.Marshal(fromCoreMsgs([]*core.Msg{core.NewMsgToolCall("1", "fn", "{}")}))
+	if !strings.Contains(string(got), `"content":null`) {
+		t.Errorf("expected null content for a tool call only message, got %s", got)
+	}
+}
+
+func TestPartsConversion(t *testing.T) {
+	t.Parallel()
+
+	png := core.NewPartImage("image/png", []byte("png"))
+	pdf := core.NewPartDocument("paper.pdf", "application/pdf", []byte("pdf"))
+
+	msgs := []*core.Msg{
+		core.NewMsgContent("user", "What's in here?", png),
+		core.NewMsgToolCall("call_a", "readAttachment", `{"path":"paper.pdf"}`),
+		core.NewMsgToolResult("call_a", "Attached paper.pdf.", pdf),
+		core.NewMsgContent("assistant", "A paper."),
+	}
+
+	got, _ := json.Marshal(fromCoreMsgs(msgs))
+	want := `[` +
+		`{"role":"user","content":[{"type":"text","text":"What's in here?"},` +
+		`{"type":"image_url","image_url":{"url":"data:image/png;base64,cG5n"}}]},` +
+		`{"role":"assistant","content":null,"tool_calls":[` +
+		`{"id":"call_a","type":"function","function":{"name":"readAttachment","arguments":"{\"path\":\"paper.pdf\"}"}}]},` +
+		`{"role":"tool","content":"Attached paper.pdf.","tool_call_id":"call_a"},` +
+		`{"role":"user","content":[{"type":"file","file":{"filename":"paper.pdf","file_data":"data:application/pdf;base64,cGRm"}}]},` +
+		`{"role":"assistant","content":"A paper."}` +
+		`]`
+	if string(got) != want {
+		t.Errorf("unexpected messages:\n got: %s\nwant: %s", got, want)
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	t.Parallel()
+
+	t.Run("error status", func(t *testing.T) {
+		model := serve(t, func(r *http.Request, b capturedRequest) (int, []string) {
+			return http.StatusNotFound, []string{`{"error":{"message":"model not found"}}`}
+		})
+
+		_, err := model.OpenStream(context.Background(), http.DefaultClient, nil, nil, core.StreamCfg{})
+		if err == nil || !strings.Contains(err.Error(), "model not found") {
+			t.Fatalf("expected error with the response body, got %v", err)
+		}
+	})
+
+	for name, chunks := range map[string][]string{
+		"error chunk": {
+			`{"choices":[{"index":0,"delta":{"content":"Hel"}}]}`,
+			`{"error":{"message":"upstream overloaded","code":502}}`,
+		},
+		"truncated stream": {
+			`{"choices":[{"index":0,"delta":{"content":"Hel"}}]}`,
+		},
+		"invalid chunk": {
+			`{"choices":[`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			model := serve(t, func(r *http.Request, b capturedRequest) (int, []string) {
+				return http.StatusOK, chunks
+			})
+
+			stream, err := model.OpenStream(context.Background(), http.DefaultClient, nil, nil, core.StreamCfg{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			ch := make(chan core.Event)
+			go stream.Consume(context.Background(), ch)
+
+			var gotErr, gotResp bool
+			for ev := range ch {
+				gotErr = gotErr || ev.Type == core.EvError
+				gotResp = gotResp || ev.Type == core.EvResp
+			}
+			if !gotErr || gotResp {
+				t.Fatalf("expected an error and no response, got error=%v response=%v", gotErr, gotResp)
+			}
+		})
+	}
+}
+
+// capturedRequest is what the stand-in server decodes, keeping the tool schemas as raw JSON.
+type capturedRequest struct {
+	requestBody
+	Tools []struct {
+		Type     string `json:"type"`
+		Function struct {
+			Name       string          `json:"name"`
+			Parameters json.RawMessage `json:"parameters"`
+		} `json:"function"`
+	} `json:"tools"`
+}
+
+// serve starts a stand-in server that answers chat completion requests with the chunks returned by
+// handler, each sent as its own SSE event.
+func serve(t *testing.T, handler func(*http.Request, capturedRequest) (int, []string)) *Model {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("error reading request: %v", err)
+			return
+		}
+
+		var body capturedRequest
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Errorf("error decoding request: %v", err)
+			return
+		}
+
+		status, chunks := handler(r, body)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			io.WriteString(w, strings.Join(chunks, "\n"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, c := range chunks {
+			fmt.Fprintf(w, "data: %s\n\n", c)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return NewModel(server.URL+"/v1/", "llama3.2:3b")
+}
+
+func consume(
+	t *testing.T,
+	model *Model,
+	msgs []*core.Msg,
+	tools []core.Tool,
+	cfg core.StreamCfg,
+) (core.Response, []core.Event) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := model.OpenStream(ctx, http.DefaultClient, msgs, tools, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error opening stream: %v", err)
+	}
+
+	ch := make(chan core.Event)
+	go stream.Consume(ctx, ch)
+
+	var r core.Response
+	var events []core.Event
+	for ev := range ch {
+		switch ev.Type {
+		case core.EvError:
+			t.Fatalf("unexpected error event: %v", ev.Err)
+		case core.EvResp:
+			r = ev.Response
+		}
+		events = append(events, ev)
+	}
+
+	if r.Messages == nil {
+		t.Fatalf("no response received")
+	}
+
+	return r, events
+}
+
+func eventsOfType(events []core.Event, typ core.EventType) []core.Event {
+	var r []core.Event
+	for _, ev := range events {
+		if ev.Type == typ {
+			r = append(r, ev)
+		}
+	}
+	return r
+}
+
+var getWeatherTool = core.Tool{
+	Name: "getWeather",
+	Desc: "Get the weather for a given location",
+	Params: map[string]core.ToolParam{
+		"location": {
+			Type: core.JSTString,
+			Desc: "The location to get the weather for",
+		},
+		"units": {
+			Type:     core.JSTString,
+			Desc:     "The units to use for the weather",
+			Enum:     []string{"Celsius", "Fahrenheit"},
+			Optional: true,
+			Nullable: boolPtr(true),
+		},
+	},
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
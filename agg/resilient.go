@@ -0,0 +1,273 @@
+package agg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/victhorio/opa/agg/core"
+)
+
+// ResilientModel wraps a model so that transient failures (rate limits, overloaded or failing
+// servers, dropped connections) don't cost the user their turn. Failed requests are retried with
+// exponential backoff, honoring Retry-After, and once the attempts on a model are exhausted the
+// request fails over to the next of the fallback models.
+//
+// Streams that fail midway are retried as well, as long as no tool call was emitted yet (since the
+// agent will already be running it). The retried attempt generates its text from scratch, which
+// won't match what the failed one emitted, so an EvRetry is emitted before it to let listeners
+// discard the deltas they already got. The final response is always the one of the successful
+// attempt.
+//
+// The history and the way a response is forced (see requestFor) are prepared for the model that
+// ends up serving each attempt, so fallbacks can be from a different provider than the primary.
+type ResilientModel struct {
+	models []core.Model
+	policy RetryPolicy
+}
+
+// RetryPolicy configures how a ResilientModel retries failed requests. The zero value uses the
+// defaults described for each field.
+type RetryPolicy struct {
+	// Attempts is how many times a request is tried on each model, including the first one, before
+	// failing over to the next model. Defaults to modelAttemptsDefault.
+	Attempts int
+
+	// Backoff is the wait before the first retry, doubled on every subsequent one. Defaults to
+	// modelBackoffDefault.
+	Backoff time.Duration
+
+	// MaxBackoff caps the wait between attempts. If the API asks us to wait for longer than this
+	// we fail over right away instead, or give up if there are no more models. Defaults to
+	// modelMaxBackoffDefault.
+	MaxBackoff time.Duration
+}
+
+// NewResilientModel wraps primary so that failed requests are retried according to policy, and
+// then tried on each of the fallbacks in order.
+func NewResilientModel(primary core.Model, policy RetryPolicy, fallbacks ...core.Model) *ResilientModel {
+	if policy.Attempts <= 0 {
+		policy.Attempts = modelAttemptsDefault
+	}
+	if policy.Backoff <= 0 {
+		policy.Backoff = modelBackoffDefault
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = modelMaxBackoffDefault
+	}
+
+	return &ResilientModel{
+		models: append([]core.Model{primary}, fallbacks...),
+		policy: policy,
+	}
+}
+
+// PreparesRequests reports that the agent should leave requests as they are, since they're
+// prepared for whichever of the models serves each attempt.
+func (m *ResilientModel) PreparesRequests() bool {
+	return true
+}
+
+func (m *ResilientModel) Provider() core.Provider {
+	return m.models[0].Provider()
+}
+
+func (m *ResilientModel) OpenStream(
+	ctx context.Context,
+	client *http.Client,
+	msgs []*core.Msg,
+	tools []core.Tool,
+	cfg core.StreamCfg,
+) (core.ResponseStream, error) {
+	s := &resilientStream{
+		m:      m,
+		client: client,
+		msgs:   msgs,
+		tools:  tools,
+		cfg:    cfg,
+	}
+
+	if err := s.open(ctx, nil); err != nil {
+		return nil, fmt.Errorf("ResilientModel.OpenStream: %w", err)
+	}
+
+	return s, nil
+}
+
+// resilientStream holds everything needed to reopen the stream, along with where we are in the
+// retry policy.
+type resilientStream struct {
+	m      *ResilientModel
+	client *http.Client
+	msgs   []*core.Msg
+	tools  []core.Tool
+	cfg    core.StreamCfg
+
+	// current is the stream of the current attempt, opened by models[model]
+	current  core.ResponseStream
+	model    int
+	attempts int
+}
+
+// open opens a stream, retrying and failing over as needed. lastErr is the error that made us
+// reopen the stream, nil when opening it for the first time.
+func (s *resilientStream) open(ctx context.Context, lastErr error) error {
+	for s.model < len(s.m.models) {
+		if lastErr != nil && s.attempts >= s.m.policy.Attempts {
+			s.failover(lastErr)
+			continue
+		}
+
+		// the first attempt on a fallback model doesn't need to wait
+		if lastErr != nil && s.attempts > 0 {
+			delay := min(s.m.policy.Backoff<<min(s.attempts-1, 16), s.m.policy.MaxBackoff)
+
+			var apiErr *core.APIError
+			if errors.As(lastErr, &apiErr) && apiErr.RetryAfter > delay {
+				if apiErr.RetryAfter > s.m.policy.MaxBackoff {
+					// we were asked to wait for too long, so there's no point in retrying
+					s.failover(lastErr)
+					continue
+				}
+				delay = apiErr.RetryAfter
+			}
+
+			log.Printf("retrying model request in %s after error: %v", delay, lastErr)
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("context error: %w (after %w)", ctx.Err(), lastErr)
+			case <-time.After(delay):
+			}
+		}
+
+		model := s.m.models[s.model]
+		s.attempts++
+
+		msgs, cfg := prepareRequest(model, s.msgs, s.cfg)
+		stream, err := model.OpenStream(ctx, s.client, msgs, s.tools, cfg)
+		if err == nil {
+			s.current = stream
+			return nil
+		}
+		if !isTransient(err) {
+			return err
+		}
+		lastErr = err
+	}
+
+	return fmt.Errorf("giving up after exhausting every model: %w", lastErr)
+}
+
+func (s *resilientStream) failover(err error) {
+	s.model++
+	s.attempts = 0
+	if s.model < len(s.m.models) {
+		log.Printf("failing over to %s model after error: %v", s.m.models[s.model].Provider(), err)
+	}
+}
+
+// Consume forwards the events of the current stream, reopening it if it fails midway. This
+// function closes the channel at the end of execution.
+func (s *resilientStream) Consume(ctx context.Context, out chan<- core.Event) {
+	defer close(out)
+
+	// whether deltas were emitted since the stream started or was last reset with an EvRetry, and
+	// whether a tool call was, which rules out retrying
+	var sentDeltas, sentCalls bool
+
+	for {
+		provider := s.m.models[s.model].Provider()
+
+		ctxAttempt, cancel := context.WithCancel(ctx)
+		events := make(chan core.Event, 1)
+		go s.current.Consume(ctxAttempt, events)
+
+		var failure error
+
+	loop:
+		for event := range events {
+			switch event.Type {
+			case core.EvDelta, core.EvDeltaReason:
+				sentDeltas = true
+			case core.EvToolCall:
+				sentCalls = true
+			case core.EvResp:
+				for _, msg := range event.Response.Messages {
+					msg.Provider = provider
+				}
+			case core.EvError:
+				failure = event.Err
+				break loop
+			}
+
+			if !sendEvent(ctx, out, event) {
+				break
+			}
+		}
+		cancel()
+
+		if failure == nil {
+			// either we're done or the context was cancelled
+			return
+		}
+
+		if sentCalls || !isTransient(failure) {
+			_ = sendEvent(ctx, out, core.NewEvError(failure))
+			return
+		}
+
+		if sentDeltas {
+			if !sendEvent(ctx, out, core.NewEvRetry(failure)) {
+				return
+			}
+			sentDeltas = false
+		}
+
+		if err := s.open(ctx, failure); err != nil {
+			_ = sendEvent(ctx, out, core.NewEvError(fmt.Errorf("ResilientModel: %w", err)))
+			return
+		}
+	}
+}
+
+// isTransient reports whether err is worth retrying: transient API errors and network failures,
+// including connections that were closed before the response was complete.
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr *core.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+// sendEvent sends an event to the output channel while avoiding blocking if context is done.
+// Returns true if the event was sent, false if the context is done.
+func sendEvent(ctx context.Context, out chan<- core.Event, ev core.Event) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case out <- ev:
+		return true
+	}
+}
+
+const (
+	modelAttemptsDefault   = 3
+	modelBackoffDefault    = time.Second
+	modelMaxBackoffDefault = 30 * time.Second
+)
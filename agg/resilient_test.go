@@ -0,0 +1,306 @@
+package agg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/victhorio/opa/agg/anthropic"
+	"github.com/victhorio/opa/agg/core"
+	"github.com/victhorio/opa/agg/fake"
+	"github.com/victhorio/opa/agg/openaicompat"
+)
+
+// quickRetries keeps the tests fast while still going through the backoff.
+var quickRetries = RetryPolicy{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: 100 * time.Millisecond}
+
+func TestResilientRetriesRateLimit(t *testing.T) {
+	var calls atomic.Int32
+	srv := serveAttempts(t, &calls, func(w http.ResponseWriter, attempt int) {
+		if attempt == 1 {
+			w.Header().Set("Retry-After", "0.05")
+			w.WriteHeader(http.StatusTooManyRequests)
+			io.WriteString(w, `{"error":{"message":"slow down"}}`)
+			return
+		}
+		writeChunks(w, true, "Hel", "lo!")
+	})
+
+	start := time.Now()
+	out, deltas, err := runResilient(t, NewResilientModel(openaicompat.NewModel(srv.URL, "m"), quickRetries))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "Hello!" || deltas != "Hel|lo!" {
+		t.Errorf("expected 'Hello!' from deltas 'Hel|lo!', got %q from %q", out, deltas)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("expected 2 requests, got %d", calls.Load())
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected Retry-After to be honored, retried after %s", elapsed)
+	}
+}
+
+func TestResilientRetriesMidStream(t *testing.T) {
+	var calls atomic.Int32
+	srv := serveAttempts(t, &calls, func(w http.ResponseWriter, attempt int) {
+		switch attempt {
+		case 1:
+			w.WriteHeader(http.StatusInternalServerError)
+		case 2:
+			// the connection drops before the response is finished
+			writeChunks(w, false, "The cap", "ital")
+		default:
+			writeChunks(w, true, "The capital ", "is Paris.")
+		}
+	})
+
+	out, deltas, err := runResilient(t, NewResilientModel(openaicompat.NewModel(srv.URL, "m"), quickRetries))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "The capital is Paris." {
+		t.Errorf("expected the response of the last attempt, got %q", out)
+	}
+	// the retry starts over, after telling listeners to drop what the failed attempt delivered
+	if deltas != "The cap|ital|<retry>|The capital |is Paris." {
+		t.Errorf("expected the deltas of both attempts around a retry, got %q", deltas)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("expected 3 requests, got %d", calls.Load())
+	}
+}
+
+func TestResilientRetryDiscardsDeltas(t *testing.T) {
+	var calls atomic.Int32
+	srv := serveAttempts(t, &calls, func(w http.ResponseWriter, attempt int) {
+		if attempt == 1 {
+			writeChunks(w, false, "The capital of France ", "is")
+			return
+		}
+		// the retry takes a different turn, so nothing of the failed attempt can be kept
+		writeChunks(w, true, "Paris is ", "the capital.")
+	})
+
+	// a listener that shows the text as it streams, as the TUI does
+	var shown strings.Builder
+	store := NewEphemeralStore()
+	agent := NewAgent("sys", NewResilientModel(openaicompat.NewModel(srv.URL, "m"), quickRetries), &store, nil)
+	out, err := agent.RunStream(context.Background(), http.DefaultClient, "s", "hi", false, func(ev core.Event) {
+		switch ev.Type {
+		case core.EvDelta:
+			shown.WriteString(ev.Delta)
+		case core.EvRetry:
+			shown.Reset()
+		}
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "Paris is the capital." || shown.String() != out {
+		t.Errorf("expected to show exactly the response of the retry, got %q (response %q)", shown.String(), out)
+	}
+}
+
+func TestResilientFailover(t *testing.T) {
+	var calls atomic.Int32
+	srv := serveAttempts(t, &calls, func(w http.ResponseWriter, attempt int) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	fallback := fake.NewModel(core.ProviderAnthropic, fake.NewTurn().Text("Hi from the fallback."))
+	model := NewResilientModel(openaicompat.NewModel(srv.URL, "m"), quickRetries, fallback)
+
+	store := NewEphemeralStore()
+	agent := NewAgent("sys", model, &store, nil)
+	out, err := agent.RunStream(context.Background(), http.DefaultClient, "s", "hi", false, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "Hi from the fallback." {
+		t.Errorf("expected the fallback's response, got %q", out)
+	}
+	if calls.Load() != int32(quickRetries.Attempts) {
+		t.Errorf("expected %d requests to the primary, got %d", quickRetries.Attempts, calls.Load())
+	}
+
+	msgs := store.Messages("s")
+	if last := msgs[len(msgs)-1]; last.Provider != core.ProviderAnthropic {
+		t.Errorf("expected the response to be attributed to the fallback, got %q", last.Provider)
+	}
+}
+
+func TestResilientFailoverForcedResponse(t *testing.T) {
+	// an OpenAI primary that calls tools until the round limit and then goes down
+	primary := fake.NewModel(core.ProviderOpenAI)
+	for i := range agentRoundsMax - 1 {
+		primary.Push(fake.NewTurn().ToolCall(fmt.Sprint(i), "sleep", `{"ms": 0}`))
+	}
+	for range quickRetries.Attempts {
+		primary.Push(fake.NewTurn().FailOpen(&core.APIError{Provider: core.ProviderOpenAI, Status: http.StatusServiceUnavailable}))
+	}
+
+	var bodies []string
+	srv := serveAnthropic(t, &bodies, "Done for now.")
+	fallback := anthropic.NewModel(anthropic.Haiku, 1024, 0, false).WithBaseURL(srv.URL)
+
+	store := NewEphemeralStore()
+	agent := NewAgent("sys", NewResilientModel(primary, quickRetries, fallback), &store, []Tool{sleepTool()})
+	out, err := agent.Run(context.Background(), http.DefaultClient, "s", "hi", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "Done for now." {
+		t.Errorf("expected the fallback's response, got %q", out)
+	}
+
+	// each model gets the response forced its own way
+	calls := primary.Calls()
+	if last := calls[len(calls)-1]; !hasSystemPrompt(last.Msgs, toolCallLimitReachedPrompt) {
+		t.Errorf("expected OpenAI to be forced with a system message")
+	}
+	if len(bodies) != 1 || !strings.Contains(bodies[0], `"tool_choice":{"type":"none"}`) {
+		t.Errorf("expected Anthropic to be forced with tools disabled, got %v", bodies)
+	}
+	if strings.Contains(bodies[0], "maximum number of sequential tool call turns") {
+		t.Errorf("expected no system message for Anthropic besides the system prompt")
+	}
+}
+
+func TestResilientNestedForcedResponse(t *testing.T) {
+	model := fake.NewModel(core.ProviderOpenAI)
+	for i := range agentRoundsMax - 1 {
+		model.Push(fake.NewTurn().ToolCall(fmt.Sprint(i), "sleep", `{"ms": 0}`))
+	}
+	model.Push(fake.NewTurn().Text("Done for now."))
+
+	// the request is only prepared once, by the innermost model that serves it
+	nested := NewResilientModel(NewResilientModel(model, quickRetries), quickRetries)
+	store := NewEphemeralStore()
+	agent := NewAgent("sys", nested, &store, []Tool{sleepTool()})
+	if _, err := agent.Run(context.Background(), http.DefaultClient, "s", "hi", false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	calls := model.Calls()
+	forced := 0
+	for _, msg := range calls[len(calls)-1].Msgs {
+		if c, ok := msg.AsContent(); ok && c.Role == "system" && c.Text == toolCallLimitReachedPrompt {
+			forced++
+		}
+	}
+	if forced != 1 {
+		t.Errorf("expected the response to be forced once, got %d system messages", forced)
+	}
+}
+
+func TestResilientGivesUp(t *testing.T) {
+	for name, tc := range map[string]struct {
+		status   int
+		header   string
+		attempts int32
+	}{
+		"non-transient":     {http.StatusBadRequest, "", 1},
+		"retry-after large": {http.StatusTooManyRequests, "3600", 1},
+		"exhausted":         {http.StatusBadGateway, "", int32(quickRetries.Attempts)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var calls atomic.Int32
+			srv := serveAttempts(t, &calls, func(w http.ResponseWriter, attempt int) {
+				if tc.header != "" {
+					w.Header().Set("Retry-After", tc.header)
+				}
+				w.WriteHeader(tc.status)
+			})
+
+			_, _, err := runResilient(t, NewResilientModel(openaicompat.NewModel(srv.URL, "m"), quickRetries))
+
+			var apiErr *core.APIError
+			if !errors.As(err, &apiErr) || apiErr.Status != tc.status {
+				t.Fatalf("expected an API error with status %d, got %v", tc.status, err)
+			}
+			if calls.Load() != tc.attempts {
+				t.Errorf("expected %d requests, got %d", tc.attempts, calls.Load())
+			}
+		})
+	}
+}
+
+func TestResilientNoRetryAfterToolCall(t *testing.T) {
+	overloaded := &core.APIError{Provider: core.ProviderAnthropic, Type: "overloaded_error", Message: "Overloaded"}
+	primary := fake.NewModel(
+		core.ProviderAnthropic,
+		fake.NewTurn().ToolCall("call_1", "sleep", `{"ms":1}`).Error(overloaded),
+		fake.NewTurn().Text("never used"),
+	)
+	model := NewResilientModel(primary, quickRetries)
+
+	store := NewEphemeralStore()
+	agent := NewAgent("sys", model, &store, []Tool{sleepTool()})
+	_, err := agent.RunStream(context.Background(), http.DefaultClient, "s", "hi", false, nil)
+
+	var apiErr *core.APIError
+	if !errors.As(err, &apiErr) || apiErr.Type != "overloaded_error" {
+		t.Fatalf("expected the overloaded error, got %v", err)
+	}
+	if len(primary.Calls()) != 1 {
+		t.Errorf("expected no retries after a tool call, got %d calls", len(primary.Calls()))
+	}
+}
+
+// serveAttempts starts a stand-in server that counts the requests it gets and lets handler answer
+// each of them given its (1-based) number.
+func serveAttempts(t *testing.T, calls *atomic.Int32, handler func(w http.ResponseWriter, attempt int)) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		handler(w, int(calls.Add(1)))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// writeChunks streams the given text deltas as chat completion chunks, finishing the response only
+// if complete is set.
+func writeChunks(w http.ResponseWriter, complete bool, deltas ...string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	for _, d := range deltas {
+		fmt.Fprintf(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":%q},\"finish_reason\":null}]}\n\n", d)
+	}
+	if !complete {
+		return
+	}
+	fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n")
+	fmt.Fprint(w, "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":5,\"completion_tokens\":3,\"total_tokens\":8}}\n\n")
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+// runResilient runs a single turn with model, returning the output and the deltas joined by "|",
+// with retries as "<retry>".
+func runResilient(t *testing.T, model core.Model) (string, string, error) {
+	t.Helper()
+
+	store := NewEphemeralStore()
+	agent := NewAgent("sys", model, &store, nil)
+
+	var deltas []string
+	out, err := agent.RunStream(context.Background(), http.DefaultClient, "s", "hi", false, func(ev core.Event) {
+		switch ev.Type {
+		case core.EvDelta:
+			deltas = append(deltas, ev.Delta)
+		case core.EvRetry:
+			deltas = append(deltas, "<retry>")
+		}
+	})
+	return out, strings.Join(deltas, "|"), err
+}
@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/victhorio/opa/agg/core"
 	_ "modernc.org/sqlite"
@@ -70,24 +73,104 @@ func initSchema(db *sql.DB) error {
 		CREATE INDEX IF NOT EXISTS idx_messages_session_id_id
 			ON messages(session_id, id);
 
-		CREATE TABLE IF NOT EXISTS usage (
-			session_id TEXT PRIMARY KEY,
+		-- one row per model response, see usageRecord
+		CREATE TABLE IF NOT EXISTS usage_records (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			session_id TEXT NOT NULL,
+			message_id INTEGER REFERENCES messages(id),
+			provider TEXT NOT NULL DEFAULT '',
+			model TEXT NOT NULL DEFAULT '',
+			tools TEXT NOT NULL DEFAULT '',
 			input_tokens INTEGER NOT NULL DEFAULT 0,
 			cached_tokens INTEGER NOT NULL DEFAULT 0,
+			cache_write_tokens INTEGER NOT NULL DEFAULT 0,
 			output_tokens INTEGER NOT NULL DEFAULT 0,
 			reasoning_tokens INTEGER NOT NULL DEFAULT 0,
 			cost INTEGER NOT NULL DEFAULT 0,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 		);
+
+		CREATE INDEX IF NOT EXISTS idx_usage_records_session_id
+			ON usage_records(session_id);
+
+		-- every session, including the ones created ahead of their first message
+		CREATE TABLE IF NOT EXISTS sessions (
+			id TEXT PRIMARY KEY,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+
+		-- sessions from before the table existed only have messages
+		INSERT OR IGNORE INTO sessions (id, created_at)
+			SELECT session_id, MIN(created_at) FROM messages GROUP BY session_id;
 	`
 
 	if _, err := db.Exec(schema); err != nil {
 		return fmt.Errorf("failed to create schema: %w", err)
 	}
 
+	if err := migrateUsageTable(db); err != nil {
+		return fmt.Errorf("failed to migrate usage: %w", err)
+	}
+
 	return nil
 }
 
+// migrateUsageTable moves the usage of databases from before usage was recorded per response,
+// when there was a single aggregated row per session, into usage_records. Each session keeps its
+// totals as a single record that isn't attributed to any message or model.
+func migrateUsageTable(db *sql.DB) error {
+	var columns []string
+	rows, err := db.Query(`SELECT name FROM pragma_table_info('usage')`)
+	if err != nil {
+		return fmt.Errorf("failed to inspect usage table: %w", err)
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to inspect usage table: %w", err)
+		}
+		columns = append(columns, name)
+	}
+	rows.Close()
+
+	if len(columns) == 0 {
+		return nil
+	}
+
+	// cache writes were only tracked by the last versions that used the table
+	cacheWrite := "0"
+	if slices.Contains(columns, "cache_write_tokens") {
+		cacheWrite = "cache_write_tokens"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO usage_records (
+			session_id, input_tokens, cached_tokens, cache_write_tokens, output_tokens,
+			reasoning_tokens, cost, created_at
+		)
+		SELECT
+			session_id, input_tokens, cached_tokens, ` + cacheWrite + `, output_tokens,
+			reasoning_tokens, cost, created_at
+		FROM usage
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to copy usage: %w", err)
+	}
+
+	if _, err := tx.Exec(`DROP TABLE usage`); err != nil {
+		return fmt.Errorf("failed to drop usage table: %w", err)
+	}
+
+	return tx.Commit()
+}
+
 // Close closes the database connection.
 func (s *SQLiteStore) Close() error {
 	return s.db.Close()
@@ -179,6 +262,10 @@ func (s *SQLiteStore) Extend(sessionID string, msgs []*core.Msg, usage core.Usag
 	}
 	defer tx.Rollback()
 
+	if _, err := tx.Exec("INSERT OR IGNORE INTO sessions (id) VALUES (?)", sessionID); err != nil {
+		return fmt.Errorf("failed to insert session: %w", err)
+	}
+
 	// Insert messages
 	stmt, err := tx.Prepare("INSERT INTO messages (session_id, payload) VALUES (?, ?)")
 	if err != nil {
@@ -186,30 +273,69 @@ func (s *SQLiteStore) Extend(sessionID string, msgs []*core.Msg, usage core.Usag
 	}
 	defer stmt.Close()
 
+	var records []usageRecord
+	var attributed core.Usage
+	var tools toolsTracker
+
 	for _, msg := range msgs {
 		payload, err := json.Marshal(msg)
 		if err != nil {
 			return fmt.Errorf("failed to serialize message: %w", err)
 		}
 
-		if _, err := stmt.Exec(sessionID, payload); err != nil {
+		res, err := stmt.Exec(sessionID, payload)
+		if err != nil {
 			return fmt.Errorf("failed to insert message: %w", err)
 		}
+
+		tools.track(msg)
+		if msg.Usage == nil {
+			continue
+		}
+
+		id, err := res.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("failed to get message id: %w", err)
+		}
+
+		var toolNames string
+		if msg.Type == core.MsgTypeToolResult {
+			// what a tool spent on its own (e.g. a sub-agent) is only the tool's
+			toolNames = tools.names[msg.ToolResult.ID]
+		} else {
+			toolNames = tools.flush()
+		}
+
+		records = append(records, usageRecord{
+			messageID: sql.NullInt64{Int64: id, Valid: true},
+			provider:  msg.Provider,
+			model:     msg.Model,
+			tools:     toolNames,
+			usage:     *msg.Usage,
+		})
+		attributed.Inc(*msg.Usage)
 	}
 
-	// Upsert usage with accumulation
-	_, err = tx.Exec(`
-		INSERT INTO usage (session_id, input_tokens, cached_tokens, output_tokens, reasoning_tokens, cost)
-		VALUES (?, ?, ?, ?, ?, ?)
-		ON CONFLICT(session_id) DO UPDATE SET
-			input_tokens = usage.input_tokens + excluded.input_tokens,
-			cached_tokens = usage.cached_tokens + excluded.cached_tokens,
-			output_tokens = usage.output_tokens + excluded.output_tokens,
-			reasoning_tokens = usage.reasoning_tokens + excluded.reasoning_tokens,
-			cost = usage.cost + excluded.cost
-	`, sessionID, usage.Input, usage.Cached, usage.Output, usage.Reasoning, usage.Cost)
-	if err != nil {
-		return fmt.Errorf("failed to upsert usage: %w", err)
+	// whatever usage didn't come with a message (e.g. from a response that was interrupted) is
+	// still recorded, just not attributed to anything
+	if rest := usageDiff(usage, attributed); rest != (core.Usage{}) {
+		records = append(records, usageRecord{usage: rest})
+	}
+
+	for _, r := range records {
+		_, err = tx.Exec(`
+			INSERT INTO usage_records (
+				session_id, message_id, provider, model, tools, input_tokens, cached_tokens,
+				cache_write_tokens, output_tokens, reasoning_tokens, cost
+			)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`,
+			sessionID, r.messageID, r.provider, r.model, r.tools, r.usage.Input, r.usage.Cached,
+			r.usage.CacheWrite, r.usage.Output, r.usage.Reasoning, r.usage.Cost,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to insert usage: %w", err)
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -261,22 +387,203 @@ func (s *SQLiteStore) loadMessages(sessionID string) ([]*core.Msg, error) {
 func (s *SQLiteStore) loadUsage(sessionID string) (core.Usage, error) {
 	var usage core.Usage
 	err := s.db.QueryRow(`
-		SELECT input_tokens, cached_tokens, output_tokens, reasoning_tokens, cost
-		FROM usage
+		SELECT
+			COALESCE(SUM(input_tokens), 0),
+			COALESCE(SUM(cached_tokens), 0),
+			COALESCE(SUM(cache_write_tokens), 0),
+			COALESCE(SUM(output_tokens), 0),
+			COALESCE(SUM(reasoning_tokens), 0),
+			COALESCE(SUM(cost), 0)
+		FROM usage_records
 		WHERE session_id = ?
-	`, sessionID).Scan(&usage.Input, &usage.Cached, &usage.Output, &usage.Reasoning, &usage.Cost)
-
-	if err == sql.ErrNoRows {
-		// No usage data found, return zero-valued Usage
-		return core.Usage{}, nil
-	}
-
+	`, sessionID).Scan(&usage.Input, &usage.Cached, &usage.CacheWrite, &usage.Output, &usage.Reasoning, &usage.Cost)
 	if err != nil {
 		return core.Usage{}, fmt.Errorf("failed to query usage: %w", err)
 	}
 
 	// Recompute total
-	usage.Total = usage.Input + usage.Cached + usage.Output
+	usage.Total = usage.Input + usage.Cached + usage.CacheWrite + usage.Output
 
 	return usage, nil
 }
+
+// UsageBreakdown returns the usage of the responses that match filter, grouped by group and sorted
+// by key.
+func (s *SQLiteStore) UsageBreakdown(group UsageGroup, filter UsageFilter) ([]UsageRow, error) {
+	var key string
+	switch group {
+	case UsageByDay:
+		key = "date(created_at, 'localtime')"
+	case UsageByModel:
+		key = "CASE WHEN provider = '' THEN model ELSE provider || ':' || model END"
+	case UsageBySession:
+		key = "session_id"
+	case UsageByTool:
+		key = "tools"
+	default:
+		return nil, fmt.Errorf("SQLiteStore.UsageBreakdown: unknown group %d", group)
+	}
+
+	var where []string
+	var args []any
+	if !filter.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, filter.Since.UTC().Format(time.DateTime))
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, filter.Until.UTC().Format(time.DateTime))
+	}
+	if filter.SessionID != "" {
+		where = append(where, "session_id = ?")
+		args = append(args, filter.SessionID)
+	}
+
+	query := `
+		SELECT ` + key + ` AS k, COUNT(message_id), SUM(input_tokens), SUM(cached_tokens),
+			SUM(cache_write_tokens), SUM(output_tokens), SUM(reasoning_tokens), SUM(cost)
+		FROM usage_records`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " GROUP BY k ORDER BY k"
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("SQLiteStore.UsageBreakdown: failed to query usage: %w", err)
+	}
+	defer rows.Close()
+
+	var r []UsageRow
+	for rows.Next() {
+		var row UsageRow
+		u := &row.Usage
+		if err := rows.Scan(&row.Key, &row.Responses, &u.Input, &u.Cached, &u.CacheWrite, &u.Output, &u.Reasoning, &u.Cost); err != nil {
+			return nil, fmt.Errorf("SQLiteStore.UsageBreakdown: failed to scan usage: %w", err)
+		}
+		u.Total = u.Input + u.Cached + u.CacheWrite + u.Output
+		r = append(r, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SQLiteStore.UsageBreakdown: failed to read usage: %w", err)
+	}
+
+	return r, nil
+}
+
+// Spend returns how much was spent since the given time, across every session and embeddings.
+func (s *SQLiteStore) Spend(since time.Time) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var spent int64
+	err := s.db.QueryRow(
+		"SELECT COALESCE(SUM(cost), 0) FROM usage_records WHERE created_at >= ?",
+		since.UTC().Format(time.DateTime),
+	).Scan(&spent)
+	if err != nil {
+		return 0, fmt.Errorf("SQLiteStore.Spend: failed to query usage: %w", err)
+	}
+
+	return spent, nil
+}
+
+// RecordEmbeddings records the usage of an embeddings request. Since embeddings don't belong to
+// any session, they're recorded with an empty session ID, which is how they show up in usage
+// breakdowns by session.
+func (s *SQLiteStore) RecordEmbeddings(provider core.Provider, result *core.EmbeddingsResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec(`
+		INSERT INTO usage_records (session_id, provider, model, input_tokens, cost)
+		VALUES ('', ?, ?, ?, ?)
+	`, provider, result.Model, result.Tokens, result.Cost)
+	if err != nil {
+		return fmt.Errorf("SQLiteStore.RecordEmbeddings: failed to insert usage: %w", err)
+	}
+
+	return nil
+}
+
+// SessionInfo summarizes a session, as returned by SQLiteStore.Sessions.
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	// UpdatedAt is when the last message was added, or CreatedAt if there are none yet.
+	UpdatedAt time.Time `json:"updated_at"`
+	Messages  int       `json:"messages"`
+	Cost      int64     `json:"cost"`
+}
+
+// CreateSession registers a session ahead of its first message, so that it's listed by Sessions.
+// Creating a session that already exists is not an error.
+func (s *SQLiteStore) CreateSession(sessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.db.Exec("INSERT OR IGNORE INTO sessions (id) VALUES (?)", sessionID); err != nil {
+		return fmt.Errorf("SQLiteStore.CreateSession: failed to insert session: %w", err)
+	}
+	return nil
+}
+
+// HasSession reports whether the session exists, either created with CreateSession or extended.
+func (s *SQLiteStore) HasSession(sessionID string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var n int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM sessions WHERE id = ?", sessionID).Scan(&n); err != nil {
+		return false, fmt.Errorf("SQLiteStore.HasSession: failed to query session: %w", err)
+	}
+	return n > 0, nil
+}
+
+// Sessions returns every session, most recently updated first.
+func (s *SQLiteStore) Sessions() ([]SessionInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.Query(`
+		SELECT s.id,
+			strftime('%Y-%m-%d %H:%M:%S', s.created_at),
+			strftime('%Y-%m-%d %H:%M:%S', COALESCE(MAX(m.created_at), s.created_at)) AS updated_at,
+			COUNT(m.id),
+			(SELECT COALESCE(SUM(cost), 0) FROM usage_records u WHERE u.session_id = s.id)
+		FROM sessions s
+		LEFT JOIN messages m ON m.session_id = s.id
+		GROUP BY s.id
+		ORDER BY updated_at DESC, s.id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("SQLiteStore.Sessions: failed to query sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var r []SessionInfo
+	for rows.Next() {
+		var info SessionInfo
+		var created, updated string
+		if err := rows.Scan(&info.ID, &created, &updated, &info.Messages, &info.Cost); err != nil {
+			return nil, fmt.Errorf("SQLiteStore.Sessions: failed to scan session: %w", err)
+		}
+
+		// sqlite's CURRENT_TIMESTAMP is always in UTC
+		if info.CreatedAt, err = time.ParseInLocation(time.DateTime, created, time.UTC); err != nil {
+			return nil, fmt.Errorf("SQLiteStore.Sessions: invalid creation time %q: %w", created, err)
+		}
+		if info.UpdatedAt, err = time.ParseInLocation(time.DateTime, updated, time.UTC); err != nil {
+			return nil, fmt.Errorf("SQLiteStore.Sessions: invalid update time %q: %w", updated, err)
+		}
+		r = append(r, info)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SQLiteStore.Sessions: failed to read sessions: %w", err)
+	}
+
+	return r, nil
+}
@@ -1,10 +1,16 @@
 package agg
 
 import (
+	"context"
+	"database/sql"
+	"net/http"
 	"path/filepath"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/victhorio/opa/agg/core"
+	"github.com/victhorio/opa/agg/fake"
 )
 
 func TestSQLiteStore_Memory(t *testing.T) {
@@ -351,3 +357,217 @@ func TestSQLiteStore_Persistence(t *testing.T) {
 		}
 	})
 }
+
+func TestSQLiteStore_MigratesUsageTable(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "old.db")
+
+	// a database from before usage was recorded per response
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE usage (
+			session_id TEXT PRIMARY KEY,
+			input_tokens INTEGER NOT NULL DEFAULT 0,
+			cached_tokens INTEGER NOT NULL DEFAULT 0,
+			output_tokens INTEGER NOT NULL DEFAULT 0,
+			reasoning_tokens INTEGER NOT NULL DEFAULT 0,
+			cost INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		INSERT INTO usage (session_id, input_tokens, output_tokens) VALUES ('s', 10, 5);
+	`)
+	db.Close()
+	if err != nil {
+		t.Fatalf("failed to create old schema: %v", err)
+	}
+
+	store, err := NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+
+	if err := store.Extend("s", nil, core.Usage{Input: 1, CacheWrite: 100, Output: 1}); err != nil {
+		t.Fatalf("failed to extend session: %v", err)
+	}
+
+	store.Close()
+
+	// the usage is read back from the database since it's not loaded yet
+	store, err = NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store.Close()
+
+	if u := store.Usage("s"); u.Input != 11 || u.CacheWrite != 100 || u.Total != 117 {
+		t.Fatalf("unexpected usage after migration: %+v", u)
+	}
+}
+
+func TestSQLiteStore_UsageBreakdown(t *testing.T) {
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	model := fake.NewModel(
+		core.ProviderOpenAI,
+		fake.NewTurn().ToolCall("c1", "sleep", `{"ms":1}`).Usage(core.Usage{Input: 100, Output: 10, Reasoning: 5, Cost: 1000}),
+		fake.NewTurn().Text("Done.").Usage(core.Usage{Input: 120, Cached: 100, Output: 20, Cost: 2000}),
+	)
+	agent := NewAgent("sys", model, store, []Tool{sleepTool()})
+	if _, err := agent.Run(context.Background(), http.DefaultClient, "s", "hi", false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// usage that doesn't come with any message is kept as well
+	if err := store.Extend("other", nil, core.Usage{Input: 1, Cost: 3}); err != nil {
+		t.Fatalf("failed to extend session: %v", err)
+	}
+
+	byTool, err := store.UsageBreakdown(UsageByTool, UsageFilter{SessionID: "s"})
+	if err != nil {
+		t.Fatalf("UsageBreakdown failed: %v", err)
+	}
+	want := []UsageRow{
+		{Key: "", Responses: 1, Usage: core.Usage{Input: 100, Output: 10, Reasoning: 5, Total: 110, Cost: 1000}},
+		{Key: "sleep", Responses: 1, Usage: core.Usage{Input: 120, Cached: 100, Output: 20, Total: 240, Cost: 2000}},
+	}
+	if !slices.Equal(byTool, want) {
+		t.Errorf("unexpected breakdown by tool:\n got %+v\nwant %+v", byTool, want)
+	}
+
+	byModel, err := store.UsageBreakdown(UsageByModel, UsageFilter{})
+	if err != nil {
+		t.Fatalf("UsageBreakdown failed: %v", err)
+	}
+	if len(byModel) != 2 || byModel[0].Key != "" || byModel[1].Key != "openai:fake" || byModel[1].Usage.Cost != 3000 {
+		t.Errorf("unexpected breakdown by model: %+v", byModel)
+	}
+
+	byDay, err := store.UsageBreakdown(UsageByDay, UsageFilter{Since: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatalf("UsageBreakdown failed: %v", err)
+	}
+	if len(byDay) != 1 || byDay[0].Responses != 2 || byDay[0].Usage.Cost != 3003 {
+		t.Errorf("unexpected breakdown by day: %+v", byDay)
+	}
+
+	future, err := store.UsageBreakdown(UsageByDay, UsageFilter{Since: time.Now().Add(time.Hour)})
+	if err != nil || len(future) != 0 {
+		t.Errorf("expected no usage in the future, got %+v (%v)", future, err)
+	}
+
+	if u := store.Usage("s"); u.Input != 220 || u.Cost != 3000 {
+		t.Errorf("expected the session totals to add up, got %+v", u)
+	}
+}
+
+func TestSQLiteStore_SpendAndEmbeddings(t *testing.T) {
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.Extend("s", nil, core.Usage{Input: 10, Cost: 500}); err != nil {
+		t.Fatalf("failed to extend session: %v", err)
+	}
+	err = store.RecordEmbeddings(core.ProviderOpenAI, &core.EmbeddingsResult{Model: "text-embedding-3-large", Tokens: 1000, Cost: 130})
+	if err != nil {
+		t.Fatalf("failed to record embeddings: %v", err)
+	}
+
+	if spent, err := store.Spend(time.Now().Add(-time.Hour)); err != nil || spent != 630 {
+		t.Fatalf("expected to have spent 630, got %d (%v)", spent, err)
+	}
+	if spent, err := store.Spend(time.Now().Add(time.Hour)); err != nil || spent != 0 {
+		t.Fatalf("expected to have spent nothing since the future, got %d (%v)", spent, err)
+	}
+
+	bySession, err := store.UsageBreakdown(UsageBySession, UsageFilter{})
+	if err != nil {
+		t.Fatalf("UsageBreakdown failed: %v", err)
+	}
+	if len(bySession) != 2 || bySession[0].Key != "" || bySession[0].Usage.Input != 1000 || bySession[0].Usage.Cost != 130 {
+		t.Fatalf("expected the embeddings to have no session, got %+v", bySession)
+	}
+}
+
+func TestSQLiteStore_Sessions(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+
+	// a session from before the sessions table existed
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE messages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			session_id TEXT NOT NULL,
+			payload BLOB NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		INSERT INTO messages (session_id, payload, created_at)
+			VALUES ('old', '{"type":0,"content":{"role":"user","text":"hi"}}', '2025-01-01 10:00:00');
+	`)
+	db.Close()
+	if err != nil {
+		t.Fatalf("failed to create old schema: %v", err)
+	}
+
+	store, err := NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.CreateSession("empty"); err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	if err := store.CreateSession("empty"); err != nil {
+		t.Fatalf("expected creating a session twice to be fine, got %v", err)
+	}
+
+	msg := core.NewMsgContent("assistant", "Hi!")
+	msg.Usage = &core.Usage{Input: 10, Cost: 42}
+	if err := store.Extend("new", []*core.Msg{core.NewMsgContent("user", "hi"), msg}, *msg.Usage); err != nil {
+		t.Fatalf("failed to extend session: %v", err)
+	}
+
+	sessions, err := store.Sessions()
+	if err != nil {
+		t.Fatalf("failed to list sessions: %v", err)
+	}
+	if len(sessions) != 3 {
+		t.Fatalf("expected 3 sessions, got %+v", sessions)
+	}
+
+	byID := make(map[string]SessionInfo)
+	for _, s := range sessions {
+		byID[s.ID] = s
+	}
+	if s := byID["new"]; s.Messages != 2 || s.Cost != 42 {
+		t.Errorf("unexpected new session %+v", s)
+	}
+	if s := byID["empty"]; s.Messages != 0 || !s.UpdatedAt.Equal(s.CreatedAt) {
+		t.Errorf("unexpected empty session %+v", s)
+	}
+	old := byID["old"]
+	if want := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC); old.Messages != 1 || !old.CreatedAt.Equal(want) {
+		t.Errorf("expected the old session to be migrated, got %+v", old)
+	}
+	if sessions[2].ID != "old" {
+		t.Errorf("expected the old session to be listed last, got %+v", sessions)
+	}
+
+	for id, want := range map[string]bool{"old": true, "empty": true, "new": true, "missing": false} {
+		if got, err := store.HasSession(id); err != nil || got != want {
+			t.Errorf("expected HasSession(%q) to be %v, got %v (%v)", id, want, got, err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package agg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/victhorio/opa/agg/core"
+)
+
+// SubAgentCfg configures the child agent of a SubAgent tool.
+type SubAgentCfg struct {
+	SysPrompt string
+	Model     core.Model
+	Tools     []Tool
+
+	// Client is used for the requests of the child, defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// SubAgent creates a tool that delegates to a child agent. Every call starts a new conversation
+// with the child, using prompt to turn the arguments of the call into its input, and the child's
+// final answer is the result of the tool.
+//
+// When the tool is called by an Agent, the child's usage is rolled up into the calling run (on
+// the tool result message, attributed to the child's model) and its events are surfaced through
+// the caller's callback with the tool's name prepended to their Path. Errors of the child end up
+// in the tool result instead of being surfaced as events.
+func SubAgent[T any](spec core.Tool, cfg SubAgentCfg, prompt func(context.Context, T) (string, error)) Tool {
+	handler := func(ctx context.Context, args T) (string, error) {
+		input, err := prompt(ctx, args)
+		if err != nil {
+			return "", err
+		}
+
+		out, _, err := RunSubAgent(ctx, spec.Name, cfg, input)
+		return out, err
+	}
+
+	return NewTool(handler, spec)
+}
+
+// RunSubAgent runs a new conversation with a child agent, returning its final answer along with
+// what it spent. It's what SubAgent tools do on every call, and it's meant for tools that need to
+// run several children per call (e.g. one per note they read), which can be done concurrently.
+//
+// When ctx is the one of a tool call made by an Agent, the child is rolled up into the calling run
+// like for SubAgent, with name prepended to the Path of its events.
+func RunSubAgent(ctx context.Context, name string, cfg SubAgentCfg, input string) (string, core.Usage, error) {
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	store := NewEphemeralStore()
+	child := NewAgent(cfg.SysPrompt, cfg.Model, &store, cfg.Tools)
+
+	scope := toolCallScopeFrom(ctx)
+	onEvent := func(ev core.Event) {
+		if scope == nil || ev.Type == core.EvError {
+			return
+		}
+		ev.Path = append([]string{name}, ev.Path...)
+		scope.emit(ev)
+	}
+
+	const sessionID = "sub-agent"
+	out, err := child.RunStream(ctx, client, sessionID, input, false, onEvent)
+
+	// whatever was spent counts, even if the child didn't make it to the end
+	usage := store.Usage(sessionID)
+	if scope != nil {
+		scope.spend(usage, store.Messages(sessionID))
+	}
+
+	if err != nil {
+		return "", usage, fmt.Errorf("sub-agent %s failed: %w", name, err)
+	}
+	return out, usage, nil
+}
+
+// toolCallScope is given to every tool call of an Agent through its context, so that tools that
+// run models of their own (i.e. sub-agents) can report back to the run that called them.
+type toolCallScope struct {
+	// emit surfaces an event through the calling run
+	emit func(core.Event)
+
+	mu    sync.Mutex
+	total *toolSpend
+}
+
+// toolSpend is the usage of the models run by a tool call.
+type toolSpend struct {
+	usage    core.Usage
+	provider core.Provider
+	model    string
+}
+
+type toolCallScopeKey struct{}
+
+func withToolCallScope(ctx context.Context, scope *toolCallScope) context.Context {
+	return context.WithValue(ctx, toolCallScopeKey{}, scope)
+}
+
+// toolCallScopeFrom returns the scope of the tool call running with ctx, or nil if the tool wasn't
+// called by an Agent.
+func toolCallScopeFrom(ctx context.Context) *toolCallScope {
+	scope, _ := ctx.Value(toolCallScopeKey{}).(*toolCallScope)
+	return scope
+}
+
+// spend records the usage of a conversation run by the tool, attributing it to the model that
+// generated the last response of the conversation.
+func (s *toolCallScope) spend(usage core.Usage, msgs []*core.Msg) {
+	if usage == (core.Usage{}) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.total == nil {
+		s.total = &toolSpend{}
+	}
+	s.total.usage.Inc(usage)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].Usage != nil && msgs[i].Model != "" {
+			s.total.provider, s.total.model = msgs[i].Provider, msgs[i].Model
+			break
+		}
+	}
+}
+
+// spent returns what was spent by the tool call, or nil if nothing was.
+func (s *toolCallScope) spent() *toolSpend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.total == nil {
+		return nil
+	}
+	r := *s.total
+	return &r
+}
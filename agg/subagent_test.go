@@ -0,0 +1,167 @@
+package agg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/victhorio/opa/agg/core"
+	"github.com/victhorio/opa/agg/fake"
+)
+
+func TestSubAgent(t *testing.T) {
+	child := fake.NewModel(
+		core.ProviderAnthropic,
+		fake.NewTurn().ToolCall("k1", "sleep", `{"ms":1}`).Cost(5),
+		fake.NewTurn().Text("child ", "answer").Cost(10),
+	)
+	parent := fake.NewModel(
+		core.ProviderOpenAI,
+		fake.NewTurn().ToolCall("c1", "delegate", `{"task":"x"}`).Cost(100),
+		fake.NewTurn().Text("done").Cost(1),
+	)
+
+	store, err := NewSQLiteStore(":memory:")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer store.Close()
+
+	agent := NewAgent("sys", parent, store, []Tool{delegateTool(child)})
+
+	var mu sync.Mutex
+	var nested []string
+	var deltas []string
+	out, err := agent.RunStream(context.Background(), http.DefaultClient, "s", "hi", false, func(ev core.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case len(ev.Path) > 0 && ev.Type == core.EvToolCall:
+			nested = append(nested, strings.Join(ev.Path, "/")+":call:"+ev.Call.Name)
+		case len(ev.Path) > 0 && ev.Type == core.EvDelta:
+			nested = append(nested, strings.Join(ev.Path, "/")+":delta:"+ev.Delta)
+		case ev.Type == core.EvDelta:
+			deltas = append(deltas, ev.Delta)
+		}
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "done" {
+		t.Errorf("expected output 'done', got %q", out)
+	}
+
+	// only the parent's own deltas are unnested
+	if got := strings.Join(deltas, "|"); got != "done" {
+		t.Errorf("expected the parent's deltas to be 'done', got %q", got)
+	}
+	want := []string{"delegate:call:sleep", "delegate:delta:child ", "delegate:delta:answer"}
+	if !slices.Equal(nested, want) {
+		t.Errorf("expected nested events %v, got %v", want, nested)
+	}
+
+	calls := child.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("expected 2 calls to the child model, got %d", len(calls))
+	}
+	assertRoles(t, calls[0].Msgs, "system", "user")
+	if c, _ := calls[0].Msgs[1].AsContent(); c.Text != "do: x" {
+		t.Errorf("expected the child's input to come from the prompt, got %q", c.Text)
+	}
+
+	// the child's answer is the tool result, carrying what the child spent
+	msgs := store.Messages("s")
+	assertRoles(t, msgs, "system", "user", "tool", "tool", "assistant")
+	result := msgs[3]
+	if result.ToolResult.Result != "child answer" {
+		t.Errorf("expected the child's answer as the tool result, got %q", result.ToolResult.Result)
+	}
+	if result.Usage == nil || result.Usage.Cost != 15 || result.Provider != core.ProviderAnthropic || result.Model != "fake" {
+		t.Errorf("expected the tool result to carry the child's usage, got %+v (%s:%s)", result.Usage, result.Provider, result.Model)
+	}
+
+	if u := store.Usage("s"); u.Cost != 116 {
+		t.Errorf("expected the session to cost 116 including the child, got %d", u.Cost)
+	}
+
+	rows, err := store.UsageBreakdown(UsageByModel, UsageFilter{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	byModel := make(map[string]int64)
+	for _, row := range rows {
+		byModel[row.Key] = row.Usage.Cost
+	}
+	if byModel["anthropic:fake"] != 15 || byModel["openai:fake"] != 101 {
+		t.Errorf("expected the child's usage to be attributed to its model, got %v", byModel)
+	}
+}
+
+func TestSubAgentFailure(t *testing.T) {
+	child := fake.NewModel(core.ProviderOpenAI, fake.NewTurn().Text("par").Error(errors.New("boom")))
+	parent := fake.NewModel(
+		core.ProviderOpenAI,
+		fake.NewTurn().ToolCall("c1", "delegate", `{"task":"x"}`),
+		fake.NewTurn().Text("sorry"),
+	)
+
+	store := NewEphemeralStore()
+	agent := NewAgent("sys", parent, &store, []Tool{delegateTool(child)})
+
+	var mu sync.Mutex
+	var errorEvents int
+	out, err := agent.RunStream(context.Background(), http.DefaultClient, "s", "hi", false, func(ev core.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if ev.Type == core.EvError {
+			errorEvents++
+		}
+	})
+	if err != nil {
+		t.Fatalf("expected the parent to recover from the child's failure, got %v", err)
+	}
+	if out != "sorry" {
+		t.Errorf("expected output 'sorry', got %q", out)
+	}
+	if errorEvents != 0 {
+		t.Errorf("expected the child's error not to be surfaced as an event, got %d", errorEvents)
+	}
+
+	result := store.Messages("s")[3].ToolResult.Result
+	if !strings.Contains(result, "sub-agent delegate failed") || !strings.Contains(result, "boom") {
+		t.Errorf("expected the tool result to report the failure, got %q", result)
+	}
+}
+
+func TestSubAgentOutsideAgent(t *testing.T) {
+	child := fake.NewModel(core.ProviderOpenAI, fake.NewTurn().Text("ok").Cost(3))
+
+	registry := NewToolRegistry()
+	registry.Register(delegateTool(child))
+
+	out, err := registry.Call(context.Background(), "delegate", []byte(`{"task":"x"}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Text != "ok" {
+		t.Errorf("expected 'ok', got %q", out.Text)
+	}
+}
+
+func delegateTool(model core.Model) Tool {
+	spec := core.Tool{
+		Name:   "delegate",
+		Params: map[string]core.ToolParam{"task": {Type: core.JSTString, Desc: "What to do"}},
+	}
+	cfg := SubAgentCfg{SysPrompt: "child sys", Model: model, Tools: []Tool{sleepTool()}}
+
+	return SubAgent(spec, cfg, func(ctx context.Context, args struct {
+		Task string `json:"task"`
+	}) (string, error) {
+		return "do: " + args.Task, nil
+	})
+}
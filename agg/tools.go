@@ -4,7 +4,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
 
 	"github.com/victhorio/opa/agg/core"
 )
@@ -12,63 +16,267 @@ import (
 type Tool struct {
 	Handler ToolHandler
 	Spec    core.Tool
+	Policy  ToolPolicy
 }
 
 func NewTool[T any](f ToolCallable[T], spec core.Tool) Tool {
+	return Tool{
+		Handler: createHandler(func(ctx context.Context, args T) (ToolOutput, error) {
+			text, err := f(ctx, args)
+			return ToolOutput{Text: text}, err
+		}),
+		Spec: spec,
+	}
+}
+
+// NewToolWithParts is like NewTool, for tools that return images or documents along with their
+// text.
+func NewToolWithParts[T any](f ToolCallableParts[T], spec core.Tool) Tool {
 	return Tool{
 		Handler: createHandler(f),
 		Spec:    spec,
 	}
 }
 
+// WithPolicy returns a copy of the tool using the given execution policy.
+func (t Tool) WithPolicy(p ToolPolicy) Tool {
+	t.Policy = p
+	return t
+}
+
+// ToolPolicy configures how the calls to a tool are executed. The zero value means no timeout, no
+// retries and no limit on concurrent calls.
+type ToolPolicy struct {
+	// Timeout is the maximum duration of a single attempt. Once it elapses the handler's context
+	// is cancelled and the model is told the call timed out, even if the handler ignores its
+	// context and keeps running.
+	Timeout time.Duration
+
+	// Retries is how many additional attempts are made when the handler fails with an error
+	// marked with Retryable.
+	Retries int
+
+	// Backoff is the wait before the first retry, doubled on every subsequent one. Defaults to
+	// toolRetryBackoffDefault if Retries is set.
+	Backoff time.Duration
+
+	// MaxConcurrent caps how many handlers of this tool can be running at the same time, across
+	// every run of the agent. Calls over the limit wait for a slot. A handler that timed out but
+	// ignores its context keeps its slot until it actually returns.
+	MaxConcurrent int
+}
+
 type ToolCallable[T any] func(context.Context, T) (string, error)
-type ToolHandler func(context.Context, json.RawMessage) (string, error)
+type ToolCallableParts[T any] func(context.Context, T) (ToolOutput, error)
+type ToolHandler func(context.Context, json.RawMessage) (ToolOutput, error)
+
+// ToolOutput is what a tool returns to the model: its text, followed by any parts such as images.
+type ToolOutput struct {
+	Text  string
+	Parts []core.Part
+}
+
+// Retryable marks an error returned by a tool handler as transient, so that it's retried according
+// to the tool's ToolPolicy.
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &retryableError{err: err}
+}
+
+// IsRetryable reports whether any error in err's chain was marked with Retryable.
+func IsRetryable(err error) bool {
+	var r *retryableError
+	return errors.As(err, &r)
+}
+
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// ToolTimeoutError is returned by ToolRegistry.Call when a tool call exceeds its policy timeout.
+// Like ToolArgsError, its message is meant to be given back to the model as the tool result.
+type ToolTimeoutError struct {
+	Tool    string
+	Timeout time.Duration
+}
+
+func (e *ToolTimeoutError) Error() string {
+	return fmt.Sprintf(
+		"<error>Tool %s timed out after %s and was cancelled. Try a narrower request or a different approach.</error>",
+		e.Tool,
+		e.Timeout,
+	)
+}
 
 type ToolRegistry struct {
-	m map[string]ToolHandler
+	m map[string]registeredTool
+}
+
+type registeredTool struct {
+	Tool
+	// sem limits the number of concurrent calls, nil if unlimited
+	sem chan struct{}
 }
 
 func NewToolRegistry() ToolRegistry {
-	return ToolRegistry{m: make(map[string]ToolHandler)}
+	return ToolRegistry{m: make(map[string]registeredTool)}
 }
 
-func (r *ToolRegistry) Register(name string, h ToolHandler) {
+func (r *ToolRegistry) Register(tool Tool) {
+	name := tool.Spec.Name
 	if _, ok := r.m[name]; ok {
 		panic(fmt.Errorf("ToolRegistry.Register: tool %s already registered", name))
 	}
 
-	r.m[name] = h
+	rt := registeredTool{Tool: tool}
+	if tool.Policy.MaxConcurrent > 0 {
+		rt.sem = make(chan struct{}, tool.Policy.MaxConcurrent)
+	}
+
+	r.m[name] = rt
 }
 
-func (r *ToolRegistry) Call(ctx context.Context, name string, args []byte) (string, error) {
-	h, ok := r.m[name]
+// Call validates the arguments against the tool's spec and, if they're valid, dispatches them to
+// the tool's handler following its ToolPolicy. Invalid arguments and timeouts are reported through
+// a *ToolArgsError and a *ToolTimeoutError respectively, whose messages are suitable to be given
+// back to the model as-is.
+func (r *ToolRegistry) Call(ctx context.Context, name string, args []byte) (ToolOutput, error) {
+	tool, ok := r.m[name]
 	if !ok {
-		return "", fmt.Errorf("ToolRegistry.Call: tool %s not found", name)
+		return ToolOutput{}, fmt.Errorf("ToolRegistry.Call: tool %s not found", name)
+	}
+
+	if err := validateArgs(tool.Spec, json.RawMessage(args)); err != nil {
+		return ToolOutput{}, err
+	}
+
+	backoff := tool.Policy.Backoff
+	if backoff <= 0 {
+		backoff = toolRetryBackoffDefault
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := tool.acquire(ctx); err != nil {
+			return ToolOutput{}, fmt.Errorf("ToolRegistry.Call: context error waiting for a slot: %w", err)
+		}
+
+		out, err := tool.invoke(ctx, json.RawMessage(args))
+		if err == nil {
+			return out, nil
+		}
+
+		var timeoutErr *ToolTimeoutError
+		if errors.As(err, &timeoutErr) {
+			return ToolOutput{}, err
+		}
+
+		if !IsRetryable(err) || attempt >= tool.Policy.Retries {
+			return ToolOutput{}, fmt.Errorf("ToolRegistry.Call: error calling handler: %w", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ToolOutput{}, fmt.Errorf("ToolRegistry.Call: context error while retrying: %w (last error: %w)", ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// acquire waits for one of the tool's concurrency slots, if it's limited. The slot is released by
+// invoke once the handler returns.
+func (t *registeredTool) acquire(ctx context.Context) error {
+	if t.sem == nil {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case t.sem <- struct{}{}:
+		return nil
+	}
+}
+
+// invoke runs a single attempt of the handler, enforcing the policy timeout. The handler runs in
+// its own goroutine so that a handler that doesn't respect its context can't block the caller.
+// That goroutine holds the slot taken by acquire until the handler actually returns, even if we
+// gave up on it, so that handlers that keep timing out can't pile up past MaxConcurrent.
+func (t *registeredTool) invoke(ctx context.Context, args json.RawMessage) (ToolOutput, error) {
+	parent := ctx
+	if t.Policy.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Policy.Timeout)
+		defer cancel()
 	}
 
-	out, err := h(ctx, json.RawMessage(args))
-	if err != nil {
-		return "", fmt.Errorf("ToolRegistry.Call: error calling handler: %w", err)
+	// it's only our timeout if the parent context is still fine
+	timedOut := func() bool {
+		return t.Policy.Timeout > 0 && parent.Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded)
 	}
 
-	return out, nil
+	type result struct {
+		out ToolOutput
+		err error
+	}
+
+	// buffered so the goroutine can always finish, even if nobody is listening anymore
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if t.sem != nil {
+				<-t.sem
+			}
+		}()
+		defer func() {
+			// a bug in a single tool shouldn't take the whole process down with it
+			if r := recover(); r != nil {
+				log.Printf("tool %s panicked: %v\n%s", t.Spec.Name, r, debug.Stack())
+				done <- result{err: fmt.Errorf("tool panicked: %v", r)}
+			}
+		}()
+
+		out, err := t.Handler(ctx, args)
+		done <- result{out, err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil && timedOut() {
+			// the handler noticed the cancellation and returned, but it was still our timeout
+			return ToolOutput{}, &ToolTimeoutError{Tool: t.Spec.Name, Timeout: t.Policy.Timeout}
+		}
+		return res.out, res.err
+	case <-ctx.Done():
+		if timedOut() {
+			return ToolOutput{}, &ToolTimeoutError{Tool: t.Spec.Name, Timeout: t.Policy.Timeout}
+		}
+		return ToolOutput{}, ctx.Err()
+	}
 }
 
-func createHandler[T any](f ToolCallable[T]) ToolHandler {
-	return func(ctx context.Context, raw json.RawMessage) (string, error) {
+func createHandler[T any](f ToolCallableParts[T]) ToolHandler {
+	return func(ctx context.Context, raw json.RawMessage) (ToolOutput, error) {
 		var args T
 
 		dec := json.NewDecoder(bytes.NewReader(raw))
 		dec.DisallowUnknownFields() // let's catch problems early
 		if err := dec.Decode(&args); err != nil {
-			return "", fmt.Errorf("handler: invalid args: %w", err)
+			return ToolOutput{}, fmt.Errorf("handler: invalid args: %w", err)
 		}
 
 		if dec.More() {
 			// make sure there's no trailing junk
-			return "", fmt.Errorf("handler: invalid args: extra JSON values: %s", raw)
+			return ToolOutput{}, fmt.Errorf("handler: invalid args: extra JSON values: %s", raw)
 		}
 
 		return f(ctx, args)
 	}
 }
+
+const toolRetryBackoffDefault = 500 * time.Millisecond
@@ -24,6 +24,14 @@ const (
 	agenticSearchTimeoutExt = 60 * time.Second
 )
 
+// webSearchPolicy retries transient network errors. Each request already has its own timeout, so
+// we don't need one here.
+var webSearchPolicy = agg.ToolPolicy{
+	Retries:       2,
+	Backoff:       time.Second,
+	MaxConcurrent: 4,
+}
+
 // CreateWebSearchTool creates a tool that performs direct web searches using Perplexity API.
 // Returns up to 5 results with content snippets (max 1024 tokens per page).
 func CreateWebSearchTool(client *http.Client) (agg.Tool, error) {
@@ -68,7 +76,7 @@ You will get up to 1024 tokens worth of content for the top-5 most relevant resu
 		)
 		if err != nil {
 			// TODO(logging): log the error details
-			return "", fmt.Errorf("WebSearch: error making API request: %w", err)
+			return "", agg.Retryable(fmt.Errorf("WebSearch: error making API request: %w", err))
 		}
 
 		if statusCode != http.StatusOK {
@@ -96,7 +104,7 @@ You will get up to 1024 tokens worth of content for the top-5 most relevant resu
 		return string(resultsJSON), nil
 	}
 
-	return agg.NewTool(handler, spec), nil
+	return agg.NewTool(handler, spec).WithPolicy(webSearchPolicy), nil
 }
 
 // CreateAgenticWebSearchTool creates a tool that uses Perplexity's Sonar LLM models to search
@@ -165,7 +173,7 @@ Use 'reasoning' to enable a more capable reasoning agent that can search through
 		)
 		if err != nil {
 			// TODO(logging): log the error details
-			return "", fmt.Errorf("AgenticWebSearch: error making API request: %w", err)
+			return "", agg.Retryable(fmt.Errorf("AgenticWebSearch: error making API request: %w", err))
 		}
 
 		if statusCode != http.StatusOK {
@@ -195,7 +203,7 @@ Use 'reasoning' to enable a more capable reasoning agent that can search through
 		return formatAgenticSearchResponse(content, resp.SearchResults), nil
 	}
 
-	return agg.NewTool(handler, spec), nil
+	return agg.NewTool(handler, spec).WithPolicy(webSearchPolicy), nil
 }
 
 // WebSearch API types
@@ -0,0 +1,305 @@
+package agg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/victhorio/opa/agg/core"
+)
+
+func TestValidateArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		args string
+		// every string in wantIssues must be found in the issue at the same position
+		wantIssues []string
+	}{
+		{"valid", `{"query": "x", "units": "Celsius", "k": 3}`, nil},
+		{"valid with optional omitted", `{"query": "x", "units": "Celsius"}`, nil},
+		{"valid with optional null", `{"query": "x", "units": "Celsius", "k": null}`, nil},
+		{"valid integral float", `{"query": "x", "units": "Celsius", "k": 3.0}`, nil},
+		{"not json", `{"query": `, []string{"valid JSON object"}},
+		{"not an object", `["x"]`, []string{"expected an object, got an array"}},
+		{"trailing data", `{"query": "x", "units": "Celsius"} {}`, []string{"trailing data"}},
+		{
+			"missing required",
+			`{"k": 2}`,
+			[]string{"query: missing required parameter, provide a string", `units: missing required parameter, provide one of "Celsius", "Fahrenheit"`},
+		},
+		{"wrong type", `{"query": 1, "units": "Celsius"}`, []string{"query: expected a string, got a number"}},
+		{"null required", `{"query": null, "units": "Celsius"}`, []string{"query: must not be null"}},
+		{"enum violation", `{"query": "x", "units": "Kelvin"}`, []string{`units: "Kelvin" is not allowed, use one of "Celsius", "Fahrenheit"`}},
+		{"not an integer", `{"query": "x", "units": "Celsius", "k": 2.5}`, []string{"k: expected an integer, got 2.5"}},
+		{"integer as string", `{"query": "x", "units": "Celsius", "k": "2"}`, []string{"k: expected an integer, got a string"}},
+		{"below minimum", `{"query": "x", "units": "Celsius", "k": 0}`, []string{"k: must be at least 1, got 0"}},
+		{"unknown field", `{"query": "x", "units": "Celsius", "foo": 1}`, []string{"foo: unknown parameter, remove it (valid parameters: k, query, tags, units, where)"}},
+		{"array items", `{"query": "x", "units": "Celsius", "tags": ["a", 2]}`, []string{"tags[1]: expected a string, got a number"}},
+		{"array too long", `{"query": "x", "units": "Celsius", "tags": ["a", "b", "c"]}`, []string{"tags: must have at most 2 items, got 3"}},
+		{"nested object", `{"query": "x", "units": "Celsius", "where": {"folder": true}}`, []string{"where.folder: expected a string, got a boolean"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateArgs(validatedTool, []byte(tt.args))
+			if len(tt.wantIssues) == 0 {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+
+			var argsErr *ToolArgsError
+			if !errors.As(err, &argsErr) {
+				t.Fatalf("expected *ToolArgsError, got %v", err)
+			}
+			if len(argsErr.Issues) != len(tt.wantIssues) {
+				t.Fatalf("expected %d issues, got %d: %v", len(tt.wantIssues), len(argsErr.Issues), argsErr.Issues)
+			}
+			for i, want := range tt.wantIssues {
+				got := argsErr.Issues[i].Fix
+				if argsErr.Issues[i].Path != "" {
+					got = argsErr.Issues[i].Path + ": " + got
+				}
+				if !strings.Contains(got, want) {
+					t.Errorf("issue %d: expected %q to contain %q", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestToolRegistryCallValidates(t *testing.T) {
+	var called bool
+	handler := func(ctx context.Context, args struct {
+		Query string   `json:"query"`
+		Units string   `json:"units"`
+		K     *int     `json:"k"`
+		Tags  []string `json:"tags"`
+		Where *struct {
+			Folder string `json:"folder"`
+		} `json:"where"`
+	}) (string, error) {
+		called = true
+		return "ok: " + args.Query, nil
+	}
+
+	r := NewToolRegistry()
+	r.Register(NewTool(handler, validatedTool))
+
+	_, err := r.Call(context.Background(), "search", []byte(`{"query": "x", "units": "Kelvin"}`))
+	var argsErr *ToolArgsError
+	if !errors.As(err, &argsErr) {
+		t.Fatalf("expected *ToolArgsError, got %v", err)
+	}
+	if called {
+		t.Fatalf("handler should not be called with invalid arguments")
+	}
+
+	msg := err.Error()
+	if !strings.HasPrefix(msg, "<error>Invalid arguments for tool search.") || !strings.Contains(msg, "- units: ") {
+		t.Fatalf("unexpected error message: %s", msg)
+	}
+
+	out, err := r.Call(context.Background(), "search", []byte(`{"query": "x", "units": "Celsius"}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Text != "ok: x" || !called {
+		t.Fatalf("expected handler to be called, got %q", out.Text)
+	}
+}
+
+func TestToolPolicyTimeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	// this handler ignores its context on purpose, the registry must still give up on it
+	handler := func(ctx context.Context, args struct{}) (string, error) {
+		<-block
+		return "too late", nil
+	}
+
+	r := NewToolRegistry()
+	r.Register(NewTool(handler, core.Tool{Name: "stuck"}).WithPolicy(ToolPolicy{Timeout: 20 * time.Millisecond}))
+
+	start := time.Now()
+	_, err := r.Call(context.Background(), "stuck", []byte(`{}`))
+
+	var timeoutErr *ToolTimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("expected *ToolTimeoutError, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected call to return shortly after the timeout, took %s", elapsed)
+	}
+	if !strings.Contains(err.Error(), "stuck timed out after 20ms") {
+		t.Fatalf("unexpected error message: %s", err.Error())
+	}
+}
+
+func TestToolPolicyRetries(t *testing.T) {
+	var calls atomic.Int32
+	handler := func(ctx context.Context, args struct {
+		FailTimes int32 `json:"fail_times"`
+		Retryable bool  `json:"retryable"`
+	}) (string, error) {
+		n := calls.Add(1)
+		if n <= args.FailTimes {
+			err := fmt.Errorf("failure %d", n)
+			if args.Retryable {
+				return "", Retryable(err)
+			}
+			return "", err
+		}
+		return fmt.Sprintf("ok after %d", n), nil
+	}
+
+	spec := core.Tool{
+		Name: "flaky",
+		Params: map[string]core.ToolParam{
+			"fail_times": {Type: core.JSTInteger, Desc: "How many times to fail"},
+			"retryable":  {Type: core.JSTBoolean, Desc: "Whether failures are retryable"},
+		},
+	}
+
+	r := NewToolRegistry()
+	r.Register(NewTool(handler, spec).WithPolicy(ToolPolicy{Retries: 2, Backoff: time.Millisecond}))
+
+	tests := []struct {
+		name      string
+		args      string
+		wantOut   string
+		wantErr   bool
+		wantCalls int32
+	}{
+		{"succeeds after retries", `{"fail_times": 2, "retryable": true}`, "ok after 3", false, 3},
+		{"gives up after retries", `{"fail_times": 5, "retryable": true}`, "", true, 3},
+		{"does not retry unmarked errors", `{"fail_times": 1, "retryable": false}`, "", true, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls.Store(0)
+			out, err := r.Call(context.Background(), "flaky", []byte(tt.args))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error=%v, got %v", tt.wantErr, err)
+			}
+			if out.Text != tt.wantOut {
+				t.Fatalf("expected output %q, got %q", tt.wantOut, out.Text)
+			}
+			if n := calls.Load(); n != tt.wantCalls {
+				t.Fatalf("expected %d calls, got %d", tt.wantCalls, n)
+			}
+		})
+	}
+}
+
+func TestToolPolicyMaxConcurrent(t *testing.T) {
+	var running, peak atomic.Int32
+	handler := func(ctx context.Context, args struct{}) (string, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return "ok", nil
+	}
+
+	r := NewToolRegistry()
+	r.Register(NewTool(handler, core.Tool{Name: "limited"}).WithPolicy(ToolPolicy{MaxConcurrent: 2}))
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			if _, err := r.Call(context.Background(), "limited", []byte(`{}`)); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+	wg.Wait()
+
+	if p := peak.Load(); p != 2 {
+		t.Fatalf("expected at most (and exactly) 2 concurrent calls, got %d", p)
+	}
+}
+
+func TestToolPolicyMaxConcurrentCountsTimedOutHandlers(t *testing.T) {
+	release := make(chan struct{})
+	handler := func(ctx context.Context, args struct{}) (string, error) {
+		// ignores its context, like a misbehaving tool would
+		<-release
+		return "ok", nil
+	}
+
+	r := NewToolRegistry()
+	r.Register(NewTool(handler, core.Tool{Name: "stuck"}).WithPolicy(ToolPolicy{
+		Timeout:       10 * time.Millisecond,
+		MaxConcurrent: 1,
+	}))
+
+	_, err := r.Call(context.Background(), "stuck", []byte(`{}`))
+	var timeoutErr *ToolTimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("expected ToolTimeoutError, got %v", err)
+	}
+
+	// the handler that timed out is still running, so there's no slot for another one
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := r.Call(ctx, "stuck", []byte(`{}`)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected to time out waiting for a slot, got %v", err)
+	}
+
+	// once it returns, the slot is free again
+	close(release)
+	out, err := r.Call(context.Background(), "stuck", []byte(`{}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Text != "ok" {
+		t.Fatalf("expected ok, got %q", out.Text)
+	}
+}
+
+var validatedTool = core.Tool{
+	Name: "search",
+	Desc: "Search things",
+	Params: map[string]core.ToolParam{
+		"query": {Type: core.JSTString, Desc: "The query"},
+		"units": {Type: core.JSTString, Desc: "The units", Enum: []string{"Celsius", "Fahrenheit"}},
+		"k":     {Type: core.JSTInteger, Desc: "How many", Optional: true, Minimum: floatPtr(1)},
+		"tags": {
+			Type:     core.JSTArray,
+			Desc:     "Tags",
+			Optional: true,
+			Items:    &core.ToolParam{Type: core.JSTString, Desc: "A tag"},
+			MaxItems: intPtr(2),
+		},
+		"where": {
+			Type:     core.JSTObject,
+			Desc:     "Where to search",
+			Optional: true,
+			Properties: map[string]core.ToolParam{
+				"folder": {Type: core.JSTString, Desc: "The folder"},
+			},
+		},
+	},
+}
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+func intPtr(i int) *int {
+	return &i
+}
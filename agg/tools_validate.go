@@ -0,0 +1,230 @@
+package agg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/victhorio/opa/agg/core"
+)
+
+// ToolArgsError is returned by ToolRegistry.Call when the arguments generated by the model do not
+// match the tool's spec. Its message is meant to be fed back to the model as the tool result, so it
+// lists every problem found along with what needs to change.
+type ToolArgsError struct {
+	Tool   string
+	Issues []ToolArgsIssue
+}
+
+// ToolArgsIssue is a single problem found while validating tool arguments. Path is the location
+// of the offending value (e.g. "dates.from" or "tags[2]"), empty when it refers to the arguments
+// as a whole.
+type ToolArgsIssue struct {
+	Path string
+	Fix  string
+}
+
+func (e *ToolArgsError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "<error>Invalid arguments for tool %s. Fix the following and call the tool again:\n", e.Tool)
+	for _, issue := range e.Issues {
+		if issue.Path == "" {
+			fmt.Fprintf(&sb, "- %s\n", issue.Fix)
+		} else {
+			fmt.Fprintf(&sb, "- %s: %s\n", issue.Path, issue.Fix)
+		}
+	}
+	sb.WriteString("</error>")
+	return sb.String()
+}
+
+// validateArgs checks the raw JSON arguments of a tool call against its spec. Returns nil if the
+// arguments are valid, otherwise a *ToolArgsError listing every issue found.
+func validateArgs(spec core.Tool, raw json.RawMessage) error {
+	var args any
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&args); err != nil {
+		return &ToolArgsError{
+			Tool:   spec.Name,
+			Issues: []ToolArgsIssue{{Fix: fmt.Sprintf("arguments must be a valid JSON object (%v)", err)}},
+		}
+	}
+	if dec.More() {
+		return &ToolArgsError{
+			Tool:   spec.Name,
+			Issues: []ToolArgsIssue{{Fix: "arguments must be a single JSON object, found trailing data"}},
+		}
+	}
+
+	var v argsValidator
+	v.object("", spec.Params, args)
+	if len(v.issues) == 0 {
+		return nil
+	}
+
+	return &ToolArgsError{Tool: spec.Name, Issues: v.issues}
+}
+
+type argsValidator struct {
+	issues []ToolArgsIssue
+}
+
+func (v *argsValidator) fail(path, format string, args ...any) {
+	v.issues = append(v.issues, ToolArgsIssue{Path: path, Fix: fmt.Sprintf(format, args...)})
+}
+
+func (v *argsValidator) object(path string, params map[string]core.ToolParam, value any) {
+	obj, ok := value.(map[string]any)
+	if !ok {
+		v.fail(path, "expected an object, got %s", describeJSON(value))
+		return
+	}
+
+	names := slices.Sorted(maps.Keys(params))
+	for _, name := range names {
+		param := params[name]
+		val, present := obj[name]
+		if !present {
+			if !param.Optional {
+				v.fail(joinPath(path, name), "missing required parameter, provide %s", describeType(param))
+			}
+			continue
+		}
+		v.param(joinPath(path, name), param, val)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(obj)) {
+		if _, ok := params[name]; !ok {
+			v.fail(joinPath(path, name), "unknown parameter, remove it (valid parameters: %s)", strings.Join(names, ", "))
+		}
+	}
+}
+
+func (v *argsValidator) param(path string, param core.ToolParam, value any) {
+	if value == nil {
+		nullable := param.Nullable != nil && *param.Nullable
+		if !nullable && !param.Optional {
+			v.fail(path, "must not be null, provide %s", describeType(param))
+		}
+		return
+	}
+
+	switch param.Type {
+	case core.JSTString:
+		s, ok := value.(string)
+		if !ok {
+			v.fail(path, "expected a string, got %s", describeJSON(value))
+			return
+		}
+		if len(param.Enum) > 0 && !slices.Contains(param.Enum, s) {
+			v.fail(path, "%q is not allowed, use one of %s", s, quoteAll(param.Enum))
+		}
+	case core.JSTNumber, core.JSTInteger:
+		n, ok := value.(json.Number)
+		if !ok {
+			v.fail(path, "expected %s, got %s", describeType(param), describeJSON(value))
+			return
+		}
+		f, err := n.Float64()
+		if err != nil {
+			v.fail(path, "expected %s, got %s", describeType(param), n)
+			return
+		}
+		if param.Type == core.JSTInteger && f != math.Trunc(f) {
+			v.fail(path, "expected an integer, got %s", n)
+			return
+		}
+		if param.Minimum != nil && f < *param.Minimum {
+			v.fail(path, "must be at least %v, got %s", *param.Minimum, n)
+		}
+		if param.Maximum != nil && f > *param.Maximum {
+			v.fail(path, "must be at most %v, got %s", *param.Maximum, n)
+		}
+	case core.JSTBoolean:
+		if _, ok := value.(bool); !ok {
+			v.fail(path, "expected a boolean, got %s", describeJSON(value))
+		}
+	case core.JSTArray:
+		arr, ok := value.([]any)
+		if !ok {
+			v.fail(path, "expected an array, got %s", describeJSON(value))
+			return
+		}
+		if param.MinItems != nil && len(arr) < *param.MinItems {
+			v.fail(path, "must have at least %d items, got %d", *param.MinItems, len(arr))
+		}
+		if param.MaxItems != nil && len(arr) > *param.MaxItems {
+			v.fail(path, "must have at most %d items, got %d", *param.MaxItems, len(arr))
+		}
+		if param.Items != nil {
+			for i, item := range arr {
+				v.param(fmt.Sprintf("%s[%d]", path, i), *param.Items, item)
+			}
+		}
+	case core.JSTObject:
+		v.object(path, param.Properties, value)
+	}
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// describeType describes the expected type of a parameter, e.g. "an integer" or "one of "a", "b"".
+func describeType(param core.ToolParam) string {
+	switch param.Type {
+	case core.JSTString:
+		if len(param.Enum) > 0 {
+			return "one of " + quoteAll(param.Enum)
+		}
+		return "a string"
+	case core.JSTNumber:
+		return "a number"
+	case core.JSTInteger:
+		return "an integer"
+	case core.JSTBoolean:
+		return "a boolean"
+	case core.JSTArray:
+		return "an array"
+	case core.JSTObject:
+		return "an object"
+	default:
+		return string(param.Type)
+	}
+}
+
+// describeJSON describes the type of a decoded JSON value, as seen by the model.
+func describeJSON(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "a string"
+	case json.Number:
+		return "a number"
+	case bool:
+		return "a boolean"
+	case []any:
+		return "an array"
+	case map[string]any:
+		return "an object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func quoteAll(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = fmt.Sprintf("%q", v)
+	}
+	return strings.Join(quoted, ", ")
+}
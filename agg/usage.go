@@ -0,0 +1,96 @@
+package agg
+
+import (
+	"database/sql"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/victhorio/opa/agg/core"
+)
+
+// UsageGroup is what a usage breakdown is grouped by.
+type UsageGroup int
+
+const (
+	// UsageByDay groups by the local date of the responses, as "2006-01-02".
+	UsageByDay UsageGroup = iota
+	// UsageByModel groups by the model that generated the responses, as "provider:model".
+	UsageByModel
+	// UsageBySession groups by session, where "" is the usage that doesn't belong to any session,
+	// i.e. embeddings.
+	UsageBySession
+	// UsageByTool groups by the tools whose results the responses were generated from, which is
+	// what it cost to have the model read them. Responses to more than one tool are grouped by
+	// the combination of their (comma-separated) names, and responses to the user by "".
+	UsageByTool
+)
+
+// UsageRow is a single row of a usage breakdown.
+type UsageRow struct {
+	Key       string
+	Responses int
+	Usage     core.Usage
+}
+
+// UsageFilter restricts which responses a usage breakdown includes. The zero value includes every
+// response.
+type UsageFilter struct {
+	// Since and Until, if not zero, restrict the breakdown to the responses in [Since, Until).
+	Since time.Time
+	Until time.Time
+	// SessionID, if set, restricts the breakdown to a single session.
+	SessionID string
+}
+
+// usageRecord is the usage of a single response, as stored by SQLiteStore. Usage that isn't
+// attributed to any response (e.g. from before it was tracked per response) has no message.
+type usageRecord struct {
+	messageID sql.NullInt64
+	provider  core.Provider
+	model     string
+	tools     string
+	usage     core.Usage
+}
+
+// toolsTracker keeps track of which tools were called before each response, going through the
+// messages in order.
+type toolsTracker struct {
+	names   map[string]string
+	pending []string
+}
+
+func (t *toolsTracker) track(msg *core.Msg) {
+	switch msg.Type {
+	case core.MsgTypeToolCall:
+		if t.names == nil {
+			t.names = make(map[string]string)
+		}
+		t.names[msg.ToolCall.ID] = msg.ToolCall.Name
+	case core.MsgTypeToolResult:
+		if name, ok := t.names[msg.ToolResult.ID]; ok && !slices.Contains(t.pending, name) {
+			t.pending = append(t.pending, name)
+		}
+	}
+}
+
+// flush returns the tools whose results were given to the response being tracked, and starts over
+// for the next one.
+func (t *toolsTracker) flush() string {
+	slices.Sort(t.pending)
+	r := strings.Join(t.pending, ",")
+	t.pending = t.pending[:0]
+	return r
+}
+
+// usageDiff returns a - b, leaving out the total since it's not stored but derived from the rest.
+func usageDiff(a, b core.Usage) core.Usage {
+	return core.Usage{
+		Input:      a.Input - b.Input,
+		Cached:     a.Cached - b.Cached,
+		CacheWrite: a.CacheWrite - b.CacheWrite,
+		Output:     a.Output - b.Output,
+		Reasoning:  a.Reasoning - b.Reasoning,
+		Cost:       a.Cost - b.Cost,
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+
+	"github.com/victhorio/opa/agg"
+	"github.com/victhorio/opa/agg/core"
+)
+
+// Exit codes of `opa ask`, so that scripts can tell failures apart.
+const (
+	exitOK          = 0
+	exitError       = 1
+	exitUsage       = 2
+	exitBudget      = 3
+	exitInterrupted = 130
+)
+
+// errUsage marks errors caused by how opa was invoked rather than by running the prompt.
+var errUsage = errors.New("usage error")
+
+// askOpts are the options of a single `opa ask` run.
+type askOpts struct {
+	prompt    string
+	sessionID string
+	internals bool
+	json      bool
+}
+
+// askResult is what `opa ask -json` prints once the turn is done.
+type askResult struct {
+	SessionID string    `json:"session_id"`
+	Model     string    `json:"model"`
+	Output    string    `json:"output"`
+	Usage     usageJSON `json:"usage"`
+}
+
+// usageJSON is how usage is reported to scripts and API clients, with the cost in dollars.
+type usageJSON struct {
+	Input     int64   `json:"input_tokens"`
+	Cached    int64   `json:"cached_tokens"`
+	Output    int64   `json:"output_tokens"`
+	Reasoning int64   `json:"reasoning_tokens"`
+	CostUSD   float64 `json:"cost_usd"`
+}
+
+// runAsk implements `opa ask`, which runs a single turn of the agent and writes the answer to
+// stdout as it's generated. Anything piped into stdin is given to the model along with the prompt.
+// Returns the exit code for the process.
+func runAsk(args []string) int {
+	fs := flag.NewFlagSet("ask", flag.ContinueOnError)
+	model := fs.String("model", *modelSpec, "model to use as provider:name (defaults to the one in ~/.opa/models.yaml)")
+	session := fs.String("session", "", "session to continue, a new one is started if empty")
+	toolNames := fs.String("tools", "all", `comma separated tools to enable, "all" or "none"`)
+	internals := fs.Bool("internals", false, "also output reasoning summaries and tool calls")
+	asJSON := fs.Bool("json", false, "output a JSON object with the answer and usage once done, instead of streaming text")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: opa ask [flags] <prompt>\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	stdin, err := readPipedStdin()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return exitError
+	}
+
+	opts := askOpts{
+		prompt:    askPrompt(strings.Join(fs.Args(), " "), stdin),
+		sessionID: *session,
+		internals: *internals,
+		json:      *asJSON,
+	}
+	if opts.prompt == "" {
+		fs.Usage()
+		return exitUsage
+	}
+	if opts.sessionID == "" {
+		opts.sessionID = newSessionID("ask")
+	}
+
+	if err := setupLogging(); err != nil {
+		fmt.Fprintf(os.Stderr, "error setting up logging: %v\n", err)
+		return exitError
+	}
+
+	agent, spec, _, closeAll, err := loadAgent(*model, *toolNames)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return exitCode(err)
+	}
+	defer closeAll()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err = ask(ctx, os.Stdout, os.Stderr, &agent, spec, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	}
+	return exitCode(err)
+}
+
+// loadAgent sets up an agent for the non-interactive commands, with only the tools given by
+// toolNames, out of ours and those of the configured MCP servers. The returned function closes the
+// store and disconnects from the MCP servers, and must be called by the caller once done.
+func loadAgent(spec, toolNames string) (agg.Agent, string, *agg.SQLiteStore, func(), error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return agg.Agent{}, "", nil, nil, fmt.Errorf("error loading config: %w", err)
+	}
+
+	model, spec, err := loadModel(spec, cfg)
+	if err != nil {
+		return agg.Agent{}, "", nil, nil, fmt.Errorf("%w: error loading model: %w", errUsage, err)
+	}
+
+	store, err := openStore()
+	if err != nil {
+		return agg.Agent{}, "", nil, nil, fmt.Errorf("error opening store: %w", err)
+	}
+
+	vault, err := openVault(store)
+	if err != nil {
+		store.Close()
+		return agg.Agent{}, "", nil, nil, fmt.Errorf("error loading vault: %w", err)
+	}
+
+	ours := allTools(vault)
+	external, closeMCP := connectMCPServers(ours)
+	closeAll := func() {
+		closeMCP()
+		store.Close()
+	}
+
+	tools, err := selectTools(append(ours, external...), toolNames)
+	if err != nil {
+		closeAll()
+		return agg.Agent{}, "", nil, nil, err
+	}
+
+	// unlike the TUI we can't answer before semantic search is ready, so we wait for it
+	if err := <-vault.RefreshEmbeddingsAsync(); err != nil {
+		log.Printf("warning: failed to load embeddings: %v", err)
+	}
+
+	agent := newAgent(vault, model, store, tools)
+	agent.SetBudget(cfg.Budget.Budget(), store)
+
+	return agent, spec, store, closeAll, nil
+}
+
+// ask runs a single turn of the agent. Text is streamed to w as it arrives unless opts.json is
+// set, in which case a single askResult is written once the turn is done. Warnings go to errW.
+func ask(ctx context.Context, w, errW io.Writer, agent *agg.Agent, spec string, opts askOpts) error {
+	text := &citationPrinter{w: w}
+	onEvent := func(ev core.Event) {
+		if ev.Type == core.EvWarning {
+			fmt.Fprintf(errW, "warning: %v\n", ev.Err)
+			return
+		}
+		if opts.json {
+			return
+		}
+		if ev.Type == core.EvRetry && len(ev.Path) == 0 {
+			// what was printed can't be taken back, so the response starts over on a line of its own
+			text.reset()
+			fmt.Fprintf(errW, "warning: the response was interrupted and starts over: %v\n", ev.Err)
+			return
+		}
+
+		if len(ev.Path) > 0 {
+			// the answers of sub-agents aren't ours, only their tool calls are worth showing
+			if ev.Type == core.EvToolCall && opts.internals {
+				fmt.Fprintf(w, "\n[Tool Call: %s > %s, %s, %s]\n\n", strings.Join(ev.Path, " > "), ev.Call.Name, ev.Call.ID, ev.Call.Arguments)
+			}
+			return
+		}
+
+		switch ev.Type {
+		case core.EvDelta:
+			text.delta(ev.Delta)
+		case core.EvResp:
+			if len(ev.Response.Messages) == 0 {
+				return
+			}
+			if content, ok := ev.Response.Messages[len(ev.Response.Messages)-1].AsContent(); ok {
+				text.done(content.Text)
+			}
+		case core.EvDeltaReason:
+			if opts.internals {
+				fmt.Fprintf(w, "\n[Reasoning: %s]\n\n", ev.Delta)
+			}
+		case core.EvToolCall:
+			if opts.internals {
+				fmt.Fprintf(w, "\n[Tool Call: %s, %s, %s]\n\n", ev.Call.Name, ev.Call.ID, ev.Call.Arguments)
+			}
+		}
+	}
+
+	out, err := agent.RunStream(ctx, http.DefaultClient, opts.sessionID, opts.prompt, opts.internals, onEvent)
+	if err != nil {
+		if !opts.json {
+			// whatever was streamed so far shouldn't be left without a newline
+			fmt.Fprintln(w)
+		}
+		return err
+	}
+
+	if !opts.json {
+		if !strings.HasSuffix(out, "\n") {
+			fmt.Fprintln(w)
+		}
+		return nil
+	}
+
+	result := askResult{
+		SessionID: opts.sessionID,
+		Model:     spec,
+		Output:    out,
+		Usage:     newUsageJSON(agent.Store.Usage(opts.sessionID)),
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result)
+}
+
+// citationPrinter prints the text of a response as it streams, holding back the lines that
+// define its citations, since the agent only resolves them into a references section once the
+// response is done. That section is printed in their place.
+type citationPrinter struct {
+	w io.Writer
+	// line is what wasn't printed yet of the current line, which may turn out to be a definition
+	line    string
+	printed bool // whether some of the current line was printed, so it can't be a definition
+	// held has the definitions and empty lines since the last line that was printed
+	held string
+	last byte // the last byte printed
+}
+
+func (p *citationPrinter) delta(text string) {
+	for text != "" {
+		segment, rest, newline := strings.Cut(text, "\n")
+		text = rest
+
+		switch {
+		case p.printed:
+			p.print(segment)
+		case !citationPrefixRe.MatchString(p.line + segment):
+			// definitions only come at the end, so what was held wasn't the end after all
+			p.print(p.held + p.line + segment)
+			p.held, p.line, p.printed = "", "", true
+		default:
+			p.line += segment
+		}
+		if !newline {
+			continue
+		}
+
+		if p.printed {
+			p.print("\n")
+		} else if strings.TrimSpace(p.line) == "" || citationDefRe.MatchString(p.line) {
+			p.held += p.line + "\n"
+		} else {
+			p.print(p.held + p.line + "\n")
+			p.held = ""
+		}
+		p.line, p.printed = "", false
+	}
+}
+
+// done ends the response, given its text as the agent resolved it.
+func (p *citationPrinter) done(resolved string) {
+	body, refs := splitReferences(resolved)
+	if refs == nil {
+		p.print(p.held + p.line)
+	} else {
+		section := resolved[len(body):]
+		if p.last == '\n' {
+			section = "\n" + strings.TrimLeft(section, "\n")
+		}
+		p.print(section)
+	}
+	p.line, p.held, p.printed = "", "", false
+}
+
+// reset drops what's held of a response that starts over, making it start on a new line.
+func (p *citationPrinter) reset() {
+	if p.last != 0 && p.last != '\n' {
+		p.print("\n")
+	}
+	p.line, p.held, p.printed = "", "", false
+}
+
+func (p *citationPrinter) print(s string) {
+	if s == "" {
+		return
+	}
+	fmt.Fprint(p.w, s)
+	p.last = s[len(s)-1]
+}
+
+func newUsageJSON(u core.Usage) usageJSON {
+	return usageJSON{
+		Input:     u.Input,
+		Cached:    u.Cached,
+		Output:    u.Output,
+		Reasoning: u.Reasoning,
+		CostUSD:   float64(u.Cost) / 1_000_000_000,
+	}
+}
+
+// askPrompt combines the prompt given as arguments with whatever was piped into stdin, which
+// becomes the prompt itself when there are no arguments.
+func askPrompt(prompt, stdin string) string {
+	prompt = strings.TrimSpace(prompt)
+	stdin = strings.TrimSpace(stdin)
+
+	switch {
+	case stdin == "":
+		return prompt
+	case prompt == "":
+		return stdin
+	default:
+		return fmt.Sprintf("%s\n\n<stdin>\n%s\n</stdin>", prompt, stdin)
+	}
+}
+
+// readPipedStdin reads stdin if it's not a terminal, so that `opa ask` doesn't hang waiting for
+// input when nothing was piped.
+func readPipedStdin() (string, error) {
+	info, err := os.Stdin.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to stat stdin: %w", err)
+	}
+	if info.Mode()&os.ModeCharDevice != 0 {
+		return "", nil
+	}
+
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return "", fmt.Errorf("failed to read stdin: %w", err)
+	}
+	return string(data), nil
+}
+
+// selectTools picks the tools named in the comma separated names, which are matched against the
+// tool names case insensitively. "all" keeps every tool and "none" none of them.
+func selectTools(tools []agg.Tool, names string) ([]agg.Tool, error) {
+	switch strings.ToLower(strings.TrimSpace(names)) {
+	case "", "all":
+		return tools, nil
+	case "none":
+		return nil, nil
+	}
+
+	available := make([]string, 0, len(tools))
+	for _, tool := range tools {
+		available = append(available, tool.Spec.Name)
+	}
+
+	var r []agg.Tool
+	for name := range strings.SplitSeq(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		idx := slices.IndexFunc(tools, func(tool agg.Tool) bool {
+			return strings.EqualFold(tool.Spec.Name, name)
+		})
+		if idx < 0 {
+			return nil, fmt.Errorf("%w: unknown tool %q (available: %s)", errUsage, name, strings.Join(available, ", "))
+		}
+		r = append(r, tools[idx])
+	}
+
+	return r, nil
+}
+
+// exitCode maps the error of a run to the exit code of the process.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errUsage):
+		return exitUsage
+	case errors.Is(err, agg.ErrBudgetExceeded):
+		return exitBudget
+	case errors.Is(err, context.Canceled):
+		return exitInterrupted
+	default:
+		return exitError
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/victhorio/opa/agg"
+	"github.com/victhorio/opa/agg/core"
+	"github.com/victhorio/opa/agg/fake"
+	"github.com/victhorio/opa/obsidian"
+)
+
+func TestAskStreamsText(t *testing.T) {
+	model := fake.NewModel(
+		core.ProviderAnthropic,
+		fake.NewTurn().Reasoning("hmm").ToolCall("1", "ReadNote", `{"note_name":"x"}`),
+		fake.NewTurn().Text("Last ", "Tuesday."),
+	)
+	store := agg.NewEphemeralStore()
+	agent := agg.NewAgent("sys", model, &store, nil)
+
+	var out, errOut strings.Builder
+	opts := askOpts{prompt: "what did I do?", sessionID: "ask-1", internals: true}
+	if err := ask(context.Background(), &out, &errOut, &agent, "anthropic:fake", opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := "\n[Reasoning: hmm]\n\n\n[Tool Call: ReadNote, 1, {\"note_name\":\"x\"}]\n\nLast Tuesday.\n"
+	if out.String() != want {
+		t.Errorf("unexpected output:\n got: %q\nwant: %q", out.String(), want)
+	}
+	if len(store.Messages("ask-1")) == 0 {
+		t.Errorf("expected the turn to be stored in the session")
+	}
+}
+
+func TestAskResolvesCitations(t *testing.T) {
+	vault, _ := writeVault(t, citationsNotes, obsidian.Cfg{})
+	model := fake.NewModel(
+		core.ProviderOpenAI,
+		fake.NewTurn().Text(
+			"The plan is set [1].\n[x",
+			"] is not a citation.\n\n[",
+			"1]: Big Plan#Ste",
+			"ps:L3-L4\n[2]: https://example.com/run",
+		),
+	)
+	store := agg.NewEphemeralStore()
+	agent := agg.NewAgent("sys", model, &store, nil)
+	agent.SetPostProcess(func(text string) string { return resolveCitations(vault, text) })
+
+	var out, errOut strings.Builder
+	opts := askOpts{prompt: "what's the plan?", sessionID: "ask-3"}
+	if err := ask(context.Background(), &out, &errOut, &agent, "openai:fake", opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the definitions are never printed, the references section is printed in their place
+	text := "The plan is set [1].\n[x] is not a citation.\n\n[1]: Big Plan#Steps:L3-L4\n[2]: https://example.com/run"
+	if want := resolveCitations(vault, text) + "\n"; out.String() != want {
+		t.Errorf("unexpected output:\n got: %q\nwant: %q", out.String(), want)
+	}
+}
+
+func TestAskJSON(t *testing.T) {
+	model := fake.NewModel(
+		core.ProviderOpenAI,
+		fake.NewTurn().Text("Paris.").Usage(core.Usage{Input: 10, Output: 2, Cost: 500_000_000}),
+	)
+	store := agg.NewEphemeralStore()
+	agent := agg.NewAgent("sys", model, &store, nil)
+
+	var out, errOut strings.Builder
+	opts := askOpts{prompt: "capital of France?", sessionID: "ask-2", json: true}
+	if err := ask(context.Background(), &out, &errOut, &agent, "openai:fake", opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got askResult
+	if err := json.Unmarshal([]byte(out.String()), &got); err != nil {
+		t.Fatalf("expected a JSON object, got %q: %v", out.String(), err)
+	}
+	want := askResult{
+		SessionID: "ask-2",
+		Model:     "openai:fake",
+		Output:    "Paris.",
+		Usage:     usageJSON{Input: 10, Output: 2, CostUSD: 0.5},
+	}
+	if got != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestAskPrompt(t *testing.T) {
+	tests := []struct {
+		prompt, stdin, want string
+	}{
+		{"summarize", "", "summarize"},
+		{"", "some notes\n", "some notes"},
+		{"summarize", "some notes\n", "summarize\n\n<stdin>\nsome notes\n</stdin>"},
+		{"  ", "  ", ""},
+	}
+
+	for _, tt := range tests {
+		if got := askPrompt(tt.prompt, tt.stdin); got != tt.want {
+			t.Errorf("askPrompt(%q, %q) = %q, want %q", tt.prompt, tt.stdin, got, tt.want)
+		}
+	}
+}
+
+func TestSelectTools(t *testing.T) {
+	tools := []agg.Tool{
+		{Spec: core.Tool{Name: "ReadNote"}},
+		{Spec: core.Tool{Name: "RipGrep"}},
+		{Spec: core.Tool{Name: "AgenticWebSearch"}},
+	}
+
+	if got, _ := selectTools(tools, "all"); len(got) != 3 {
+		t.Errorf("expected every tool for all, got %d", len(got))
+	}
+	if got, _ := selectTools(tools, "none"); len(got) != 0 {
+		t.Errorf("expected no tools for none, got %d", len(got))
+	}
+
+	got, err := selectTools(tools, "ripgrep, ReadNote")
+	if err != nil || len(got) != 2 || got[0].Spec.Name != "RipGrep" || got[1].Spec.Name != "ReadNote" {
+		t.Errorf("expected RipGrep and ReadNote, got %+v (%v)", got, err)
+	}
+
+	_, err = selectTools(tools, "ReadNote,Nope")
+	if exitCode(err) != exitUsage || !strings.Contains(err.Error(), "AgenticWebSearch") {
+		t.Errorf("expected a usage error listing the tools, got %v", err)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, exitOK},
+		{errors.New("boom"), exitError},
+		{fmt.Errorf("Agent.Run: %w", agg.ErrBudgetExceeded), exitBudget},
+		{fmt.Errorf("Agent.Run: context error: %w", context.Canceled), exitInterrupted},
+	}
+
+	for _, tt := range tests {
+		if got := exitCode(tt.err); got != tt.want {
+			t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
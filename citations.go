@@ -0,0 +1,110 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/victhorio/opa/obsidian"
+)
+
+// referencesHeader starts the references section added to responses that cite their sources.
+const referencesHeader = "\n\n**References**\n\n"
+
+var (
+	// citationDefRe matches the lines defining the `[n]` citations of a response, which the
+	// system prompt asks for at its end, e.g. `[1]: Alpha#The plan:L3-L8`.
+	citationDefRe = regexp.MustCompile(`(?m)^[ \t]*\[(\d+)\]:[ \t]*(.+?)[ \t]*$\n?`)
+	// citationPrefixRe matches what a line defining a citation may start with, for streams.
+	citationPrefixRe = regexp.MustCompile(`^[ \t]*(?:\[(?:\d+(?:\](?::.*)?)?)?)?$`)
+	// referenceRe matches the lines of a references section, as written by formatReferences.
+	referenceRe = regexp.MustCompile(`^- \[(\d+)\] (?:\[((?:\\.|[^\]\\])*)\]\((\S+)\)|(.*))$`)
+	// escapedRe matches the characters escaped in the labels of a references section.
+	escapedRe = regexp.MustCompile(`\\(.)`)
+)
+
+// reference is a source cited by a response, along with the URI opening it if there's one: in
+// Obsidian for notes of the vault, or the source itself for web pages.
+type reference struct {
+	n     int
+	label string
+	uri   string
+}
+
+// resolveCitations replaces the definitions of the `[n]` citations of a response with a
+// references section, linking every source to its note in Obsidian. Responses without any are
+// left as they are.
+func resolveCitations(vault *obsidian.Vault, text string) string {
+	defs := citationDefRe.FindAllStringSubmatch(text, -1)
+	if len(defs) == 0 {
+		return text
+	}
+
+	var refs []reference
+	for _, def := range defs {
+		n, _ := strconv.Atoi(def[1])
+		if slices.ContainsFunc(refs, func(r reference) bool { return r.n == n }) {
+			continue
+		}
+
+		ref := reference{n: n, label: strings.Trim(def[2], "`<>")}
+		if strings.HasPrefix(ref.label, "https://") || strings.HasPrefix(ref.label, "http://") {
+			// e.g. from a web search
+			ref.uri = ref.label
+		} else if source, err := obsidian.ParseSource(ref.label); err == nil {
+			// sources that aren't in the vault (i.e. made up) are kept as they are
+			if uri, err := vault.SourceURI(source); err == nil {
+				ref.label, ref.uri = source.Label(), uri
+			}
+		}
+		refs = append(refs, ref)
+	}
+	slices.SortFunc(refs, func(a, b reference) int { return cmp.Compare(a.n, b.n) })
+
+	body := strings.TrimRight(citationDefRe.ReplaceAllString(text, ""), "\n ")
+	return body + formatReferences(refs)
+}
+
+func formatReferences(refs []reference) string {
+	var sb strings.Builder
+	sb.WriteString(referencesHeader)
+	for _, ref := range refs {
+		if ref.uri == "" {
+			fmt.Fprintf(&sb, "- [%d] %s\n", ref.n, ref.label)
+			continue
+		}
+		label := strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`).Replace(ref.label)
+		fmt.Fprintf(&sb, "- [%d] [%s](%s)\n", ref.n, label, ref.uri)
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// splitReferences splits a response into its body and the references added by resolveCitations,
+// if it has any.
+func splitReferences(text string) (string, []reference) {
+	i := strings.LastIndex(text, referencesHeader)
+	if i < 0 {
+		return text, nil
+	}
+
+	var refs []reference
+	for _, line := range strings.Split(text[i+len(referencesHeader):], "\n") {
+		m := referenceRe.FindStringSubmatch(line)
+		if m == nil {
+			// not one of ours after all
+			return text, nil
+		}
+
+		n, _ := strconv.Atoi(m[1])
+		ref := reference{n: n, label: m[4], uri: m[3]}
+		if ref.uri != "" {
+			ref.label = escapedRe.ReplaceAllString(m[2], "$1")
+		}
+		refs = append(refs, ref)
+	}
+
+	return text[:i], refs
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/victhorio/opa/obsidian"
+)
+
+func TestResolveCitations(t *testing.T) {
+	vault, root := writeVault(t, citationsNotes, obsidian.Cfg{})
+	name := filepath.Base(root)
+
+	text := strings.Join([]string{
+		"The plan is set [1], and running is fun [2][3].",
+		"",
+		"[1]: Big Plan#Steps:L3-L4",
+		"[2]: `2025-10-11`",
+		"[3]: Made Up#Nope",
+		"[1]: Big Plan",
+		"[4]: https://example.com/run",
+	}, "\n")
+
+	got := resolveCitations(vault, text)
+	want := "The plan is set [1], and running is fun [2][3]." + referencesHeader +
+		"- [1] [Big Plan › Steps (lines 3-4)](obsidian://open?vault=" + name + "&file=Projects%2FBig%20Plan)\n" +
+		"- [2] [2025-10-11](obsidian://open?vault=" + name + "&file=Daily%2F2025-10-11)\n" +
+		"- [3] Made Up#Nope\n" +
+		"- [4] [https://example.com/run](https://example.com/run)"
+	if got != want {
+		t.Errorf("unexpected resolved response:\ngot:  %q\nwant: %q", got, want)
+	}
+
+	body, refs := splitReferences(got)
+	if body != "The plan is set [1], and running is fun [2][3]." {
+		t.Errorf("unexpected body %q", body)
+	}
+	wantRefs := []reference{
+		{1, "Big Plan › Steps (lines 3-4)", "obsidian://open?vault=" + name + "&file=Projects%2FBig%20Plan"},
+		{2, "2025-10-11", "obsidian://open?vault=" + name + "&file=Daily%2F2025-10-11"},
+		{3, "Made Up#Nope", ""},
+		{4, "https://example.com/run", "https://example.com/run"},
+	}
+	if !slices.Equal(refs, wantRefs) {
+		t.Errorf("expected references %+v, got %+v", wantRefs, refs)
+	}
+
+	// responses without citations are left alone, and so are those that just look like they
+	// have references
+	for _, text := range []string{"nothing to cite here", "odd" + referencesHeader + "not a reference"} {
+		if got := resolveCitations(vault, text); got != text {
+			t.Errorf("expected %q to be left as is, got %q", text, got)
+		}
+		if body, refs := splitReferences(text); body != text || refs != nil {
+			t.Errorf("expected no references in %q, got %+v", text, refs)
+		}
+	}
+}
+
+func TestReadNoteSources(t *testing.T) {
+	vault, _ := writeVault(t, citationsNotes, obsidian.Cfg{})
+
+	got, err := vault.ReadNote("Big Plan")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{
+		"<section source=\"Big Plan:L1-L3\">\n---\n# not a heading\n---\n</section>",
+		"<section source=\"Big Plan#Big Plan:L4\">",
+		"<section source=\"Big Plan#Steps:L5-L9\">\n## Steps\nstep one\n```\n# also not a heading\n```\n</section>",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected the note to contain %q, got %q", want, got)
+		}
+	}
+}
+
+// citationsNotes are the notes of the vault the citation tests resolve sources against.
+var citationsNotes = map[string]string{
+	"Daily/2025-10-11.md":  "went for a run",
+	"Projects/Big Plan.md": "---\n# not a heading\n---\n# Big Plan\n## Steps\nstep one\n```\n# also not a heading\n```\n",
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/victhorio/opa/obsidian"
+)
+
+var (
+	monthPattern = `(jan|feb|mar|apr|may|jun|jul|aug|sep|sept|oct|nov|dec)[a-z]*`
+	dayPattern   = `(\d{1,2})(?:st|nd|rd|th)?`
+
+	rangeSepRe   = regexp.MustCompile(`^(?:from |between )?(.+?)(?: to | until | through | and | - )(.+)$`)
+	agoRe        = regexp.MustCompile(`^(\d+|a|an|one) (day|week|month|year)s? ago$`)
+	lastNRe      = regexp.MustCompile(`^(?:last|past|previous) (\d+) (day|week|month)s?$`)
+	relUnitRe    = regexp.MustCompile(`^(this|last|previous|next) (week|month|quarter|year)$`)
+	weekdayRe    = regexp.MustCompile(`^(?:(last|this|next) )?(` + strings.ToLower(strings.Join(obsidian.WeekdayNames, "|")) + `)$`)
+	weekOfRe     = regexp.MustCompile(`^week of (.+)$`)
+	quarterRe    = regexp.MustCompile(`^(?:q([1-4])(?: (\d{4}))?|(\d{4})[ -]?q([1-4]))$`)
+	isoRe        = regexp.MustCompile(`^(\d{4})(?:-(\d{2})(?:-(\d{2}))?)?$`)
+	monthDayRe   = regexp.MustCompile(`^` + monthPattern + `(?: ` + dayPattern + `)?(?: (\d{4}))?$`)
+	dayMonthRe   = regexp.MustCompile(`^` + dayPattern + ` (?:of )?` + monthPattern + `(?: (\d{4}))?$`)
+	whitespaceRe = regexp.MustCompile(`\s+`)
+)
+
+// resolveDateRange resolves a natural description of a span of days, relative to now, into its
+// first and last days. It understands things like "yesterday", "last tuesday", "this week",
+// "the week of March 3", "last 10 days", "2 weeks ago", "March 2025", "Q3 2025", "2025-10-11",
+// and ranges between any two of them like "from March 3 to yesterday".
+//
+// Weeks start on Monday, and dates without a year are the last ones that aren't in the future.
+func resolveDateRange(expr string, now time.Time) (time.Time, time.Time, error) {
+	s := strings.ToLower(strings.TrimSpace(expr))
+	s = strings.NewReplacer(",", " ", ".", "").Replace(s)
+	s = whitespaceRe.ReplaceAllString(strings.TrimSpace(s), " ")
+
+	today := obsidian.Day(now)
+
+	if m := rangeSepRe.FindStringSubmatch(s); m != nil {
+		from, _, err := resolveSpan(m[1], today)
+		if err == nil {
+			_, to, err := resolveSpan(m[2], today)
+			if err != nil {
+				return time.Time{}, time.Time{}, fmt.Errorf("can't make sense of %q in %q", m[2], expr)
+			}
+			if to.Before(from) {
+				return time.Time{}, time.Time{}, fmt.Errorf("%q ends before it starts", expr)
+			}
+			return from, to, nil
+		}
+	}
+
+	from, to, err := resolveSpan(s, today)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("can't make sense of %q as dates", expr)
+	}
+	return from, to, nil
+}
+
+// resolveSpan resolves a single span of days, see resolveDateRange.
+func resolveSpan(s string, today time.Time) (time.Time, time.Time, error) {
+	s = strings.TrimPrefix(s, "the ")
+
+	switch s {
+	case "today":
+		return today, today, nil
+	case "yesterday":
+		d := today.AddDate(0, 0, -1)
+		return d, d, nil
+	case "tomorrow":
+		d := today.AddDate(0, 0, 1)
+		return d, d, nil
+	}
+
+	if m := agoRe.FindStringSubmatch(s); m != nil {
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			n = 1 // a, an or one
+		}
+		return unitSpan(m[2], today, -n)
+	}
+
+	if m := lastNRe.FindStringSubmatch(s); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		if n == 0 {
+			return time.Time{}, time.Time{}, fmt.Errorf("empty span")
+		}
+		var from time.Time
+		switch m[2] {
+		case "day":
+			from = today.AddDate(0, 0, -n+1)
+		case "week":
+			from = today.AddDate(0, 0, -7*n+1)
+		case "month":
+			from = today.AddDate(0, -n, 1)
+		}
+		return from, today, nil
+	}
+
+	if m := relUnitRe.FindStringSubmatch(s); m != nil {
+		offset := map[string]int{"this": 0, "last": -1, "previous": -1, "next": 1}[m[1]]
+		return unitSpan(m[2], today, offset)
+	}
+
+	if m := weekdayRe.FindStringSubmatch(s); m != nil {
+		weekday := time.Weekday(slices.IndexFunc(obsidian.WeekdayNames, func(name string) bool { return strings.EqualFold(name, m[2]) }))
+		var d time.Time
+		switch m[1] {
+		case "", "last":
+			// the last one that isn't today for "last", and also today otherwise
+			d = today
+			if m[1] == "last" {
+				d = d.AddDate(0, 0, -1)
+			}
+			for d.Weekday() != weekday {
+				d = d.AddDate(0, 0, -1)
+			}
+		case "this":
+			d = obsidian.WeekStart(today).AddDate(0, 0, (int(weekday)+6)%7)
+		case "next":
+			d = today.AddDate(0, 0, 1)
+			for d.Weekday() != weekday {
+				d = d.AddDate(0, 0, 1)
+			}
+		}
+		return d, d, nil
+	}
+
+	if m := weekOfRe.FindStringSubmatch(s); m != nil {
+		from, _, err := resolveSpan(m[1], today)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		return unitSpan("week", from, 0)
+	}
+
+	if m := quarterRe.FindStringSubmatch(s); m != nil {
+		q, year := m[1], m[2]
+		if q == "" {
+			q, year = m[4], m[3]
+		}
+		n, _ := strconv.Atoi(q)
+		y := today.Year()
+		if year != "" {
+			y, _ = strconv.Atoi(year)
+		}
+		from := time.Date(y, time.Month((n-1)*3+1), 1, 0, 0, 0, 0, time.Local)
+		return from, from.AddDate(0, 3, -1), nil
+	}
+
+	if m := isoRe.FindStringSubmatch(s); m != nil {
+		year, _ := strconv.Atoi(m[1])
+		switch {
+		case m[2] == "":
+			from := time.Date(year, time.January, 1, 0, 0, 0, 0, time.Local)
+			return from, from.AddDate(1, 0, -1), nil
+		case m[3] == "":
+			month, _ := strconv.Atoi(m[2])
+			return monthSpan(year, month)
+		}
+		month, _ := strconv.Atoi(m[2])
+		d, _ := strconv.Atoi(m[3])
+		return daySpan(year, month, d)
+	}
+
+	var monthName, dayOfMonth, year string
+	if m := monthDayRe.FindStringSubmatch(s); m != nil {
+		monthName, dayOfMonth, year = m[1], m[2], m[3]
+	} else if m := dayMonthRe.FindStringSubmatch(s); m != nil {
+		dayOfMonth, monthName, year = m[1], m[2], m[3]
+	} else {
+		return time.Time{}, time.Time{}, fmt.Errorf("unknown date %s", s)
+	}
+
+	month := 1 + slices.IndexFunc(obsidian.MonthNames, func(name string) bool { return strings.EqualFold(name[:3], monthName[:3]) })
+	y := today.Year()
+	if year != "" {
+		y, _ = strconv.Atoi(year)
+	}
+
+	if dayOfMonth == "" {
+		from, to, err := monthSpan(y, month)
+		if err == nil && year == "" && from.After(today) {
+			return monthSpan(y-1, month)
+		}
+		return from, to, err
+	}
+
+	d, _ := strconv.Atoi(dayOfMonth)
+	from, to, err := daySpan(y, month, d)
+	if err == nil && year == "" && from.After(today) {
+		return daySpan(y-1, month, d)
+	}
+	return from, to, err
+}
+
+// unitSpan returns the week, month, quarter or year (or day) of d, moved by offset of them.
+func unitSpan(unit string, d time.Time, offset int) (time.Time, time.Time, error) {
+	switch unit {
+	case "day":
+		d = d.AddDate(0, 0, offset)
+		return d, d, nil
+	case "week":
+		from := obsidian.WeekStart(d).AddDate(0, 0, 7*offset)
+		return from, from.AddDate(0, 0, 6), nil
+	case "month":
+		from := time.Date(d.Year(), d.Month()+time.Month(offset), 1, 0, 0, 0, 0, time.Local)
+		return from, from.AddDate(0, 1, -1), nil
+	case "quarter":
+		from := time.Date(d.Year(), (d.Month()-1)/3*3+1+time.Month(3*offset), 1, 0, 0, 0, 0, time.Local)
+		return from, from.AddDate(0, 3, -1), nil
+	case "year":
+		from := time.Date(d.Year()+offset, time.January, 1, 0, 0, 0, 0, time.Local)
+		return from, from.AddDate(1, 0, -1), nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("unknown unit %s", unit)
+}
+
+func monthSpan(year, month int) (time.Time, time.Time, error) {
+	if month < 1 || month > 12 {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid month %d", month)
+	}
+	from := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.Local)
+	return from, from.AddDate(0, 1, -1), nil
+}
+
+func daySpan(year, month, day int) (time.Time, time.Time, error) {
+	d, ok := obsidian.Date(year, month, day)
+	if !ok {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid date %d-%02d-%02d", year, month, day)
+	}
+	return d, d, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/victhorio/opa/obsidian"
+)
+
+func TestResolveDateRange(t *testing.T) {
+	// a Wednesday
+	now := time.Date(2025, time.March, 12, 15, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		expr     string
+		from, to string
+		wantErr  bool
+	}{
+		{"today", "2025-03-12", "2025-03-12", false},
+		{"Yesterday", "2025-03-11", "2025-03-11", false},
+		{"tomorrow", "2025-03-13", "2025-03-13", false},
+		{"3 days ago", "2025-03-09", "2025-03-09", false},
+		{"a week ago", "2025-03-03", "2025-03-09", false},
+		{"last 10 days", "2025-03-03", "2025-03-12", false},
+		{"past 2 weeks", "2025-02-27", "2025-03-12", false},
+		{"last 1 month", "2025-02-13", "2025-03-12", false},
+		{"this week", "2025-03-10", "2025-03-16", false},
+		{"last week", "2025-03-03", "2025-03-09", false},
+		{"next week", "2025-03-17", "2025-03-23", false},
+		{"last month", "2025-02-01", "2025-02-28", false},
+		{"this quarter", "2025-01-01", "2025-03-31", false},
+		{"last quarter", "2024-10-01", "2024-12-31", false},
+		{"last year", "2024-01-01", "2024-12-31", false},
+		{"wednesday", "2025-03-12", "2025-03-12", false},
+		{"last wednesday", "2025-03-05", "2025-03-05", false},
+		{"friday", "2025-03-07", "2025-03-07", false},
+		{"this friday", "2025-03-14", "2025-03-14", false},
+		{"next monday", "2025-03-17", "2025-03-17", false},
+		{"the week of March 5", "2025-03-03", "2025-03-09", false},
+		{"Q3 2024", "2024-07-01", "2024-09-30", false},
+		{"2024-Q4", "2024-10-01", "2024-12-31", false},
+		{"2025-02-14", "2025-02-14", "2025-02-14", false},
+		{"2024-02", "2024-02-01", "2024-02-29", false},
+		{"2024", "2024-01-01", "2024-12-31", false},
+		{"March 2024", "2024-03-01", "2024-03-31", false},
+		{"Feb 3rd", "2025-02-03", "2025-02-03", false},
+		{"3 February, 2024", "2024-02-03", "2024-02-03", false},
+		{"december", "2024-12-01", "2024-12-31", false},
+		{"April 1", "2024-04-01", "2024-04-01", false},
+		{"from March 3 to yesterday", "2025-03-03", "2025-03-11", false},
+		{"between 2025-01-30 and 2025-02-02", "2025-01-30", "2025-02-02", false},
+		{"last month through this week", "2025-02-01", "2025-03-16", false},
+		{"2025-03-01 - 2025-03-02", "2025-03-01", "2025-03-02", false},
+		{"yesterday to March 3", "", "", true},
+		{"2025-02-30", "", "", true},
+		{"last 0 days", "", "", true},
+		{"someday", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			from, to, err := resolveDateRange(tt.expr, now)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %s to %s", from.Format(time.DateOnly), to.Format(time.DateOnly))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := from.Format(time.DateOnly); got != tt.from {
+				t.Errorf("expected to start on %s, got %s", tt.from, got)
+			}
+			if got := to.Format(time.DateOnly); got != tt.to {
+				t.Errorf("expected to end on %s, got %s", tt.to, got)
+			}
+		})
+	}
+}
+
+func TestReadDailiesTool(t *testing.T) {
+	vault, _ := writeVault(t, map[string]string{
+		"0 Daily/2025-03-03.md":       "went for a run",
+		"0 Daily/2025-03-10.md":       "planning day",
+		"0 Daily/2025-03-11.md":       "wrote the report",
+		"0 Daily/template.md":         "{{date}}",
+		"0 Weekly/2025-W11.md":        "a good week",
+		"Projects/2025-03-10 Demo.md": "not a daily",
+	}, obsidian.Cfg{})
+	tool := createReadDailiesTool(vault)
+
+	call := func(args string) string {
+		t.Helper()
+		out, err := tool.Handler(context.Background(), json.RawMessage(args))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return out.Text
+	}
+
+	got := call(`{"range":"from 2025-03-01 to 2025-03-10"}`)
+	if !strings.HasPrefix(got, "2 daily notes from 2025-03-01 (Saturday) to 2025-03-10 (Monday)\n") {
+		t.Errorf("unexpected header in %q", got)
+	}
+	first, second := strings.Index(got, "went for a run"), strings.Index(got, "planning day")
+	if first < 0 || second < first || strings.Contains(got, "wrote the report") {
+		t.Errorf("expected the dailies of the range in order, got %q", got)
+	}
+
+	got = call(`{"range":"2025-03-12","period":"weekly"}`)
+	if !strings.Contains(got, "<note_name>2025-W11</note_name>") {
+		t.Errorf("expected the weekly of the day, got %q", got)
+	}
+
+	for args, want := range map[string]string{
+		`{"range":"2024"}`:                      "<error>No daily notes",
+		`{"range":"someday"}`:                   "<error>Failed to resolve range",
+		`{"range":"today","period":"hourly"}`:   "<error>Invalid period",
+		`{"range":"2025","period":"quarterly"}`: "<error>No quarterly notes",
+	} {
+		if got := call(args); !strings.HasPrefix(got, want) {
+			t.Errorf("expected %s to fail with %q, got %q", args, want, got)
+		}
+	}
+}
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -17,14 +22,73 @@ import (
 	"github.com/victhorio/opa/prompts"
 )
 
-const sessionID = "tui-session"
+const (
+	defaultModel = "openai:gpt-5.1"
+	vaultPath    = "~/Documents/Cortex"
+)
+
+var modelSpec = flag.String(
+	"model",
+	"",
+	"model to use as provider:name, e.g. anthropic:sonnet (defaults to the one in ~/.opa/models.yaml)",
+)
 
 func main() {
+	flag.Parse()
+
+	// `opa usage` reports what was spent instead of starting a session
+	if flag.Arg(0) == "usage" {
+		if err := runUsage(flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// `opa ask` answers a single prompt without the TUI, for scripts and pipelines
+	if flag.Arg(0) == "ask" {
+		os.Exit(runAsk(flag.Args()[1:]))
+	}
+
+	// `opa mcp` shares the vault tools with other agents over stdio
+	if flag.Arg(0) == "mcp" {
+		if err := runMCP(flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// `opa serve` exposes sessions over HTTP for other clients
+	if flag.Arg(0) == "serve" {
+		if err := runServe(flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if err := setupLogging(); err != nil {
 		log.Fatalf("error setting up logging: %v", err)
 	}
 
-	vault, err := obsidian.LoadVault("~/Documents/Cortex", obsidian.Cfg{ComputeEmbeddings: false})
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("error loading config: %v", err)
+	}
+
+	model, spec, err := loadModel(*modelSpec, cfg)
+	if err != nil {
+		log.Fatalf("error loading model: %v", err)
+	}
+
+	store, err := openStore()
+	if err != nil {
+		log.Fatalf("error opening store: %v", err)
+	}
+	defer store.Close()
+
+	vault, err := openVault(store)
 	if err != nil {
 		log.Fatalf("error loading vault: %v", err)
 	}
@@ -32,8 +96,16 @@ func main() {
 	// Start embeddings refresh in background so TUI opens immediately.
 	embeddingsDone := vault.RefreshEmbeddingsAsync()
 
-	agent := newAgent(vault)
-	if err := runTUI(agent, sessionID, embeddingsDone); err != nil {
+	tools := allTools(vault)
+	external, closeMCP := connectMCPServers(tools)
+	defer closeMCP()
+
+	agent := newAgent(vault, model, store, append(tools, external...))
+	agent.SetBudget(cfg.Budget.Budget(), store)
+
+	// every run is a new session, the store keeps the previous ones for the usage reports
+	sessionID := newSessionID("tui")
+	if err := runTUI(agent, spec, sessionID, embeddingsDone); err != nil {
 		log.Fatalf("error running TUI: %v", err)
 	}
 
@@ -41,36 +113,117 @@ func main() {
 	printUsage(u)
 }
 
-func newAgent(vault *obsidian.Vault) agg.Agent {
-	model := openai.NewModel(openai.GPT51, "low")
-	store, err := agg.NewSQLiteStore(":memory:")
+func newAgent(vault *obsidian.Vault, model core.Model, store agg.Store, tools []agg.Tool) agg.Agent {
+	sysPrompt, err := loadSysPrompt(vault)
 	if err != nil {
-		log.Fatalf("error creating SQLite store: %v", err)
+		log.Fatalf("error loading system prompt: %v", err)
 	}
 
+	agent := agg.NewAgent(sysPrompt, model, store, tools)
+	agent.SetPostProcess(func(text string) string { return resolveCitations(vault, text) })
+
+	return agent
+}
+
+// allTools returns every tool opa has, which is what the TUI uses.
+func allTools(vault *obsidian.Vault) []agg.Tool {
 	webSearchTool, err := tools.CreateAgenticWebSearchTool(http.DefaultClient)
 	if err != nil {
 		log.Fatalf("error creating web search tool: %v", err)
 	}
 
-	sysPrompt, err := loadSysPrompt(vault)
+	researchModel := openai.NewModel(openai.GPT5Mini, "low")
+
+	return append(
+		vaultTools(vault),
+		createSmartReadNoteTool(vault, nil),
+		createResearchTool(vault, researchModel, nil),
+		webSearchTool,
+	)
+}
+
+// vaultTools returns the tools that only work on the vault, without running an LLM of their own,
+// which is what `opa mcp` shares with other agents.
+func vaultTools(vault *obsidian.Vault) []agg.Tool {
+	return []agg.Tool{
+		createReadNoteTool(vault),
+		createReadDailiesTool(vault),
+		createListDirTool(vault),
+		createReadAttachmentTool(vault),
+		createRipGrepTool(vault),
+		createSemanticSearchTool(vault),
+		createFindTasksTool(vault),
+		createToggleTaskTool(vault),
+	}
+}
+
+// openVault loads the vault, with the periodic notes configured in ~/.opa/models.yaml if any.
+// Embedding requests are recorded in ledger.
+func openVault(ledger core.EmbeddingsLedger) (*obsidian.Vault, error) {
+	home, err := os.UserHomeDir()
 	if err != nil {
-		log.Fatalf("error loading system prompt: %v", err)
+		return nil, fmt.Errorf("failed to get home directory: %w", err)
 	}
 
-	return agg.NewAgent(
-		sysPrompt,
-		model,
-		store,
-		[]agg.Tool{
-			createReadNoteTool(vault),
-			createSmartReadNoteTool(vault, nil),
-			createListDirTool(vault),
-			createRipGrepTool(vault),
-			createSemanticSearchTool(vault),
-			webSearchTool,
-		},
-	)
+	periodic, err := obsidian.LoadPeriodicConfig(filepath.Join(home, ".opa", "models.yaml"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	return obsidian.LoadVault(vaultPath, obsidian.Cfg{ComputeEmbeddings: false, Ledger: ledger, Periodic: periodic})
+}
+
+// openStore opens the store at ~/.opa/opa.db, which keeps every session along with its usage.
+func openStore() (*agg.SQLiteStore, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get home directory: %w", err)
+	}
+
+	return agg.NewSQLiteStore(filepath.Join(home, ".opa", "opa.db"))
+}
+
+// loadConfig reads ~/.opa/models.yaml, registering the models and prices it declares, if it exists.
+func loadConfig() (agg.ModelConfig, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return agg.ModelConfig{}, fmt.Errorf("failed to get home directory: %w", err)
+	}
+
+	cfg, err := agg.LoadModelConfig(filepath.Join(home, ".opa", "models.yaml"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return agg.ModelConfig{}, err
+	}
+
+	return cfg, nil
+}
+
+// loadModel creates the model given by spec, where an empty spec picks the default model of the
+// config. The model retries failed requests and fails over to the fallbacks of the config. The
+// spec that was used is returned along with the model.
+func loadModel(spec string, cfg agg.ModelConfig) (core.Model, string, error) {
+	if spec == "" {
+		spec = cmp.Or(cfg.Model, defaultModel)
+	}
+
+	model, err := agg.NewModelFromSpec(spec)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var fallbacks []core.Model
+	for _, fallbackSpec := range cfg.Fallbacks {
+		if fallbackSpec == spec {
+			continue
+		}
+		fallback, err := agg.NewModelFromSpec(fallbackSpec)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid fallback model: %w", err)
+		}
+		fallbacks = append(fallbacks, fallback)
+	}
+
+	return agg.NewResilientModel(model, agg.RetryPolicy{}, fallbacks...), spec, nil
 }
 
 func loadSysPrompt(vault *obsidian.Vault) (string, error) {
@@ -111,6 +264,9 @@ func printUsage(u core.Usage) {
 	fmt.Printf("\n\033[33;1mUsage:\033[0m\n")
 	fmt.Printf("  \033[33mInput:\033[0m %d\n", u.Input)
 	fmt.Printf("    \033[33mCached:\033[0m %d\n", u.Cached)
+	if u.CacheWrite > 0 {
+		fmt.Printf("    \033[33mCache writes:\033[0m %d\n", u.CacheWrite)
+	}
 	fmt.Printf("  \033[33mOutput:\033[0m %d\n", u.Output)
 	fmt.Printf("  \033[33;1mCost:\033[0m $%.3f\n", float64(u.Cost)/1_000_000_000)
 }
@@ -139,3 +295,11 @@ func setupLogging() error {
 
 	return nil
 }
+
+// newSessionID returns a new session ID, e.g. "tui-20250310-153000-1a2b3c4d". The random suffix
+// keeps sessions started within the same second apart.
+func newSessionID(prefix string) string {
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	return prefix + "-" + time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(b[:])
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/victhorio/opa/agg"
+	"github.com/victhorio/opa/agg/mcp"
+	"github.com/victhorio/opa/obsidian"
+)
+
+// noteURIPrefix is the prefix of the URIs notes are exposed as, followed by the escaped note name.
+const noteURIPrefix = "opa://notes/"
+
+// mcpStartTimeout bounds how long each configured MCP server has to start and list its tools.
+const mcpStartTimeout = 10 * time.Second
+
+// runMCP implements `opa mcp`, which serves the vault tools and notes over MCP on stdio until the
+// client closes stdin.
+func runMCP(args []string) error {
+	fs := flag.NewFlagSet("mcp", flag.ExitOnError)
+	fs.Parse(args)
+
+	// stdout is the protocol stream, so nothing else can be written to it
+	if err := setupLogging(); err != nil {
+		return fmt.Errorf("error setting up logging: %w", err)
+	}
+
+	store, err := openStore()
+	if err != nil {
+		return fmt.Errorf("error opening store: %w", err)
+	}
+	defer store.Close()
+
+	vault, err := openVault(store)
+	if err != nil {
+		return fmt.Errorf("error loading vault: %w", err)
+	}
+
+	// we serve right away, semantic searches wait for the embeddings if they're not ready yet
+	embeddingsDone := vault.RefreshEmbeddingsAsync()
+	go func() {
+		if err := <-embeddingsDone; err != nil {
+			log.Printf("warning: failed to load embeddings: %v", err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	server := mcp.NewServer("opa", buildVersion(), vaultTools(vault)).WithResources(noteResources{vault})
+	return server.Serve(ctx, os.Stdin, os.Stdout)
+}
+
+// noteResources exposes every note of the vault as a markdown resource.
+type noteResources struct {
+	vault *obsidian.Vault
+}
+
+func (n noteResources) ListResources() ([]mcp.Resource, error) {
+	notes := n.vault.Notes()
+	r := make([]mcp.Resource, 0, len(notes))
+	for _, note := range notes {
+		r = append(r, mcp.Resource{
+			URI:         noteURIPrefix + url.PathEscape(note.Name),
+			Name:        note.Name,
+			Description: note.RelPath,
+			MimeType:    "text/markdown",
+		})
+	}
+	return r, nil
+}
+
+func (n noteResources) ReadResource(uri string) (mcp.ResourceContents, error) {
+	escaped, ok := strings.CutPrefix(uri, noteURIPrefix)
+	if !ok {
+		return mcp.ResourceContents{}, fmt.Errorf("%w: %s", mcp.ErrResourceNotFound, uri)
+	}
+	name, err := url.PathUnescape(escaped)
+	if err != nil {
+		return mcp.ResourceContents{}, fmt.Errorf("%w: %s", mcp.ErrResourceNotFound, uri)
+	}
+
+	content, err := n.vault.NoteContent(name)
+	if err != nil {
+		return mcp.ResourceContents{}, fmt.Errorf("%w: %v", mcp.ErrResourceNotFound, err)
+	}
+
+	return mcp.ResourceContents{URI: uri, MimeType: "text/markdown", Text: content}, nil
+}
+
+// connectMCPServers connects to the MCP servers listed in ~/.opa/models.yaml, returning their tools
+// along with a function that disconnects from every server. Servers that fail to start are only
+// logged, as are tools whose name is already taken by ours (or by an earlier server), so a broken
+// server never keeps opa from starting.
+func connectMCPServers(ours []agg.Tool) ([]agg.Tool, func()) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Printf("warning: not connecting to MCP servers: %v", err)
+		return nil, func() {}
+	}
+
+	servers, err := mcp.LoadConfig(filepath.Join(home, ".opa", "models.yaml"))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("warning: not connecting to MCP servers: %v", err)
+		}
+		return nil, func() {}
+	}
+
+	taken := make(map[string]bool, len(ours))
+	for _, tool := range ours {
+		taken[tool.Spec.Name] = true
+	}
+
+	var tools []agg.Tool
+	var clients []*mcp.Client
+	for _, server := range servers {
+		ctx, cancel := context.WithTimeout(context.Background(), mcpStartTimeout)
+		client, err := mcp.Dial(ctx, http.DefaultClient, server)
+		if err != nil {
+			cancel()
+			log.Printf("warning: %v", err)
+			continue
+		}
+		clients = append(clients, client)
+
+		serverTools, err := client.Tools(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("warning: %v", err)
+			continue
+		}
+
+		for _, tool := range serverTools {
+			if taken[tool.Spec.Name] {
+				log.Printf("warning: skipping tool %s of MCP server %s, the name is taken", tool.Spec.Name, server.Name)
+				continue
+			}
+			taken[tool.Spec.Name] = true
+			tools = append(tools, tool)
+		}
+	}
+
+	closeAll := func() {
+		for _, client := range clients {
+			if err := client.Close(); err != nil {
+				log.Printf("warning: %v", err)
+			}
+		}
+	}
+	return tools, closeAll
+}
+
+// buildVersion returns the module version opa was built from, which is "(devel)" for local builds.
+func buildVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
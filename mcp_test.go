@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/victhorio/opa/agg/mcp"
+	"github.com/victhorio/opa/obsidian"
+)
+
+func TestNoteResources(t *testing.T) {
+	vault, _ := writeVault(t, map[string]string{
+		"Daily/2025-10-11.md":    "went for a run",
+		"Projects/Big Plan.md":   "# Big Plan\nstep one",
+		"Projects/.hidden/no.md": "never listed",
+	}, obsidian.Cfg{})
+	resources := noteResources{vault}
+
+	list, err := resources.ListResources()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("expected 2 resources, got %+v", list)
+	}
+	if list[1].URI != "opa://notes/Big%20Plan" || list[1].Name != "Big Plan" || list[1].MimeType != "text/markdown" {
+		t.Errorf("unexpected resource %+v", list[1])
+	}
+
+	contents, err := resources.ReadResource(list[1].URI)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if contents.Text != "# Big Plan\nstep one" || contents.URI != list[1].URI {
+		t.Errorf("unexpected contents %+v", contents)
+	}
+
+	for _, uri := range []string{"opa://notes/nope", "file:///etc/passwd"} {
+		if _, err := resources.ReadResource(uri); !errors.Is(err, mcp.ErrResourceNotFound) {
+			t.Errorf("expected %s not to be found, got %v", uri, err)
+		}
+	}
+}
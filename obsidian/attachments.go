@@ -0,0 +1,127 @@
+package obsidian
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/victhorio/opa/agg/core"
+)
+
+// Size limits for attachments, in line with what providers accept for a single image or document.
+const (
+	MaxImageSize    = 5 << 20
+	MaxDocumentSize = 20 << 20
+)
+
+// attachmentTypes maps the supported attachment extensions to their media types.
+var attachmentTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".pdf":  "application/pdf",
+}
+
+// ReadAttachment reads an image or PDF from the vault and returns it as a message part.
+// The path can be relative to the vault root or just the file name, in which case the whole vault
+// is searched for it like Obsidian does for embeds. An embed like `![[diagram.png|300]]` also works.
+//
+// Returns an error if the attachment can't be found, isn't a supported type or is over the size
+// limit for its type.
+func (v *Vault) ReadAttachment(path string) (core.Part, error) {
+	path = cleanEmbed(path)
+
+	mediaType, ok := attachmentTypes[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		return core.Part{}, fmt.Errorf("unsupported attachment type for %s", path)
+	}
+
+	fullPath, err := v.resolveAttachment(path)
+	if err != nil {
+		return core.Part{}, err
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return core.Part{}, fmt.Errorf("failed to stat attachment %s: %w", path, err)
+	}
+
+	limit := int64(MaxImageSize)
+	if mediaType == "application/pdf" {
+		limit = MaxDocumentSize
+	}
+	if info.Size() > limit {
+		return core.Part{}, fmt.Errorf(
+			"attachment %s is too large (%d bytes, limit is %d)", path, info.Size(), limit,
+		)
+	}
+
+	data, err := os.ReadFile(fullPath)
+	if err != nil {
+		return core.Part{}, fmt.Errorf("failed to read attachment %s: %w", path, err)
+	}
+
+	if mediaType == "application/pdf" {
+		return core.NewPartDocument(filepath.Base(fullPath), mediaType, data), nil
+	}
+	return core.NewPartImage(mediaType, data), nil
+}
+
+// cleanEmbed strips the embed syntax and any size or alias suffix from an attachment reference.
+func cleanEmbed(path string) string {
+	path = strings.TrimSpace(path)
+	path = strings.TrimPrefix(path, "!")
+	path = strings.TrimPrefix(path, "[[")
+	path = strings.TrimSuffix(path, "]]")
+	if i := strings.Index(path, "|"); i >= 0 {
+		path = path[:i]
+	}
+	return strings.TrimSpace(path)
+}
+
+// resolveAttachment returns the full path of an attachment, first trying path relative to the
+// vault root and then looking for a file with the same name anywhere in the vault. Paths that
+// would escape the vault are rejected.
+func (v *Vault) resolveAttachment(path string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(path))
+	if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("attachment %s is outside the vault", path)
+	}
+
+	fullPath := filepath.Join(v.rootDir, rel)
+	if info, err := os.Stat(fullPath); err == nil && !info.IsDir() {
+		return fullPath, nil
+	}
+
+	name := filepath.Base(rel)
+	var found string
+	handler := func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != v.rootDir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Name() == name {
+			found = p
+			return filepath.SkipAll
+		}
+		return nil
+	}
+
+	if err := filepath.WalkDir(v.rootDir, handler); err != nil {
+		return "", fmt.Errorf("failed to search the vault for attachment %s: %w", path, err)
+	}
+	if found == "" {
+		return "", fmt.Errorf("attachment %s not found", path)
+	}
+
+	return found, nil
+}
@@ -0,0 +1,207 @@
+package obsidian
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dateFormat parses dates written in a format of the syntax of moment.js, which is what Obsidian
+// uses to name periodic notes, e.g. `YYYY-MM-DD` or `gggg-[W]ww`. Only the tokens that make sense
+// in note names are supported. `GGGG` and `WW` are ISO weeks, starting on Monday, while `gggg` and
+// `ww` are the weeks of moment's default English locale, which Obsidian uses unless configured
+// otherwise: they start on Sunday and the first week of a year is the one with January 1st.
+type dateFormat struct {
+	layout string
+	re     *regexp.Regexp
+	groups []string // the token of each capture group of re
+}
+
+var (
+	// MonthNames are the names of the months in English, indexed by time.Month - 1.
+	MonthNames = []string{
+		"January", "February", "March", "April", "May", "June",
+		"July", "August", "September", "October", "November", "December",
+	}
+	// WeekdayNames are the names of the days of the week in English, indexed by time.Weekday.
+	WeekdayNames = []string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"}
+)
+
+// dateTokens maps every supported token to the pattern it matches, longest tokens first so that
+// e.g. `MMMM` isn't taken for two `MM`.
+var dateTokens = []struct{ token, pattern string }{
+	{"YYYY", `(\d{4})`},
+	{"GGGG", `(\d{4})`},
+	{"gggg", `(\d{4})`},
+	{"MMMM", "(" + strings.Join(MonthNames, "|") + ")"},
+	{"dddd", "(?:" + strings.Join(WeekdayNames, "|") + ")"},
+	{"MMM", "(" + strings.Join(abbreviate(MonthNames), "|") + ")"},
+	{"ddd", "(?:" + strings.Join(abbreviate(WeekdayNames), "|") + ")"},
+	{"YY", `(\d{2})`},
+	{"MM", `(\d{2})`},
+	{"DD", `(\d{2})`},
+	{"Do", `(\d{1,2})(?:st|nd|rd|th)`},
+	{"WW", `(\d{2})`},
+	{"ww", `(\d{2})`},
+	{"M", `(\d{1,2})`},
+	{"D", `(\d{1,2})`},
+	{"W", `(\d{1,2})`},
+	{"w", `(\d{1,2})`},
+	{"Q", `([1-4])`},
+}
+
+func abbreviate(names []string) []string {
+	r := make([]string, len(names))
+	for i, name := range names {
+		r[i] = name[:3]
+	}
+	return r
+}
+
+// newDateFormat compiles a format, where text between brackets is taken literally, e.g. `[W]`.
+func newDateFormat(layout string) (*dateFormat, error) {
+	f := &dateFormat{layout: layout}
+
+	var pattern strings.Builder
+	pattern.WriteString("(?i)^")
+	rest := layout
+	hasYear := false
+outer:
+	for rest != "" {
+		if rest[0] == '[' {
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed [ in date format %s", layout)
+			}
+			pattern.WriteString(regexp.QuoteMeta(rest[1:end]))
+			rest = rest[end+1:]
+			continue
+		}
+
+		for _, tok := range dateTokens {
+			if strings.HasPrefix(rest, tok.token) {
+				pattern.WriteString(tok.pattern)
+				if strings.HasPrefix(tok.pattern, "(") && !strings.HasPrefix(tok.pattern, "(?:") {
+					f.groups = append(f.groups, tok.token)
+				}
+				hasYear = hasYear || strings.ContainsAny(tok.token[:1], "YGg")
+				rest = rest[len(tok.token):]
+				continue outer
+			}
+		}
+
+		pattern.WriteString(regexp.QuoteMeta(rest[:1]))
+		rest = rest[1:]
+	}
+	pattern.WriteString("$")
+
+	if !hasYear {
+		return nil, fmt.Errorf("date format %s has no year", layout)
+	}
+
+	re, err := regexp.Compile(pattern.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid date format %s: %w", layout, err)
+	}
+	f.re = re
+	return f, nil
+}
+
+// parse returns the date s is for, which is the first day of the week, month or quarter when the
+// format only goes that far, or false if s isn't in the format.
+func (f *dateFormat) parse(s string) (time.Time, bool) {
+	m := f.re.FindStringSubmatch(s)
+	if m == nil {
+		return time.Time{}, false
+	}
+
+	var year, weekYear, month, day, week, quarter int
+	localeWeek := false
+	for i, tok := range f.groups {
+		value := m[i+1]
+		n, _ := strconv.Atoi(value)
+		switch tok {
+		case "YYYY":
+			year = n
+		case "YY":
+			year = 2000 + n
+		case "GGGG", "gggg":
+			weekYear = n
+		case "MMMM", "MMM":
+			for j, name := range MonthNames {
+				if strings.HasPrefix(strings.ToLower(name), strings.ToLower(value)) {
+					month = j + 1
+					break
+				}
+			}
+		case "MM", "M":
+			month = n
+		case "DD", "D", "Do":
+			day = n
+		case "WW", "W":
+			week = n
+		case "ww", "w":
+			week, localeWeek = n, true
+		case "Q":
+			quarter = n
+		}
+	}
+
+	switch {
+	case week > 0:
+		if weekYear == 0 {
+			weekYear = year
+		}
+		if localeWeek {
+			t := localeWeekStart(weekYear, week)
+			// the week belongs to the year of its Saturday, so the last ones may be of the next year
+			if t.AddDate(0, 0, 6).Year() != weekYear {
+				return time.Time{}, false
+			}
+			return t, true
+		}
+		t := isoWeekStart(weekYear, week)
+		if y, w := t.ISOWeek(); y != weekYear || w != week {
+			return time.Time{}, false
+		}
+		return t, true
+	case year == 0:
+		return time.Time{}, false
+	case quarter > 0:
+		return time.Date(year, time.Month((quarter-1)*3+1), 1, 0, 0, 0, 0, time.Local), true
+	}
+
+	return Date(year, max(month, 1), max(day, 1))
+}
+
+// Date returns the start of the given day in the local time zone, or false if there's no such day.
+func Date(year, month, day int) (time.Time, bool) {
+	t := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.Local)
+	// time.Date normalizes things like February 30, which aren't dates at all
+	if t.Month() != time.Month(month) || t.Day() != day {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// isoWeekStart returns the Monday starting the given ISO week.
+func isoWeekStart(year, week int) time.Time {
+	// January 4th is always in the first week
+	jan4 := time.Date(year, time.January, 4, 0, 0, 0, 0, time.Local)
+	return WeekStart(jan4).AddDate(0, 0, (week-1)*7)
+}
+
+// WeekStart returns the Monday of the week of d.
+func WeekStart(d time.Time) time.Time {
+	return d.AddDate(0, 0, -((int(d.Weekday()) + 6) % 7))
+}
+
+// localeWeekStart returns the Sunday starting the given week of moment's English locale.
+func localeWeekStart(year, week int) time.Time {
+	// January 1st is always in the first week
+	jan1 := time.Date(year, time.January, 1, 0, 0, 0, 0, time.Local)
+	sunday := jan1.AddDate(0, 0, -int(jan1.Weekday()))
+	return sunday.AddDate(0, 0, (week-1)*7)
+}
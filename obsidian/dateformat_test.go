@@ -0,0 +1,59 @@
+package obsidian
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDateFormat(t *testing.T) {
+	tests := []struct {
+		layout, s string
+		want      string // empty when s isn't in the format
+	}{
+		{"YYYY-MM-DD", "2025-03-10", "2025-03-10"},
+		{"YYYY-MM-DD", "2025-02-30", ""},
+		{"YYYY-MM-DD", "2025-03-10 Demo", ""},
+		{"GGGG-[W]WW", "2025-W11", "2025-03-10"},
+		{"GGGG-[W]WW", "2026-W01", "2025-12-29"},
+		{"GGGG-[W]WW", "2027-W01", "2027-01-04"},
+		{"GGGG-[W]WW", "2026-W53", "2026-12-28"},
+		{"GGGG-[W]WW", "2025-W53", ""},
+		// locale weeks start on Sunday, with January 1st in the first one
+		{"gggg-[W]ww", "2025-W11", "2025-03-09"},
+		{"gggg-[W]ww", "2026-W01", "2025-12-28"},
+		{"gggg-[W]ww", "2027-W01", "2026-12-27"},
+		{"gggg-[W]ww", "2026-W52", "2026-12-20"},
+		{"gggg-[W]ww", "2026-W53", ""},
+		{"YYYY/MMMM", "2025/February", "2025-02-01"},
+		{"YYYY/MMMM", "2025/february", "2025-02-01"},
+		{"YYYY-[Q]Q", "2025-Q2", "2025-04-01"},
+		{"dddd, MMMM Do YYYY", "Monday, March 10th 2025", "2025-03-10"},
+		{"ddd D MMM YY", "Sun 9 Mar 25", "2025-03-09"},
+		{"YYMMDD", "250310", "2025-03-10"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.layout+" "+tt.s, func(t *testing.T) {
+			f, err := newDateFormat(tt.layout)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got, ok := f.parse(tt.s)
+			if tt.want == "" {
+				if ok {
+					t.Errorf("expected %q not to be a date, got %s", tt.s, got.Format(time.DateOnly))
+				}
+				return
+			}
+			if !ok || got != testDate(tt.want) {
+				t.Errorf("expected %s, got %s (%v)", tt.want, got.Format(time.DateOnly), ok)
+			}
+		})
+	}
+
+	for _, layout := range []string{"MM-DD", "YYYY-[W"} {
+		if _, err := newDateFormat(layout); err == nil {
+			t.Errorf("expected %s to be invalid", layout)
+		}
+	}
+}
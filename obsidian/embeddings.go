@@ -4,6 +4,7 @@ import (
 	"cmp"
 	"context"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -24,6 +25,10 @@ const (
 	embeddingBatchSize = 100
 )
 
+// ErrEmbeddingsPending is returned by semantic searches made while the embeddings are still being
+// computed, see RefreshEmbeddingsAsync.
+var ErrEmbeddingsPending = errors.New("embeddings are still being computed")
+
 // embeddingEntry represents a single cached embedding with its content hash.
 type embeddingEntry struct {
 	NoteName    string
@@ -178,6 +183,7 @@ func (v *Vault) RefreshEmbeddings() error {
 			return fmt.Errorf("failed to embed contents: %w", err)
 		}
 		log.Printf("embedded %d notes, cost: $%.4f", len(notesToEmbed), float64(result.Cost)/1_000_000_000)
+		v.recordEmbeddings(embedder, result)
 
 		for i, noteName := range notesToEmbed {
 			e.embeds[noteName] = result.Vectors[i]
@@ -210,6 +216,17 @@ func (v *Vault) RefreshEmbeddings() error {
 	return nil
 }
 
+// recordEmbeddings records the embeddings in the ledger of the vault, if it has one. Failing to do
+// so isn't worth failing the operation over, so errors are only logged.
+func (v *Vault) recordEmbeddings(embedder core.Embedder, result *core.EmbeddingsResult) {
+	if v.cfg.Ledger == nil {
+		return
+	}
+	if err := v.cfg.Ledger.RecordEmbeddings(embedder.Provider(), result); err != nil {
+		log.Printf("warning: failed to record embeddings usage: %v", err)
+	}
+}
+
 // embedInBatches splits a large embedding request into smaller batches to avoid API limits.
 func (v *Vault) embedInBatches(ctx context.Context, embedder core.Embedder, contents []string) (*core.EmbeddingsResult, error) {
 	if len(contents) <= embeddingBatchSize {
@@ -217,7 +234,8 @@ func (v *Vault) embedInBatches(ctx context.Context, embedder core.Embedder, cont
 	}
 
 	allVectors := make([][]float64, len(contents))
-	var totalCost int64
+	var totalTokens, totalCost int64
+	var model string
 
 	for i := 0; i < len(contents); i += embeddingBatchSize {
 		end := i + embeddingBatchSize
@@ -236,11 +254,15 @@ func (v *Vault) embedInBatches(ctx context.Context, embedder core.Embedder, cont
 		for j, vec := range result.Vectors {
 			allVectors[i+j] = vec
 		}
+		totalTokens += result.Tokens
 		totalCost += result.Cost
+		model = result.Model
 	}
 
 	return &core.EmbeddingsResult{
 		Vectors: allVectors,
+		Model:   model,
+		Tokens:  totalTokens,
 		Cost:    totalCost,
 	}, nil
 }
@@ -248,6 +270,13 @@ func (v *Vault) embedInBatches(ctx context.Context, embedder core.Embedder, cont
 func (v *Vault) SemanticSearch(query string, k int) ([]SemanticMatch, error) {
 	// TODO(correctness): accept a context here
 
+	if v.embedsDone != nil {
+		select {
+		case <-v.embedsDone:
+		default:
+			return nil, ErrEmbeddingsPending
+		}
+	}
 	if v.idx.embeds == nil {
 		return nil, fmt.Errorf("embeddings not computed")
 	}
@@ -257,6 +286,7 @@ func (v *Vault) SemanticSearch(query string, k int) ([]SemanticMatch, error) {
 		return nil, fmt.Errorf("failed to embed query: %w", err)
 	}
 	qEmbed := qResult.Vectors[0]
+	v.recordEmbeddings(v.idx.embeds.embedder, qResult)
 
 	topNotes := make([]SemanticMatch, 0, k)
 
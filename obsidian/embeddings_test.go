@@ -0,0 +1,37 @@
+package obsidian
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSemanticSearchPendingEmbeddings(t *testing.T) {
+	vault, _ := testVault(t, map[string]string{"Daily/2025-03-10.md": "some note"}, Cfg{})
+
+	// stands in for a refresh started by RefreshEmbeddingsAsync that hasn't finished yet
+	vault.embedsDone = make(chan struct{})
+	if vault.EmbeddingsReady() {
+		t.Errorf("expected embeddings not to be ready while pending")
+	}
+	if _, err := vault.SemanticSearch("note", 1); !errors.Is(err, ErrEmbeddingsPending) {
+		t.Errorf("expected ErrEmbeddingsPending, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := vault.WaitEmbeddings(ctx)
+	if !errors.Is(err, ErrEmbeddingsPending) || !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a pending error from the cancelled wait, got %v", err)
+	}
+
+	refreshErr := errors.New("no API key")
+	vault.embedsErr = refreshErr
+	close(vault.embedsDone)
+	if err := vault.WaitEmbeddings(context.Background()); !errors.Is(err, refreshErr) {
+		t.Errorf("expected the refresh error, got %v", err)
+	}
+	if _, err := vault.SemanticSearch("note", 1); err == nil || errors.Is(err, ErrEmbeddingsPending) {
+		t.Errorf("expected embeddings not to be computed, got %v", err)
+	}
+}
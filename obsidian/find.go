@@ -0,0 +1,172 @@
+package obsidian
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-yaml"
+)
+
+// NoteFilter selects notes of the vault for FindNotes. Fields left empty don't filter anything,
+// and the ones that are set must all match.
+type NoteFilter struct {
+	// Folder is relative to the root directory of the vault, and includes its sub-folders.
+	Folder string
+
+	// Tag matches notes with the tag in their frontmatter or inline (e.g. `#project`), with or
+	// without the leading `#`. Nested tags match their parents, so "project" matches `#project/opa`.
+	Tag string
+
+	// From and To bound the date of the notes, inclusively. The date of a periodic note is the first
+	// day of its period, and other notes are dated by the date their name starts with (e.g.
+	// `2025-10-11` or `251110 - example note`), or by the day they were last modified.
+	From time.Time
+	To   time.Time
+}
+
+// FindNotes lists the notes matching filter, sorted by name.
+func (v *Vault) FindNotes(filter NoteFilter) ([]NoteRef, error) {
+	folder := filepath.Clean(filter.Folder)
+	tag := strings.ToLower(strings.TrimPrefix(filter.Tag, "#"))
+
+	var r []NoteRef
+	for _, ref := range v.Notes() {
+		if !inFolder(ref, folder) {
+			continue
+		}
+
+		if !filter.From.IsZero() || !filter.To.IsZero() {
+			date, err := v.noteDate(ref)
+			if err != nil {
+				return nil, err
+			}
+			if !filter.From.IsZero() && date.Before(Day(filter.From)) {
+				continue
+			}
+			if !filter.To.IsZero() && date.After(Day(filter.To)) {
+				continue
+			}
+		}
+
+		if tag != "" {
+			content, err := v.NoteContent(ref.Name)
+			if err != nil {
+				return nil, err
+			}
+			if !hasTag(noteTags(content), tag) {
+				continue
+			}
+		}
+
+		r = append(r, ref)
+	}
+
+	return r, nil
+}
+
+// inFolder reports whether a note is in folder, or in one of its sub-folders. The folder has to be
+// cleaned already, and "." is the root directory of the vault.
+func inFolder(ref NoteRef, folder string) bool {
+	return folder == "." || strings.HasPrefix(ref.RelPath, folder+string(filepath.Separator))
+}
+
+// noteDate returns the date of a note as described in NoteFilter.
+func (v *Vault) noteDate(ref NoteRef) (time.Time, error) {
+	if date, ok := v.idx.periodicDates[ref.Name]; ok {
+		return date, nil
+	}
+
+	for _, layout := range []string{"2006-01-02", "060102"} {
+		if len(ref.Name) < len(layout) {
+			continue
+		}
+		// the date must be the whole name or be followed by something that isn't part of it
+		if rest := ref.Name[len(layout):]; rest != "" && !strings.ContainsAny(rest[:1], " -_") {
+			continue
+		}
+		if date, err := time.ParseInLocation(layout, ref.Name[:len(layout)], time.Local); err == nil {
+			return date, nil
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(v.rootDir, ref.RelPath))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to stat note %s: %w", ref.Name, err)
+	}
+	return Day(info.ModTime()), nil
+}
+
+// Day truncates t to the start of its day, in the local time zone.
+func Day(t time.Time) time.Time {
+	y, m, d := t.In(time.Local).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+}
+
+// inlineTagRe matches `#tags` in the body of a note. Like Obsidian, a tag needs at least one
+// character that isn't a digit, so that things like `#1` aren't taken for tags.
+var inlineTagRe = regexp.MustCompile(`(?:^|\s)#([\p{L}\p{N}_/-]*[\p{L}_/-][\p{L}\p{N}_/-]*)`)
+
+// noteTags returns the tags of a note, from its frontmatter and from its body (outside of code
+// blocks), lowercased and without the leading `#`.
+func noteTags(content string) []string {
+	var tags []string
+
+	body := content
+	if rest, ok := strings.CutPrefix(content, "---\n"); ok {
+		if frontmatter, after, ok := strings.Cut(rest, "\n---"); ok {
+			body = after
+
+			var meta struct {
+				Tags any `yaml:"tags"`
+			}
+			// a broken frontmatter is still a note, we just don't get its tags
+			if err := yaml.Unmarshal([]byte(frontmatter), &meta); err == nil {
+				switch t := meta.Tags.(type) {
+				case string:
+					tags = append(tags, strings.FieldsFunc(t, func(r rune) bool { return r == ',' || r == ' ' })...)
+				case []any:
+					for _, item := range t {
+						tags = append(tags, fmt.Sprint(item))
+					}
+				}
+			}
+		}
+	}
+
+	inCode := false
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			continue
+		}
+		for _, m := range inlineTagRe.FindAllStringSubmatch(line, -1) {
+			tags = append(tags, m[1])
+		}
+	}
+
+	for i, tag := range tags {
+		tags[i] = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+	}
+	return tags
+}
+
+// hasTag reports whether tag, or one of its nested tags, is in tags.
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag || strings.HasPrefix(t, tag+"/") {
+			return true
+		}
+	}
+	return false
+}
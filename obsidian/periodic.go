@@ -0,0 +1,258 @@
+package obsidian
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-yaml"
+)
+
+// Period is the span of time covered by a kind of periodic note.
+type Period int
+
+const (
+	PeriodDaily Period = iota
+	PeriodWeekly
+	PeriodMonthly
+	PeriodQuarterly
+)
+
+var periods = []Period{PeriodDaily, PeriodWeekly, PeriodMonthly, PeriodQuarterly}
+
+func (p Period) String() string {
+	switch p {
+	case PeriodDaily:
+		return "daily"
+	case PeriodWeekly:
+		return "weekly"
+	case PeriodMonthly:
+		return "monthly"
+	case PeriodQuarterly:
+		return "quarterly"
+	}
+	return fmt.Sprintf("Period(%d)", int(p))
+}
+
+// ParsePeriod parses the name of a period as given by Period.String.
+func ParsePeriod(s string) (Period, error) {
+	for _, p := range periods {
+		if strings.EqualFold(s, p.String()) {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown period %s", s)
+}
+
+// end returns the last day of the period starting on start.
+func (p Period) end(start time.Time) time.Time {
+	switch p {
+	case PeriodWeekly:
+		return start.AddDate(0, 0, 6)
+	case PeriodMonthly:
+		return start.AddDate(0, 1, -1)
+	case PeriodQuarterly:
+		return start.AddDate(0, 3, -1)
+	}
+	return start
+}
+
+// PeriodicNotesCfg configures the periodic notes of the vault, like the Periodic Notes plugin of
+// Obsidian does.
+type PeriodicNotesCfg struct {
+	Daily     PeriodicCfg `yaml:"daily"`
+	Weekly    PeriodicCfg `yaml:"weekly"`
+	Monthly   PeriodicCfg `yaml:"monthly"`
+	Quarterly PeriodicCfg `yaml:"quarterly"`
+}
+
+// PeriodicCfg configures one kind of periodic note.
+type PeriodicCfg struct {
+	// Folder is relative to the root directory of the vault. If empty, the first folder with the
+	// name of the period in its name is used, e.g. `0 Daily` for dailies.
+	Folder string `yaml:"folder"`
+
+	// Format is the moment.js format of the names of the notes, like in Obsidian, where a `/`
+	// stands for sub-folders. Defaults to `YYYY-MM-DD`, `gggg-[W]ww`, `YYYY-MM` and `YYYY-[Q]Q`, where
+	// `gggg-[W]ww` are weeks starting on Sunday like in Obsidian, `GGGG-[W]WW` are ISO weeks.
+	Format string `yaml:"format"`
+}
+
+func (c PeriodicNotesCfg) of(p Period) PeriodicCfg {
+	switch p {
+	case PeriodWeekly:
+		return c.Weekly
+	case PeriodMonthly:
+		return c.Monthly
+	case PeriodQuarterly:
+		return c.Quarterly
+	}
+	return c.Daily
+}
+
+var defaultPeriodicFormats = map[Period]string{
+	PeriodDaily:     "YYYY-MM-DD",
+	PeriodWeekly:    "gggg-[W]ww",
+	PeriodMonthly:   "YYYY-MM",
+	PeriodQuarterly: "YYYY-[Q]Q",
+}
+
+// LoadPeriodicConfig reads the configuration of the periodic notes under periodic_notes in the
+// YAML file at path, e.g.:
+//
+//	periodic_notes:
+//	  daily:
+//	    folder: 0 Daily
+//	    format: YYYY/MM/YYYY-MM-DD
+//	  weekly:
+//	    format: YYYY-[W]WW
+//
+// Other keys are ignored, so it can live in a file with other settings.
+func LoadPeriodicConfig(path string) (PeriodicNotesCfg, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return PeriodicNotesCfg{}, fmt.Errorf("obsidian.LoadPeriodicConfig: %w", err)
+	}
+
+	var file struct {
+		Periodic PeriodicNotesCfg `yaml:"periodic_notes"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return PeriodicNotesCfg{}, fmt.Errorf("obsidian.LoadPeriodicConfig: error parsing %s: %w", path, err)
+	}
+
+	for _, p := range periods {
+		if format := file.Periodic.of(p).Format; format != "" {
+			if _, err := newDateFormat(format); err != nil {
+				return PeriodicNotesCfg{}, fmt.Errorf("obsidian.LoadPeriodicConfig: %s: %w", p, err)
+			}
+		}
+	}
+
+	return file.Periodic, nil
+}
+
+// PeriodicNote is a periodic note (e.g. a daily) along with the first day of its period.
+type PeriodicNote struct {
+	NoteRef
+	Date time.Time
+}
+
+// DailyFor returns the daily note of the given day, if there's one.
+func (v *Vault) DailyFor(date time.Time) (PeriodicNote, bool) {
+	return v.PeriodicFor(PeriodDaily, date)
+}
+
+// DailiesBetween returns the daily notes from one day to another, both inclusive, sorted by date.
+func (v *Vault) DailiesBetween(from, to time.Time) []PeriodicNote {
+	return v.PeriodicBetween(PeriodDaily, from, to)
+}
+
+// PeriodicFor returns the periodic note whose period includes the given day, if there's one.
+func (v *Vault) PeriodicFor(p Period, date time.Time) (PeriodicNote, bool) {
+	notes := v.PeriodicBetween(p, date, date)
+	if len(notes) == 0 {
+		return PeriodicNote{}, false
+	}
+	return notes[0], true
+}
+
+// PeriodicBetween returns the periodic notes whose period overlaps with the days from one to
+// another, both inclusive, sorted by date.
+func (v *Vault) PeriodicBetween(p Period, from, to time.Time) []PeriodicNote {
+	from, to = Day(from), Day(to)
+
+	var r []PeriodicNote
+	for _, note := range v.idx.periodic[p] {
+		if !note.Date.After(to) && !p.end(note.Date).Before(from) {
+			r = append(r, note)
+		}
+	}
+	return r
+}
+
+// indexPeriodic finds the periodic notes among the notes of the index, given the folders found
+// for each period while walking the vault.
+func (v *Vault) indexPeriodic() error {
+	v.idx.periodic = make(map[Period][]PeriodicNote)
+	v.idx.periodicDates = make(map[string]time.Time)
+
+	for _, p := range periods {
+		cfg := v.cfg.Periodic.of(p)
+
+		if cfg.Folder != "" {
+			dir := filepath.Join(v.rootDir, cfg.Folder)
+			if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+				return fmt.Errorf("%s folder %s not found", p, cfg.Folder)
+			}
+			v.idx.periodicDirs[p] = dir
+		}
+		dir := v.idx.periodicDirs[p]
+		if dir == "" {
+			continue
+		}
+		relDir, err := filepath.Rel(v.rootDir, dir)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path of %s folder: %w", p, err)
+		}
+
+		format, err := newDateFormat(cmp.Or(cfg.Format, defaultPeriodicFormats[p]))
+		if err != nil {
+			return fmt.Errorf("invalid %s format: %w", p, err)
+		}
+
+		for name, note := range v.idx.notes {
+			rel, err := filepath.Rel(relDir, note.relPath)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				continue
+			}
+
+			// formats with a `/` put notes in sub-folders, while the others only name them, so
+			// that notes can also be filed away in sub-folders of their own
+			s := name
+			if strings.Contains(format.layout, "/") {
+				s = filepath.ToSlash(strings.TrimSuffix(rel, ".md"))
+			}
+
+			// e.g. templates or whatever other notes live in the folder
+			date, ok := format.parse(s)
+			if !ok {
+				continue
+			}
+
+			v.idx.periodic[p] = append(v.idx.periodic[p], PeriodicNote{
+				NoteRef: NoteRef{Name: name, RelPath: note.relPath},
+				Date:    date,
+			})
+			if _, ok := v.idx.periodicDates[name]; !ok {
+				v.idx.periodicDates[name] = date
+			}
+		}
+
+		slices.SortFunc(v.idx.periodic[p], func(a, b PeriodicNote) int {
+			return cmp.Or(a.Date.Compare(b.Date), strings.Compare(a.Name, b.Name))
+		})
+	}
+
+	return nil
+}
+
+// readRecentPeriodic reads the n most recent notes of a period, most recent first.
+func (v *Vault) readRecentPeriodic(p Period, n int) ([]string, error) {
+	notes := v.idx.periodic[p]
+
+	r := make([]string, 0, n)
+	for i := len(notes) - 1; i >= 0 && len(r) < n; i-- {
+		content, err := v.ReadNote(notes[i].Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read note %s: %w", notes[i].Name, err)
+		}
+		r = append(r, content)
+	}
+
+	return r, nil
+}
@@ -0,0 +1,81 @@
+package obsidian
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPeriodicNotes(t *testing.T) {
+	vault, _ := testVault(t, map[string]string{
+		"0 Daily/2025-03-03.md":       "went for a run",
+		"0 Daily/2025-03-10.md":       "planning day",
+		"0 Daily/2025-03-11.md":       "wrote the report",
+		"0 Daily/template.md":         "{{date}}",
+		"0 Weekly/2025-W11.md":        "a good week",
+		"Reviews/2025/February.md":    "a short month",
+		"Projects/2025-03-10 Demo.md": "not a daily",
+	}, Cfg{Periodic: PeriodicNotesCfg{
+		Monthly: PeriodicCfg{Folder: "Reviews", Format: "YYYY/MMMM"},
+	}})
+
+	if note, ok := vault.DailyFor(testDate("2025-03-10")); !ok || note.Name != "2025-03-10" {
+		t.Errorf("expected the daily of 2025-03-10, got %+v", note)
+	}
+	if _, ok := vault.DailyFor(testDate("2025-03-09")); ok {
+		t.Error("expected no daily for 2025-03-09")
+	}
+
+	var names []string
+	for _, note := range vault.DailiesBetween(testDate("2025-03-01"), testDate("2025-03-11")) {
+		names = append(names, note.Name)
+	}
+	// the template isn't a daily, even though it's in the folder
+	if got := strings.Join(names, ","); got != "2025-03-03,2025-03-10,2025-03-11" {
+		t.Errorf("unexpected dailies %s", got)
+	}
+
+	// by default weeks go from Sunday to Saturday, like in Obsidian
+	if note, ok := vault.PeriodicFor(PeriodWeekly, testDate("2025-03-15")); !ok || note.Name != "2025-W11" || note.Date != testDate("2025-03-09") {
+		t.Errorf("expected the weekly 2025-W11, got %+v", note)
+	}
+	if note, ok := vault.PeriodicFor(PeriodWeekly, testDate("2025-03-16")); ok {
+		t.Errorf("expected no weekly for 2025-03-16, got %+v", note)
+	}
+	if note, ok := vault.PeriodicFor(PeriodMonthly, testDate("2025-02-14")); !ok || note.Name != "February" || note.Date != testDate("2025-02-01") {
+		t.Errorf("expected the monthly of February, got %+v", note)
+	}
+	if _, ok := vault.PeriodicFor(PeriodQuarterly, testDate("2025-02-14")); ok {
+		t.Error("expected no quarterlies")
+	}
+}
+
+// testVault creates a vault with the given notes, returning it along with its root directory.
+func testVault(t *testing.T, notes map[string]string, cfg Cfg) (*Vault, string) {
+	t.Helper()
+
+	root := t.TempDir()
+	for path, content := range notes {
+		full := filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vault, err := LoadVault(root, cfg)
+	if err != nil {
+		t.Fatalf("error loading vault: %v", err)
+	}
+	return vault, root
+}
+
+// testDate returns the local date written as YYYY-MM-DD.
+func testDate(s string) time.Time {
+	d, _ := time.ParseInLocation(time.DateOnly, s, time.Local)
+	return d
+}
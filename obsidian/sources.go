@@ -0,0 +1,185 @@
+package obsidian
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Source identifies a passage of a note, so that answers can cite where they came from. Its
+// string form is what the tools give to the model, e.g. `Alpha#The plan:L3-L8`, where the heading
+// and the line range are both optional.
+type Source struct {
+	Note    string
+	Heading string // the closest heading above the passage, if any
+	Start   int    // 1-based, inclusive, 0 for the whole note
+	End     int
+}
+
+func (s Source) String() string {
+	var sb strings.Builder
+	sb.WriteString(s.Note)
+	if s.Heading != "" {
+		fmt.Fprintf(&sb, "#%s", s.Heading)
+	}
+	switch {
+	case s.Start == 0:
+	case s.End <= s.Start:
+		fmt.Fprintf(&sb, ":L%d", s.Start)
+	default:
+		fmt.Fprintf(&sb, ":L%d-L%d", s.Start, s.End)
+	}
+	return sb.String()
+}
+
+// Label describes the source for people, e.g. `Alpha › The plan (lines 3-8)`.
+func (s Source) Label() string {
+	label := s.Note
+	if s.Heading != "" {
+		label += " › " + s.Heading
+	}
+	switch {
+	case s.Start == 0:
+	case s.End <= s.Start:
+		label += fmt.Sprintf(" (line %d)", s.Start)
+	default:
+		label += fmt.Sprintf(" (lines %d-%d)", s.Start, s.End)
+	}
+	return label
+}
+
+// ParseSource parses the string form of a Source.
+func ParseSource(id string) (Source, error) {
+	var s Source
+	id = strings.TrimSpace(id)
+
+	// headings may have a `:L` of their own, so it's only a line range if it parses as one
+	if i := strings.LastIndex(id, ":L"); i >= 0 {
+		start, end, isRange := strings.Cut(id[i+2:], "-L")
+		if n, err := strconv.Atoi(start); err == nil && n > 0 {
+			s.Start, s.End = n, n
+			if isRange {
+				if s.End, err = strconv.Atoi(end); err != nil || s.End < s.Start {
+					return Source{}, fmt.Errorf("invalid line range in source %s", id)
+				}
+			}
+			id = id[:i]
+		}
+	}
+
+	s.Note, s.Heading, _ = strings.Cut(id, "#")
+	if s.Note == "" {
+		return Source{}, fmt.Errorf("source %s has no note", id)
+	}
+	return s, nil
+}
+
+// SourceURI returns the `obsidian://` URI opening the note of a source in Obsidian.
+func (v *Vault) SourceURI(s Source) (string, error) {
+	note, ok := v.idx.notes[s.Note]
+	if !ok {
+		return "", fmt.Errorf("note %s not found", s.Note)
+	}
+
+	file := filepath.ToSlash(strings.TrimSuffix(note.relPath, ".md"))
+	query := "vault=" + queryEscape(filepath.Base(v.rootDir)) + "&file=" + queryEscape(file)
+	return "obsidian://open?" + query, nil
+}
+
+// queryEscape escapes s for a query, with spaces as %20 since Obsidian doesn't take them as `+`.
+func queryEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// Section is a passage of a note that goes from one heading to the next.
+type Section struct {
+	Source Source
+	Text   string
+}
+
+// NoteSections splits a note into its sections, each with the source it's cited by.
+// The name of the note is given like for ReadNote.
+func (v *Vault) NoteSections(name string) ([]Section, error) {
+	content, err := v.NoteContent(name)
+	if err != nil {
+		return nil, err
+	}
+	return noteSections(name, content), nil
+}
+
+// noteSections splits the content of a note at its headings. Whatever comes before the first
+// heading (e.g. the frontmatter) is a section without a heading.
+func noteSections(name, content string) []Section {
+	var sections []Section
+	var curr Section
+	var lines []string
+	flush := func(end int) {
+		if len(lines) > 0 {
+			curr.Source.End = end
+			curr.Text = strings.Join(lines, "\n")
+			sections = append(sections, curr)
+		}
+		lines = nil
+	}
+
+	all := strings.Split(strings.TrimRight(content, "\n"), "\n")
+	for i, heading := range lineHeadings(all) {
+		if heading != "" {
+			flush(i)
+			curr = Section{Source: Source{Note: name, Heading: heading, Start: i + 1}}
+		} else if i == 0 {
+			curr = Section{Source: Source{Note: name, Start: 1}}
+		}
+		lines = append(lines, all[i])
+	}
+	flush(curr.Source.Start + len(lines) - 1)
+
+	return sections
+}
+
+// headingAt returns the closest heading above the given 1-based line of a note, if any.
+func headingAt(content string, line int) string {
+	lines := strings.Split(content, "\n")
+	headings := lineHeadings(lines[:min(line, len(lines))])
+	for i := len(headings) - 1; i >= 0; i-- {
+		if headings[i] != "" {
+			return headings[i]
+		}
+	}
+	return ""
+}
+
+// lineHeadings returns the heading of every line of a note that is one, and "" for the others.
+// Lines in the frontmatter or in code blocks are never headings.
+func lineHeadings(lines []string) []string {
+	headings := make([]string, len(lines))
+	inFrontmatter := len(lines) > 0 && lines[0] == "---"
+	inCode := false
+	for i, line := range lines {
+		switch {
+		case inFrontmatter:
+			inFrontmatter = i == 0 || line != "---"
+		case strings.HasPrefix(strings.TrimSpace(line), "```"):
+			inCode = !inCode
+		case !inCode:
+			headings[i], _ = parseHeading(line)
+		}
+	}
+	return headings
+}
+
+// parseHeading returns the text of a markdown heading line, e.g. `## The plan`.
+func parseHeading(line string) (string, bool) {
+	level := 0
+	for level < len(line) && line[level] == '#' {
+		level++
+	}
+	if level == 0 || level > 6 || level == len(line) || line[level] != ' ' {
+		return "", false
+	}
+
+	heading := strings.TrimSpace(line[level:])
+	return heading, heading != ""
+}
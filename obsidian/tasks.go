@@ -0,0 +1,387 @@
+package obsidian
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrTaskChanged is returned when writing back a task whose line isn't what it was when the task
+// was read, e.g. because the note was edited in the meantime.
+var ErrTaskChanged = errors.New("task changed since it was read")
+
+// TaskStatus is the character between the brackets of a task, e.g. `x` for `- [x] done`.
+type TaskStatus rune
+
+const (
+	TaskOpen       TaskStatus = ' '
+	TaskInProgress TaskStatus = '/'
+	TaskDone       TaskStatus = 'x'
+	TaskCancelled  TaskStatus = '-'
+)
+
+func (s TaskStatus) String() string {
+	switch s {
+	case TaskOpen:
+		return "open"
+	case TaskInProgress:
+		return "in progress"
+	case TaskDone, 'X':
+		return "done"
+	case TaskCancelled:
+		return "cancelled"
+	}
+	return fmt.Sprintf("custom (%c)", rune(s))
+}
+
+// IsOpen reports whether a task still has to be done, which is the case of every status that
+// isn't done or cancelled, like the Tasks plugin does.
+func (s TaskStatus) IsOpen() bool {
+	return s != TaskDone && s != 'X' && s != TaskCancelled
+}
+
+// TaskPriority is the priority of a task, from TaskLowest to TaskHighest, with tasks that don't
+// have one in the middle like the Tasks plugin does.
+type TaskPriority int
+
+const (
+	TaskLowest TaskPriority = iota - 2
+	TaskLow
+	TaskNormal
+	TaskMedium
+	TaskHigh
+	TaskHighest
+)
+
+func (p TaskPriority) String() string {
+	switch p {
+	case TaskLowest:
+		return "lowest"
+	case TaskLow:
+		return "low"
+	case TaskNormal:
+		return "normal"
+	case TaskMedium:
+		return "medium"
+	case TaskHigh:
+		return "high"
+	case TaskHighest:
+		return "highest"
+	}
+	return fmt.Sprintf("TaskPriority(%d)", int(p))
+}
+
+// Task is a checkbox item of a note, e.g. `- [ ] pay rent 📅 2025-03-14 ⏫ #home`, with the dates
+// and the priority of the emoji format of the Tasks plugin.
+type Task struct {
+	Source   Source // the line of the task, and the closest heading above it
+	Status   TaskStatus
+	Text     string // the description, without its dates and priority
+	Priority TaskPriority
+	Tags     []string // lowercased and without the leading `#`
+
+	// Due, Scheduled, Start and Done are zero when the task doesn't have them.
+	Due       time.Time
+	Scheduled time.Time
+	Start     time.Time
+	Done      time.Time
+
+	line string // as it was read, to detect changes before writing it back
+}
+
+// ID identifies the task along with the contents of its line, e.g. `2025-03-10:L12@1f2e3d4c`, so
+// that ToggleTask can tell whether it changed since it was read.
+func (t Task) ID() string {
+	return fmt.Sprintf("%s:L%d@%s", t.Source.Note, t.Source.Start, lineHash(t.line))
+}
+
+func lineHash(line string) string {
+	hash := sha256.Sum256([]byte(line))
+	return hex.EncodeToString(hash[:4])
+}
+
+var (
+	// taskRe matches the checkbox items of lists, e.g. `- [ ] todo` or `1. [x] done`.
+	taskRe = regexp.MustCompile(`^(\s*(?:[-*+]|\d+[.)])\s+\[)([^\]])(\]\s+)(.*?)\s*$`)
+	// taskDateRe matches the dates of a task, e.g. `📅 2025-03-14`.
+	taskDateRe = regexp.MustCompile(`\s*(📅|⏳|⌛|🛫|✅|➕|❌)\x{FE0F}?\s*(\d{4}-\d{2}-\d{2})`)
+	// statusDateRe matches the dates of a task that depend on its status, i.e. done and cancelled.
+	statusDateRe = regexp.MustCompile(`\s*(✅|❌)\x{FE0F}?\s*\d{4}-\d{2}-\d{2}`)
+	// taskPriorityRe matches the priority of a task, e.g. `⏫`.
+	taskPriorityRe = regexp.MustCompile(`\s*(🔺|⏫|🔼|🔽|⏬)\x{FE0F}?`)
+	// blockIDRe matches the block ID a line may end with, e.g. `^abc123`.
+	blockIDRe = regexp.MustCompile(`\s+\^[\w-]+$`)
+)
+
+var taskPriorities = map[string]TaskPriority{
+	"🔺": TaskHighest,
+	"⏫": TaskHigh,
+	"🔼": TaskMedium,
+	"🔽": TaskLow,
+	"⏬": TaskLowest,
+}
+
+// parseTask parses a line of a note as a task, returning false if it isn't one.
+func parseTask(source Source, line string) (Task, bool) {
+	m := taskRe.FindStringSubmatch(strings.TrimSuffix(line, "\r"))
+	if m == nil || m[4] == "" {
+		return Task{}, false
+	}
+
+	t := Task{Source: source, Status: TaskStatus([]rune(m[2])[0]), line: line}
+	text := m[4]
+
+	for _, date := range taskDateRe.FindAllStringSubmatch(text, -1) {
+		d, err := time.ParseInLocation("2006-01-02", date[2], time.Local)
+		if err != nil {
+			continue
+		}
+		switch date[1] {
+		case "📅":
+			t.Due = d
+		case "⏳", "⌛":
+			t.Scheduled = d
+		case "🛫":
+			t.Start = d
+		case "✅":
+			t.Done = d
+		}
+	}
+	text = taskDateRe.ReplaceAllString(text, "")
+
+	if p := taskPriorityRe.FindStringSubmatch(text); p != nil {
+		t.Priority = taskPriorities[p[1]]
+	}
+	text = taskPriorityRe.ReplaceAllString(text, "")
+
+	t.Text = strings.TrimSpace(text)
+	for _, tag := range inlineTagRe.FindAllStringSubmatch(t.Text, -1) {
+		t.Tags = append(t.Tags, strings.ToLower(tag[1]))
+	}
+
+	return t, true
+}
+
+// parseTasks returns the tasks of a note, skipping the lines of its frontmatter and code blocks.
+func parseTasks(name, content string) []Task {
+	lines := strings.Split(content, "\n")
+
+	var tasks []Task
+	var heading string
+	inFrontmatter := len(lines) > 0 && strings.TrimSuffix(lines[0], "\r") == "---"
+	inCode := false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case inFrontmatter:
+			inFrontmatter = i == 0 || trimmed != "---"
+		case strings.HasPrefix(trimmed, "```"):
+			inCode = !inCode
+		case inCode:
+		default:
+			if h, ok := parseHeading(strings.TrimSuffix(line, "\r")); ok {
+				heading = h
+				continue
+			}
+			if t, ok := parseTask(Source{Note: name, Heading: heading, Start: i + 1, End: i + 1}, line); ok {
+				tasks = append(tasks, t)
+			}
+		}
+	}
+
+	return tasks
+}
+
+// TaskFilter selects tasks for Tasks. Fields left empty don't filter anything, and the ones that
+// are set must all match.
+type TaskFilter struct {
+	// Folder is relative to the root directory of the vault, and includes its sub-folders.
+	Folder string
+
+	// Tag matches tasks with the tag in their description, with or without the leading `#`.
+	// Nested tags match their parents, so "home" matches `#home/chores`.
+	Tag string
+
+	// Open only selects tasks that aren't done or cancelled.
+	Open bool
+
+	// DueFrom and DueTo bound the due date of the tasks, inclusively. Tasks without a due date
+	// aren't selected when either is set.
+	DueFrom time.Time
+	DueTo   time.Time
+}
+
+// Tasks lists the tasks of the vault matching filter, sorted by due date (with the tasks without
+// one last), then from the highest priority to the lowest, and then by note and line.
+func (v *Vault) Tasks(filter TaskFilter) ([]Task, error) {
+	folder := filepath.Clean(filter.Folder)
+	tag := strings.ToLower(strings.TrimPrefix(filter.Tag, "#"))
+	byDue := !filter.DueFrom.IsZero() || !filter.DueTo.IsZero()
+
+	var r []Task
+	for _, ref := range v.Notes() {
+		if !inFolder(ref, folder) {
+			continue
+		}
+
+		content, err := v.NoteContent(ref.Name)
+		if err != nil {
+			return nil, fmt.Errorf("obsidian.Tasks: %w", err)
+		}
+
+		for _, t := range parseTasks(ref.Name, content) {
+			if filter.Open && !t.Status.IsOpen() {
+				continue
+			}
+			if tag != "" && !hasTag(t.Tags, tag) {
+				continue
+			}
+			if byDue {
+				if t.Due.IsZero() {
+					continue
+				}
+				if !filter.DueFrom.IsZero() && t.Due.Before(Day(filter.DueFrom)) {
+					continue
+				}
+				if !filter.DueTo.IsZero() && t.Due.After(Day(filter.DueTo)) {
+					continue
+				}
+			}
+			r = append(r, t)
+		}
+	}
+
+	slices.SortStableFunc(r, func(a, b Task) int {
+		if a.Due.IsZero() != b.Due.IsZero() {
+			if a.Due.IsZero() {
+				return 1
+			}
+			return -1
+		}
+		return cmp.Or(a.Due.Compare(b.Due), cmp.Compare(b.Priority, a.Priority))
+	})
+
+	return r, nil
+}
+
+// ToggleTask marks the task with the given ID (see Task.ID) as done, or as open again if it was
+// done or cancelled, writing it back to its line in the note. Like the Tasks plugin, a done date is
+// added to the tasks that get done and removed from the ones that don't anymore.
+//
+// Returns ErrTaskChanged if the line isn't the one the ID was made from, in which case the note is
+// left untouched.
+func (v *Vault) ToggleTask(id string, today time.Time) (Task, error) {
+	source, hash, err := parseTaskID(id)
+	if err != nil {
+		return Task{}, fmt.Errorf("obsidian.ToggleTask: %w", err)
+	}
+
+	note, ok := v.idx.notes[source.Note]
+	if !ok {
+		return Task{}, fmt.Errorf("obsidian.ToggleTask: note %s not found", source.Note)
+	}
+	path := filepath.Join(v.rootDir, note.relPath)
+
+	// the line is checked and written under the lock, so that concurrent toggles of tasks of the
+	// same note don't undo each other
+	v.writeMu.Lock()
+	defer v.writeMu.Unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Task{}, fmt.Errorf("obsidian.ToggleTask: failed to read note %s: %w", source.Note, err)
+	}
+
+	lines := strings.Split(string(data), "\n")
+	if source.Start > len(lines) || lineHash(lines[source.Start-1]) != hash {
+		return Task{}, fmt.Errorf("obsidian.ToggleTask: %s: %w", id, ErrTaskChanged)
+	}
+
+	source.Heading = headingAt(string(data), source.Start)
+	task, ok := parseTask(source, lines[source.Start-1])
+	if !ok {
+		return Task{}, fmt.Errorf("obsidian.ToggleTask: line %d of %s isn't a task", source.Start, source.Note)
+	}
+
+	lines[source.Start-1] = toggledLine(task, today)
+	if err := writeFileAtomic(path, []byte(strings.Join(lines, "\n"))); err != nil {
+		return Task{}, fmt.Errorf("obsidian.ToggleTask: failed to write note %s: %w", source.Note, err)
+	}
+
+	toggled, _ := parseTask(source, lines[source.Start-1])
+	return toggled, nil
+}
+
+// toggledLine returns the line of a task once toggled, see ToggleTask.
+func toggledLine(t Task, today time.Time) string {
+	line, cr := strings.CutSuffix(t.line, "\r")
+	m := taskRe.FindStringSubmatch(line)
+	prefix, sep, text := m[1], m[3], m[4]
+
+	// the dates that depend on the status are the ones going away in any case
+	text = statusDateRe.ReplaceAllString(text, "")
+
+	status := TaskOpen
+	if t.Status.IsOpen() {
+		status = TaskDone
+
+		// the done date goes before the block ID, which has to stay at the end of the line
+		blockID := blockIDRe.FindString(text)
+		text = strings.TrimSuffix(text, blockID) + " ✅ " + Day(today).Format("2006-01-02") + blockID
+	}
+
+	line = prefix + string(rune(status)) + sep + text
+	if cr {
+		line += "\r"
+	}
+	return line
+}
+
+// parseTaskID parses an ID made by Task.ID into the line of the task and the hash of its contents.
+func parseTaskID(id string) (Source, string, error) {
+	id = strings.TrimSpace(id)
+
+	i := strings.LastIndex(id, "@")
+	j := strings.LastIndex(id, ":L")
+	if i < 0 || j < 0 || j > i {
+		return Source{}, "", fmt.Errorf("invalid task ID %s", id)
+	}
+
+	line, err := strconv.Atoi(id[j+2 : i])
+	if err != nil || line < 1 || id[:j] == "" {
+		return Source{}, "", fmt.Errorf("invalid task ID %s", id)
+	}
+
+	return Source{Note: id[:j], Start: line, End: line}, id[i+1:], nil
+}
+
+// writeFileAtomic replaces the contents of the file at path, keeping its permissions, by writing
+// them to a temporary file first and then renaming it, so that the file is never left half written.
+func writeFileAtomic(path string, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".opa.tmp"
+	if err := os.WriteFile(tmpPath, data, info.Mode().Perm()); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package obsidian
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTasks(t *testing.T) {
+	vault, _ := testVault(t, map[string]string{
+		"Daily/2025-03-10.md": strings.Join([]string{
+			"---",
+			"- [ ] not a task, frontmatter",
+			"---",
+			"## Todo",
+			"- [ ] pay rent 📅 2025-03-14 ⏫ #home",
+			"- [x] call mom ✅ 2025-03-10",
+			"  - [/] draft the report ⏳ 2025-03-12 🛫 2025-03-11 #work/reports",
+			"- [-] cancelled thing 📅 2025-03-11",
+			"* [ ] water plants 📅 2025-03-09 🔽 #home/garden",
+			"```",
+			"- [ ] not a task, code",
+			"```",
+			"1. [ ] no dates at all",
+			"- [ ]",
+		}, "\n"),
+		"Projects/Alpha.md": "# Alpha\n- [ ] ship it 📅 2025-03-14 🔺 #work",
+	}, Cfg{})
+	texts := func(tasks []Task) string {
+		var r []string
+		for _, task := range tasks {
+			r = append(r, task.Text)
+		}
+		return strings.Join(r, "|")
+	}
+
+	all, err := vault.Tasks(TaskFilter{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// by due date, then by priority, then without a due date
+	want := "water plants #home/garden|cancelled thing|ship it #work|pay rent #home|call mom|draft the report #work/reports|no dates at all"
+	if got := texts(all); got != want {
+		t.Fatalf("expected tasks %q, got %q", want, got)
+	}
+
+	rent := all[3]
+	if rent.Status != TaskOpen || rent.Priority != TaskHigh || rent.Due != testDate("2025-03-14") {
+		t.Errorf("unexpected task %+v", rent)
+	}
+	if got := rent.Source.String(); got != "2025-03-10#Todo:L5" {
+		t.Errorf("expected the task at 2025-03-10#Todo:L5, got %s", got)
+	}
+	if !strings.HasPrefix(rent.ID(), "2025-03-10:L5@") {
+		t.Errorf("unexpected ID %s", rent.ID())
+	}
+
+	report := all[5]
+	if report.Status != TaskInProgress || !report.Status.IsOpen() || report.Scheduled != testDate("2025-03-12") || report.Start != testDate("2025-03-11") {
+		t.Errorf("unexpected task %+v", report)
+	}
+	if all[4].Done != testDate("2025-03-10") || all[4].Status.IsOpen() {
+		t.Errorf("unexpected task %+v", all[4])
+	}
+
+	for _, tt := range []struct {
+		name   string
+		filter TaskFilter
+		want   string
+	}{
+		{"open", TaskFilter{Open: true}, "water plants #home/garden|ship it #work|pay rent #home|draft the report #work/reports|no dates at all"},
+		{"tag", TaskFilter{Tag: "#home"}, "water plants #home/garden|pay rent #home"},
+		{"nested tag", TaskFilter{Tag: "work/reports"}, "draft the report #work/reports"},
+		{"folder", TaskFilter{Folder: "Projects"}, "ship it #work"},
+		{"due", TaskFilter{Open: true, DueFrom: testDate("2025-03-10"), DueTo: testDate("2025-03-16")}, "ship it #work|pay rent #home"},
+		{"overdue", TaskFilter{Open: true, DueTo: testDate("2025-03-11")}, "water plants #home/garden"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tasks, err := vault.Tasks(tt.filter)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := texts(tasks); got != tt.want {
+				t.Errorf("expected tasks %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestToggleTask(t *testing.T) {
+	vault, root := testVault(t, map[string]string{
+		"Daily/2025-03-10.md": "# Todo\r\n- [ ] pay rent 📅 2025-03-14 ^rent\r\n- [x] call mom ✅ 2025-03-09\r\n",
+	}, Cfg{})
+	path := filepath.Join(root, "Daily", "2025-03-10.md")
+	today := time.Date(2025, time.March, 12, 15, 0, 0, 0, time.Local)
+
+	tasks, err := vault.Tasks(TaskFilter{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rent, err := vault.ToggleTask(tasks[0].ID(), today)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rent.Status != TaskDone || rent.Done != testDate("2025-03-12") || rent.Source.Heading != "Todo" {
+		t.Errorf("unexpected task %+v", rent)
+	}
+
+	mom, err := vault.ToggleTask(tasks[1].ID(), today)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mom.Status != TaskOpen || !mom.Done.IsZero() {
+		t.Errorf("unexpected task %+v", mom)
+	}
+
+	// only the lines of the tasks changed, keeping the block ID at the end and the line endings
+	want := "# Todo\r\n- [x] pay rent 📅 2025-03-14 ✅ 2025-03-12 ^rent\r\n- [ ] call mom\r\n"
+	if got, _ := os.ReadFile(path); string(got) != want {
+		t.Errorf("expected the note to be %q, got %q", want, got)
+	}
+
+	// the IDs listed before are stale now, so they must not write anything
+	if _, err := vault.ToggleTask(tasks[0].ID(), today); !errors.Is(err, ErrTaskChanged) {
+		t.Errorf("expected ErrTaskChanged, got %v", err)
+	}
+	if err := os.WriteFile(path, []byte("# Todo\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vault.ToggleTask(rent.ID(), today); !errors.Is(err, ErrTaskChanged) {
+		t.Errorf("expected ErrTaskChanged for a line that's gone, got %v", err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != "# Todo\r\n" {
+		t.Errorf("expected the note to be left as it is, got %q", got)
+	}
+
+	for _, id := range []string{"2025-03-10", "2025-03-10:L0@abc", "Missing:L1@abc"} {
+		if _, err := vault.ToggleTask(id, today); err == nil || errors.Is(err, ErrTaskChanged) {
+			t.Errorf("expected %s to be invalid, got %v", id, err)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package obsidian
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -12,23 +13,45 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/victhorio/opa/agg/core"
 )
 
 type Vault struct {
 	rootDir string
 	idx     *vaultIdx
 	cfg     Cfg
+
+	// writeMu serializes the writes to the notes of the vault, e.g. by ToggleTask.
+	writeMu sync.Mutex
+
+	// embedsDone is closed once the refresh started by RefreshEmbeddingsAsync finishes, with its
+	// error in embedsErr. It's nil if no refresh was started.
+	embedsDone chan struct{}
+	embedsErr  error
 }
 
 type Cfg struct {
 	ComputeEmbeddings bool
+	// Ledger, if set, records the cost of every embedding request.
+	Ledger core.EmbeddingsLedger
+	// Periodic configures where the periodic notes are and how they're named.
+	Periodic PeriodicNotesCfg
 }
 
 type vaultIdx struct {
-	notes     map[string]note
-	dailyDir  string
-	weeklyDir string
+	notes map[string]note
+
+	// periodicDirs are the folders of the periodic notes, spotted by their names unless they're
+	// configured. periodic has the notes of each period sorted by date, which periodicDates has
+	// by note name.
+	periodicDirs  map[Period]string
+	periodic      map[Period][]PeriodicNote
+	periodicDates map[string]time.Time
 
 	// Only used if cfg.computeEmbeddings is set in the vault.
 	embeds *embedIdx
@@ -63,8 +86,8 @@ func LoadVault(rootDir string, cfg Cfg) (*Vault, error) {
 	v := &Vault{
 		rootDir: rootDir,
 		idx: &vaultIdx{
-			notes:    make(map[string]note),
-			dailyDir: "",
+			notes:        make(map[string]note),
+			periodicDirs: make(map[Period]string),
 		},
 		cfg: cfg,
 	}
@@ -73,21 +96,19 @@ func LoadVault(rootDir string, cfg Cfg) (*Vault, error) {
 		return nil, fmt.Errorf("failed to create index: %w", err)
 	}
 
-	if v.idx.dailyDir == "" {
+	if v.idx.periodicDirs[PeriodDaily] == "" {
 		return nil, fmt.Errorf("daily folder not found in vault")
 	}
 
-	// NOTE: We're okay with the weeklyDir not being found.
+	// NOTE: We're okay with the folders of the other periods not being found.
 
 	return v, nil
 }
 
 // RefreshIndex refreshes the index of the vault.
 // It walks through every dir/subdir in the vault, to save all notes into the index.
-// It also spots the daily folder, which is used to read the most recent dailies.
+// It also spots the folders of the periodic notes (e.g. dailies), and indexes them by date.
 // It skips all subdirectories that start with a ".".
-//
-// Returns an error if the daily folder is not found.
 func (v *Vault) RefreshIndex() error {
 	// Let's walk through every dir/subdir in the vault, to save all notes into the index.
 
@@ -104,13 +125,11 @@ func (v *Vault) RefreshIndex() error {
 				return filepath.SkipDir
 			}
 
-			// Let's also try and spot the daily folder.
-			if v.idx.dailyDir == "" && strings.Contains(strings.ToLower(d.Name()), "daily") {
-				v.idx.dailyDir = path
-			}
-			// Let's do the same to try and get the weekly folder
-			if v.idx.weeklyDir == "" && strings.Contains(strings.ToLower(d.Name()), "weekly") {
-				v.idx.weeklyDir = path
+			// Let's also try and spot the folders of the periodic notes, e.g. "0 Daily".
+			for _, p := range periods {
+				if v.idx.periodicDirs[p] == "" && strings.Contains(strings.ToLower(d.Name()), p.String()) {
+					v.idx.periodicDirs[p] = path
+				}
 			}
 
 			return nil
@@ -155,6 +174,10 @@ func (v *Vault) RefreshIndex() error {
 		return fmt.Errorf("failed to walk the vault: %w", err)
 	}
 
+	if err := v.indexPeriodic(); err != nil {
+		return fmt.Errorf("failed to index periodic notes: %w", err)
+	}
+
 	return nil
 }
 
@@ -162,28 +185,68 @@ func (v *Vault) RefreshIndex() error {
 // Returns a channel that receives nil on success or an error.
 // The channel is closed after sending.
 func (v *Vault) RefreshEmbeddingsAsync() <-chan error {
+	v.embedsDone = make(chan struct{})
 	done := make(chan error, 1)
 	go func() {
 		defer close(done)
-		if err := v.RefreshEmbeddings(); err != nil {
-			done <- err
-			return
-		}
-		done <- nil
+		v.embedsErr = v.RefreshEmbeddings()
+		close(v.embedsDone)
+		done <- v.embedsErr
 	}()
 	return done
 }
 
 // EmbeddingsReady returns true if embeddings are available for semantic search.
 func (v *Vault) EmbeddingsReady() bool {
-	return v.idx.embeds != nil
+	if v.embedsDone == nil {
+		return v.idx.embeds != nil
+	}
+	select {
+	case <-v.embedsDone:
+		return v.idx.embeds != nil
+	default:
+		return false
+	}
+}
+
+// WaitEmbeddings waits for the refresh started by RefreshEmbeddingsAsync to finish, returning its
+// error. It returns right away if no refresh was started.
+func (v *Vault) WaitEmbeddings(ctx context.Context) error {
+	if v.embedsDone == nil {
+		return nil
+	}
+	select {
+	case <-v.embedsDone:
+		return v.embedsErr
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %w", ErrEmbeddingsPending, ctx.Err())
+	}
 }
 
 // ReadNote reads the contents of a note from the vault.
 // The name of the note is "pure", without directories and without exensions.
 // E.g.: to read a note in `<rooDir>/dailies/2025-10-11.md`, the name is `2025-10-11` only.
-// Returns the contents of the note wrapped in a `<note>` tag, with the note name and content.
+// Returns the contents of the note wrapped in a `<note>` tag, with the note name and content. The
+// content is split in `<section>` tags at its headings, each with the Source it can be cited by.
 func (v *Vault) ReadNote(name string) (string, error) {
+	content, err := v.NoteContent(name)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "<note>\n<note_name>%s</note_name>\n\n<content>\n", name)
+	for _, section := range noteSections(name, content) {
+		fmt.Fprintf(&sb, "<section source=%q>\n%s\n</section>\n", section.Source, section.Text)
+	}
+	sb.WriteString("</content></note>")
+
+	return sb.String(), nil
+}
+
+// NoteContent reads the contents of a note from the vault, as is.
+// The name of the note is given like for ReadNote.
+func (v *Vault) NoteContent(name string) (string, error) {
 	note, ok := v.idx.notes[name]
 	if !ok {
 		return "", fmt.Errorf("note %s not found", name)
@@ -194,7 +257,23 @@ func (v *Vault) ReadNote(name string) (string, error) {
 		return "", fmt.Errorf("failed to read note %s: %w", name, err)
 	}
 
-	return fmt.Sprintf("<note>\n<note_name>%s</note_name>\n\n<content>%s</content></note>", name, content), nil
+	return string(content), nil
+}
+
+// Notes lists every note in the vault, sorted by name.
+func (v *Vault) Notes() []NoteRef {
+	r := make([]NoteRef, 0, len(v.idx.notes))
+	for name, note := range v.idx.notes {
+		r = append(r, NoteRef{Name: name, RelPath: note.relPath})
+	}
+	slices.SortFunc(r, func(a, b NoteRef) int { return strings.Compare(a.Name, b.Name) })
+	return r
+}
+
+// NoteRef identifies a note in the vault.
+type NoteRef struct {
+	Name    string // as given to ReadNote
+	RelPath string // relative to the root directory of the vault
 }
 
 // ListDir lists the items for a given relative directory in the vault.
@@ -229,14 +308,21 @@ func (v *Vault) ListDir(relPath string) ([]string, error) {
 // Match represents a ripgrep search result for a single note.
 type Match struct {
 	NoteName     string
-	MatchedLines []string
+	MatchedLines []MatchedLine
+}
+
+// MatchedLine is a line of a note matched by ripgrep, along with the Source it can be cited by.
+type MatchedLine struct {
+	Source Source
+	Text   string
 }
 
 // RipGrep searches markdown notes under subFolder for pattern using ripgrep.
 // Returns a slice of matches, where each match contains the note name (basename without .md)
 // and the matched lines from that note.
 // subFolder is joined with the vault root; hidden vault internals are excluded.
-func (v *Vault) RipGrep(pattern, subFolder string, caseSensitive bool) ([]Match, error) {
+// The ripgrep process is killed if ctx is cancelled before it finishes.
+func (v *Vault) RipGrep(ctx context.Context, pattern, subFolder string, caseSensitive bool) ([]Match, error) {
 	if pattern == "" {
 		return nil, fmt.Errorf("pattern cannot be empty")
 	}
@@ -263,7 +349,7 @@ func (v *Vault) RipGrep(pattern, subFolder string, caseSensitive bool) ([]Match,
 	}
 	args = append(args, pattern, fullPath)
 
-	cmd := exec.Command("rg", args...)
+	cmd := exec.CommandContext(ctx, "rg", args...)
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 
@@ -303,6 +389,7 @@ func (v *Vault) RipGrep(pattern, subFolder string, caseSensitive bool) ([]Match,
 			Lines struct {
 				Text string `json:"text"`
 			} `json:"lines"`
+			LineNumber int `json:"line_number"`
 		} `json:"data"`
 	}
 
@@ -325,7 +412,10 @@ func (v *Vault) RipGrep(pattern, subFolder string, caseSensitive bool) ([]Match,
 		}
 
 		noteName := strings.TrimSuffix(filepath.Base(ev.Data.Path.Text), ".md")
-		matched := strings.TrimSpace(ev.Data.Lines.Text)
+		matched := MatchedLine{
+			Source: Source{Note: noteName, Start: ev.Data.LineNumber, End: ev.Data.LineNumber},
+			Text:   strings.TrimSpace(ev.Data.Lines.Text),
+		}
 
 		if idx, exists := noteIndex[noteName]; exists {
 			// Note already exists, append to its MatchedLines
@@ -335,7 +425,7 @@ func (v *Vault) RipGrep(pattern, subFolder string, caseSensitive bool) ([]Match,
 			noteIndex[noteName] = len(matches)
 			matches = append(matches, Match{
 				NoteName:     noteName,
-				MatchedLines: []string{matched},
+				MatchedLines: []MatchedLine{matched},
 			})
 		}
 	}
@@ -363,85 +453,36 @@ func (v *Vault) RipGrep(pattern, subFolder string, caseSensitive bool) ([]Match,
 		return nil, fmt.Errorf("ripgrep failed: %w; stderr: %s", waitErr, stderr.String())
 	}
 
+	// The headings of the matched lines need the whole note, so we read every matched note once.
+	// Notes that can't be read anymore (e.g. deleted since) are just left without headings.
+	for i := range matches {
+		content, err := v.NoteContent(matches[i].NoteName)
+		if err != nil {
+			continue
+		}
+		for j := range matches[i].MatchedLines {
+			source := &matches[i].MatchedLines[j].Source
+			source.Heading = headingAt(content, source.Start)
+		}
+	}
+
 	return matches, nil
 }
 
 // ReadRecentDailies reads the `n` most recent dailies.
-// The dailies are sorted by descending filenames, with the most recent dates first.
+// The dailies are sorted by descending dates, with the most recent first. Notes in the daily
+// folder that aren't named by a date (e.g. templates) are skipped.
 // The contents of the returned slice are defined by ReadNote.
 func (v *Vault) ReadRecentDailies(n int) ([]string, error) {
-	files, err := os.ReadDir(v.idx.dailyDir)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read daily directory: %w", err)
-	}
-
-	r := make([]string, 0, n)
-
-	// We know that os.ReadDir returns all the directory entries /sorted/ by filename. Since daily
-	// notes contain only the date in their name, we can search for the most recent notes simply by
-	// traversing the result of os.ReadDir backwards.
-	for i := len(files) - 1; i >= 0; i-- {
-		name := files[i].Name()
-		// TODO(feature): let's be smart and skip potential random files here like "template.md"
-		if !strings.HasSuffix(name, ".md") {
-			continue
-		}
-
-		noteName := strings.TrimSuffix(name, ".md")
-
-		content, err := v.ReadNote(noteName)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read note %s: %w", noteName, err)
-		}
-		r = append(r, content)
-
-		if len(r) >= n {
-			break
-		}
-	}
-
-	return r, nil
+	return v.readRecentPeriodic(PeriodDaily, n)
 }
 
 // ReadRecentWeeklies reads the `n` most recent weeklies.
-// The weeklies are sorted by descinding filename, with the most recent weeklies first.
+// The weeklies are sorted like for ReadRecentDailies.
 // The contents of the returned slice are defined by ReadNote.
-// If no weekly directory is available, returns a nil slice.
+// If no weekly notes are available, returns an empty slice.
 func (v *Vault) ReadRecentWeeklies(n int) ([]string, error) {
-	if v.idx.weeklyDir == "" {
-		return nil, nil
-	}
-
-	files, err := os.ReadDir(v.idx.weeklyDir)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read weekly directory: %w", err)
-	}
-
-	r := make([]string, 0, n)
-
-	// We know that os.ReadDir returns all the directory entries /sorted/ by filename. Since weekly
-	// notes contain only the date in their name, we can search for the most recent notes simply by
-	// traversing the result of os.ReadDir backwards.
-	for i := len(files) - 1; i >= 0; i-- {
-		name := files[i].Name()
-		if !strings.HasSuffix(name, ".md") {
-			continue
-		}
-
-		noteName := strings.TrimSuffix(name, ".md")
-
-		content, err := v.ReadNote(noteName)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read note %s: %w", noteName, err)
-		}
-		r = append(r, content)
-
-		if len(r) >= n {
-			break
-		}
-	}
-
-	return r, nil
+	return v.readRecentPeriodic(PeriodWeekly, n)
 }
 
 func expandHomeDir(path string) (string, error) {
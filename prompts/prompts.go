@@ -14,6 +14,12 @@ var OpaSysPrompt string
 //go:embed smart_read_note.txt
 var SmartReadNotePrompt string
 
+//go:embed research_read.txt
+var ResearchReadPrompt string
+
+//go:embed research_reduce.txt
+var ResearchReducePrompt string
+
 //go:embed tools/*.yaml
 var toolSpecs embed.FS
 
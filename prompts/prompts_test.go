@@ -14,8 +14,13 @@ func TestLoadToolSpec(t *testing.T) {
 		{"ReadNote", "read_note", "ReadNote", 1},
 		{"SmartReadNote", "smart_read_note", "SmartReadNote", 2},
 		{"ListDir", "list_dir", "ListDir", 1},
+		{"ReadAttachment", "read_attachment", "ReadAttachment", 1},
 		{"RipGrep", "rip_grep", "RipGrep", 3},
 		{"SemanticSearch", "semantic_search", "SemanticSearch", 2},
+		{"Research", "research", "Research", 6},
+		{"ReadDailies", "read_dailies", "ReadDailies", 2},
+		{"FindTasks", "find_tasks", "FindTasks", 5},
+		{"ToggleTask", "toggle_task", "ToggleTask", 1},
 	}
 
 	for _, tt := range tests {
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/victhorio/opa/agg"
+	"github.com/victhorio/opa/agg/core"
+	"github.com/victhorio/opa/obsidian"
+	"github.com/victhorio/opa/prompts"
+)
+
+const (
+	// researchNotesMax caps how many notes a single research reads, which is what keeps its cost
+	// and duration in check.
+	researchNotesMax = 50
+	// researchConcurrency is how many notes are read at the same time.
+	researchConcurrency = 8
+	researchTimeout     = 5 * time.Minute
+
+	// nothingRelevant is what readers answer for notes that don't help with the question.
+	nothingRelevant = "NOTHING RELEVANT"
+)
+
+type researchArgs struct {
+	Question string `json:"question"`
+	Search   string `json:"search"`
+	Folder   string `json:"folder"`
+	Tag      string `json:"tag"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+}
+
+// researchFinding is what a reader got out of a single note.
+type researchFinding struct {
+	note string
+	text string
+	err  error
+}
+
+// createResearchTool creates a tool that answers a question across many notes, map-reduce style:
+// every selected note is read by its own sub-agent running model, and the findings are reduced
+// into a single answer by another one. Everything the sub-agents spend rolls up into the run.
+func createResearchTool(vault *obsidian.Vault, model core.Model, client *http.Client) agg.Tool {
+	spec := loadToolSpec("research")
+	readCfg := agg.SubAgentCfg{SysPrompt: prompts.ResearchReadPrompt, Model: model, Client: client}
+	reduceCfg := agg.SubAgentCfg{SysPrompt: prompts.ResearchReducePrompt, Model: model, Client: client}
+
+	wrapper := func(ctx context.Context, args researchArgs) (string, error) {
+		notes, err := selectResearchNotes(vault, args)
+		if err != nil {
+			return fmt.Sprintf("<error>Failed to select notes: %s</error>", err.Error()), nil
+		}
+		if len(notes) == 0 {
+			return "<error>No notes match the selection</error>", nil
+		}
+
+		var skipped int
+		if len(notes) > researchNotesMax {
+			skipped = len(notes) - researchNotesMax
+			notes = notes[:researchNotesMax]
+		}
+
+		findings, usage := readForResearch(ctx, vault, readCfg, spec.Name, notes, args.Question)
+
+		var relevant []researchFinding
+		var failed []string
+		for _, f := range findings {
+			switch {
+			case f.err != nil:
+				failed = append(failed, f.note)
+			case f.text != "" && !strings.HasPrefix(f.text, nothingRelevant):
+				relevant = append(relevant, f)
+			}
+		}
+
+		answer := "None of the notes have anything relevant to the question."
+		if len(relevant) > 0 {
+			var u core.Usage
+			answer, u, err = agg.RunSubAgent(ctx, spec.Name, reduceCfg, reduceInput(relevant, args.Question))
+			usage.Inc(u)
+			if err != nil {
+				return "", err
+			}
+		} else if len(failed) == len(notes) {
+			return "", fmt.Errorf("failed to read any of the %d notes: %w", len(notes), findings[0].err)
+		}
+
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "<answer>\n%s\n</answer>\n\n", answer)
+		fmt.Fprintf(&sb, "<research>Read %d notes, %d with relevant findings.", len(notes), len(relevant))
+		if skipped > 0 {
+			fmt.Fprintf(&sb, " Skipped the last %d notes of the selection, which is over the limit of %d.", skipped, researchNotesMax)
+		}
+		if len(failed) > 0 {
+			fmt.Fprintf(&sb, " Failed to read: %s.", strings.Join(failed, ", "))
+		}
+		fmt.Fprintf(&sb, " Cost: $%.4f.</research>", float64(usage.Cost)/1_000_000_000)
+
+		return sb.String(), nil
+	}
+
+	return agg.NewTool(wrapper, spec).WithPolicy(agg.ToolPolicy{Timeout: researchTimeout})
+}
+
+// selectResearchNotes returns the names of the notes selected by args, in order of relevance for
+// a search and sorted by name otherwise.
+func selectResearchNotes(vault *obsidian.Vault, args researchArgs) ([]string, error) {
+	var filter obsidian.NoteFilter
+	filter.Folder, filter.Tag = args.Folder, args.Tag
+	for _, bound := range []struct {
+		value string
+		dst   *time.Time
+	}{{args.From, &filter.From}, {args.To, &filter.To}} {
+		if bound.value == "" {
+			continue
+		}
+		date, err := time.ParseInLocation("2006-01-02", bound.value, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date %s, expected YYYY-MM-DD", bound.value)
+		}
+		*bound.dst = date
+	}
+
+	if args.Search == "" && filter == (obsidian.NoteFilter{}) {
+		return nil, fmt.Errorf("at least one of search, folder, tag, from and to must be given")
+	}
+
+	refs, err := vault.FindNotes(filter)
+	if err != nil {
+		return nil, err
+	}
+	if args.Search == "" {
+		names := make([]string, len(refs))
+		for i, ref := range refs {
+			names[i] = ref.Name
+		}
+		return names, nil
+	}
+
+	matches, err := vault.SemanticSearch(args.Search, researchNotesMax)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search for %s: %w", args.Search, err)
+	}
+	selected := make(map[string]bool, len(refs))
+	for _, ref := range refs {
+		selected[ref.Name] = true
+	}
+	var names []string
+	for _, match := range matches {
+		if selected[match.Name] {
+			names = append(names, match.Name)
+		}
+	}
+	return names, nil
+}
+
+// readForResearch has every note read by a sub-agent, researchConcurrency at a time, returning
+// the findings in the same order as notes along with what was spent.
+func readForResearch(
+	ctx context.Context,
+	vault *obsidian.Vault,
+	cfg agg.SubAgentCfg,
+	name string,
+	notes []string,
+	question string,
+) ([]researchFinding, core.Usage) {
+	findings := make([]researchFinding, len(notes))
+	sem := make(chan struct{}, researchConcurrency)
+
+	var mu sync.Mutex
+	var usage core.Usage
+	var wg sync.WaitGroup
+	for i, note := range notes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			findings[i].note = note
+			content, err := vault.ReadNote(note)
+			if err != nil {
+				findings[i].err = err
+				return
+			}
+
+			input := fmt.Sprintf("%s\n\n<question>%s</question>", content, question)
+			text, u, err := agg.RunSubAgent(ctx, name, cfg, input)
+			findings[i].text, findings[i].err = strings.TrimSpace(text), err
+
+			mu.Lock()
+			usage.Inc(u)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	return findings, usage
+}
+
+func reduceInput(findings []researchFinding, question string) string {
+	var sb strings.Builder
+	for _, f := range findings {
+		fmt.Fprintf(&sb, "<findings note=%q>\n%s\n</findings>\n\n", f.note, f.text)
+	}
+	fmt.Fprintf(&sb, "<question>%s</question>", question)
+	return sb.String()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/victhorio/opa/agg"
+	"github.com/victhorio/opa/agg/core"
+	"github.com/victhorio/opa/agg/fake"
+	"github.com/victhorio/opa/obsidian"
+)
+
+func TestSelectResearchNotes(t *testing.T) {
+	vault, _ := writeVault(t, researchNotes, obsidian.Cfg{})
+
+	tests := []struct {
+		name    string
+		args    researchArgs
+		want    []string
+		wantErr string
+	}{
+		{"folder", researchArgs{Folder: "Projects"}, []string{"Alpha", "Beta", "Gamma"}, ""},
+		{"tag", researchArgs{Tag: "#project"}, []string{"Alpha", "Beta"}, ""},
+		{"nested tag", researchArgs{Tag: "project/alpha"}, []string{"Alpha"}, ""},
+		{"date range", researchArgs{From: "2025-10-12", To: "2025-10-13"}, []string{"2025-10-12"}, ""},
+		{"combined", researchArgs{Folder: "Daily", To: "2025-10-11"}, []string{"2025-10-11"}, ""},
+		{"nothing selected", researchArgs{}, nil, "at least one of"},
+		{"invalid date", researchArgs{From: "last week"}, nil, "invalid date"},
+		{"search without embeddings", researchArgs{Search: "plans"}, nil, "embeddings not computed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectResearchNotes(vault, tt.args)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestResearchTool(t *testing.T) {
+	vault, _ := writeVault(t, researchNotes, obsidian.Cfg{})
+
+	// every note is read before the findings are reduced, but the reads are concurrent so there's
+	// no telling which note gets which of the first turns
+	readers := fake.NewModel(
+		core.ProviderOpenAI,
+		fake.NewTurn().Text("a finding").Cost(1_000_000),
+		fake.NewTurn().Text(nothingRelevant).Cost(1_000_000),
+		fake.NewTurn().Text("another finding").Cost(1_000_000),
+		fake.NewTurn().Text("the answer [[Alpha]]").Cost(10_000_000),
+	)
+	parent := fake.NewModel(
+		core.ProviderOpenAI,
+		fake.NewTurn().ToolCall("c1", "Research", `{"question":"what's the plan?","folder":"Projects"}`),
+		fake.NewTurn().Text("done"),
+	)
+
+	store := agg.NewEphemeralStore()
+	agent := agg.NewAgent("sys", parent, &store, []agg.Tool{createResearchTool(vault, readers, nil)})
+
+	if _, err := agent.RunStream(context.Background(), http.DefaultClient, "s", "hi", false, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	result := store.Messages("s")[3].ToolResult.Result
+	for _, want := range []string{
+		"<answer>\nthe answer [[Alpha]]\n</answer>",
+		"Read 3 notes, 2 with relevant findings.",
+		"Cost: $0.0130.",
+	} {
+		if !strings.Contains(result, want) {
+			t.Errorf("expected the result to contain %q, got %q", want, result)
+		}
+	}
+
+	calls := readers.Calls()
+	if len(calls) != 4 {
+		t.Fatalf("expected 3 reads and a reduce, got %d calls", len(calls))
+	}
+	reduce, _ := calls[3].Msgs[1].AsContent()
+	if n := strings.Count(reduce.Text, "<findings note="); n != 2 {
+		t.Errorf("expected only the 2 relevant findings to be reduced, got %d in %q", n, reduce.Text)
+	}
+	if strings.Contains(reduce.Text, nothingRelevant) || !strings.HasSuffix(reduce.Text, "<question>what's the plan?</question>") {
+		t.Errorf("unexpected reduce input %q", reduce.Text)
+	}
+
+	// what the sub-agents spent is part of the session
+	if u := store.Usage("s"); u.Cost != 13_000_000 {
+		t.Errorf("expected the session to cost 13000000, got %d", u.Cost)
+	}
+}
+
+// researchNotes are the notes of the vault the research tests select from.
+var researchNotes = map[string]string{
+	"Daily/2025-10-11.md":  "went for a run",
+	"Daily/2025-10-12.md":  "planning day #planning",
+	"Projects/Alpha.md":    "# Alpha\nthe plan is #project/alpha",
+	"Projects/Beta.md":     "---\ntags: [project, beta]\n---\n# Beta",
+	"Projects/Gamma.md":    "# Gamma\nissue #1 is open",
+	"Ideas/Code Sample.md": "```\n#project\n```",
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/victhorio/opa/agg"
+	"github.com/victhorio/opa/agg/core"
+)
+
+// sessionStore is what the server needs from the store besides what the agent uses.
+type sessionStore interface {
+	CreateSession(sessionID string) error
+	HasSession(sessionID string) (bool, error)
+	Sessions() ([]agg.SessionInfo, error)
+}
+
+// server exposes the agent over HTTP. Every request must carry the bearer token, and a session can
+// only run one turn at a time.
+type server struct {
+	agent  *agg.Agent
+	store  sessionStore
+	client *http.Client
+	token  string
+	model  string
+
+	// busy has the sessions running a turn, which are removed once the turn is over
+	mu   sync.Mutex
+	busy map[string]bool
+}
+
+func newServer(agent *agg.Agent, store sessionStore, model, token string) *server {
+	return &server{
+		agent:  agent,
+		store:  store,
+		client: http.DefaultClient,
+		token:  token,
+		model:  model,
+		busy:   make(map[string]bool),
+	}
+}
+
+// runServe implements `opa serve`, which serves the API until interrupted.
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:7878", "address to listen on")
+	token := fs.String("token", os.Getenv("OPA_TOKEN"), "bearer token clients must send (defaults to $OPA_TOKEN)")
+	model := fs.String("model", *modelSpec, "model to use as provider:name (defaults to the one in ~/.opa/models.yaml)")
+	toolNames := fs.String("tools", "all", `comma separated tools to enable, "all" or "none"`)
+	fs.Parse(args)
+
+	if *token == "" {
+		return errors.New("a token is required, set -token or $OPA_TOKEN")
+	}
+
+	if err := setupLogging(); err != nil {
+		return fmt.Errorf("error setting up logging: %w", err)
+	}
+
+	agent, spec, store, closeAll, err := loadAgent(*model, *toolNames)
+	if err != nil {
+		return err
+	}
+	defer closeAll()
+
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           newServer(&agent, store, spec, *token).routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Fprintf(os.Stderr, "opa serving %s on http://%s\n", spec, *addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", s.handleListSessions)
+	mux.HandleFunc("POST /sessions", s.handleCreateSession)
+	mux.HandleFunc("POST /sessions/{id}/messages", s.handlePostMessage)
+	return s.authenticate(mux)
+}
+
+// authenticate rejects requests without the bearer token.
+func (s *server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "missing or invalid token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *server) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := s.store.Sessions()
+	if err != nil {
+		log.Printf("error listing sessions: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list sessions")
+		return
+	}
+	if sessions == nil {
+		sessions = []agg.SessionInfo{}
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+func (s *server) handleCreateSession(w http.ResponseWriter, r *http.Request) {
+	// the body is optional, it only lets clients pick the ID themselves
+	var req struct {
+		ID string `json:"id"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid body: %v", err))
+			return
+		}
+	}
+	if req.ID == "" {
+		req.ID = newSessionID("api")
+	}
+
+	if err := s.store.CreateSession(req.ID); err != nil {
+		log.Printf("error creating session: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to create session")
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{"id": req.ID})
+}
+
+// handlePostMessage runs a turn of the session with the posted message, which must have been
+// created before. Clients that accept text/event-stream get every event as it happens, the others
+// a single JSON object at the end.
+func (s *server) handlePostMessage(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.PathValue("id")
+
+	var req struct {
+		Content   string `json:"content"`
+		Internals bool   `json:"internals"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid body: %v", err))
+		return
+	}
+	if strings.TrimSpace(req.Content) == "" {
+		writeError(w, http.StatusBadRequest, "content must not be empty")
+		return
+	}
+
+	exists, err := s.store.HasSession(sessionID)
+	if err != nil {
+		log.Printf("error looking up session: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to look up session")
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+
+	unlock, ok := s.lockSession(sessionID)
+	if !ok {
+		writeError(w, http.StatusConflict, "session is already running a turn")
+		return
+	}
+	defer unlock()
+
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		out, err := s.agent.RunStream(r.Context(), s.client, sessionID, req.Content, req.Internals, nil)
+		if err != nil {
+			writeError(w, turnErrorStatus(err), err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, askResult{
+			SessionID: sessionID,
+			Model:     s.model,
+			Output:    out,
+			Usage:     newUsageJSON(s.agent.Store.Usage(sessionID)),
+		})
+		return
+	}
+
+	sse := newSSEWriter(w)
+	out, err := s.agent.RunStream(r.Context(), s.client, sessionID, req.Content, req.Internals, sse.event)
+	if err != nil {
+		sse.send("error", map[string]string{"message": err.Error()})
+		return
+	}
+	sse.send("done", askResult{
+		SessionID: sessionID,
+		Model:     s.model,
+		Output:    out,
+		Usage:     newUsageJSON(s.agent.Store.Usage(sessionID)),
+	})
+}
+
+// lockSession marks the session as busy unless it already is, returning how to release it.
+func (s *server) lockSession(sessionID string) (func(), bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.busy[sessionID] {
+		return nil, false
+	}
+	s.busy[sessionID] = true
+
+	return func() {
+		s.mu.Lock()
+		delete(s.busy, sessionID)
+		s.mu.Unlock()
+	}, true
+}
+
+// sseWriter writes server-sent events, flushing each one as soon as it's written.
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newSSEWriter(w http.ResponseWriter) *sseWriter {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	return &sseWriter{w: w, flusher: flusher}
+}
+
+// event sends a core.Event. Errors of the stream aren't sent here since the turn ends with an
+// error of its own. Events of sub-agents carry their path, e.g. ["SmartReadNote"].
+func (s *sseWriter) event(ev core.Event) {
+	var name string
+	var data map[string]any
+	switch ev.Type {
+	case core.EvDelta:
+		name, data = "delta", map[string]any{"text": ev.Delta}
+	case core.EvDeltaReason:
+		name, data = "reasoning", map[string]any{"text": ev.Delta}
+	case core.EvToolCall:
+		name, data = "tool_call", map[string]any{
+			"id":        ev.Call.ID,
+			"name":      ev.Call.Name,
+			"arguments": ev.Call.Arguments,
+		}
+	case core.EvWarning:
+		name, data = "warning", map[string]any{"message": ev.Err.Error()}
+	case core.EvRetry:
+		// the deltas and reasoning sent since the last response (or retry) are to be discarded
+		name, data = "retry", map[string]any{"message": ev.Err.Error()}
+	case core.EvResp:
+		name, data = "response", map[string]any{
+			"model": ev.Response.Model,
+			"usage": newUsageJSON(ev.Response.Usage),
+		}
+	default:
+		return
+	}
+
+	if len(ev.Path) > 0 {
+		data["path"] = ev.Path
+	}
+	s.send(name, data)
+}
+
+func (s *sseWriter) send(event string, data any) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		// Should never happen for the types we send.
+		log.Printf("error marshalling %s event: %v", event, err)
+		return
+	}
+
+	fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, payload)
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+}
+
+// turnErrorStatus maps the error of a turn to the status code of the response.
+func turnErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, agg.ErrBudgetExceeded):
+		return http.StatusPaymentRequired
+	case errors.Is(err, context.Canceled):
+		// the client is gone, so this is only for the logs
+		return 499
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("error writing response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
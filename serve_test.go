@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/victhorio/opa/agg"
+	"github.com/victhorio/opa/agg/core"
+	"github.com/victhorio/opa/agg/fake"
+)
+
+const testToken = "secret"
+
+func newTestServer(t *testing.T, model *fake.Model) *httptest.Server {
+	t.Helper()
+
+	store, err := agg.NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	agent := agg.NewAgent("sys", model, store, nil)
+	srv := httptest.NewServer(newServer(&agent, store, "openai:fake", testToken).routes())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func doRequest(t *testing.T, ctx context.Context, srv *httptest.Server, method, path, body string, header map[string]string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(ctx, method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	return resp
+}
+
+func decodeBody[T any](t *testing.T, resp *http.Response) T {
+	t.Helper()
+	defer resp.Body.Close()
+
+	var v T
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return v
+}
+
+func TestServeAuth(t *testing.T) {
+	srv := newTestServer(t, fake.NewModel(core.ProviderOpenAI))
+
+	for _, auth := range []string{"", "Bearer nope", testToken} {
+		req, _ := http.NewRequest("GET", srv.URL+"/sessions", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected 401 for Authorization %q, got %d", auth, resp.StatusCode)
+		}
+	}
+}
+
+func TestServeSessions(t *testing.T) {
+	srv := newTestServer(t, fake.NewModel(core.ProviderOpenAI))
+	ctx := context.Background()
+
+	resp := doRequest(t, ctx, srv, "POST", "/sessions", "", nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+	created := decodeBody[map[string]string](t, resp)
+	if !strings.HasPrefix(created["id"], "api-") {
+		t.Errorf("expected a generated session ID, got %q", created["id"])
+	}
+
+	resp = doRequest(t, ctx, srv, "POST", "/sessions", `{"id":"editor"}`, nil)
+	if got := decodeBody[map[string]string](t, resp); got["id"] != "editor" {
+		t.Errorf("expected the requested session ID, got %q", got["id"])
+	}
+
+	resp = doRequest(t, ctx, srv, "GET", "/sessions", "", nil)
+	sessions := decodeBody[[]agg.SessionInfo](t, resp)
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %+v", sessions)
+	}
+}
+
+func TestServePostMessage(t *testing.T) {
+	model := fake.NewModel(
+		core.ProviderOpenAI,
+		fake.NewTurn().Text("Paris.").Usage(core.Usage{Input: 10, Output: 2, Cost: 1_000_000}),
+		fake.NewTurn().Text("About 2 ", "million."),
+	)
+	srv := newTestServer(t, model)
+	ctx := context.Background()
+
+	resp := doRequest(t, ctx, srv, "POST", "/sessions/s1/messages", `{"content":"capital of France?"}`, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for a session that wasn't created, got %d", resp.StatusCode)
+	}
+	if len(model.Calls()) != 0 {
+		t.Fatalf("expected no turn to run for a missing session")
+	}
+
+	doRequest(t, ctx, srv, "POST", "/sessions", `{"id":"s1"}`, nil).Body.Close()
+	resp = doRequest(t, ctx, srv, "POST", "/sessions/s1/messages", `{"content":"capital of France?"}`, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	result := decodeBody[askResult](t, resp)
+	if result.Output != "Paris." || result.SessionID != "s1" || result.Usage.Input != 10 {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	// the second turn continues the session, streaming its events
+	resp = doRequest(t, ctx, srv, "POST", "/sessions/s1/messages", `{"content":"population?"}`,
+		map[string]string{"Accept": "text/event-stream"})
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %q", ct)
+	}
+
+	var events []string
+	var done askResult
+	scanner := bufio.NewScanner(resp.Body)
+	var event string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			event = name
+			events = append(events, name)
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok && event == "done" {
+			if err := json.Unmarshal([]byte(data), &done); err != nil {
+				t.Fatalf("invalid done event %q: %v", data, err)
+			}
+		}
+	}
+
+	if got := strings.Join(events, ","); got != "delta,delta,response,done" {
+		t.Errorf("unexpected events %s", got)
+	}
+	if done.Output != "About 2 million." {
+		t.Errorf("unexpected final output %q", done.Output)
+	}
+
+	// system, user, assistant, user
+	msgs := model.Calls()[1].Msgs
+	if len(msgs) != 4 {
+		t.Errorf("expected the second turn to see the history, got %d messages", len(msgs))
+	}
+}
+
+func TestServeSessionLock(t *testing.T) {
+	model := fake.NewModel(
+		core.ProviderOpenAI,
+		fake.NewTurn().Hang(),
+		fake.NewTurn().Text("other session"),
+		fake.NewTurn().Text("after"),
+	)
+	srv := newTestServer(t, model)
+	for _, id := range []string{"s1", "s2"} {
+		doRequest(t, context.Background(), srv, "POST", "/sessions", `{"id":"`+id+`"}`, nil).Body.Close()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	firstDone := make(chan struct{})
+	go func() {
+		defer close(firstDone)
+		req, _ := http.NewRequestWithContext(ctx, "POST", srv.URL+"/sessions/s1/messages", strings.NewReader(`{"content":"hi"}`))
+		req.Header.Set("Authorization", "Bearer "+testToken)
+		if resp, err := srv.Client().Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(model.Calls()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the first turn never started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	resp := doRequest(t, context.Background(), srv, "POST", "/sessions/s1/messages", `{"content":"again"}`, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected 409 while the session is busy, got %d", resp.StatusCode)
+	}
+
+	// other sessions aren't affected
+	resp = doRequest(t, context.Background(), srv, "POST", "/sessions/s2/messages", `{"content":"hi"}`, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected another session to run, got %d", resp.StatusCode)
+	}
+
+	cancel()
+	<-firstDone
+
+	// the lock is released once the turn is over, which happens shortly after the client is gone
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		resp = doRequest(t, context.Background(), srv, "POST", "/sessions/s1/messages", `{"content":"again"}`, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusConflict || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the session to be unlocked, got %d", resp.StatusCode)
+	}
+}
+
+func TestServeSessionLockRelease(t *testing.T) {
+	s := newServer(nil, nil, "openai:fake", testToken)
+
+	unlock, ok := s.lockSession("s1")
+	if !ok {
+		t.Fatal("expected to lock an idle session")
+	}
+	if _, ok := s.lockSession("s1"); ok {
+		t.Error("expected a busy session not to be locked again")
+	}
+	unlock()
+
+	// sessions that are done with their turn aren't kept around
+	if len(s.busy) != 0 {
+		t.Errorf("expected no busy sessions after unlocking, got %v", s.busy)
+	}
+	if _, ok := s.lockSession("s1"); !ok {
+		t.Error("expected to lock the session again once released")
+	}
+}
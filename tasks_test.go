@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/victhorio/opa/agg"
+	"github.com/victhorio/opa/obsidian"
+)
+
+func TestTaskTools(t *testing.T) {
+	yesterday := time.Now().AddDate(0, 0, -1).Format(time.DateOnly)
+	vault, _ := writeVault(t, map[string]string{
+		"Daily/2025-03-10.md": "- [ ] pay rent 📅 " + yesterday + " ⏫\n- [ ] water plants 📅 2099-01-01",
+	}, obsidian.Cfg{})
+	find, toggle := createFindTasksTool(vault), createToggleTaskTool(vault)
+
+	call := func(tool agg.Tool, args string) string {
+		t.Helper()
+		out, err := tool.Handler(context.Background(), json.RawMessage(args))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return out.Text
+	}
+
+	got := call(find, `{"overdue":true}`)
+	wantLine := "- [ ] pay rent (due " + formatDay(obsidian.Day(time.Now().AddDate(0, 0, -1))) + ", overdue, high priority)\n"
+	if !strings.HasPrefix(got, "1 tasks\n\n"+wantLine) || !strings.Contains(got, "  id: 2025-03-10:L1@") {
+		t.Errorf("unexpected overdue tasks %q", got)
+	}
+
+	id := strings.TrimSuffix(strings.Split(strings.Split(got, "id: ")[1], ",")[0], "\n")
+	if got := call(toggle, `{"id":"`+id+`"}`); !strings.HasPrefix(got, "Marked as done:\n\n- [x] pay rent") {
+		t.Errorf("unexpected toggle result %q", got)
+	}
+	if got := call(toggle, `{"id":"`+id+`"}`); !strings.HasPrefix(got, "<error>The task changed") {
+		t.Errorf("expected a conflict toggling again, got %q", got)
+	}
+
+	for args, want := range map[string]string{
+		`{"overdue":true}`:                      "<error>No tasks found",
+		`{"due":"2099"}`:                        "1 tasks",
+		`{"due":"someday"}`:                     "<error>Failed to resolve due range",
+		`{"due":"today","overdue":true}`:        "<error>Use either",
+		`{"overdue":false,"include_done":true}`: "2 tasks",
+	} {
+		if got := call(find, args); !strings.HasPrefix(got, want) {
+			t.Errorf("expected %s to give %q, got %q", args, want, got)
+		}
+	}
+}
+
+// writeVault writes the given notes into a new vault and loads it with cfg, returning the vault
+// along with its root directory.
+func writeVault(t *testing.T, notes map[string]string, cfg obsidian.Cfg) (*obsidian.Vault, string) {
+	t.Helper()
+
+	root := t.TempDir()
+	for path, content := range notes {
+		full := filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vault, err := obsidian.LoadVault(root, cfg)
+	if err != nil {
+		t.Fatalf("error loading vault: %v", err)
+	}
+	return vault, root
+}
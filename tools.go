@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/victhorio/opa/agg"
 	"github.com/victhorio/opa/agg/core"
@@ -42,12 +44,12 @@ func createReadNoteTool(vault *obsidian.Vault) agg.Tool {
 }
 
 func createSmartReadNoteTool(vault *obsidian.Vault, client *http.Client) agg.Tool {
-	if client == nil {
-		client = http.DefaultClient
-	}
-
-	model := openai.NewModel(openai.GPT5Mini, "low")
 	spec := loadToolSpec("smart_read_note")
+	cfg := agg.SubAgentCfg{
+		SysPrompt: prompts.SmartReadNotePrompt,
+		Model:     openai.NewModel(openai.GPT5Mini, "low"),
+		Client:    client,
+	}
 
 	wrapper := func(
 		ctx context.Context,
@@ -61,44 +63,12 @@ func createSmartReadNoteTool(vault *obsidian.Vault, client *http.Client) agg.Too
 			return fmt.Sprintf("<error>Failed to read note %s: %s</error>", args.NoteName, err.Error()), nil
 		}
 
-		sysPrompt := strings.NewReplacer("{note}", note).Replace(prompts.SmartReadNotePrompt)
-		msgs := []*core.Msg{
-			core.NewMsgContent("system", sysPrompt),
-			core.NewMsgContent("user", args.Prompt),
-		}
-
-		stream, err := model.OpenStream(ctx, client, msgs, []core.Tool{}, core.StreamCfg{})
-		if err != nil {
-			return fmt.Sprintf("<error>Failed to send message to LLM: %s</error>", err.Error()), nil
-		}
-
-		ch := make(chan core.Event, 1)
-		go stream.Consume(ctx, ch)
-
-		var resp *core.Response
-		for event := range ch {
-			switch event.Type {
-			case core.EvResp:
-				resp = &event.Response
-			case core.EvError:
-				return fmt.Sprintf("<error>Failed to read message from LLM: %s</error>", event.Err.Error()), nil
-			}
-		}
-
-		if resp == nil {
-			return "", fmt.Errorf("left channel without receiving a response, something went wrong")
-		}
-
-		msg := resp.Messages[len(resp.Messages)-1]
-		content, ok := msg.AsContent()
-		if !ok {
-			return "", fmt.Errorf("expected content message, got %d", msg.Type)
-		}
-
-		return content.Text, nil
+		input := fmt.Sprintf("%s\n\n<query>%s</query>", note, args.Prompt)
+		out, _, err := agg.RunSubAgent(ctx, spec.Name, cfg, input)
+		return out, err
 	}
 
-	return agg.NewTool(wrapper, spec)
+	return agg.NewTool(wrapper, spec).WithPolicy(agg.ToolPolicy{Timeout: smartReadNoteTimeout})
 }
 
 func createListDirTool(vault *obsidian.Vault) agg.Tool {
@@ -121,6 +91,31 @@ func createListDirTool(vault *obsidian.Vault) agg.Tool {
 	return agg.NewTool(wrapper, spec)
 }
 
+func createReadAttachmentTool(vault *obsidian.Vault) agg.Tool {
+	spec := loadToolSpec("read_attachment")
+
+	wrapper := func(
+		ctx context.Context,
+		args struct {
+			Path string `json:"path"`
+		},
+	) (agg.ToolOutput, error) {
+		part, err := vault.ReadAttachment(args.Path)
+		if err != nil {
+			return agg.ToolOutput{
+				Text: fmt.Sprintf("<error>Failed to read attachment %s: %s</error>", args.Path, err.Error()),
+			}, nil
+		}
+
+		return agg.ToolOutput{
+			Text:  fmt.Sprintf("<attachment>%s</attachment>", args.Path),
+			Parts: []core.Part{part},
+		}, nil
+	}
+
+	return agg.NewToolWithParts(wrapper, spec)
+}
+
 func createRipGrepTool(vault *obsidian.Vault) agg.Tool {
 	spec := loadToolSpec("rip_grep")
 
@@ -132,7 +127,7 @@ func createRipGrepTool(vault *obsidian.Vault) agg.Tool {
 			CaseSensitive bool   `json:"case_sensitive"`
 		},
 	) (string, error) {
-		matches, err := vault.RipGrep(args.Pattern, args.Folder, args.CaseSensitive)
+		matches, err := vault.RipGrep(ctx, args.Pattern, args.Folder, args.CaseSensitive)
 		if err != nil {
 			return fmt.Sprintf("<error>Failed to search vault for pattern %s: %s</error>", args.Pattern, err.Error()), nil
 		}
@@ -142,7 +137,7 @@ func createRipGrepTool(vault *obsidian.Vault) agg.Tool {
 		for _, match := range matches {
 			fmt.Fprintf(&sb, "NOTE %s\n", match.NoteName)
 			for _, line := range match.MatchedLines {
-				fmt.Fprintf(&sb, "LINE %s\n", line)
+				fmt.Fprintf(&sb, "LINE [%s] %s\n", line.Source, line.Text)
 			}
 			sb.WriteString("\n")
 		}
@@ -155,9 +150,183 @@ func createRipGrepTool(vault *obsidian.Vault) agg.Tool {
 		return ret, nil
 	}
 
+	// ripgrep is fast enough that anything taking longer than this is a pathological pattern, and
+	// since it's CPU heavy there's no point in running many searches at the same time.
+	return agg.NewTool(wrapper, spec).WithPolicy(agg.ToolPolicy{
+		Timeout:       ripGrepTimeout,
+		MaxConcurrent: 2,
+	})
+}
+
+func createReadDailiesTool(vault *obsidian.Vault) agg.Tool {
+	spec := loadToolSpec("read_dailies")
+
+	wrapper := func(
+		ctx context.Context,
+		args struct {
+			Range  string `json:"range"`
+			Period string `json:"period"`
+		},
+	) (string, error) {
+		period := obsidian.PeriodDaily
+		if args.Period != "" {
+			p, err := obsidian.ParsePeriod(args.Period)
+			if err != nil {
+				return fmt.Sprintf("<error>Invalid period %s</error>", args.Period), nil
+			}
+			period = p
+		}
+
+		from, to, err := resolveDateRange(args.Range, time.Now())
+		if err != nil {
+			return fmt.Sprintf("<error>Failed to resolve range: %s</error>", err.Error()), nil
+		}
+
+		notes := vault.PeriodicBetween(period, from, to)
+		if len(notes) == 0 {
+			return fmt.Sprintf("<error>No %s notes from %s to %s</error>", period, formatDay(from), formatDay(to)), nil
+		}
+
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "%d %s notes from %s to %s", len(notes), period, formatDay(from), formatDay(to))
+		if len(notes) > readDailiesMax {
+			fmt.Fprintf(&sb, ", showing the most recent %d", readDailiesMax)
+			notes = notes[len(notes)-readDailiesMax:]
+		}
+		sb.WriteString("\n")
+
+		for _, note := range notes {
+			content, err := vault.ReadNote(note.Name)
+			if err != nil {
+				return fmt.Sprintf("<error>Failed to read note %s: %s</error>", note.Name, err.Error()), nil
+			}
+			sb.WriteString("\n")
+			sb.WriteString(content)
+			sb.WriteString("\n")
+		}
+
+		return sb.String(), nil
+	}
+
+	return agg.NewTool(wrapper, spec)
+}
+
+// formatDay formats a day along with its weekday, which models tend to get wrong on their own.
+func formatDay(t time.Time) string {
+	return t.Format("2006-01-02 (Monday)")
+}
+
+func createFindTasksTool(vault *obsidian.Vault) agg.Tool {
+	spec := loadToolSpec("find_tasks")
+
+	wrapper := func(
+		ctx context.Context,
+		args struct {
+			Due         string `json:"due"`
+			Overdue     bool   `json:"overdue"`
+			Tag         string `json:"tag"`
+			Folder      string `json:"folder"`
+			IncludeDone bool   `json:"include_done"`
+		},
+	) (string, error) {
+		filter := obsidian.TaskFilter{Folder: args.Folder, Tag: args.Tag, Open: !args.IncludeDone}
+
+		now := time.Now()
+		switch {
+		case args.Overdue && args.Due != "":
+			return "<error>Use either 'due' or 'overdue', not both</error>", nil
+		case args.Overdue:
+			filter.Open = true
+			filter.DueTo = now.AddDate(0, 0, -1)
+		case args.Due != "":
+			from, to, err := resolveDateRange(args.Due, now)
+			if err != nil {
+				return fmt.Sprintf("<error>Failed to resolve due range: %s</error>", err.Error()), nil
+			}
+			filter.DueFrom, filter.DueTo = from, to
+		}
+
+		tasks, err := vault.Tasks(filter)
+		if err != nil {
+			return fmt.Sprintf("<error>Failed to find tasks: %s</error>", err.Error()), nil
+		}
+		if len(tasks) == 0 {
+			return "<error>No tasks found</error>", nil
+		}
+
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "%d tasks", len(tasks))
+		if len(tasks) > findTasksMax {
+			fmt.Fprintf(&sb, ", showing the first %d", findTasksMax)
+			tasks = tasks[:findTasksMax]
+		}
+		sb.WriteString("\n\n")
+
+		for _, task := range tasks {
+			sb.WriteString(formatTask(task, now))
+		}
+
+		return sb.String(), nil
+	}
+
 	return agg.NewTool(wrapper, spec)
 }
 
+func createToggleTaskTool(vault *obsidian.Vault) agg.Tool {
+	spec := loadToolSpec("toggle_task")
+
+	wrapper := func(
+		ctx context.Context,
+		args struct {
+			ID string `json:"id"`
+		},
+	) (string, error) {
+		now := time.Now()
+
+		task, err := vault.ToggleTask(args.ID, now)
+		if errors.Is(err, obsidian.ErrTaskChanged) {
+			return "<error>The task changed since it was listed, use FindTasks to get its current ID</error>", nil
+		}
+		if err != nil {
+			return fmt.Sprintf("<error>Failed to toggle task %s: %s</error>", args.ID, err.Error()), nil
+		}
+
+		return fmt.Sprintf("Marked as %s:\n\n%s", task.Status, formatTask(task, now)), nil
+	}
+
+	return agg.NewTool(wrapper, spec)
+}
+
+// formatTask formats a task for the model, along with its ID and the source it can be cited by.
+func formatTask(task obsidian.Task, now time.Time) string {
+	var details []string
+	for _, date := range []struct {
+		name string
+		date time.Time
+	}{{"due", task.Due}, {"scheduled", task.Scheduled}, {"starts", task.Start}, {"done", task.Done}} {
+		if !date.date.IsZero() {
+			details = append(details, date.name+" "+formatDay(date.date))
+		}
+	}
+	if task.Status.IsOpen() && !task.Due.IsZero() && task.Due.Before(obsidian.Day(now)) {
+		details = append(details, "overdue")
+	}
+	if task.Priority != obsidian.TaskNormal {
+		details = append(details, task.Priority.String()+" priority")
+	}
+	if task.Status != obsidian.TaskOpen && task.Status != obsidian.TaskDone {
+		details = append(details, task.Status.String())
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "- [%c] %s", rune(task.Status), task.Text)
+	if len(details) > 0 {
+		fmt.Fprintf(&sb, " (%s)", strings.Join(details, ", "))
+	}
+	fmt.Fprintf(&sb, "\n  id: %s, source: %s\n", task.ID(), task.Source)
+	return sb.String()
+}
+
 func createSemanticSearchTool(vault *obsidian.Vault) agg.Tool {
 	spec := loadToolSpec("semantic_search")
 
@@ -168,6 +337,12 @@ func createSemanticSearchTool(vault *obsidian.Vault) agg.Tool {
 			K         int    `json:"k"`
 		},
 	) (string, error) {
+		// the embeddings may still be computing in the background, in which case we wait for them
+		// as long as the tool's timeout allows
+		if err := vault.WaitEmbeddings(ctx); err != nil {
+			return fmt.Sprintf("<error>Semantic search is unavailable: %s</error>", err.Error()), nil
+		}
+
 		matches, err := vault.SemanticSearch(args.QueryText, args.K)
 		if err != nil {
 			return fmt.Sprintf("<error>Failed to perform semantic search for query '%s': %s</error>", args.QueryText, err.Error()), nil
@@ -175,12 +350,49 @@ func createSemanticSearchTool(vault *obsidian.Vault) agg.Tool {
 
 		var sb strings.Builder
 
-		for i, match := range matches {
-			sb.WriteString(fmt.Sprintf("%d. %s (score: %.4f)\n", i+1, match.Name, match.Score))
+		// like for RipGrep, every passage comes with the source it can be cited by
+		for _, match := range matches {
+			fmt.Fprintf(&sb, "NOTE %s (score: %.4f)\n", match.Name, match.Score)
+			sections, err := vault.NoteSections(match.Name)
+			if err != nil {
+				return fmt.Sprintf("<error>Failed to read note %s: %s</error>", match.Name, err.Error()), nil
+			}
+			for _, section := range sections[:min(len(sections), semanticSearchSections)] {
+				if line := sectionPreview(section.Text); line != "" {
+					fmt.Fprintf(&sb, "SECTION [%s] %s\n", section.Source, maybeTruncate(line, 120))
+				}
+			}
+			sb.WriteString("\n")
 		}
 
 		return sb.String(), nil
 	}
 
-	return agg.NewTool(wrapper, spec)
+	return agg.NewTool(wrapper, spec).WithPolicy(agg.ToolPolicy{Timeout: semanticSearchTimeout})
 }
+
+// sectionPreview returns the first line of a section with some text of its own, skipping its
+// heading and frontmatter delimiters.
+func sectionPreview(text string) string {
+	for line := range strings.Lines(text) {
+		line = strings.TrimSpace(line)
+		if line != "" && line != "---" && !strings.HasPrefix(line, "#") {
+			return line
+		}
+	}
+	return ""
+}
+
+const (
+	smartReadNoteTimeout  = 90 * time.Second
+	ripGrepTimeout        = 15 * time.Second
+	semanticSearchTimeout = 15 * time.Second
+
+	// semanticSearchSections is the most sections SemanticSearch previews of each note.
+	semanticSearchSections = 8
+
+	// readDailiesMax is the most notes ReadDailies returns, which is about a month of dailies.
+	readDailiesMax = 31
+	// findTasksMax is the most tasks FindTasks lists.
+	findTasksMax = 100
+)
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/victhorio/opa/obsidian"
+)
+
+func TestSmartReadNoteMissingNote(t *testing.T) {
+	vault, _ := writeVault(t, map[string]string{"Daily/2025-10-11.md": "went for a run"}, obsidian.Cfg{})
+
+	// a missing note never gets to the sub-agent
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		t.Errorf("unexpected request to %s", r.URL)
+		return nil, errors.New("no requests expected")
+	})}
+	tool := createSmartReadNoteTool(vault, client)
+
+	out, err := tool.Handler(context.Background(), json.RawMessage(`{"note_name":"Nope","prompt":"what's in it?"}`))
+	if err != nil {
+		t.Fatalf("expected the failure in the result, got error %v", err)
+	}
+	if !strings.HasPrefix(out.Text, "<error>Failed to read note Nope: ") {
+		t.Errorf("unexpected result %q", out.Text)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
 	"strings"
 
 	"github.com/charmbracelet/bubbles/textarea"
@@ -34,6 +35,7 @@ var (
 	errorStyle         = lipgloss.NewStyle().Foreground(lipgloss.Color("196"))
 	dividerStyle       = lipgloss.NewStyle().Foreground(lipgloss.Color("240"))
 	assistantBodyStyle = lipgloss.NewStyle()
+	referenceStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("75")).Underline(true)
 )
 
 type msgKind int
@@ -43,6 +45,7 @@ const (
 	msgAssistant
 	msgTool
 	msgReasoning
+	msgInfo
 )
 
 type chatMessage struct {
@@ -58,6 +61,8 @@ type botErrorMsg struct{ err error }        // error during streaming
 type streamClosedMsg struct{}               // channel was closed
 type toolCallMsg struct{ text string }      // tool call (complete, not streamed)
 type reasoningMsg struct{ text string }     // reasoning block (complete, not streamed)
+type botRetryMsg struct{ err error }        // the response is starting over, drop what we have
+type warningMsg struct{ text string }       // something to let the user know, e.g. budget
 type embeddingsReadyMsg struct{ err error } // embeddings computation completed
 
 // TUIModel is the Bubble Tea model for the chat interface. It manages both the UI state
@@ -71,6 +76,11 @@ type TUIModel struct {
 	client    *http.Client
 	sessionID string
 
+	// modelSpec is the spec of the model the agent is using, see agg.NewModelFromSpec. picker is
+	// non-nil while the user is choosing a new one.
+	modelSpec string
+	picker    *modelPicker
+
 	modelUserInput   textarea.Model
 	modelChatHistory viewport.Model
 
@@ -108,7 +118,7 @@ type TUIModel struct {
 	embeddingsDone  <-chan error
 }
 
-func newTUIModel(agent agg.Agent, sessionID string, embeddingsDone <-chan error) TUIModel {
+func newTUIModel(agent agg.Agent, modelSpec, sessionID string, embeddingsDone <-chan error) TUIModel {
 	ta := textarea.New()
 	ta.Placeholder = "Ask opa..."
 	ta.Focus()
@@ -124,6 +134,7 @@ func newTUIModel(agent agg.Agent, sessionID string, embeddingsDone <-chan error)
 		agent:            agent,
 		client:           http.DefaultClient,
 		sessionID:        sessionID,
+		modelSpec:        modelSpec,
 		modelUserInput:   ta,
 		modelChatHistory: vp,
 		messages:         []chatMessage{},
@@ -133,8 +144,8 @@ func newTUIModel(agent agg.Agent, sessionID string, embeddingsDone <-chan error)
 	}
 }
 
-func runTUI(agent agg.Agent, sessionID string, embeddingsDone <-chan error) error {
-	p := tea.NewProgram(newTUIModel(agent, sessionID, embeddingsDone), tea.WithAltScreen())
+func runTUI(agent agg.Agent, modelSpec, sessionID string, embeddingsDone <-chan error) error {
+	p := tea.NewProgram(newTUIModel(agent, modelSpec, sessionID, embeddingsDone), tea.WithAltScreen())
 	_, err := p.Run()
 	return err
 }
@@ -204,6 +215,27 @@ func (m TUIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.messages = append(m.messages, chatMessage{kind: msgReasoning, text: msg.text})
 		m.updateViewport()
 		return m, m.waitForStream()
+	case warningMsg:
+		m.messages = append(m.messages, chatMessage{kind: msgInfo, text: "Warning: " + msg.text})
+		m.updateViewport()
+		return m, m.waitForStream()
+	case botRetryMsg:
+		// The reasoning of the abandoned attempt is whatever came after the last tool call (or the
+		// user's input), since streams that made tool calls aren't retried.
+		start := len(m.messages)
+		for start > 0 && m.messages[start-1].kind != msgTool && m.messages[start-1].kind != msgUser {
+			start--
+		}
+		kept := m.messages[:start]
+		for _, cm := range m.messages[start:] {
+			if cm.kind != msgReasoning {
+				kept = append(kept, cm)
+			}
+		}
+		m.messages = append(kept, chatMessage{kind: msgInfo, text: "Retrying after error: " + msg.err.Error()})
+		m.partialResponse = ""
+		m.updateViewport()
+		return m, m.waitForStream()
 	}
 
 	// Handle non-KeyMsg messages (mouse, focus, etc.) that the textarea might want.
@@ -221,14 +253,21 @@ func (m TUIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 func (m TUIModel) View() string {
 	var b strings.Builder
 
-	b.WriteString(m.modelChatHistory.View())
+	if m.picker != nil {
+		b.WriteString(m.picker.view(m.modelChatHistory.Height))
+	} else {
+		b.WriteString(m.modelChatHistory.View())
+	}
 	b.WriteString("\n")
 	b.WriteString(renderDivider(m.width))
 	b.WriteString("\n")
 	b.WriteString(m.modelUserInput.View())
 	b.WriteString("\n")
 
-	hint := "Enter to send • Alt+Enter for newline • :q to quit • Ctrl+C"
+	hint := m.modelSpec + " • Enter to send • Alt+Enter for newline • /model to switch • :q to quit"
+	if m.picker != nil {
+		hint = "↑/↓ to choose a model • Enter to switch • Esc to cancel"
+	}
 	if !m.embeddingsReady {
 		hint = "Loading embeddings... " + hint
 	}
@@ -244,6 +283,10 @@ func (m TUIModel) View() string {
 }
 
 func (m TUIModel) updateKey(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	if m.picker != nil {
+		return m.updatePickerKey(msg)
+	}
+
 	switch msg.Type {
 	case tea.KeyCtrlC:
 		m.stopStream()
@@ -301,6 +344,18 @@ func (m TUIModel) submitInput() (tea.Model, tea.Cmd) {
 		return m, tea.Quit
 	}
 
+	if cmd, arg, _ := strings.Cut(input, " "); cmd == "/model" {
+		m.modelUserInput.Reset()
+		m.syncInputHeight()
+		if arg = strings.TrimSpace(arg); arg != "" {
+			m.switchModel(arg)
+		} else {
+			m.picker = newModelPicker(m.modelSpec)
+		}
+		m.updateViewport()
+		return m, nil
+	}
+
 	m.messages = append(m.messages, chatMessage{kind: msgUser, text: input})
 	m.modelUserInput.Reset()
 	m.partialResponse = ""
@@ -319,6 +374,95 @@ func (m TUIModel) submitInput() (tea.Model, tea.Cmd) {
 	return m, m.waitForStream()
 }
 
+// updatePickerKey handles keys while the model picker is open, which takes over the input.
+func (m TUIModel) updatePickerKey(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyCtrlC:
+		return m, tea.Quit
+	case tea.KeyUp:
+		m.picker.cursor = max(m.picker.cursor-1, 0)
+	case tea.KeyDown:
+		m.picker.cursor = min(m.picker.cursor+1, len(m.picker.models)-1)
+	case tea.KeyEnter:
+		if len(m.picker.models) > 0 {
+			info := m.picker.models[m.picker.cursor]
+			m.switchModel(fmt.Sprintf("%s:%s", info.Provider, info.ID))
+		}
+		m.picker = nil
+	case tea.KeyEsc:
+		m.picker = nil
+	}
+
+	m.updateViewport()
+	return m, nil
+}
+
+// switchModel makes the agent use the model with the given spec from the next message onwards.
+// Only called while not generating, so the agent isn't in the middle of a turn.
+func (m *TUIModel) switchModel(spec string) {
+	model, err := agg.NewModelFromSpec(spec)
+	if err != nil {
+		m.errMsg = err.Error()
+		return
+	}
+
+	// the fallbacks from the config are meant for the default model, so here we only retry
+	m.agent.SetModel(agg.NewResilientModel(model, agg.RetryPolicy{}))
+	m.modelSpec = spec
+	m.errMsg = ""
+	m.messages = append(m.messages, chatMessage{kind: msgInfo, text: "Switched to " + spec})
+}
+
+// modelPicker lists the registered models for the user to choose from.
+type modelPicker struct {
+	models []core.ModelInfo
+	cursor int
+}
+
+func newModelPicker(current string) *modelPicker {
+	p := &modelPicker{models: core.Models()}
+
+	provider, name, _ := strings.Cut(current, ":")
+	if info, ok := core.LookupModel(core.Provider(provider), name); ok {
+		p.cursor = max(slices.IndexFunc(p.models, func(other core.ModelInfo) bool {
+			return other.Provider == info.Provider && other.ID == info.ID
+		}), 0)
+	}
+
+	return p
+}
+
+// view renders the list, scrolled so that the cursor is always visible within height lines.
+func (p *modelPicker) view(height int) string {
+	height = max(height, 1)
+	start := max(p.cursor-height+1, 0)
+	end := min(start+height, len(p.models))
+
+	lines := make([]string, 0, height)
+	for i := start; i < end; i++ {
+		info := p.models[i]
+		line := fmt.Sprintf("%s:%s", info.Provider, info.ID)
+		if len(info.Aliases) > 0 {
+			line += fmt.Sprintf(" (%s)", strings.Join(info.Aliases, ", "))
+		}
+		if info.ContextWindow > 0 {
+			line += hintStyle.Render(fmt.Sprintf(" • %dk context", info.ContextWindow/1000))
+		}
+
+		if i == p.cursor {
+			line = labelUserStyle.Render("> ") + line
+		} else {
+			line = "  " + line
+		}
+		lines = append(lines, line)
+	}
+
+	for len(lines) < height {
+		lines = append(lines, "")
+	}
+	return strings.Join(lines, "\n")
+}
+
 // runStreamingRequest spawns a goroutine that calls agent.RunStream and translates core.Event
 // into tea.Msg, sending them through the returned channel. Does not modify TUIModel state.
 // The goroutine exits when ctx is cancelled or the stream completes.
@@ -336,6 +480,18 @@ func (m TUIModel) runStreamingRequest(ctx context.Context, input string) <-chan
 		}
 
 		_, err := m.agent.RunStream(ctx, m.client, m.sessionID, input, false, func(ev core.Event) {
+			if len(ev.Path) > 0 {
+				// of sub-agents we only show what they do, what they say comes back as a tool result
+				switch ev.Type {
+				case core.EvToolCall:
+					call := fmt.Sprintf("%s › %s (%s): %s", strings.Join(ev.Path, " › "), ev.Call.Name, ev.Call.ID, ev.Call.Arguments)
+					sendEvent(toolCallMsg{text: maybeTruncate(call, 300)})
+				case core.EvWarning:
+					sendEvent(warningMsg{text: ev.Err.Error()})
+				}
+				return
+			}
+
 			switch ev.Type {
 			case core.EvDelta:
 				sendEvent(botDeltaMsg{text: ev.Delta})
@@ -355,6 +511,10 @@ func (m TUIModel) runStreamingRequest(ctx context.Context, input string) <-chan
 				sendEvent(reasoningMsg{text: ev.Delta})
 			case core.EvError:
 				sendEvent(botErrorMsg{err: ev.Err})
+			case core.EvWarning:
+				sendEvent(warningMsg{text: ev.Err.Error()})
+			case core.EvRetry:
+				sendEvent(botRetryMsg{err: ev.Err})
 			}
 		})
 		if err != nil {
@@ -500,15 +660,20 @@ func (m *TUIModel) renderMessage(msg chatMessage) string {
 	case msgAssistant:
 		label = labelBotStyle.Render("Assistant:")
 		sep = "\n"
+		// references are rendered by us, since glamour can't make links clickable
+		text, refs := splitReferences(msg.text)
 		if m.mdRenderer != nil {
-			rendered, err := m.mdRenderer.Render(msg.text)
+			rendered, err := m.mdRenderer.Render(text)
 			if err == nil {
 				body = strings.TrimSpace(rendered)
 			} else {
-				body = assistantBodyStyle.Render(msg.text)
+				body = assistantBodyStyle.Render(text)
 			}
 		} else {
-			body = assistantBodyStyle.Render(msg.text)
+			body = assistantBodyStyle.Render(text)
+		}
+		if len(refs) > 0 {
+			body += "\n\n" + renderReferences(refs)
 		}
 	case msgTool:
 		label = labelToolStyle.Render("Tool")
@@ -518,6 +683,8 @@ func (m *TUIModel) renderMessage(msg chatMessage) string {
 		label = labelReasonStyle.Render("Reasoning")
 		body = bodyReasonStyle.Render(msg.text)
 		sep = " "
+	case msgInfo:
+		return hintStyle.Render(msg.text)
 	}
 	if sep == " " {
 		return fmt.Sprintf("%s:%s%s", label, sep, body)
@@ -525,6 +692,25 @@ func (m *TUIModel) renderMessage(msg chatMessage) string {
 	return fmt.Sprintf("%s%s%s", label, sep, body)
 }
 
+// renderReferences renders the references of a response, linking them with OSC 8 hyperlinks so
+// that terminals supporting them open the notes in Obsidian when clicked.
+func renderReferences(refs []reference) string {
+	lines := []string{hintStyle.Render("References")}
+	for _, ref := range refs {
+		label := ref.label
+		if ref.uri != "" {
+			label = hyperlink(ref.uri, referenceStyle.Render(label))
+		}
+		lines = append(lines, fmt.Sprintf("  [%d] %s", ref.n, label))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// hyperlink wraps text in an OSC 8 hyperlink to uri. Terminals without support show the text only.
+func hyperlink(uri, text string) string {
+	return "\x1b]8;;" + uri + "\x1b\\" + text + "\x1b]8;;\x1b\\"
+}
+
 func maybeTruncate(s string, max int) string {
 	if len(s) <= max {
 		return s
@@ -6,10 +6,11 @@ import (
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/victhorio/opa/agg"
+	"github.com/victhorio/opa/agg/core"
 )
 
 func testModel() TUIModel {
-	m := newTUIModel(agg.Agent{}, "test", nil) // nil = embeddings already ready
+	m := newTUIModel(agg.Agent{}, "openai:gpt-5.1", "test", nil) // nil = embeddings already ready
 	m.width, m.height = 80, 24
 	m.syncSizes()
 	return m
@@ -178,6 +179,11 @@ func TestRenderMessage(t *testing.T) {
 		{"assistant message", chatMessage{kind: msgAssistant, text: "hi there"}, "hi there"},
 		{"tool message", chatMessage{kind: msgTool, text: "tool output"}, "tool output"},
 		{"reasoning message", chatMessage{kind: msgReasoning, text: "thinking..."}, "thinking..."},
+		{
+			"assistant message with references",
+			chatMessage{kind: msgAssistant, text: "hi [1]" + referencesHeader + "- [1] [Alpha](obsidian://open?vault=v&file=Alpha)"},
+			"\x1b]8;;obsidian://open?vault=v&file=Alpha\x1b\\",
+		},
 	}
 
 	m := testModel()
@@ -194,3 +200,60 @@ func TestRenderMessage(t *testing.T) {
 		})
 	}
 }
+
+func TestModelSwitchCommand(t *testing.T) {
+	m := testModel()
+
+	m.modelUserInput.SetValue("/model anthropic:sonnet")
+	model, _ := m.submitInput()
+	result := model.(TUIModel)
+
+	if result.modelSpec != "anthropic:sonnet" {
+		t.Errorf("expected the model to be switched, got %q", result.modelSpec)
+	}
+	if result.agent.Model() == nil || result.agent.Model().Provider() != core.ProviderAnthropic {
+		t.Errorf("expected the agent to use an anthropic model")
+	}
+	if len(result.messages) != 1 || result.messages[0].kind != msgInfo {
+		t.Errorf("expected a single info message, got %+v", result.messages)
+	}
+
+	// unknown models are reported without switching
+	result.modelUserInput.SetValue("/model anthropic:nope")
+	model, _ = result.submitInput()
+	result = model.(TUIModel)
+	if result.modelSpec != "anthropic:sonnet" || result.errMsg == "" {
+		t.Errorf("expected an error and no switch, got %q and %q", result.modelSpec, result.errMsg)
+	}
+}
+
+func TestModelPicker(t *testing.T) {
+	m := testModel()
+
+	m.modelUserInput.SetValue("/model")
+	model, _ := m.submitInput()
+	result := model.(TUIModel)
+	if result.picker == nil {
+		t.Fatal("expected /model to open the picker")
+	}
+
+	// the picker starts at the current model
+	current := result.picker.models[result.picker.cursor]
+	if current.Provider != core.ProviderOpenAI || current.ID != "gpt-5.1" {
+		t.Fatalf("expected the cursor on the current model, got %s:%s", current.Provider, current.ID)
+	}
+	if view := result.picker.view(5); !strings.Contains(view, "openai:gpt-5.1") {
+		t.Errorf("expected the picker to show the current model, got %q", view)
+	}
+
+	model, _ = result.updateKey(tea.KeyMsg{Type: tea.KeyDown})
+	model, _ = model.(TUIModel).updateKey(tea.KeyMsg{Type: tea.KeyEnter})
+	result = model.(TUIModel)
+
+	if result.picker != nil {
+		t.Error("expected the picker to close after choosing")
+	}
+	if result.modelSpec == "openai:gpt-5.1" {
+		t.Error("expected a different model to be chosen")
+	}
+}
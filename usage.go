@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/victhorio/opa/agg"
+	"github.com/victhorio/opa/agg/core"
+)
+
+// runUsage implements `opa usage`, which reports what was spent over the last days by day,
+// session, model and tool, along with how it compares to the budgets of the config file.
+func runUsage(args []string) error {
+	fs := flag.NewFlagSet("usage", flag.ExitOnError)
+	days := fs.Int("days", 30, "how many days to report, including today")
+	fs.Parse(args)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+
+	store, err := openStore()
+	if err != nil {
+		return fmt.Errorf("error opening store: %w", err)
+	}
+	defer store.Close()
+
+	return reportUsage(os.Stdout, store, time.Now(), max(*days, 1), cfg.Budget.Budget())
+}
+
+// reportUsage writes the usage report of the given number of days up to now.
+func reportUsage(w io.Writer, store *agg.SQLiteStore, now time.Time, days int, budget agg.Budget) error {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	filter := agg.UsageFilter{Since: today.AddDate(0, 0, -(days - 1))}
+
+	fmt.Fprintf(w, "Usage since %s\n", filter.Since.Format(time.DateOnly))
+
+	sections := []struct {
+		title string
+		group agg.UsageGroup
+		empty string
+	}{
+		{"By day", agg.UsageByDay, ""},
+		{"By session", agg.UsageBySession, "(embeddings)"},
+		{"By model", agg.UsageByModel, "(unattributed)"},
+		{"By tool", agg.UsageByTool, "(no tools)"},
+	}
+
+	for _, section := range sections {
+		rows, err := store.UsageBreakdown(section.group, filter)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "\n%s:\n", section.title)
+		if len(rows) == 0 {
+			fmt.Fprintln(w, "  nothing")
+			continue
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "\tResponses\tInput\tCached\tCache writes\tOutput\tCost")
+
+		var total core.Usage
+		var responses int
+		for _, row := range rows {
+			key := row.Key
+			if key == "" {
+				key = section.empty
+			}
+			writeUsageRow(tw, key, row.Responses, row.Usage)
+			total.Inc(row.Usage)
+			responses += row.Responses
+		}
+		writeUsageRow(tw, "Total", responses, total)
+
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if budget.Daily <= 0 && budget.Monthly <= 0 {
+		return nil
+	}
+
+	fmt.Fprintf(w, "\nBudgets:\n")
+	periods := []struct {
+		name  string
+		cap   int64
+		since time.Time
+	}{
+		{"Today", budget.Daily, today},
+		{"This month", budget.Monthly, today.AddDate(0, 0, 1-today.Day())},
+	}
+	for _, p := range periods {
+		if p.cap <= 0 {
+			continue
+		}
+		spent, err := store.Spend(p.since)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "  %s: %s of %s (%.0f%%)\n", p.name, agg.FormatCost(spent), agg.FormatCost(p.cap), 100*float64(spent)/float64(p.cap))
+	}
+
+	return nil
+}
+
+// writeUsageRow writes a row of a usage table.
+func writeUsageRow(w io.Writer, key string, responses int, u core.Usage) {
+	fmt.Fprintf(w, "  %s\t%d\t%d\t%d\t%d\t%d\t%s\n", key, responses, u.Input, u.Cached, u.CacheWrite, u.Output, agg.FormatCost(u.Cost))
+}
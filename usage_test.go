@@ -0,0 +1,77 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/victhorio/opa/agg"
+	"github.com/victhorio/opa/agg/core"
+)
+
+func TestReportUsage(t *testing.T) {
+	store, err := agg.NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	msg := core.NewMsgContent("assistant", "Hi!")
+	msg.Provider, msg.Model = core.ProviderAnthropic, "claude-sonnet"
+	msg.Usage = &core.Usage{Input: 100, Output: 10, Cost: 2_000_000_000}
+	if err := store.Extend("tui-1", []*core.Msg{msg}, *msg.Usage); err != nil {
+		t.Fatalf("failed to extend session: %v", err)
+	}
+
+	// the response that follows a tool's result is attributed to that tool
+	call := core.NewMsgToolCall("c1", "ReadNote", `{"note_name":"x"}`)
+	call.Provider, call.Model = core.ProviderOpenAI, "gpt-5.1"
+	call.Usage = &core.Usage{Input: 10, Cost: 100_000_000}
+	answer := core.NewMsgContent("assistant", "Found it.")
+	answer.Provider, answer.Model = core.ProviderOpenAI, "gpt-5.1"
+	answer.Usage = &core.Usage{Input: 20, Output: 5, Cost: 300_000_000}
+	msgs := []*core.Msg{call, core.NewMsgToolResult("c1", "the note"), answer}
+	if err := store.Extend("tui-2", msgs, core.Usage{Input: 30, Output: 5, Cost: 400_000_000}); err != nil {
+		t.Fatalf("failed to extend session: %v", err)
+	}
+
+	if err := store.RecordEmbeddings(core.ProviderOpenAI, &core.EmbeddingsResult{Model: "text-embedding-3-large", Tokens: 50, Cost: 500_000_000}); err != nil {
+		t.Fatalf("failed to record embeddings: %v", err)
+	}
+
+	var out strings.Builder
+	budget := agg.Budget{Daily: 5_000_000_000}
+	if err := reportUsage(&out, store, time.Now(), 7, budget); err != nil {
+		t.Fatalf("reportUsage failed: %v", err)
+	}
+
+	report := out.String()
+	for _, want := range []string{"tui-1", "(embeddings)", "anthropic:claude-sonnet", "openai:text-embedding-3-large", "$2.900", "Today: $2.900 of $5.000 (58%)"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("expected the report to contain %q, got:\n%s", want, report)
+		}
+	}
+	_, byTool, ok := strings.Cut(report, "By tool:\n")
+	if !ok {
+		t.Fatalf("expected a breakdown by tool, got:\n%s", report)
+	}
+	byTool, _, _ = strings.Cut(byTool, "\n\n")
+	rows := make(map[string]string)
+	for _, line := range strings.Split(byTool, "\n")[1:] {
+		fields := strings.Fields(line)
+		rows[strings.Join(fields[:len(fields)-6], " ")] = strings.Join(fields[len(fields)-6:], " ")
+	}
+	for key, want := range map[string]string{
+		"ReadNote":   "1 20 0 0 5 $0.300",
+		"(no tools)": "2 160 0 0 10 $2.600",
+	} {
+		if rows[key] != want {
+			t.Errorf("expected %s to have %q in the breakdown by tool, got:\n%s", key, want, byTool)
+		}
+	}
+
+	if strings.Contains(report, "This month") {
+		t.Errorf("expected no monthly budget in the report, got:\n%s", report)
+	}
+}